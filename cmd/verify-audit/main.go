@@ -0,0 +1,65 @@
+// verify-audit checks that audit events, as JSON lines written by the file, stdout or webhook sinks, form unbroken
+// tamper-evident chains. Events are read from the files provided as arguments, or from stdin if there are none. Line
+// numbers in the report count across all of the files, in the order they are provided.
+//
+// Usage:
+//
+//	AUDIT_CHAIN_KEY=<key> verify-audit [file ...]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ONSdigital/dp-api-router/event"
+)
+
+func main() {
+	key := flag.String("key", os.Getenv("AUDIT_CHAIN_KEY"), "the key the audit events were signed with (defaults to AUDIT_CHAIN_KEY)")
+	flag.Parse()
+
+	if *key == "" {
+		fmt.Fprintln(os.Stderr, "an audit chain key is required, using -key or AUDIT_CHAIN_KEY")
+		os.Exit(2)
+	}
+
+	input, err := openInput(flag.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	report, err := event.VerifyChain(input, []byte(*key))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	for _, issue := range report.Issues {
+		fmt.Println(issue)
+	}
+	fmt.Printf("%d events from %d instances, %d duplicates, %d issues\n", report.Events, len(report.Instances), report.Duplicates, len(report.Issues))
+
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
+
+// openInput returns a reader of the concatenated files, or stdin if no files are provided
+func openInput(paths []string) (io.Reader, error) {
+	if len(paths) == 0 {
+		return os.Stdin, nil
+	}
+
+	readers := make([]io.Reader, 0, len(paths))
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		readers = append(readers, f)
+	}
+	return io.MultiReader(readers...), nil
+}
@@ -13,12 +13,33 @@ type Config struct {
 	BindAddr                             string         `envconfig:"BIND_ADDR"`
 	Version                              string         `envconfig:"VERSION"`
 	EnableInterceptor                    bool           `envconfig:"ENABLE_INTERCEPTOR"`
+	EnableRequestInterceptor             bool           `envconfig:"ENABLE_REQUEST_INTERCEPTOR"`
+	InterceptorMaxBodySize               int64          `envconfig:"INTERCEPTOR_MAX_BODY_SIZE"`
 	EnableV1BetaRestriction              bool           `envconfig:"ENABLE_V1_BETA_RESTRICTION"`
 	EnablePrivateEndpoints               bool           `envconfig:"ENABLE_PRIVATE_ENDPOINTS"`
 	EnableObservationAPI                 bool           `envconfig:"ENABLE_OBSERVATION_API"`
 	EnableBundleAPI                      bool           `envconfig:"ENABLE_BUNDLE_API"`
 	EnableAudit                          bool           `envconfig:"ENABLE_AUDIT"`
 	EnableZebedeeAudit                   bool           `envconfig:"ENABLE_ZEBEDEE_AUDIT"`
+	AuditIgnoreRules                     []string       `envconfig:"AUDIT_IGNORE_RULES"`
+	AuditSkipIdentityRules               []string       `envconfig:"AUDIT_SKIP_IDENTITY_RULES"`
+	AuditRedactionConfigFilePath         string         `envconfig:"AUDIT_REDACTION_CONFIG_FILE_PATH"`
+	IdentityCacheTTL                     time.Duration  `envconfig:"IDENTITY_CACHE_TTL"`
+	IdentityCacheNegativeTTL             time.Duration  `envconfig:"IDENTITY_CACHE_NEGATIVE_TTL"`
+	IdentityCacheMaxSize                 int            `envconfig:"IDENTITY_CACHE_MAX_SIZE"`
+	JWTKeysRefreshInterval               time.Duration  `envconfig:"JWT_KEYS_REFRESH_INTERVAL"`
+	JWTKeysMaxAge                        time.Duration  `envconfig:"JWT_KEYS_MAX_AGE"`
+	EdgeAuthorisationConfigFilePath      string         `envconfig:"EDGE_AUTHORISATION_CONFIG_FILE_PATH"`
+	RateLimitConfigFilePath              string         `envconfig:"RATE_LIMIT_CONFIG_FILE_PATH"`
+	IPFilterConfigFilePath               string         `envconfig:"IP_FILTER_CONFIG_FILE_PATH"`
+	TrustedProxies                       []string       `envconfig:"TRUSTED_PROXIES"`
+	SecurityHeadersConfigFilePath        string         `envconfig:"SECURITY_HEADERS_CONFIG_FILE_PATH"`
+	CORSConfigFilePath                   string         `envconfig:"CORS_CONFIG_FILE_PATH"`
+	APIKeysConfigFilePath                string         `envconfig:"API_KEYS_CONFIG_FILE_PATH"`
+	ConcurrencyLimitConfigFilePath       string         `envconfig:"CONCURRENCY_LIMIT_CONFIG_FILE_PATH"`
+	OpenAPIValidationConfigFilePath      string         `envconfig:"OPENAPI_VALIDATION_CONFIG_FILE_PATH"`
+	EnableOpenAPIResponseValidation      bool           `envconfig:"ENABLE_OPENAPI_RESPONSE_VALIDATION"`
+	RequestHygieneConfigFilePath         string         `envconfig:"REQUEST_HYGIENE_CONFIG_FILE_PATH"`
 	ZebedeeURL                           string         `envconfig:"ZEBEDEE_URL"`
 	HierarchyAPIURL                      string         `envconfig:"HIERARCHY_API_URL"`
 	FilterAPIURL                         string         `envconfig:"FILTER_API_URL"`
@@ -40,6 +61,7 @@ type Config struct {
 	PermissionsAPIURL                    string         `envconfig:"PERMISSIONS_API_URL"`
 	PermissionsAPIVersions               []string       `envconfig:"PERMISSIONS_API_VERSIONS"`
 	EnvironmentHost                      string         `envconfig:"ENV_HOST"`
+	PublicHosts                          []string       `envconfig:"PUBLIC_HOSTS"`
 	GracefulShutdown                     time.Duration  `envconfig:"SHUTDOWN_TIMEOUT"`
 	AllowedMethods                       []string       `envconfig:"ALLOWED_METHODS"`
 	AllowedHeaders                       []string       `envconfig:"ALLOWED_HEADERS"`
@@ -56,6 +78,20 @@ type Config struct {
 	KafkaMaxBytes                        int            `envconfig:"KAFKA_MAX_BYTES"`
 	KafkaMinHealthyBrokers               int            `envconfig:"KAFKA_MIN_HEALTHY_BROKERS"`
 	AuditTopic                           string         `envconfig:"AUDIT_TOPIC"`
+	AuditQueueSize                       int            `envconfig:"AUDIT_QUEUE_SIZE"`
+	AuditQueueOverflowPolicy             string         `envconfig:"AUDIT_QUEUE_OVERFLOW_POLICY"`
+	AuditSchemaVersion                   int            `envconfig:"AUDIT_SCHEMA_VERSION"`
+	AuditSinks                           []string       `envconfig:"AUDIT_SINKS"`
+	AuditFilePath                        string         `envconfig:"AUDIT_FILE_PATH"`
+	AuditFileMaxBytes                    int64          `envconfig:"AUDIT_FILE_MAX_BYTES"`
+	AuditFileMaxBackups                  int            `envconfig:"AUDIT_FILE_MAX_BACKUPS"`
+	AuditWebhookURL                      string         `envconfig:"AUDIT_WEBHOOK_URL" json:"-"`
+	AuditWebhookTimeout                  time.Duration  `envconfig:"AUDIT_WEBHOOK_TIMEOUT"`
+	AuditSpoolPath                       string         `envconfig:"AUDIT_SPOOL_PATH"`
+	AuditSpoolMaxBytes                   int64          `envconfig:"AUDIT_SPOOL_MAX_BYTES"`
+	AuditSpoolReplayInterval             time.Duration  `envconfig:"AUDIT_SPOOL_REPLAY_INTERVAL"`
+	AuditSpoolSendTimeout                time.Duration  `envconfig:"AUDIT_SPOOL_SEND_TIMEOUT"`
+	AuditChainKey                        string         `envconfig:"AUDIT_CHAIN_KEY" json:"-"`
 	TopicAPIURL                          string         `envconfig:"TOPIC_API_URL"`
 	EnableFeedbackAPI                    bool           `envconfig:"ENABLE_FEEDBACK_API"`
 	FeedbackAPIURL                       string         `envconfig:"FEEDBACK_API_URL"`
@@ -84,6 +120,10 @@ type Config struct {
 	OTBatchTimeout                       time.Duration  `envconfig:"OTEL_BATCH_TIMEOUT"`
 	OtelEnabled                          bool           `envconfig:"OTEL_ENABLED"`
 	DeprecationConfigFilePath            string         `envconfig:"DEPRECATION_CONFIG_FILE_PATH"`
+	EnableMetricsEndpoint                bool           `envconfig:"ENABLE_METRICS_ENDPOINT"`
+	MetricsAuthToken                     string         `envconfig:"METRICS_AUTH_TOKEN" json:"-"`
+	EnableAdminEndpoints                 bool           `envconfig:"ENABLE_ADMIN_ENDPOINTS"`
+	AdminAuthToken                       string         `envconfig:"ADMIN_AUTH_TOKEN" json:"-"`
 	Auth                                 authorisation.Config
 }
 
@@ -99,11 +139,32 @@ func Get() (*Config, error) {
 		BindAddr:                             ":23200",
 		Version:                              "v1",
 		EnableInterceptor:                    true,
+		EnableRequestInterceptor:             false,
+		InterceptorMaxBodySize:               10 * 1024 * 1024,
 		EnablePrivateEndpoints:               true,
 		EnableV1BetaRestriction:              false,
 		EnableObservationAPI:                 false,
 		EnableAudit:                          false,
 		EnableZebedeeAudit:                   false,
+		AuditIgnoreRules:                     []string{"/ping", "/clickEventLog", "/health"},
+		AuditSkipIdentityRules:               []string{"/login", "/password", "/tokens/", "/password-reset/", "/users/self/password"},
+		AuditRedactionConfigFilePath:         "",
+		IdentityCacheTTL:                     0,
+		IdentityCacheNegativeTTL:             5 * time.Second,
+		IdentityCacheMaxSize:                 10000,
+		JWTKeysRefreshInterval:               5 * time.Minute,
+		JWTKeysMaxAge:                        30 * time.Minute,
+		EdgeAuthorisationConfigFilePath:      "",
+		RateLimitConfigFilePath:              "",
+		IPFilterConfigFilePath:               "",
+		TrustedProxies:                       []string{},
+		SecurityHeadersConfigFilePath:        "",
+		CORSConfigFilePath:                   "",
+		APIKeysConfigFilePath:                "",
+		ConcurrencyLimitConfigFilePath:       "",
+		OpenAPIValidationConfigFilePath:      "",
+		EnableOpenAPIResponseValidation:      false,
+		RequestHygieneConfigFilePath:         "",
 		EnableFilesAPI:                       false,
 		ZebedeeURL:                           "http://localhost:8082",
 		HierarchyAPIURL:                      "http://localhost:22600",
@@ -125,6 +186,7 @@ func Get() (*Config, error) {
 		PermissionsAPIURL:                    "http://localhost:25400",
 		PermissionsAPIVersions:               []string{"v1"},
 		EnvironmentHost:                      "http://localhost:23200",
+		PublicHosts:                          []string{},
 		GracefulShutdown:                     5 * time.Second,
 		HealthCheckInterval:                  30 * time.Second,
 		HealthCheckCriticalTimeout:           90 * time.Second,
@@ -136,6 +198,20 @@ func Get() (*Config, error) {
 		KafkaMaxBytes:                        2000000,
 		KafkaMinHealthyBrokers:               0,
 		AuditTopic:                           "audit",
+		AuditQueueSize:                       1000,
+		AuditQueueOverflowPolicy:             "block",
+		AuditSchemaVersion:                   1,
+		AuditSinks:                           []string{"kafka"},
+		AuditFilePath:                        "audit.log",
+		AuditFileMaxBytes:                    100 * 1024 * 1024,
+		AuditFileMaxBackups:                  5,
+		AuditWebhookURL:                      "",
+		AuditWebhookTimeout:                  5 * time.Second,
+		AuditSpoolPath:                       "",
+		AuditSpoolMaxBytes:                   512 * 1024 * 1024,
+		AuditSpoolReplayInterval:             10 * time.Second,
+		AuditSpoolSendTimeout:                5 * time.Second,
+		AuditChainKey:                        "",
 		TopicAPIURL:                          "http://localhost:25300",
 		FeedbackAPIURL:                       "http://localhost:28600",
 		EnableFeedbackAPI:                    false,
@@ -163,9 +239,49 @@ func Get() (*Config, error) {
 		OTServiceName:                        "dp-api-router",
 		OTBatchTimeout:                       time.Second * 5,
 		DeprecationConfigFilePath:            "",
+		EnableMetricsEndpoint:                false,
+		MetricsAuthToken:                     "",
+		EnableAdminEndpoints:                 false,
+		AdminAuthToken:                       "",
 		OtelEnabled:                          false,
 		EnableBundleAPI:                      false,
+		Auth: authorisation.Config{
+			PermissionsCacheUpdateInterval: time.Minute,
+			PermissionsMaxCacheTime:        5 * time.Minute,
+		},
 	}
 
 	return cfg, envconfig.Process("", cfg)
 }
+
+// UpstreamURLs returns the URLs of the upstream services that requests are proxied to
+func (c *Config) UpstreamURLs() []string {
+	return []string{
+		c.ZebedeeURL,
+		c.HierarchyAPIURL,
+		c.FilterAPIURL,
+		c.FilterFlexAPIURL,
+		c.DatasetAPIURL,
+		c.ObservationAPIURL,
+		c.BundleAPIURL,
+		c.CodelistAPIURL,
+		c.RecipeAPIURL,
+		c.ImportAPIURL,
+		c.SearchAPIURL,
+		c.DimensionSearchAPIURL,
+		c.ImageAPIURL,
+		c.UploadServiceAPIURL,
+		c.FilesAPIURL,
+		c.IdentityAPIURL,
+		c.PermissionsAPIURL,
+		c.TopicAPIURL,
+		c.FeedbackAPIURL,
+		c.PopulationTypesAPIURL,
+		c.ReleaseCalendarAPIURL,
+		c.CantabularMetadataExtractorAPIURL,
+		c.SearchScrubberAPIURL,
+		c.CategoryAPIURL,
+		c.BerlinAPIURL,
+		c.RedirectAPIURL,
+	}
+}
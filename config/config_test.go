@@ -5,6 +5,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/ONSdigital/dp-authorisation/v2/authorisation"
+
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -18,11 +20,32 @@ func TestGetReturnsDefaultValues(t *testing.T) {
 			BindAddr:                             ":23200",
 			Version:                              "v1",
 			EnableInterceptor:                    true,
+			EnableRequestInterceptor:             false,
+			InterceptorMaxBodySize:               10 * 1024 * 1024,
 			EnablePrivateEndpoints:               true,
 			EnableV1BetaRestriction:              false,
 			EnableObservationAPI:                 false,
 			EnableAudit:                          false,
 			EnableZebedeeAudit:                   false,
+			AuditIgnoreRules:                     []string{"/ping", "/clickEventLog", "/health"},
+			AuditSkipIdentityRules:               []string{"/login", "/password", "/tokens/", "/password-reset/", "/users/self/password"},
+			AuditRedactionConfigFilePath:         "",
+			IdentityCacheTTL:                     0,
+			IdentityCacheNegativeTTL:             5 * time.Second,
+			IdentityCacheMaxSize:                 10000,
+			JWTKeysRefreshInterval:               5 * time.Minute,
+			JWTKeysMaxAge:                        30 * time.Minute,
+			EdgeAuthorisationConfigFilePath:      "",
+			RateLimitConfigFilePath:              "",
+			IPFilterConfigFilePath:               "",
+			TrustedProxies:                       []string{},
+			SecurityHeadersConfigFilePath:        "",
+			CORSConfigFilePath:                   "",
+			APIKeysConfigFilePath:                "",
+			ConcurrencyLimitConfigFilePath:       "",
+			OpenAPIValidationConfigFilePath:      "",
+			EnableOpenAPIResponseValidation:      false,
+			RequestHygieneConfigFilePath:         "",
 			EnableFilesAPI:                       false,
 			EnableBundleAPI:                      false,
 			ZebedeeURL:                           "http://localhost:8082",
@@ -45,6 +68,7 @@ func TestGetReturnsDefaultValues(t *testing.T) {
 			SearchAPIURL:                         "http://localhost:23900",
 			DimensionSearchAPIURL:                "http://localhost:23100",
 			EnvironmentHost:                      "http://localhost:23200",
+			PublicHosts:                          []string{},
 			GracefulShutdown:                     5 * time.Second,
 			HealthCheckInterval:                  30 * time.Second,
 			HealthCheckCriticalTimeout:           90 * time.Second,
@@ -55,6 +79,20 @@ func TestGetReturnsDefaultValues(t *testing.T) {
 			AllowedOrigins:                       []string{"http://localhost:20000", "http://localhost:8081"},
 			AllowedMethods:                       []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodHead, http.MethodOptions},
 			AuditTopic:                           "audit",
+			AuditQueueSize:                       1000,
+			AuditQueueOverflowPolicy:             "block",
+			AuditSchemaVersion:                   1,
+			AuditSinks:                           []string{"kafka"},
+			AuditFilePath:                        "audit.log",
+			AuditFileMaxBytes:                    100 * 1024 * 1024,
+			AuditFileMaxBackups:                  5,
+			AuditWebhookURL:                      "",
+			AuditWebhookTimeout:                  5 * time.Second,
+			AuditSpoolPath:                       "",
+			AuditSpoolMaxBytes:                   512 * 1024 * 1024,
+			AuditSpoolReplayInterval:             10 * time.Second,
+			AuditSpoolSendTimeout:                5 * time.Second,
+			AuditChainKey:                        "",
 			TopicAPIURL:                          "http://localhost:25300",
 			FeedbackAPIURL:                       "http://localhost:28600",
 			EnableFeedbackAPI:                    false,
@@ -81,6 +119,22 @@ func TestGetReturnsDefaultValues(t *testing.T) {
 			OTServiceName:                        "dp-api-router",
 			OTBatchTimeout:                       5 * time.Second,
 			DeprecationConfigFilePath:            "",
+			EnableMetricsEndpoint:                false,
+			MetricsAuthToken:                     "",
+			EnableAdminEndpoints:                 false,
+			AdminAuthToken:                       "",
+			Auth: authorisation.Config{
+				PermissionsCacheUpdateInterval: time.Minute,
+				PermissionsMaxCacheTime:        5 * time.Minute,
+			},
+		})
+
+		Convey("Then the upstream URLs include every API the router proxies to", func() {
+			upstreams := configuration.UpstreamURLs()
+			So(upstreams, ShouldContain, "http://localhost:8082")
+			So(upstreams, ShouldContain, "http://localhost:22000")
+			So(upstreams, ShouldContain, "http://localhost:29900")
+			So(upstreams, ShouldNotContain, "")
 		})
 	})
 }
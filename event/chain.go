@@ -0,0 +1,222 @@
+package event
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Possible kinds of ChainIssue
+const (
+	// IssueUnchained is reported for events that don't carry an instance ID or HMAC
+	IssueUnchained = "unchained"
+	// IssueTampered is reported for events whose HMAC doesn't match their content
+	IssueTampered = "tampered"
+	// IssueGap is reported when sequence numbers are missing between two events
+	IssueGap = "gap"
+	// IssueBrokenChain is reported when an event doesn't link to the HMAC of the event before it
+	IssueBrokenChain = "broken chain"
+	// IssueConflict is reported when two different events have the same sequence number
+	IssueConflict = "conflict"
+)
+
+// Chain links audit events into a tamper-evident sequence for one instance of the router. Each event is given the next
+// sequence number and the HMAC of the previous event, and is then signed with its own HMAC.
+type Chain struct {
+	key        []byte
+	instanceID string
+
+	mu       sync.Mutex
+	sequence int64
+	previous string
+}
+
+// NewChain creates a chain for the instance, which signs events with the provided key
+func NewChain(key []byte, instanceID string) *Chain {
+	return &Chain{key: key, instanceID: instanceID}
+}
+
+// Link adds the event to the end of the chain, setting its chain fields
+func (c *Chain) Link(e *Audit) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sequence++
+	e.InstanceID = c.instanceID
+	e.Sequence = c.sequence
+	e.PreviousHMAC = c.previous
+	e.HMAC = ComputeHMAC(c.key, e)
+	c.previous = e.HMAC
+}
+
+// ComputeHMAC returns the hex encoded HMAC-SHA256 of the event, using the provided key. The HMAC covers every field of
+// the event apart from the HMAC itself, as a JSON array of the field values in the order of the schema. Fields added
+// after the version 3 schema are only included if they are set, so that version 3 events can still be verified.
+func ComputeHMAC(key []byte, e *Audit) string {
+	fields := []interface{}{
+		e.CreatedAt, e.RequestID, e.Identity, e.CollectionID, e.Path, e.Method, e.StatusCode, e.QueryParam,
+		e.DurationMillis, e.ResponseBytes, e.ClientIP, e.UserAgent, e.Route, e.Upstream, e.AuthType,
+		e.InstanceID, e.Sequence, e.PreviousHMAC,
+	}
+	if e.APIKeyOwner != "" {
+		fields = append(fields, e.APIKeyOwner)
+	}
+	// marshalling a slice of strings and integers can't fail
+	b, _ := json.Marshal(fields)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ChainIssue describes a problem found when verifying a sequence of audit events
+type ChainIssue struct {
+	Kind       string
+	Line       int
+	InstanceID string
+	Sequence   int64
+	Detail     string
+}
+
+func (i ChainIssue) String() string {
+	return fmt.Sprintf("line %d: %s: instance %q sequence %d: %s", i.Line, i.Kind, i.InstanceID, i.Sequence, i.Detail)
+}
+
+// ChainReport is the result of verifying a sequence of audit events
+type ChainReport struct {
+	Events     int
+	Duplicates int
+	Instances  map[string]int
+	Issues     []ChainIssue
+}
+
+// OK returns true if no issues were found
+func (r *ChainReport) OK() bool {
+	return len(r.Issues) == 0
+}
+
+// chainedEvent is an audit event decoded from a JSON line, as written by the JSON sinks
+type chainedEvent struct {
+	line  int
+	event Audit
+}
+
+// jsonAudit is the JSON representation of an audit event, keyed by the avro field names
+type jsonAudit struct {
+	CreatedAt      int64  `json:"created_at"`
+	RequestID      string `json:"request_id"`
+	Identity       string `json:"identity"`
+	CollectionID   string `json:"collection_id"`
+	Path           string `json:"path"`
+	Method         string `json:"method"`
+	StatusCode     int32  `json:"status_code"`
+	QueryParam     string `json:"query_param"`
+	DurationMillis int64  `json:"duration_ms"`
+	ResponseBytes  int64  `json:"response_bytes"`
+	ClientIP       string `json:"client_ip"`
+	UserAgent      string `json:"user_agent"`
+	Route          string `json:"route"`
+	Upstream       string `json:"upstream"`
+	AuthType       string `json:"auth_type"`
+	InstanceID     string `json:"instance_id"`
+	Sequence       int64  `json:"sequence"`
+	PreviousHMAC   string `json:"previous_hmac"`
+	HMAC           string `json:"hmac"`
+	APIKeyOwner    string `json:"api_key_owner"`
+}
+
+// VerifyChain reads audit events from r, one JSON object per line, and checks that they form unbroken chains signed
+// with the provided key. Events may be in any order and from any number of instances. Events that appear more than
+// once, for example because they were resent after a failure, are only counted as duplicates.
+func VerifyChain(r io.Reader, key []byte) (*ChainReport, error) {
+	report := &ChainReport{Instances: map[string]int{}}
+	chains := map[string][]chainedEvent{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var decoded jsonAudit
+		if err := json.Unmarshal(scanner.Bytes(), &decoded); err != nil {
+			return nil, errors.Wrapf(err, "invalid audit event on line %d", line)
+		}
+		e := Audit(decoded)
+		report.Events++
+
+		if e.InstanceID == "" || e.HMAC == "" {
+			report.Issues = append(report.Issues, ChainIssue{Kind: IssueUnchained, Line: line, Detail: "event has no chain fields"})
+			continue
+		}
+		if !hmac.Equal([]byte(ComputeHMAC(key, &e)), []byte(e.HMAC)) {
+			report.Issues = append(report.Issues, ChainIssue{Kind: IssueTampered, Line: line, InstanceID: e.InstanceID,
+				Sequence: e.Sequence, Detail: "hmac does not match the event"})
+			continue
+		}
+		chains[e.InstanceID] = append(chains[e.InstanceID], chainedEvent{line: line, event: e})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read audit events")
+	}
+
+	for instanceID, events := range chains {
+		sort.SliceStable(events, func(i, j int) bool {
+			return events[i].event.Sequence < events[j].event.Sequence
+		})
+		report.Instances[instanceID] = len(events)
+		report.verifyInstance(events)
+	}
+
+	sort.SliceStable(report.Issues, func(i, j int) bool {
+		return report.Issues[i].Line < report.Issues[j].Line
+	})
+	return report, nil
+}
+
+// verifyInstance checks the events of a single instance, sorted by sequence number, start from the first sequence
+// number, have no gaps and link together
+func (r *ChainReport) verifyInstance(events []chainedEvent) {
+	for i := 1; i < len(events); i++ {
+		previous, current := events[i-1], events[i]
+		issue := ChainIssue{Line: current.line, InstanceID: current.event.InstanceID, Sequence: current.event.Sequence}
+
+		switch {
+		case current.event.Sequence == previous.event.Sequence:
+			if current.event.HMAC == previous.event.HMAC {
+				r.Duplicates++
+				continue
+			}
+			issue.Kind = IssueConflict
+			issue.Detail = fmt.Sprintf("differs from the event with the same sequence on line %d", previous.line)
+		case current.event.Sequence > previous.event.Sequence+1:
+			issue.Kind = IssueGap
+			issue.Detail = fmt.Sprintf("%d events missing after sequence %d", current.event.Sequence-previous.event.Sequence-1, previous.event.Sequence)
+		case current.event.PreviousHMAC != previous.event.HMAC:
+			issue.Kind = IssueBrokenChain
+			issue.Detail = fmt.Sprintf("previous hmac does not match the event on line %d", previous.line)
+		default:
+			continue
+		}
+		r.Issues = append(r.Issues, issue)
+	}
+
+	first := events[0]
+	switch {
+	case first.event.Sequence > 1:
+		r.Issues = append(r.Issues, ChainIssue{Kind: IssueGap, Line: first.line, InstanceID: first.event.InstanceID,
+			Sequence: first.event.Sequence, Detail: fmt.Sprintf("%d events missing before sequence %d", first.event.Sequence-1, first.event.Sequence)})
+	case first.event.Sequence == 1 && first.event.PreviousHMAC != "":
+		r.Issues = append(r.Issues, ChainIssue{Kind: IssueBrokenChain, Line: first.line, InstanceID: first.event.InstanceID,
+			Sequence: 1, Detail: "first event of the chain has a previous hmac"})
+	}
+}
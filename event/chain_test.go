@@ -0,0 +1,139 @@
+package event_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/ONSdigital/dp-api-router/event"
+	"github.com/ONSdigital/dp-api-router/schema"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var testChainKey = []byte("chain-key")
+
+// chainedEvents returns the JSON lines written by a JSON sink for n events for the path, produced with a chained producer
+func chainedEvents(chain *event.Chain, path string, n int) []string {
+	buf := &bytes.Buffer{}
+	sink, err := event.NewJSONSink(buf, schema.AuditEventV4.Definition)
+	So(err, ShouldBeNil)
+	producer := event.NewAvroProducerWithSink(sink, schema.AuditEventV4)
+	producer.SetChain(chain)
+
+	for i := 0; i < n; i++ {
+		e := *testAuditEvent
+		e.Path = path
+		So(producer.Audit(&e), ShouldBeNil)
+	}
+	return strings.Split(strings.TrimSpace(buf.String()), "\n")
+}
+
+// verify runs the chain verification on the provided lines
+func verify(lines []string, key []byte) *event.ChainReport {
+	report, err := event.VerifyChain(strings.NewReader(strings.Join(lines, "\n")), key)
+	So(err, ShouldBeNil)
+	return report
+}
+
+func TestChain(t *testing.T) {
+	Convey("Given a chain", t, func() {
+		chain := event.NewChain(testChainKey, "router-1")
+
+		Convey("When events are linked, then they have consecutive sequence numbers and link to the previous event", func() {
+			first, second := *testAuditEvent, *testAuditEvent
+			chain.Link(&first)
+			chain.Link(&second)
+
+			So(first.InstanceID, ShouldEqual, "router-1")
+			So(first.Sequence, ShouldEqual, 1)
+			So(first.PreviousHMAC, ShouldBeEmpty)
+			So(first.HMAC, ShouldEqual, event.ComputeHMAC(testChainKey, &first))
+			So(second.Sequence, ShouldEqual, 2)
+			So(second.PreviousHMAC, ShouldEqual, first.HMAC)
+			So(second.HMAC, ShouldNotEqual, first.HMAC)
+		})
+
+		Convey("When an event has an API key owner, then the owner is covered by the HMAC", func() {
+			withOwner := *testAuditEvent
+			withOwner.APIKeyOwner = "myConsumer"
+			So(event.ComputeHMAC(testChainKey, &withOwner), ShouldNotEqual, event.ComputeHMAC(testChainKey, testAuditEvent))
+		})
+	})
+}
+
+func TestVerifyChain(t *testing.T) {
+	Convey("Given the events produced by two instances, interleaved and out of order", t, func() {
+		first := chainedEvents(event.NewChain(testChainKey, "router-1"), "/v1/datasets", 3)
+		second := chainedEvents(event.NewChain(testChainKey, "router-2"), "/v1/datasets", 2)
+		lines := []string{first[1], second[0], first[0], second[1], first[2]}
+
+		Convey("When they are verified, then no issues are reported", func() {
+			report := verify(lines, testChainKey)
+			So(report.OK(), ShouldBeTrue)
+			So(report.Events, ShouldEqual, 5)
+			So(report.Instances, ShouldResemble, map[string]int{"router-1": 3, "router-2": 2})
+		})
+
+		Convey("When an event was resent, then it is only counted as a duplicate", func() {
+			report := verify(append(lines, first[1]), testChainKey)
+			So(report.OK(), ShouldBeTrue)
+			So(report.Duplicates, ShouldEqual, 1)
+		})
+
+		Convey("When they are verified with the wrong key, then every event is reported as tampered", func() {
+			report := verify(lines, []byte("wrong-key"))
+			So(report.Issues, ShouldHaveLength, 5)
+			So(report.Issues[0].Kind, ShouldEqual, event.IssueTampered)
+		})
+
+		Convey("When an event has been modified, then it is reported as tampered and left out of the chain", func() {
+			lines[0] = strings.Replace(lines[0], `"identity":"myIdentity"`, `"identity":"someoneElse"`, 1)
+			report := verify(lines, testChainKey)
+			So(report.Issues, ShouldHaveLength, 2)
+			So(report.Issues[0].Kind, ShouldEqual, event.IssueTampered)
+			So(report.Issues[0].Line, ShouldEqual, 1)
+			So(report.Issues[1].Kind, ShouldEqual, event.IssueGap)
+		})
+
+		Convey("When an event is missing, then a gap is reported", func() {
+			report := verify([]string{first[0], first[2]}, testChainKey)
+			So(report.Issues, ShouldHaveLength, 1)
+			So(report.Issues[0].Kind, ShouldEqual, event.IssueGap)
+			So(report.Issues[0].Sequence, ShouldEqual, 3)
+		})
+
+		Convey("When the first events of an instance are missing, then a gap is reported before the first event", func() {
+			report := verify([]string{first[2], second[0], second[1]}, testChainKey)
+			So(report.Issues, ShouldHaveLength, 1)
+			So(report.Issues[0].Kind, ShouldEqual, event.IssueGap)
+			So(report.Issues[0].InstanceID, ShouldEqual, "router-1")
+			So(report.Issues[0].Sequence, ShouldEqual, 3)
+			So(report.Issues[0].Detail, ShouldEqual, "2 events missing before sequence 3")
+		})
+
+		Convey("When an event is replaced by one from another chain signed with the same key, then the chain is broken", func() {
+			forged := chainedEvents(event.NewChain(testChainKey, "router-1"), "/v1/forged", 2)
+			report := verify([]string{first[0], forged[1]}, testChainKey)
+			So(report.Issues, ShouldHaveLength, 1)
+			So(report.Issues[0].Kind, ShouldEqual, event.IssueBrokenChain)
+		})
+
+		Convey("When two different events have the same sequence, then a conflict is reported", func() {
+			other := chainedEvents(event.NewChain(testChainKey, "router-1"), "/v1/forged", 1)
+			report := verify([]string{first[0], other[0]}, testChainKey)
+			So(report.Issues, ShouldHaveLength, 1)
+			So(report.Issues[0].Kind, ShouldEqual, event.IssueConflict)
+		})
+	})
+
+	Convey("Given events produced without a chain, then they are reported as unchained", t, func() {
+		report := verify([]string{`{"created_at":1,"path":"/v1/datasets"}`}, testChainKey)
+		So(report.Issues, ShouldHaveLength, 1)
+		So(report.Issues[0].Kind, ShouldEqual, event.IssueUnchained)
+	})
+
+	Convey("Given a line that isn't JSON, then an error is returned", t, func() {
+		_, err := event.VerifyChain(strings.NewReader("not json"), testChainKey)
+		So(err, ShouldNotBeNil)
+	})
+}
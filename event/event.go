@@ -13,6 +13,24 @@ type Audit struct {
 	Method       string `avro:"method"`
 	StatusCode   int32  `avro:"status_code"`
 	QueryParam   string `avro:"query_param"`
+
+	// The following fields are only emitted by the version 2 schema
+	DurationMillis int64  `avro:"duration_ms"`
+	ResponseBytes  int64  `avro:"response_bytes"`
+	ClientIP       string `avro:"client_ip"`
+	UserAgent      string `avro:"user_agent"`
+	Route          string `avro:"route"`
+	Upstream       string `avro:"upstream"`
+	AuthType       string `avro:"auth_type"`
+
+	// The following fields are only emitted by the version 3 schema
+	InstanceID   string `avro:"instance_id"`
+	Sequence     int64  `avro:"sequence"`
+	PreviousHMAC string `avro:"previous_hmac"`
+	HMAC         string `avro:"hmac"`
+
+	// The following fields are only emitted by the version 4 schema
+	APIKeyOwner string `avro:"api_key_owner"`
 }
 
 // CreatedAtTime returns a time.Time representation of the CreatedAt field of an Audit struct
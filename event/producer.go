@@ -1,15 +1,61 @@
 package event
 
 import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ONSdigital/dp-api-router/metrics"
+	"github.com/ONSdigital/log.go/v2/log"
 	"github.com/pkg/errors"
 )
 
 //go:generate moq -out mock/marshaller.go -pkg mock . Marshaller
 
+// OverflowPolicy determines what an asynchronous AvroProducer does when its queue is full
+type OverflowPolicy string
+
+// Possible overflow policies
+const (
+	// OverflowBlock waits until there is space in the queue
+	OverflowBlock OverflowPolicy = "block"
+	// OverflowDropOldest discards the oldest queued message to make space for the new one
+	OverflowDropOldest OverflowPolicy = "drop-oldest"
+	// OverflowFail rejects the new message with ErrQueueFull
+	OverflowFail OverflowPolicy = "fail"
+)
+
+var (
+	// ErrQueueFull is returned when a message is rejected because the queue is full
+	ErrQueueFull = errors.New("audit queue is full")
+	// ErrProducerClosed is returned when a message is sent after the producer has been closed
+	ErrProducerClosed = errors.New("audit producer is closed")
+
+	droppedMessages = metrics.NewCounterVec("audit_queue_dropped_total",
+		"Audit messages that were dropped because the queue was full", "reason")
+)
+
+// ParseOverflowPolicy validates and returns the OverflowPolicy represented by the provided string
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch policy := OverflowPolicy(strings.ToLower(s)); policy {
+	case OverflowBlock, OverflowDropOldest, OverflowFail:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid audit queue overflow policy '%s', expected one of: %s, %s, %s", s, OverflowBlock, OverflowDropOldest, OverflowFail)
+	}
+}
+
 // AvroProducer of output events.
 type AvroProducer struct {
-	out        chan []byte
+	sink       AuditSink
 	marshaller Marshaller
+	queue      chan []byte
+	policy     OverflowPolicy
+	chain      *Chain
+	done       chan struct{}
+	flushed    chan struct{}
+	closeOnce  sync.Once
 }
 
 // Marshaller marshals events into messages.
@@ -17,12 +63,50 @@ type Marshaller interface {
 	Marshal(s interface{}) ([]byte, error)
 }
 
-// NewAvroProducer returns a new instance of AvroProducer.
+// NewAvroProducer returns a new instance of AvroProducer, which sends messages directly to the output channel.
 func NewAvroProducer(outputChannel chan []byte, marshaller Marshaller) *AvroProducer {
+	return NewAvroProducerWithSink(ChannelSink(outputChannel), marshaller)
+}
+
+// NewAvroProducerWithSink returns a new instance of AvroProducer, which sends messages directly to the sink.
+func NewAvroProducerWithSink(sink AuditSink, marshaller Marshaller) *AvroProducer {
 	return &AvroProducer{
-		out:        outputChannel,
+		sink:       sink,
+		marshaller: marshaller,
+	}
+}
+
+// NewAsyncAvroProducer returns a new instance of AvroProducer, which queues messages in a buffer of the provided size,
+// so that a slow output channel doesn't block the caller. Messages are sent from the queue to the output channel by a
+// background go-routine, until the producer is closed. The policy determines what happens when the queue is full.
+func NewAsyncAvroProducer(outputChannel chan []byte, marshaller Marshaller, queueSize int, policy OverflowPolicy) *AvroProducer {
+	return NewAsyncAvroProducerWithSink(ChannelSink(outputChannel), marshaller, queueSize, policy)
+}
+
+// NewAsyncAvroProducerWithSink returns a new instance of AvroProducer, which queues messages in a buffer of the
+// provided size and sends them to the sink from a background go-routine, like NewAsyncAvroProducer.
+func NewAsyncAvroProducerWithSink(sink AuditSink, marshaller Marshaller, queueSize int, policy OverflowPolicy) *AvroProducer {
+	producer := &AvroProducer{
+		sink:       sink,
 		marshaller: marshaller,
+		queue:      make(chan []byte, queueSize),
+		policy:     policy,
+		done:       make(chan struct{}),
+		flushed:    make(chan struct{}),
 	}
+
+	metrics.NewGaugeFunc("audit_queue_depth", "Audit messages waiting in the queue to be sent", func() float64 {
+		return float64(len(producer.queue))
+	})
+
+	go producer.forward()
+	return producer
+}
+
+// SetChain makes the producer link every event it marshals into the tamper-evident chain.
+// The chain fields are only emitted by the version 3 schema.
+func (producer *AvroProducer) SetChain(chain *Chain) {
+	producer.chain = chain
 }
 
 // Audit produces a new Audit event.
@@ -31,8 +115,7 @@ func (producer *AvroProducer) Audit(event *Audit) error {
 	if err != nil {
 		return err
 	}
-	producer.Send(bytes)
-	return nil
+	return producer.Send(bytes)
 }
 
 // Marshal marshalls an Audit event and returns the corresponding byte array
@@ -40,10 +123,105 @@ func (producer *AvroProducer) Marshal(event *Audit) ([]byte, error) {
 	if event == nil {
 		return nil, errors.New("event required but was nil")
 	}
+	if producer.chain != nil {
+		producer.chain.Link(event)
+	}
 	return producer.marshaller.Marshal(event)
 }
 
-// Send sends the byte array to the output channel
-func (producer *AvroProducer) Send(bytes []byte) {
-	producer.out <- bytes
+// Send sends the byte array to the sink, or queues it if the producer is asynchronous
+func (producer *AvroProducer) Send(bytes []byte) error {
+	if producer.queue == nil {
+		return producer.sink.Write(bytes)
+	}
+
+	select {
+	case <-producer.done:
+		return ErrProducerClosed
+	default:
+	}
+
+	switch producer.policy {
+	case OverflowFail:
+		select {
+		case producer.queue <- bytes:
+			return nil
+		default:
+			droppedMessages.Inc("rejected")
+			return ErrQueueFull
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case producer.queue <- bytes:
+				return nil
+			default:
+			}
+			// make space by discarding the oldest message, unless the forwarding go-routine has just done so
+			select {
+			case <-producer.queue:
+				droppedMessages.Inc("dropped_oldest")
+			default:
+			}
+		}
+	default:
+		select {
+		case producer.queue <- bytes:
+			return nil
+		case <-producer.done:
+			return ErrProducerClosed
+		}
+	}
+}
+
+// QueueDepth returns the number of messages waiting to be sent to the sink
+func (producer *AvroProducer) QueueDepth() int {
+	return len(producer.queue)
+}
+
+// Close stops an asynchronous producer from accepting any more messages, and waits until the messages already queued
+// have been sent to the sink, or the context is done. The sink is then closed.
+func (producer *AvroProducer) Close(ctx context.Context) error {
+	if producer.queue != nil {
+		producer.closeOnce.Do(func() {
+			close(producer.done)
+		})
+
+		select {
+		case <-producer.flushed:
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "audit queue not flushed, %d messages remaining", len(producer.queue))
+		}
+	}
+
+	return producer.sink.Close(ctx)
+}
+
+// forward sends queued messages to the sink until the producer is closed, and then flushes the queue
+func (producer *AvroProducer) forward() {
+	defer close(producer.flushed)
+
+	for {
+		select {
+		case bytes := <-producer.queue:
+			producer.write(bytes)
+		case <-producer.done:
+			for {
+				select {
+				case bytes := <-producer.queue:
+					producer.write(bytes)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// write sends a queued message to the sink. The caller has already been told the message was accepted,
+// so a failure can only be logged.
+func (producer *AvroProducer) write(bytes []byte) {
+	if err := producer.sink.Write(bytes); err != nil {
+		log.Error(context.Background(), "queued audit message could not be written to the sink", err)
+	}
 }
@@ -1,7 +1,10 @@
 package event_test
 
 import (
+	"context"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/ONSdigital/dp-api-router/event"
 	"github.com/ONSdigital/dp-api-router/event/mock"
@@ -54,7 +57,7 @@ func TestAvroProducer(t *testing.T) {
 
 		Convey("When Audit is called on the event producer", func() {
 			// eventProducer under test
-			eventProducer := event.NewAvroProducer(outputChannel, schema.AuditEvent)
+			eventProducer := event.NewAvroProducer(outputChannel, schema.AuditEventV4)
 			err := eventProducer.Audit(testAuditEvent)
 
 			Convey("The expected event is available on the output channel", func() {
@@ -92,7 +95,142 @@ func TestAvroProducer(t *testing.T) {
 // Unmarshal converts observation events to []byte.
 func unmarshal(bytes []byte) *event.Audit {
 	observationEvent := &event.Audit{}
-	err := schema.AuditEvent.Unmarshal(bytes, observationEvent)
+	err := schema.AuditEventV4.Unmarshal(bytes, observationEvent)
 	So(err, ShouldBeNil)
 	return observationEvent
 }
+
+func TestParseOverflowPolicy(t *testing.T) {
+	Convey("Valid overflow policies are parsed, regardless of case", t, func() {
+		for _, s := range []string{"block", "drop-oldest", "FAIL"} {
+			policy, err := event.ParseOverflowPolicy(s)
+			So(err, ShouldBeNil)
+			So(string(policy), ShouldEqual, strings.ToLower(s))
+		}
+	})
+
+	Convey("An invalid overflow policy results in an error", t, func() {
+		_, err := event.ParseOverflowPolicy("drop-newest")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestAsyncAvroProducer(t *testing.T) {
+	marshallerMock := &mock.MarshallerMock{
+		MarshalFunc: func(s interface{}) ([]byte, error) {
+			return []byte("hello world"), nil
+		},
+	}
+
+	Convey("Given an asynchronous producer with an output channel that is not being read", t, func() {
+		outputChannel := make(chan []byte)
+
+		Convey("When the queue is full and the overflow policy is 'fail'", func() {
+			eventProducer := event.NewAsyncAvroProducer(outputChannel, marshallerMock, 1, event.OverflowFail)
+			fillQueue(eventProducer)
+
+			Convey("Then a new message is rejected with ErrQueueFull, without blocking", func() {
+				So(eventProducer.Send([]byte("m3")), ShouldEqual, event.ErrQueueFull)
+				So(eventProducer.Audit(testAuditEvent), ShouldEqual, event.ErrQueueFull)
+			})
+
+			Convey("Then the queued messages are sent once the output channel is read", func() {
+				So(string(<-outputChannel), ShouldEqual, "m1")
+				So(string(<-outputChannel), ShouldEqual, "m2")
+			})
+		})
+
+		Convey("When the queue is full and the overflow policy is 'drop-oldest'", func() {
+			eventProducer := event.NewAsyncAvroProducer(outputChannel, marshallerMock, 1, event.OverflowDropOldest)
+			fillQueue(eventProducer)
+
+			Convey("Then a new message replaces the oldest queued message, without blocking", func() {
+				So(eventProducer.Send([]byte("m3")), ShouldBeNil)
+				So(eventProducer.QueueDepth(), ShouldEqual, 1)
+				So(string(<-outputChannel), ShouldEqual, "m1")
+				So(string(<-outputChannel), ShouldEqual, "m3")
+			})
+		})
+
+		Convey("When the queue is full and the overflow policy is 'block'", func() {
+			eventProducer := event.NewAsyncAvroProducer(outputChannel, marshallerMock, 1, event.OverflowBlock)
+			fillQueue(eventProducer)
+
+			sent := make(chan error)
+			go func() {
+				sent <- eventProducer.Send([]byte("m3"))
+			}()
+
+			Convey("Then a new message waits until there is space in the queue", func() {
+				select {
+				case <-sent:
+					t.Fatal("send should have blocked")
+				case <-time.After(50 * time.Millisecond):
+				}
+
+				So(string(<-outputChannel), ShouldEqual, "m1")
+				So(<-sent, ShouldBeNil)
+				So(string(<-outputChannel), ShouldEqual, "m2")
+				So(string(<-outputChannel), ShouldEqual, "m3")
+			})
+		})
+	})
+
+	Convey("Given an asynchronous producer with queued messages", t, func() {
+		outputChannel := make(chan []byte, 10)
+		eventProducer := event.NewAsyncAvroProducer(outputChannel, marshallerMock, 10, event.OverflowBlock)
+		So(eventProducer.Send([]byte("m1")), ShouldBeNil)
+		So(eventProducer.Send([]byte("m2")), ShouldBeNil)
+
+		Convey("When the producer is closed", func() {
+			err := eventProducer.Close(context.Background())
+
+			Convey("Then the queued messages are flushed to the output channel", func() {
+				So(err, ShouldBeNil)
+				So(len(outputChannel), ShouldEqual, 2)
+				So(string(<-outputChannel), ShouldEqual, "m1")
+				So(string(<-outputChannel), ShouldEqual, "m2")
+			})
+
+			Convey("Then any further messages are rejected", func() {
+				So(eventProducer.Send([]byte("m3")), ShouldEqual, event.ErrProducerClosed)
+			})
+
+			Convey("Then closing again has no effect", func() {
+				So(eventProducer.Close(context.Background()), ShouldBeNil)
+			})
+		})
+	})
+
+	Convey("Given an asynchronous producer with queued messages and an output channel that is not being read", t, func() {
+		eventProducer := event.NewAsyncAvroProducer(make(chan []byte), marshallerMock, 1, event.OverflowBlock)
+		fillQueue(eventProducer)
+
+		Convey("When the producer is closed with a context that times out", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			err := eventProducer.Close(ctx)
+
+			Convey("Then an error is returned", func() {
+				So(err, ShouldNotBeNil)
+				So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+// fillQueue sends a message that is taken by the forwarding go-routine (which then blocks on the output channel),
+// followed by a message that fills a queue of size 1.
+func fillQueue(eventProducer *event.AvroProducer) {
+	So(eventProducer.Send([]byte("m1")), ShouldBeNil)
+	waitFor(func() bool { return eventProducer.QueueDepth() == 0 })
+	So(eventProducer.Send([]byte("m2")), ShouldBeNil)
+	So(eventProducer.QueueDepth(), ShouldEqual, 1)
+}
+
+func waitFor(condition func() bool) {
+	for i := 0; i < 100 && !condition(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	So(condition(), ShouldBeTrue)
+}
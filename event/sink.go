@@ -0,0 +1,263 @@
+package event
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	dphttp "github.com/ONSdigital/dp-net/v3/http"
+	"github.com/go-avro/avro"
+	"github.com/pkg/errors"
+)
+
+// AuditSink is a destination for marshalled audit messages
+type AuditSink interface {
+	// Write sends a message to the sink
+	Write(message []byte) error
+	// Close releases any resources held by the sink
+	Close(ctx context.Context) error
+}
+
+// ChannelSink sends messages to a channel, such as the output channel of a kafka producer
+type ChannelSink chan []byte
+
+// Write sends the message to the channel
+func (s ChannelSink) Write(message []byte) error {
+	s <- message
+	return nil
+}
+
+// Close has no effect, as the channel is owned by the caller
+func (s ChannelSink) Close(ctx context.Context) error {
+	return nil
+}
+
+// MultiSink sends messages to all of its sinks
+type MultiSink []AuditSink
+
+// Write sends the message to every sink, returning the errors of any sinks that failed. A failing sink doesn't stop
+// the message being sent to the others, so an error is returned even though the message may have been recorded by
+// some of the sinks. When events are audited synchronously the request then fails, so that no request is proxied
+// without being recorded by every sink.
+func (s MultiSink) Write(message []byte) error {
+	var errs []error
+	for _, sink := range s {
+		if err := sink.Write(message); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return stderrors.Join(errs...)
+}
+
+// Close closes every sink, returning the errors of any sinks that failed to close
+func (s MultiSink) Close(ctx context.Context) error {
+	var errs []error
+	for _, sink := range s {
+		if err := sink.Close(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return stderrors.Join(errs...)
+}
+
+// jsonDecoder decodes avro messages into JSON objects, using the schema they were marshalled with
+type jsonDecoder struct {
+	schema avro.Schema
+}
+
+func newJSONDecoder(schemaDefinition string) (*jsonDecoder, error) {
+	schema, err := avro.ParseSchema(schemaDefinition)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid audit schema")
+	}
+	return &jsonDecoder{schema: schema}, nil
+}
+
+// decode returns the JSON representation of the avro message, without a trailing newline
+func (d *jsonDecoder) decode(message []byte) ([]byte, error) {
+	reader := avro.NewGenericDatumReader()
+	reader.SetSchema(d.schema)
+	record := avro.NewGenericRecord(d.schema)
+	if err := reader.Read(record, avro.NewBinaryDecoder(message)); err != nil {
+		return nil, errors.Wrap(err, "failed to decode audit message")
+	}
+	return json.Marshal(record.Map())
+}
+
+// JSONSink writes messages to a writer as JSON lines
+type JSONSink struct {
+	decoder *jsonDecoder
+	mu      sync.Mutex
+	w       io.Writer
+}
+
+// NewJSONSink creates a sink that writes messages, marshalled with the provided avro schema, to w as JSON lines.
+// If w is an io.Closer it is closed when the sink is closed.
+func NewJSONSink(w io.Writer, schemaDefinition string) (*JSONSink, error) {
+	decoder, err := newJSONDecoder(schemaDefinition)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONSink{decoder: decoder, w: w}, nil
+}
+
+// Write writes the message as a single JSON line
+func (s *JSONSink) Write(message []byte) error {
+	line, err := s.decoder.decode(message)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the underlying writer, if it is an io.Closer
+func (s *JSONSink) Close(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// NewFileSink creates a sink that appends messages as JSON lines to the file at path. Once the file would grow beyond
+// maxBytes it is rotated, keeping up to maxBackups previous files named path.1 (the most recent), path.2 and so on.
+func NewFileSink(path string, maxBytes int64, maxBackups int, schemaDefinition string) (*JSONSink, error) {
+	f, err := openRotatingFile(path, maxBytes, maxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONSink(f, schemaDefinition)
+}
+
+// rotatingFile is an io.WriteCloser that rotates the file once it reaches its maximum size.
+// It is not safe for concurrent use, which is guaranteed by JSONSink.
+type rotatingFile struct {
+	path       string
+	maxBytes   int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxBytes int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxBytes: maxBytes, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return errors.Wrap(err, "failed to open audit file")
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return errors.Wrap(err, "failed to stat audit file")
+	}
+	r.file = f
+	r.size = info.Size()
+	return nil
+}
+
+// Write writes b to the file, rotating it first if b would take it beyond its maximum size
+func (r *rotatingFile) Write(b []byte) (int, error) {
+	if r.maxBytes > 0 && r.size > 0 && r.size+int64(len(b)) > r.maxBytes {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the existing backups along, discarding the oldest, and moves the current file to path.1
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return errors.Wrap(err, "failed to close audit file for rotation")
+	}
+
+	if r.maxBackups <= 0 {
+		if err := os.Remove(r.path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "failed to remove audit file")
+		}
+		return r.open()
+	}
+
+	for i := r.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(r.backupPath(i), r.backupPath(i+1)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "failed to rotate audit file backup")
+		}
+	}
+	if err := os.Rename(r.path, r.backupPath(1)); err != nil {
+		return errors.Wrap(err, "failed to rotate audit file")
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) backupPath(i int) string {
+	return fmt.Sprintf("%s.%d", r.path, i)
+}
+
+// Close closes the current file
+func (r *rotatingFile) Close() error {
+	return r.file.Close()
+}
+
+// WebhookSink posts each message as a JSON object to an HTTP endpoint
+type WebhookSink struct {
+	decoder *jsonDecoder
+	client  dphttp.Clienter
+	url     string
+}
+
+// NewWebhookSink creates a sink that posts messages, marshalled with the provided avro schema, to url as JSON
+func NewWebhookSink(client dphttp.Clienter, url, schemaDefinition string) (*WebhookSink, error) {
+	decoder, err := newJSONDecoder(schemaDefinition)
+	if err != nil {
+		return nil, err
+	}
+	return &WebhookSink{decoder: decoder, client: client, url: url}, nil
+}
+
+// Write posts the message to the webhook, failing if it does not respond with a 2xx status code
+func (s *WebhookSink) Write(message []byte) error {
+	body, err := s.decoder.decode(message)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	resp, err := s.client.Post(ctx, s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to post audit message to webhook")
+	}
+	defer func() {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("audit webhook responded with unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Close has no effect, as the client is owned by the caller
+func (s *WebhookSink) Close(ctx context.Context) error {
+	return nil
+}
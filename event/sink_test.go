@@ -0,0 +1,242 @@
+package event_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ONSdigital/dp-api-router/event"
+	"github.com/ONSdigital/dp-api-router/schema"
+	dphttp "github.com/ONSdigital/dp-net/v3/http"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var errSink = errors.New("sink error")
+
+// sinkMock is an AuditSink that records the messages written to it
+type sinkMock struct {
+	messages [][]byte
+	err      error
+	closed   bool
+}
+
+func (s *sinkMock) Write(message []byte) error {
+	s.messages = append(s.messages, message)
+	return s.err
+}
+
+func (s *sinkMock) Close(ctx context.Context) error {
+	s.closed = true
+	return s.err
+}
+
+// marshalTestEvent marshals the test audit event with the provided schema
+func marshalTestEvent(s interface {
+	Marshal(interface{}) ([]byte, error)
+}) []byte {
+	b, err := s.Marshal(testAuditEvent)
+	So(err, ShouldBeNil)
+	return b
+}
+
+// decodeJSONLines decodes each line of the provided JSON lines output
+func decodeJSONLines(b []byte) []map[string]interface{} {
+	lines := []map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		m := map[string]interface{}{}
+		So(json.Unmarshal([]byte(line), &m), ShouldBeNil)
+		lines = append(lines, m)
+	}
+	return lines
+}
+
+func TestMultiSink(t *testing.T) {
+	Convey("Given a multi sink with a healthy and a failing sink", t, func() {
+		healthy := &sinkMock{}
+		failing := &sinkMock{err: errSink}
+		sink := event.MultiSink{healthy, failing}
+
+		Convey("When a message is written, then it is sent to both sinks and the failure is returned", func() {
+			err := sink.Write([]byte("m1"))
+			So(errors.Is(err, errSink), ShouldBeTrue)
+			So(healthy.messages, ShouldResemble, [][]byte{[]byte("m1")})
+			So(failing.messages, ShouldResemble, [][]byte{[]byte("m1")})
+		})
+
+		Convey("When the sink is closed, then both sinks are closed and the failure is returned", func() {
+			err := sink.Close(context.Background())
+			So(errors.Is(err, errSink), ShouldBeTrue)
+			So(healthy.closed, ShouldBeTrue)
+			So(failing.closed, ShouldBeTrue)
+		})
+	})
+
+	Convey("Given a synchronous producer with a multi sink, where one of the sinks fails", t, func() {
+		healthy := &sinkMock{}
+		failing := &sinkMock{err: errSink}
+		eventProducer := event.NewAvroProducerWithSink(event.MultiSink{failing, healthy}, schema.AuditEvent)
+
+		Convey("When an event is audited, then the failure is returned, though the event is recorded by the other sink", func() {
+			err := eventProducer.Audit(testAuditEvent)
+			So(errors.Is(err, errSink), ShouldBeTrue)
+			So(healthy.messages, ShouldHaveLength, 1)
+		})
+	})
+
+	Convey("Given an async producer with a sink", t, func() {
+		sink := &sinkMock{}
+		eventProducer := event.NewAsyncAvroProducerWithSink(sink, schema.AuditEvent, 10, event.OverflowBlock)
+
+		Convey("When events are audited and the producer is closed, then they are written to the sink and it is closed", func() {
+			So(eventProducer.Audit(testAuditEvent), ShouldBeNil)
+			So(eventProducer.Audit(testAuditEvent), ShouldBeNil)
+			So(eventProducer.Close(context.Background()), ShouldBeNil)
+			So(sink.messages, ShouldHaveLength, 2)
+			So(sink.closed, ShouldBeTrue)
+		})
+	})
+}
+
+func TestJSONSink(t *testing.T) {
+	Convey("Given a JSON sink for version 1 messages", t, func() {
+		buf := &bytes.Buffer{}
+		sink, err := event.NewJSONSink(buf, schema.AuditEvent.Definition)
+		So(err, ShouldBeNil)
+
+		Convey("When two messages are written, then they are written as JSON lines with the version 1 fields", func() {
+			message := marshalTestEvent(schema.AuditEvent)
+			So(sink.Write(message), ShouldBeNil)
+			So(sink.Write(message), ShouldBeNil)
+
+			lines := decodeJSONLines(buf.Bytes())
+			So(lines, ShouldHaveLength, 2)
+			So(lines[0], ShouldResemble, map[string]interface{}{
+				"created_at":    float64(testTimeMillis),
+				"request_id":    "myRequest",
+				"identity":      "myIdentity",
+				"collection_id": "myCollection",
+				"path":          "myPath",
+				"method":        "myMethod",
+				"status_code":   float64(200),
+				"query_param":   "myQueryParam",
+			})
+		})
+
+		Convey("When an invalid message is written, then an error is returned and nothing is written", func() {
+			So(sink.Write([]byte{0xff}), ShouldNotBeNil)
+			So(buf.Len(), ShouldEqual, 0)
+		})
+	})
+
+	Convey("Given a JSON sink for version 2 messages", t, func() {
+		buf := &bytes.Buffer{}
+		sink, err := event.NewJSONSink(buf, schema.AuditEventV2.Definition)
+		So(err, ShouldBeNil)
+
+		Convey("When a message is written, then it includes the version 2 fields", func() {
+			So(sink.Write(marshalTestEvent(schema.AuditEventV2)), ShouldBeNil)
+			lines := decodeJSONLines(buf.Bytes())
+			So(lines, ShouldHaveLength, 1)
+			So(lines[0], ShouldContainKey, "duration_ms")
+			So(lines[0], ShouldContainKey, "auth_type")
+		})
+	})
+
+	Convey("Creating a JSON sink with an invalid schema fails", t, func() {
+		_, err := event.NewJSONSink(&bytes.Buffer{}, "{")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestFileSink(t *testing.T) {
+	Convey("Given a file sink that rotates after two messages, keeping two backups", t, func() {
+		message := marshalTestEvent(schema.AuditEvent)
+		buf := &bytes.Buffer{}
+		jsonSink, err := event.NewJSONSink(buf, schema.AuditEvent.Definition)
+		So(err, ShouldBeNil)
+		So(jsonSink.Write(message), ShouldBeNil)
+		lineSize := int64(buf.Len())
+
+		path := filepath.Join(t.TempDir(), "audit.log")
+		sink, err := event.NewFileSink(path, 2*lineSize, 2, schema.AuditEvent.Definition)
+		So(err, ShouldBeNil)
+
+		Convey("When seven messages are written, then the file is rotated and only two backups are kept", func() {
+			for i := 0; i < 7; i++ {
+				So(sink.Write(message), ShouldBeNil)
+			}
+			So(sink.Close(context.Background()), ShouldBeNil)
+
+			for _, tc := range []struct {
+				path  string
+				lines int
+			}{{path, 1}, {path + ".1", 2}, {path + ".2", 2}} {
+				b, err := os.ReadFile(tc.path)
+				So(err, ShouldBeNil)
+				So(decodeJSONLines(b), ShouldHaveLength, tc.lines)
+			}
+			_, err := os.Stat(path + ".3")
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("When the sink is reopened, then messages are appended to the existing file", func() {
+			So(sink.Write(message), ShouldBeNil)
+			So(sink.Close(context.Background()), ShouldBeNil)
+
+			sink, err = event.NewFileSink(path, 2*lineSize, 2, schema.AuditEvent.Definition)
+			So(err, ShouldBeNil)
+			So(sink.Write(message), ShouldBeNil)
+			So(sink.Close(context.Background()), ShouldBeNil)
+
+			b, err := os.ReadFile(path)
+			So(err, ShouldBeNil)
+			So(decodeJSONLines(b), ShouldHaveLength, 2)
+		})
+	})
+
+	Convey("Creating a file sink in a directory that does not exist fails", t, func() {
+		_, err := event.NewFileSink(filepath.Join(t.TempDir(), "missing", "audit.log"), 0, 0, schema.AuditEvent.Definition)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestWebhookSink(t *testing.T) {
+	Convey("Given a webhook sink", t, func() {
+		statusCode := http.StatusNoContent
+		var posted []byte
+		clientMock := &dphttp.ClienterMock{
+			PostFunc: func(ctx context.Context, url, contentType string, body io.Reader) (*http.Response, error) {
+				So(url, ShouldEqual, "http://localhost:9999/audit")
+				So(contentType, ShouldEqual, "application/json")
+				posted, _ = io.ReadAll(body)
+				return &http.Response{StatusCode: statusCode, Body: io.NopCloser(strings.NewReader(""))}, nil
+			},
+		}
+		sink, err := event.NewWebhookSink(clientMock, "http://localhost:9999/audit", schema.AuditEvent.Definition)
+		So(err, ShouldBeNil)
+
+		Convey("When a message is written, then it is posted as a JSON object", func() {
+			So(sink.Write(marshalTestEvent(schema.AuditEvent)), ShouldBeNil)
+			So(decodeJSONLines(posted)[0]["identity"], ShouldEqual, "myIdentity")
+		})
+
+		Convey("When the webhook responds with an error status, then an error is returned", func() {
+			statusCode = http.StatusInternalServerError
+			So(sink.Write(marshalTestEvent(schema.AuditEvent)), ShouldNotBeNil)
+		})
+
+		Convey("When the webhook cannot be reached, then an error is returned", func() {
+			clientMock.PostFunc = func(ctx context.Context, url, contentType string, body io.Reader) (*http.Response, error) {
+				return nil, errSink
+			}
+			So(sink.Write(marshalTestEvent(schema.AuditEvent)), ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,608 @@
+package event
+
+import (
+	"context"
+	"encoding/binary"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ONSdigital/dp-api-router/metrics"
+	"github.com/ONSdigital/dp-healthcheck/healthcheck"
+	kafka "github.com/ONSdigital/dp-kafka/v3"
+	"github.com/ONSdigital/log.go/v2/log"
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+)
+
+// spoolReplayBatchSize is the number of spooled messages replayed at a time, so that new messages aren't held up
+// for the whole of a long replay
+const spoolReplayBatchSize = 100
+
+// spoolRecordHeaderSize is the size of the length prefix of each message in the spool file
+const spoolRecordHeaderSize = 4
+
+// Health check messages for the audit spool
+const (
+	msgSpoolEmpty   = "audit spool is empty"
+	msgSpoolBacklog = "%d audit messages (%d bytes) are waiting in the spool to be replayed"
+	msgSpoolFull    = "audit spool is full, %d audit messages (%d bytes) are waiting to be replayed"
+)
+
+var (
+	// ErrKafkaUnavailable is returned when a message is written to a kafka sink whose producer is not initialised
+	ErrKafkaUnavailable = errors.New("kafka audit producer is not initialised")
+	// ErrKafkaTimeout is returned when a message is not accepted by the kafka producer within the send timeout
+	ErrKafkaTimeout = errors.New("timed out sending audit message to kafka")
+	// ErrSpoolFull is returned when a message is rejected because the spool has reached its maximum size
+	ErrSpoolFull = errors.New("audit spool is full")
+
+	spoolMessages = metrics.NewCounterVec("audit_spool_messages_total",
+		"Audit messages that were spooled, replayed from the spool or rejected because the spool was full", "result")
+)
+
+// KafkaProducer is the part of a kafka producer used by KafkaSink
+type KafkaProducer interface {
+	Channels() *kafka.ProducerChannels
+	IsInitialised() bool
+	Checker(ctx context.Context, state *healthcheck.CheckState) error
+}
+
+// KafkaSink sends messages to the output channel of a kafka producer, failing if the producer is not initialised,
+// rather than letting the producer discard the message
+type KafkaSink struct {
+	producer KafkaProducer
+	timeout  time.Duration
+}
+
+// NewKafkaSink creates a sink for the provided kafka producer, which fails writes that the producer doesn't accept
+// within the timeout
+func NewKafkaSink(producer KafkaProducer, timeout time.Duration) *KafkaSink {
+	return &KafkaSink{producer: producer, timeout: timeout}
+}
+
+// Write sends the message to the producer output channel. The producer only queues the message, so a failure to
+// deliver it is reported later, to the func passed to HandleErrors.
+func (s *KafkaSink) Write(message []byte) (err error) {
+	if !s.producer.IsInitialised() {
+		return ErrKafkaUnavailable
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = ErrKafkaUnavailable // the output channel has been closed
+		}
+	}()
+
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	select {
+	case s.producer.Channels().Output <- message:
+		return nil
+	case <-timer.C:
+		return ErrKafkaTimeout
+	}
+}
+
+// HandleErrors receives the errors reported by the producer in a new go-routine, until its errors channel is closed.
+// Messages that the producer failed to deliver are passed to undelivered, e.g. to spool them, and other errors are
+// logged. It replaces the producer's LogErrors, as each error can only be received once.
+func (s *KafkaSink) HandleErrors(ctx context.Context, undelivered func(message []byte) error) {
+	producerErrors := s.producer.Channels().Errors
+	go func() {
+		for err := range producerErrors {
+			var producerErr *sarama.ProducerError
+			if !errors.As(err, &producerErr) || producerErr.Msg == nil || producerErr.Msg.Value == nil {
+				log.Error(ctx, "received kafka audit producer error", err)
+				continue
+			}
+			message, encodeErr := producerErr.Msg.Value.Encode()
+			if encodeErr != nil {
+				log.Error(ctx, "failed to read undelivered audit message", encodeErr, log.FormatErrors([]error{err}))
+				continue
+			}
+			log.Warn(ctx, "audit message could not be delivered to kafka", log.FormatErrors([]error{err}))
+			if err := undelivered(message); err != nil {
+				log.Error(ctx, "undelivered audit message was lost", err)
+			}
+		}
+	}()
+}
+
+// Close has no effect, as the producer is owned by the caller
+func (s *KafkaSink) Close(ctx context.Context) error {
+	return nil
+}
+
+// Available returns true if the producer is initialised and its health check is OK
+func (s *KafkaSink) Available(ctx context.Context) bool {
+	if !s.producer.IsInitialised() {
+		return false
+	}
+	state := healthcheck.NewCheckState("Kafka Audit Producer")
+	if err := s.producer.Checker(ctx, state); err != nil {
+		return false
+	}
+	return state.Status() == healthcheck.StatusOK
+}
+
+// SpoolSink sends messages to a sink that may become unavailable, such as kafka. While the sink is unavailable, or
+// if writing to it fails, messages are appended to a spool file on disk instead, and are replayed to the sink in order
+// once it is available again. New messages are spooled for as long as there is a backlog, so that order is preserved.
+type SpoolSink struct {
+	sink      AuditSink
+	available func(ctx context.Context) bool
+	spool     *spoolFile
+
+	mu          sync.Mutex
+	isAvailable atomic.Bool
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// NewSpoolSink creates a SpoolSink for the provided sink, spooling messages to the file at path, which is limited to
+// maxBytes. Any messages left in the spool by a previous instance are replayed once the sink is available.
+// The available func is called periodically, once the sink is started, to determine if the sink is available.
+func NewSpoolSink(sink AuditSink, available func(ctx context.Context) bool, path string, maxBytes int64) (*SpoolSink, error) {
+	spool, err := openSpoolFile(path, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SpoolSink{
+		sink:      sink,
+		available: available,
+		spool:     spool,
+		stop:      make(chan struct{}),
+	}
+	s.isAvailable.Store(true)
+
+	metrics.NewGaugeFunc("audit_spool_backlog_messages", "Audit messages waiting in the spool to be replayed", func() float64 {
+		messages, _ := s.Backlog()
+		return float64(messages)
+	})
+	metrics.NewGaugeFunc("audit_spool_backlog_bytes", "Size of the audit messages waiting in the spool to be replayed", func() float64 {
+		_, size := s.Backlog()
+		return float64(size)
+	})
+
+	return s, nil
+}
+
+// Write sends the message to the sink, or appends it to the spool if the sink is unavailable, fails or there is
+// already a backlog of spooled messages. An error is only returned if the message can't be spooled. The lock is not
+// held while writing to the sink, so that a slow sink doesn't hold up messages that are spooled or replayed.
+func (s *SpoolSink) Write(message []byte) error {
+	if s.writeToSink() {
+		err := s.sink.Write(message)
+		if err == nil {
+			return nil
+		}
+		log.Warn(context.Background(), "audit message could not be written to the sink, spooling it", log.FormatErrors([]error{err}))
+		s.isAvailable.Store(false)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.append(message)
+}
+
+// Spool appends a message that the sink accepted but then failed to deliver to the spool, and marks the sink as
+// unavailable, so that later messages are spooled behind it until the spool is replayed
+func (s *SpoolSink) Spool(message []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.isAvailable.Store(false)
+	return s.append(message)
+}
+
+// writeToSink returns true if messages can be written straight to the sink, as it is available and there is no
+// backlog of spooled messages
+func (s *SpoolSink) writeToSink() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.isAvailable.Load() && s.spool.backlog() == 0
+}
+
+// append appends the message to the spool. The caller must hold the lock.
+func (s *SpoolSink) append(message []byte) error {
+	if err := s.spool.append(message); err != nil {
+		if errors.Is(err, ErrSpoolFull) {
+			spoolMessages.Inc("rejected")
+		}
+		return err
+	}
+	spoolMessages.Inc("spooled")
+	return nil
+}
+
+// Start checks if the sink is available every interval, replaying any spooled messages to it once it is,
+// until the spool sink is closed
+func (s *SpoolSink) Start(ctx context.Context, interval time.Duration) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if s.available(ctx) {
+					s.Replay(ctx)
+				} else {
+					s.isAvailable.Store(false)
+				}
+			case <-s.stop:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Replay marks the sink as available and sends the spooled messages to it in order, in batches, until the spool is
+// empty or the sink fails. It returns the number of messages replayed.
+func (s *SpoolSink) Replay(ctx context.Context) (replayed int) {
+	s.isAvailable.Store(true)
+	for {
+		n, done, err := s.replayBatch()
+		replayed += n
+		if err != nil {
+			log.Error(ctx, "failed to replay spooled audit messages", err, log.Data{"replayed": replayed})
+			return replayed
+		}
+		if done {
+			if replayed > 0 {
+				log.Info(ctx, "replayed spooled audit messages", log.Data{"replayed": replayed})
+			}
+			return replayed
+		}
+	}
+}
+
+// replayBatch replays the next batch of spooled messages, returning the number replayed and whether the spool is
+// now empty. The sink is marked unavailable if it fails.
+func (s *SpoolSink) replayBatch() (replayed int, done bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.isAvailable.Load() {
+		return 0, true, nil
+	}
+
+	messages, sizes, err := s.spool.next(spoolReplayBatchSize)
+	if err != nil {
+		return 0, true, err
+	}
+
+	var consumed int64
+	for i, message := range messages {
+		if err = s.sink.Write(message); err != nil {
+			s.isAvailable.Store(false)
+			break
+		}
+		consumed += sizes[i]
+		replayed++
+	}
+	spoolMessages.Add(int64(replayed), "replayed")
+
+	if advanceErr := s.spool.advance(replayed, consumed); advanceErr != nil && err == nil {
+		err = advanceErr
+	}
+	return replayed, err != nil || s.spool.backlog() == 0, err
+}
+
+// Backlog returns the number and total size of the messages waiting in the spool
+func (s *SpoolSink) Backlog() (messages int, size int64) {
+	return s.spool.stats()
+}
+
+// Checker reports the backlog of the spool. It is a warning while there is a backlog, and critical if the spool
+// has been full since it was last replayed.
+func (s *SpoolSink) Checker(ctx context.Context, state *healthcheck.CheckState) error {
+	messages, size := s.spool.stats()
+
+	status, message := healthcheck.StatusOK, msgSpoolEmpty
+	switch {
+	case s.spool.isFull():
+		status, message = healthcheck.StatusCritical, fmt.Sprintf(msgSpoolFull, messages, size)
+	case messages > 0:
+		status, message = healthcheck.StatusWarning, fmt.Sprintf(msgSpoolBacklog, messages, size)
+	}
+
+	if err := state.Update(status, message, 0); err != nil {
+		log.Error(ctx, "failed to update audit spool health state", err)
+		return err
+	}
+	return nil
+}
+
+// Close stops replaying messages, closes the spool file, keeping any backlog for the next instance, and closes the sink
+func (s *SpoolSink) Close(ctx context.Context) error {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return stderrors.Join(s.spool.close(), s.sink.Close(ctx))
+}
+
+// spoolFile is an append-only file of length prefixed messages. The offset of the first message that has not been
+// replayed is kept in a separate offset file, so that a restarted instance doesn't replay the same messages again.
+// Once every message has been replayed the file is truncated. It is not safe for concurrent use.
+type spoolFile struct {
+	path     string
+	maxBytes int64
+	file     *os.File
+	size     int64
+	offset   int64
+	count    int
+	full     atomic.Bool
+
+	statsMu      sync.Mutex
+	statsCount   int
+	statsBacklog int64
+}
+
+func openSpoolFile(path string, maxBytes int64) (*spoolFile, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open audit spool file")
+	}
+	s := &spoolFile{path: path, maxBytes: maxBytes, file: f}
+
+	if err := s.load(); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads the offset file and scans the spool file to count the messages waiting to be replayed. A message that
+// was only partly written, e.g. because the instance stopped while writing it, is discarded.
+func (s *spoolFile) load() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return errors.Wrap(err, "failed to stat audit spool file")
+	}
+
+	if b, err := os.ReadFile(s.offsetPath()); err == nil {
+		s.offset, _ = strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	} else if !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to read audit spool offset file")
+	}
+	if s.offset < 0 || s.offset > info.Size() {
+		s.offset = 0
+	}
+
+	pos := s.offset
+	header := make([]byte, spoolRecordHeaderSize)
+	for pos+spoolRecordHeaderSize <= info.Size() {
+		if _, err := s.file.ReadAt(header, pos); err != nil {
+			return errors.Wrap(err, "failed to read audit spool file")
+		}
+		end := pos + spoolRecordHeaderSize + int64(binary.BigEndian.Uint32(header))
+		if end > info.Size() {
+			break
+		}
+		pos = end
+		s.count++
+	}
+
+	if pos < info.Size() {
+		if err := s.file.Truncate(pos); err != nil {
+			return errors.Wrap(err, "failed to discard partly written audit spool message")
+		}
+	}
+	s.size = pos
+	s.updateStats()
+	return nil
+}
+
+func (s *spoolFile) offsetPath() string {
+	return s.path + ".offset"
+}
+
+// append writes the message to the end of the file and syncs it to disk. If the file would grow beyond its
+// maximum size, the messages that have already been replayed are removed first.
+func (s *spoolFile) append(message []byte) error {
+	recordSize := int64(spoolRecordHeaderSize + len(message))
+	if s.maxBytes > 0 && s.size+recordSize > s.maxBytes && s.offset > 0 {
+		if err := s.compact(); err != nil {
+			return err
+		}
+	}
+	if s.maxBytes > 0 && s.size+recordSize > s.maxBytes {
+		s.full.Store(true)
+		return ErrSpoolFull
+	}
+
+	record := make([]byte, recordSize)
+	binary.BigEndian.PutUint32(record, uint32(len(message)))
+	copy(record[spoolRecordHeaderSize:], message)
+
+	if _, err := s.file.WriteAt(record, s.size); err != nil {
+		return errors.Wrap(err, "failed to write to audit spool file")
+	}
+	if err := s.file.Sync(); err != nil {
+		return errors.Wrap(err, "failed to sync audit spool file")
+	}
+	s.size += recordSize
+	s.count++
+	s.updateStats()
+	return nil
+}
+
+// next reads up to n messages from the offset, returning them with the size they take up in the file
+func (s *spoolFile) next(n int) (messages [][]byte, sizes []int64, err error) {
+	pos := s.offset
+	header := make([]byte, spoolRecordHeaderSize)
+	for len(messages) < n && pos < s.size {
+		if _, err := s.file.ReadAt(header, pos); err != nil {
+			return nil, nil, errors.Wrap(err, "failed to read audit spool file")
+		}
+		message := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err := s.file.ReadAt(message, pos+spoolRecordHeaderSize); err != nil && err != io.EOF {
+			return nil, nil, errors.Wrap(err, "failed to read audit spool file")
+		}
+		messages = append(messages, message)
+		sizes = append(sizes, int64(spoolRecordHeaderSize+len(message)))
+		pos += sizes[len(sizes)-1]
+	}
+	return messages, sizes, nil
+}
+
+// advance records that n messages, taking up size bytes, have been replayed. Once every message has been replayed
+// the file is truncated.
+func (s *spoolFile) advance(n int, size int64) error {
+	if n == 0 {
+		return nil
+	}
+	s.offset += size
+	s.count -= n
+
+	if s.count == 0 {
+		return s.reset()
+	}
+	defer s.updateStats()
+	return s.writeOffset(s.offset)
+}
+
+// reset truncates the file once every message has been replayed
+func (s *spoolFile) reset() error {
+	defer s.updateStats()
+	if err := s.file.Truncate(0); err != nil {
+		return errors.Wrap(err, "failed to truncate audit spool file")
+	}
+	s.size, s.offset, s.count = 0, 0, 0
+	s.full.Store(false)
+	if err := os.Remove(s.offsetPath()); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove audit spool offset file")
+	}
+	return nil
+}
+
+// compact rewrites the file without the messages that have already been replayed. The compacted file is synced and
+// the offset is reset to the start before it replaces the spool file, so the offset never points into the compacted
+// file. An instance that stops part way through compacting replays messages that were already replayed again, rather
+// than losing any.
+func (s *spoolFile) compact() error {
+	remaining := make([]byte, s.size-s.offset)
+	if _, err := s.file.ReadAt(remaining, s.offset); err != nil && err != io.EOF {
+		return errors.Wrap(err, "failed to read audit spool file for compaction")
+	}
+
+	tmpPath := s.path + ".tmp"
+	f, err := createSynced(tmpPath, remaining)
+	if err != nil {
+		return errors.Wrap(err, "failed to write compacted audit spool file")
+	}
+	if err := s.writeOffset(0); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	if err := renameFile(tmpPath, s.path); err != nil {
+		// the spool file is unchanged and still open, so only the offset needs to be restored
+		_ = f.Close()
+		_ = os.Remove(tmpPath)
+		return stderrors.Join(errors.Wrap(err, "failed to replace audit spool file with compacted file"), s.writeOffset(s.offset))
+	}
+
+	_ = s.file.Close()
+	s.file = f
+	s.size, s.offset = int64(len(remaining)), 0
+	s.full.Store(false)
+	return syncDir(s.path)
+}
+
+// writeOffset persists the offset, replacing the offset file atomically
+func (s *spoolFile) writeOffset(offset int64) error {
+	tmpPath := s.offsetPath() + ".tmp"
+	f, err := createSynced(tmpPath, []byte(strconv.FormatInt(offset, 10)))
+	if err != nil {
+		return errors.Wrap(err, "failed to write audit spool offset file")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "failed to write audit spool offset file")
+	}
+	if err := renameFile(tmpPath, s.offsetPath()); err != nil {
+		return errors.Wrap(err, "failed to replace audit spool offset file")
+	}
+	return syncDir(s.offsetPath())
+}
+
+// renameFile renames a file, replacing any file at the new path. It is a variable so that tests can simulate the
+// instance stopping part way through a compaction.
+var renameFile = os.Rename
+
+// createSynced creates the file at path with the data and syncs it to disk, returning the open file
+func createSynced(path string, data []byte) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// syncDir syncs the directory of the file at path to disk, so that a rename of the file is durable
+func syncDir(path string) error {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return errors.Wrap(err, "failed to open audit spool directory")
+	}
+	defer dir.Close()
+	if err := dir.Sync(); err != nil {
+		return errors.Wrap(err, "failed to sync audit spool directory")
+	}
+	return nil
+}
+
+// backlog returns the number of messages waiting to be replayed. The caller must hold the spool sink lock.
+func (s *spoolFile) backlog() int {
+	return s.count
+}
+
+// updateStats records the backlog so that it can be read without holding the spool sink lock
+func (s *spoolFile) updateStats() {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	s.statsCount = s.count
+	s.statsBacklog = s.size - s.offset
+}
+
+// stats returns the number and total size of the messages waiting to be replayed
+func (s *spoolFile) stats() (int, int64) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	return s.statsCount, s.statsBacklog
+}
+
+// isFull returns true if a message has been rejected since the spool was last emptied or compacted
+func (s *spoolFile) isFull() bool {
+	return s.full.Load()
+}
+
+func (s *spoolFile) close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,105 @@
+package event
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// errCrashed is panicked by renameFile to simulate the instance stopping part way through a compaction
+var errCrashed = errors.New("crashed")
+
+// spooledMessages opens the spool file at path, as a restarted instance would, and returns the messages waiting in it
+func spooledMessages(path string) []string {
+	spool, err := openSpoolFile(path, 0)
+	So(err, ShouldBeNil)
+	defer spool.close()
+
+	messages, _, err := spool.next(100)
+	So(err, ShouldBeNil)
+	result := []string{}
+	for _, message := range messages {
+		result = append(result, string(message))
+	}
+	return result
+}
+
+// compactWith appends a message that requires the spool to be compacted, with renameFile replaced by rename
+func compactWith(spool *spoolFile, rename func(oldPath, newPath string) error) (err error) {
+	renameFile = rename
+	defer func() {
+		renameFile = os.Rename
+		if r := recover(); r != nil {
+			err = r.(error)
+		}
+	}()
+	return spool.append([]byte("m4"))
+}
+
+func TestSpoolFileCompact(t *testing.T) {
+	Convey("Given a full spool file whose first messages have been replayed", t, func() {
+		path := filepath.Join(t.TempDir(), "audit.spool")
+		spool, err := openSpoolFile(path, 27)
+		So(err, ShouldBeNil)
+		for _, message := range []string{"m1", "message-two", "m3"} {
+			So(spool.append([]byte(message)), ShouldBeNil)
+		}
+		So(spool.advance(1, 6), ShouldBeNil)
+		So(spooledMessages(path), ShouldResemble, []string{"message-two", "m3"})
+
+		Convey("When a message is appended, then the spool is compacted to make room for it", func() {
+			So(spool.append([]byte("m4")), ShouldBeNil)
+			So(spool.close(), ShouldBeNil)
+			So(spooledMessages(path), ShouldResemble, []string{"message-two", "m3", "m4"})
+			_, err := os.Stat(path + ".tmp")
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("When replacing the spool file fails, then the spool is unchanged and can still be appended to", func() {
+			err := compactWith(spool, func(oldPath, newPath string) error {
+				if newPath == path {
+					return errors.New("rename failed")
+				}
+				return os.Rename(oldPath, newPath)
+			})
+			So(err, ShouldNotBeNil)
+			So(spooledMessages(path), ShouldResemble, []string{"message-two", "m3"})
+
+			So(spool.advance(2, 21), ShouldBeNil)
+			So(spool.append([]byte("m5")), ShouldBeNil)
+			So(spool.close(), ShouldBeNil)
+			So(spooledMessages(path), ShouldResemble, []string{"m5"})
+		})
+
+		Convey("When the instance stops after resetting the offset but before replacing the spool file", func() {
+			err := compactWith(spool, func(oldPath, newPath string) error {
+				if newPath == path {
+					panic(errCrashed)
+				}
+				return os.Rename(oldPath, newPath)
+			})
+			So(err, ShouldEqual, errCrashed)
+
+			Convey("Then no messages are lost, though replayed messages are replayed again", func() {
+				So(spooledMessages(path), ShouldResemble, []string{"m1", "message-two", "m3"})
+			})
+		})
+
+		Convey("When the instance stops after replacing the spool file", func() {
+			err := compactWith(spool, func(oldPath, newPath string) error {
+				if err := os.Rename(oldPath, newPath); err != nil || newPath != path {
+					return err
+				}
+				panic(errCrashed)
+			})
+			So(err, ShouldEqual, errCrashed)
+
+			Convey("Then the remaining messages are replayed from the start of the compacted file", func() {
+				So(spooledMessages(path), ShouldResemble, []string{"message-two", "m3"})
+			})
+		})
+	})
+}
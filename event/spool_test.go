@@ -0,0 +1,256 @@
+package event_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/dp-api-router/event"
+	"github.com/ONSdigital/dp-healthcheck/healthcheck"
+	kafka "github.com/ONSdigital/dp-kafka/v3"
+	"github.com/ONSdigital/dp-kafka/v3/kafkatest"
+	"github.com/Shopify/sarama"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var errUnavailable = errors.New("sink unavailable")
+
+// spoolState runs the spool health check and returns the resulting state
+func spoolState(sink *event.SpoolSink) *healthcheck.CheckState {
+	state := healthcheck.NewCheckState("Audit Spool")
+	So(sink.Checker(context.Background(), state), ShouldBeNil)
+	return state
+}
+
+// alwaysAvailable is an availability check for sinks that are always available
+func alwaysAvailable(ctx context.Context) bool {
+	return true
+}
+
+func TestSpoolSink(t *testing.T) {
+	Convey("Given a spool sink for a sink that is available", t, func() {
+		path := filepath.Join(t.TempDir(), "audit.spool")
+		sink := &sinkMock{}
+		spoolSink, err := event.NewSpoolSink(sink, alwaysAvailable, path, 1024)
+		So(err, ShouldBeNil)
+
+		Convey("When messages are written, then they are sent straight to the sink", func() {
+			So(spoolSink.Write([]byte("m1")), ShouldBeNil)
+			So(spoolSink.Write([]byte("m2")), ShouldBeNil)
+			So(sink.messages, ShouldResemble, [][]byte{[]byte("m1"), []byte("m2")})
+
+			messages, size := spoolSink.Backlog()
+			So(messages, ShouldEqual, 0)
+			So(size, ShouldEqual, 0)
+			So(spoolState(spoolSink).Status(), ShouldEqual, healthcheck.StatusOK)
+		})
+
+		Convey("When the sink fails", func() {
+			sink.err = errUnavailable
+			So(spoolSink.Write([]byte("m1")), ShouldBeNil)
+
+			Convey("Then later messages are spooled in order, even once the sink has recovered", func() {
+				sink.err = nil
+				So(spoolSink.Write([]byte("m2")), ShouldBeNil)
+				So(sink.messages, ShouldResemble, [][]byte{[]byte("m1")})
+
+				messages, size := spoolSink.Backlog()
+				So(messages, ShouldEqual, 2)
+				So(size, ShouldEqual, 12)
+				So(spoolState(spoolSink).Status(), ShouldEqual, healthcheck.StatusWarning)
+
+				Convey("And they are replayed in order, emptying the spool", func() {
+					sink.messages = nil
+					spoolSink.Start(context.Background(), time.Millisecond)
+					So(waitForBacklog(spoolSink, 0), ShouldBeTrue)
+					So(spoolSink.Close(context.Background()), ShouldBeNil)
+
+					So(sink.messages, ShouldResemble, [][]byte{[]byte("m1"), []byte("m2")})
+					info, err := os.Stat(path)
+					So(err, ShouldBeNil)
+					So(info.Size(), ShouldEqual, 0)
+
+					So(spoolSink.Write([]byte("m3")), ShouldBeNil)
+					So(sink.messages[2], ShouldResemble, []byte("m3"))
+				})
+			})
+		})
+
+		Convey("When the spool is full, then messages are rejected and the health check is critical", func() {
+			sink.err = errUnavailable
+			So(spoolSink.Write(make([]byte, 1000)), ShouldBeNil)
+			So(spoolSink.Write(make([]byte, 100)), ShouldEqual, event.ErrSpoolFull)
+			So(spoolState(spoolSink).Status(), ShouldEqual, healthcheck.StatusCritical)
+		})
+	})
+
+	Convey("Given a spool with a backlog, whose sink fails part way through replaying it", t, func() {
+		path := filepath.Join(t.TempDir(), "audit.spool")
+		sink := &failingSinkMock{failAfter: 2}
+		spoolSink, err := event.NewSpoolSink(sink, alwaysAvailable, path, 0)
+		So(err, ShouldBeNil)
+		for _, message := range []string{"m1", "m2", "m3", "m4"} {
+			So(spoolSink.Write([]byte(message)), ShouldBeNil)
+		}
+		So(sink.messages, ShouldBeEmpty)
+
+		Convey("When it is replayed, then only the messages before the failure are removed from the spool", func() {
+			sink.failAfter = 2
+			So(spoolSink.Replay(context.Background()), ShouldEqual, 0)
+			messages, _ := spoolSink.Backlog()
+			So(messages, ShouldEqual, 4)
+		})
+
+		Convey("When it is closed part way through replaying and reopened", func() {
+			sink.available = true
+			spoolSink.Replay(context.Background())
+			So(sink.messages, ShouldResemble, [][]byte{[]byte("m1"), []byte("m2")})
+			So(spoolSink.Close(context.Background()), ShouldBeNil)
+
+			sink.failAfter = -1
+			spoolSink, err = event.NewSpoolSink(sink, alwaysAvailable, path, 0)
+			So(err, ShouldBeNil)
+
+			Convey("Then only the remaining messages are replayed", func() {
+				messages, _ := spoolSink.Backlog()
+				So(messages, ShouldEqual, 2)
+				So(spoolSink.Replay(context.Background()), ShouldEqual, 2)
+				So(sink.messages, ShouldResemble, [][]byte{[]byte("m1"), []byte("m2"), []byte("m3"), []byte("m4")})
+			})
+		})
+	})
+
+	Convey("Given a spool file whose last message was only partly written", t, func() {
+		path := filepath.Join(t.TempDir(), "audit.spool")
+		So(os.WriteFile(path, []byte{0, 0, 0, 2, 'm', '1', 0, 0, 0, 9, 'm'}, 0o600), ShouldBeNil)
+
+		Convey("When the spool sink is created, then the partly written message is discarded", func() {
+			sink := &sinkMock{}
+			spoolSink, err := event.NewSpoolSink(sink, alwaysAvailable, path, 0)
+			So(err, ShouldBeNil)
+			messages, size := spoolSink.Backlog()
+			So(messages, ShouldEqual, 1)
+			So(size, ShouldEqual, 6)
+
+			So(spoolSink.Replay(context.Background()), ShouldEqual, 1)
+			So(sink.messages, ShouldResemble, [][]byte{[]byte("m1")})
+		})
+	})
+
+	Convey("Given a spool sink whose sink is not available", t, func() {
+		sink := &sinkMock{}
+		spoolSink, err := event.NewSpoolSink(sink, func(ctx context.Context) bool { return false }, filepath.Join(t.TempDir(), "audit.spool"), 0)
+		So(err, ShouldBeNil)
+
+		Convey("When it has been started, then messages are spooled without trying the sink", func() {
+			spoolSink.Start(context.Background(), time.Millisecond)
+			time.Sleep(20 * time.Millisecond)
+			So(spoolSink.Write([]byte("m1")), ShouldBeNil)
+			So(spoolSink.Close(context.Background()), ShouldBeNil)
+			So(sink.messages, ShouldBeEmpty)
+			So(sink.closed, ShouldBeTrue)
+		})
+	})
+}
+
+// waitForBacklog waits until the spool has the expected backlog, returning false if it doesn't within a second
+func waitForBacklog(sink *event.SpoolSink, expected int) bool {
+	for i := 0; i < 100; i++ {
+		if messages, _ := sink.Backlog(); messages == expected {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// failingSinkMock is an AuditSink that is unavailable until available is set, after which it accepts failAfter
+// messages before failing again. A negative failAfter never fails once available.
+type failingSinkMock struct {
+	sinkMock
+	available bool
+	failAfter int
+}
+
+func (s *failingSinkMock) Write(message []byte) error {
+	if !s.available || s.failAfter == 0 {
+		return errUnavailable
+	}
+	s.failAfter--
+	s.messages = append(s.messages, message)
+	return nil
+}
+
+func TestKafkaSink(t *testing.T) {
+	Convey("Given a kafka sink", t, func() {
+		initialised := false
+		status := healthcheck.StatusOK
+		channels := kafka.CreateProducerChannels()
+		producer := &kafkatest.IProducerMock{
+			IsInitialisedFunc: func() bool { return initialised },
+			ChannelsFunc:      func() *kafka.ProducerChannels { return channels },
+			CheckerFunc: func(ctx context.Context, state *healthcheck.CheckState) error {
+				return state.Update(status, "", 0)
+			},
+		}
+		sink := event.NewKafkaSink(producer, 10*time.Millisecond)
+
+		Convey("When the producer is not initialised, then writes fail and it is not available", func() {
+			So(sink.Write([]byte("m1")), ShouldEqual, event.ErrKafkaUnavailable)
+			So(sink.Available(context.Background()), ShouldBeFalse)
+		})
+
+		Convey("When the producer is initialised, then messages are sent to its output channel", func() {
+			initialised = true
+			go func() {
+				_ = sink.Write([]byte("m1"))
+			}()
+			So(<-channels.Output, ShouldResemble, []byte("m1"))
+			So(sink.Available(context.Background()), ShouldBeTrue)
+
+			Convey("And it is not available if its health check is not OK", func() {
+				status = healthcheck.StatusCritical
+				So(sink.Available(context.Background()), ShouldBeFalse)
+			})
+		})
+
+		Convey("When the producer doesn't accept a message within the timeout, then the write fails", func() {
+			initialised = true
+			So(sink.Write([]byte("m1")), ShouldEqual, event.ErrKafkaTimeout)
+		})
+
+		Convey("When it is spooled and the producer accepts a message but then fails to deliver it", func() {
+			initialised = true
+			spoolSink, err := event.NewSpoolSink(sink, sink.Available, filepath.Join(t.TempDir(), "audit.spool"), 0)
+			So(err, ShouldBeNil)
+			sink.HandleErrors(context.Background(), spoolSink.Spool)
+
+			go func() {
+				<-channels.Output
+				channels.Errors <- &sarama.ProducerError{
+					Msg: &sarama.ProducerMessage{Value: sarama.StringEncoder("m1")},
+					Err: errUnavailable,
+				}
+			}()
+			So(spoolSink.Write([]byte("m1")), ShouldBeNil)
+
+			Convey("Then the message is spooled, along with later messages, until the spool is replayed", func() {
+				So(waitForBacklog(spoolSink, 1), ShouldBeTrue)
+				So(spoolSink.Write([]byte("m2")), ShouldBeNil)
+				messages, _ := spoolSink.Backlog()
+				So(messages, ShouldEqual, 2)
+
+				replayed := make(chan [][]byte)
+				go func() {
+					replayed <- [][]byte{<-channels.Output, <-channels.Output}
+				}()
+				So(spoolSink.Replay(context.Background()), ShouldEqual, 2)
+				So(<-replayed, ShouldResemble, [][]byte{[]byte("m1"), []byte("m2")})
+				So(spoolSink.Close(context.Background()), ShouldBeNil)
+			})
+		})
+	})
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"reflect"
@@ -15,31 +16,72 @@ import (
 	"strings"
 
 	"github.com/ONSdigital/dp-api-router/config"
+	"github.com/ONSdigital/dp-api-router/metrics"
+	"github.com/ONSdigital/dp-api-router/middleware"
 	"github.com/ONSdigital/log.go/v2/log"
+	"github.com/gorilla/mux"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
 // Transport implements the http RoundTripper method and allows the
 // response body to be post processed
 type Transport struct {
-	domain string
+	domain        string
+	options       Options
+	publicHosts   []string
+	upstreamHosts []string
+	maxBodySize   int64
 	http.RoundTripper
 }
 
 var _ http.RoundTripper = &Transport{}
 
-// NewRoundTripper creates a Transport instance with configured domain
+// Options determines which parts of the proxied traffic a Transport rewrites
+type Options struct {
+	// Response rewrites upstream links in response headers and JSON response bodies to the public domain
+	Response bool
+	// Request rewrites public links in JSON request bodies back to the upstream relative form
+	Request bool
+}
+
+// linkRewriter returns the replacement for a link found under one of the known link keys
+type linkRewriter func(field, domain string) (string, error)
+
+// NewRoundTripper creates a Transport instance with configured domain, that rewrites responses
 func NewRoundTripper(domain string, rt http.RoundTripper) *Transport {
+	return NewRoundTripperWithOptions(domain, rt, Options{Response: true})
+}
+
+// NewRoundTripperWithOptions creates a Transport instance with configured domain, that rewrites the requests and/or responses according to the provided options
+func NewRoundTripperWithOptions(domain string, rt http.RoundTripper, options Options) *Transport {
 	cfg, err := config.Get()
 	if err != nil {
 		log.Error(context.Background(), "Unable to retrieve config'", err)
 	}
 
 	if cfg.OtelEnabled {
-		return &Transport{domain, otelhttp.NewTransport(rt)}
+		rt = otelhttp.NewTransport(rt)
 	}
 
-	return &Transport{domain, rt}
+	return &Transport{
+		domain:        domain,
+		options:       options,
+		publicHosts:   cfg.PublicHosts,
+		upstreamHosts: hostsOf(cfg.UpstreamURLs()),
+		maxBodySize:   cfg.InterceptorMaxBodySize,
+		RoundTripper:  rt,
+	}
+}
+
+// hostsOf returns the hosts of the URLs, leaving out any that can't be parsed
+func hostsOf(urls []string) []string {
+	var hosts []string
+	for _, u := range urls {
+		if parsed, err := url.Parse(u); err == nil && parsed.Host != "" {
+			hosts = append(hosts, parsed.Host)
+		}
+	}
+	return hosts
 }
 
 const (
@@ -56,17 +98,44 @@ const (
 
 var (
 	re = regexp.MustCompile(`^(.+://)(.+)(/v\d)$`)
+
+	// linkHeaderURI matches each URI-Reference enclosed in angle brackets within a Link header value
+	linkHeaderURI = regexp.MustCompile(`<([^>]*)>`)
+
+	// locationHeaders are the response headers that contain a single URL which may refer to an upstream host
+	locationHeaders = []string{"Location", "Content-Location"}
+
+	oversizedResponses = metrics.NewCounterVec("interceptor_oversized_responses_total",
+		"Responses that were passed through without rewriting, because their body exceeded the maximum size", "route", "upstream")
+
+	oversizedRequests = metrics.NewCounterVec("interceptor_oversized_requests_total",
+		"Requests that were passed through without rewriting, because their body exceeded the maximum size", "route", "upstream")
 )
 
 // RoundTrip intercepts the response body and post processes to add the correct environment
 // host to links
 func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	domain := t.domainFor(req)
+
+	if t.options.Request {
+		req, err = t.updateRequest(req, domain)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Make the request to the server
 	resp, err = t.RoundTripper.RoundTrip(req)
 	if err != nil {
 		return nil, err
 	}
 
+	if !t.options.Response {
+		return resp, nil
+	}
+
+	t.updateHeaders(req, resp.Header, domain)
+
 	contentType := resp.Header.Get("Content-Type") // get canonical form
 
 	if strings.Contains(contentType, "gzip") {
@@ -75,6 +144,11 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 
 	// "contentEncoding": "gzip" ... might need to exclude these things at some point
 
+	if t.maxBodySize > 0 && resp.ContentLength > t.maxBodySize {
+		t.passThroughOversized(req, resp.ContentLength, oversizedResponses, "response")
+		return resp, nil
+	}
+
 	// get small number of bytes from resp
 	readdata, err := io.ReadAll(io.LimitReader(resp.Body, maxBodyLengthToLog))
 	if err != nil {
@@ -116,16 +190,26 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 	}
 
 	// get the rest of the stream, which should be of reasonable size
-	b, err := io.ReadAll(NewMultiReadCloser(bytes.NewReader(readdata), resp.Body))
+	body := io.MultiReader(bytes.NewReader(readdata), resp.Body)
+	if t.maxBodySize > 0 {
+		body = io.LimitReader(body, t.maxBodySize+1)
+	}
+	b, err := io.ReadAll(body)
 	if err != nil {
 		return nil, err
 	}
+	if t.maxBodySize > 0 && int64(len(b)) > t.maxBodySize {
+		t.passThroughOversized(req, resp.ContentLength, oversizedResponses, "response")
+		// recombine the buffered part of the body with any remaining part of the stream
+		resp.Body = NewMultiReadCloser(bytes.NewReader(b), resp.Body)
+		return resp, nil
+	}
 	err = resp.Body.Close()
 	if err != nil {
 		return nil, err
 	}
 
-	updatedB, err := t.update(b)
+	updatedB, err := t.update(b, domain, getLink)
 	if err != nil {
 		bodyLength := len(b)
 		limitedBodyLength := bodyLength
@@ -156,6 +240,28 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 	return resp, nil
 }
 
+// passThroughOversized records a request or response that is too large to be rewritten, which is passed on unmodified
+func (t *Transport) passThroughOversized(req *http.Request, contentLength int64, counter *metrics.CounterVec, kind string) {
+	route := "unknown"
+	if r := mux.CurrentRoute(req); r != nil {
+		if tpl, err := r.GetPathTemplate(); err == nil {
+			route = tpl
+		}
+	}
+	upstream := ""
+	if req.URL != nil {
+		upstream = req.URL.Host
+	}
+
+	counter.Inc(route, upstream)
+	log.Warn(req.Context(), kind+" body exceeds the maximum size for rewriting, passing through unmodified", log.Data{
+		"route":          route,
+		"upstream":       upstream,
+		"content_length": contentLength,
+		"max_body_size":  t.maxBodySize,
+	})
+}
+
 type multiReadCloser struct {
 	readers     []io.Reader
 	multiReader io.Reader
@@ -184,17 +290,95 @@ func (r *multiReadCloser) Close() (err error) {
 	return err
 }
 
-func (t *Transport) update(b []byte) ([]byte, error) {
-	var (
-		err      error
-		resource interface{}
-	)
+// updateRequest replaces the body of a JSON request with one where any public links have been rewritten to the relative
+// form expected by the upstream. Requests without a JSON content type, with a body larger than the maximum size, or with
+// a body that can't be rewritten, are sent unmodified.
+func (t *Transport) updateRequest(req *http.Request, domain string) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody || !isJSON(req.Header.Get("Content-Type")) {
+		return req, nil
+	}
+
+	if t.maxBodySize > 0 && req.ContentLength > t.maxBodySize {
+		t.passThroughOversized(req, req.ContentLength, oversizedRequests, "request")
+		return req, nil
+	}
 
-	err = json.Unmarshal(b, &resource)
+	body := io.Reader(req.Body)
+	if t.maxBodySize > 0 {
+		body = io.LimitReader(body, t.maxBodySize+1)
+	}
+	b, err := io.ReadAll(body)
 	if err != nil {
 		return nil, err
 	}
 
+	outReq := req.Clone(req.Context())
+	if t.maxBodySize > 0 && int64(len(b)) > t.maxBodySize {
+		t.passThroughOversized(req, req.ContentLength, oversizedRequests, "request")
+		// recombine the buffered part of the body with the remaining part of the stream
+		outReq.Body = NewMultiReadCloser(bytes.NewReader(b), req.Body)
+		return outReq, nil
+	}
+	if err = req.Body.Close(); err != nil {
+		return nil, err
+	}
+	outReq.Body = io.NopCloser(bytes.NewReader(b))
+
+	trimmed := bytes.TrimLeft(b, " \t\r\n")
+	if len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return outReq, nil
+	}
+
+	updatedB, err := t.update(b, domain, getRelativeLink)
+	if err != nil {
+		log.Error(req.Context(), "could not update request body with relative links", err, log.Data{
+			"content_type": req.Header.Get("Content-Type"),
+			"body_length":  len(b),
+		})
+		return outReq, nil
+	}
+
+	outReq.Body = io.NopCloser(bytes.NewReader(updatedB))
+	outReq.ContentLength = int64(len(updatedB))
+	outReq.Header.Set("Content-Length", strconv.Itoa(len(updatedB)))
+	outReq.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(updatedB)), nil
+	}
+
+	return outReq, nil
+}
+
+// isJSON returns true if the content type is JSON, e.g. application/json or application/vnd.api+json
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// update rewrites the links within any valid JSON document. If the document has a shape that the rewriting rules
+// don't expect, then an error is returned rather than a panic, so that the caller can fall back to the original body.
+func (t *Transport) update(b []byte, domain string, rewrite linkRewriter) (updatedB []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			updatedB = nil
+			err = fmt.Errorf("recovered from panic while updating links: %v", r)
+		}
+	}()
+
+	var resource interface{}
+
+	// decode numbers as json.Number so that large integers are not rounded by a float64 conversion
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err = dec.Decode(&resource); err != nil {
+		return nil, err
+	}
+	if _, err = dec.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after top-level value")
+	}
+
 	resourceType := reflect.TypeOf(resource)
 	if resourceType == nil {
 		return nil, errors.New("nil resource type")
@@ -203,79 +387,85 @@ func (t *Transport) update(b []byte) ([]byte, error) {
 	switch resourceType.Kind() {
 	case reflect.Map: // starts with {
 		// Assert type onto document
-		return t.updateMap(resource.(map[string]interface{}))
+		return t.updateMap(resource.(map[string]interface{}), domain, rewrite)
 	case reflect.Slice: // starts with [
 		// Assert type onto documents
-		return t.updateSlice(resource.([]interface{}))
+		return t.updateSlice(resource.([]interface{}), domain, rewrite)
 	default:
 		return nil, errors.New("unknown resource type")
 	}
 }
 
-func (t *Transport) updateMap(document map[string]interface{}) ([]byte, error) {
+func (t *Transport) updateMap(document map[string]interface{}, domain string, rewrite linkRewriter) ([]byte, error) {
 	var err error
 
-	document, err = t.checkMap(document)
+	document, err = t.checkMap(document, domain, rewrite)
 	if err != nil {
 		return nil, err
 	}
 
+	return encode(document)
+}
+
+func (t *Transport) updateSlice(documents []interface{}, domain string, rewrite linkRewriter) ([]byte, error) {
+	documents, err := t.checkSlice(documents, domain, rewrite)
+	if err != nil {
+		return nil, err
+	}
+
+	return encode(documents)
+}
+
+func encode(v interface{}) ([]byte, error) {
 	var updatedB []byte
 	buf := bytes.NewBuffer(updatedB)
 
 	enc := json.NewEncoder(buf)
 	enc.SetEscapeHTML(false)
 
-	err = enc.Encode(document)
+	err := enc.Encode(v)
 
 	return buf.Bytes(), err
 }
 
-func (t *Transport) updateSlice(documents []interface{}) ([]byte, error) {
-	var (
-		err error
-	)
-	documentList := make([]map[string]interface{}, len(documents), len(documents))
+// checkSlice checks every document within an array, including those in nested arrays. Any other values are left as they are.
+func (t *Transport) checkSlice(items []interface{}, domain string, rewrite linkRewriter) ([]interface{}, error) {
+	var err error
 
-	for i := range documents {
-		document := documents[i].(map[string]interface{})
-		document, err = t.checkMap(document)
+	for i, item := range items {
+		switch val := item.(type) {
+		case map[string]interface{}:
+			items[i], err = t.checkMap(val, domain, rewrite)
+		case []interface{}:
+			items[i], err = t.checkSlice(val, domain, rewrite)
+		}
 		if err != nil {
 			return nil, err
 		}
-		documentList[i] = document
 	}
 
-	var updatedB []byte
-	buf := bytes.NewBuffer(updatedB)
-
-	enc := json.NewEncoder(buf)
-	enc.SetEscapeHTML(false)
-
-	err = enc.Encode(documentList)
-
-	return buf.Bytes(), err
+	return items, nil
 }
 
-func (t *Transport) checkMap(document map[string]interface{}) (map[string]interface{}, error) {
+func (t *Transport) checkMap(document map[string]interface{}, domain string, rewrite linkRewriter) (map[string]interface{}, error) {
 	var err error
 
 	if docLinks, ok := document[links].(map[string]interface{}); ok {
-		document[links], err = updateMap(docLinks, re.ReplaceAllString(t.domain, "${1}api.${2}${3}"))
+		document[links], err = updateMap(docLinks, re.ReplaceAllString(domain, "${1}api.${2}${3}"), rewrite)
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	if docLinks, ok := document[datasetLinks].(map[string]interface{}); ok {
-		document[datasetLinks], err = updateMap(docLinks, re.ReplaceAllString(t.domain, "${1}api.${2}${3}"))
+		document[datasetLinks], err = updateMap(docLinks, re.ReplaceAllString(domain, "${1}api.${2}${3}"), rewrite)
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	if docDownloads, ok := document[downloads].(map[string]interface{}); ok {
-		document[downloads], err = updateMap(docDownloads, re.ReplaceAllString(t.domain, "${1}download.${2}"))
+		document[downloads], err = updateMap(docDownloads, re.ReplaceAllString(domain, "${1}download.${2}"), rewrite)
 		if err != nil {
 			return nil, err
 		}
@@ -283,7 +473,7 @@ func (t *Transport) checkMap(document map[string]interface{}) (map[string]interf
 
 	// Dataset api versions endpoint treats dimensions as an array
 	if docDimensions, ok := document[dimensions].([]interface{}); ok {
-		document[dimensions], err = updateArray(docDimensions, re.ReplaceAllString(t.domain, "${1}api.${2}${3}"))
+		document[dimensions], err = updateArray(docDimensions, re.ReplaceAllString(domain, "${1}api.${2}${3}"), rewrite)
 		if err != nil {
 			return nil, err
 		}
@@ -291,7 +481,7 @@ func (t *Transport) checkMap(document map[string]interface{}) (map[string]interf
 
 	// Dataset api observations endpoint treats dimensions as a nested list
 	if docDimensions, ok := document[dimensions].(map[string]interface{}); ok {
-		document[dimensions], err = updateMap(docDimensions, re.ReplaceAllString(t.domain, "${1}api.${2}${3}"))
+		document[dimensions], err = updateMap(docDimensions, re.ReplaceAllString(domain, "${1}api.${2}${3}"), rewrite)
 		if err != nil {
 			return nil, err
 		}
@@ -299,40 +489,35 @@ func (t *Transport) checkMap(document map[string]interface{}) (map[string]interf
 
 	for k, v := range document {
 		if subDocument, ok := v.(map[string]interface{}); ok {
-			document[k], err = t.checkMap(subDocument)
+			document[k], err = t.checkMap(subDocument, domain, rewrite)
 			if err != nil {
 				return nil, err
 			}
 		}
 
 		if items, ok := v.([]interface{}); ok {
-			for i, subVal := range items {
-				if subValMap, ok := subVal.(map[string]interface{}); ok {
-					items[i], err = t.checkMap(subValMap)
-					if err != nil {
-						return nil, err
-					}
-				}
+			document[k], err = t.checkSlice(items, domain, rewrite)
+			if err != nil {
+				return nil, err
 			}
-			document[k] = items
 		}
 	}
 
 	return document, nil
 }
 
-func updateMap(docMap map[string]interface{}, domain string) (map[string]interface{}, error) {
+func updateMap(docMap map[string]interface{}, domain string, rewrite linkRewriter) (map[string]interface{}, error) {
 	var err error
 
 	for k, v := range docMap {
 		if val, ok := v.(map[string]interface{}); ok {
 			if field, ok := val[href].(string); ok {
-				val[href], err = getLink(field, domain)
+				val[href], err = rewrite(field, domain)
 				if err != nil {
 					return nil, err
 				}
 			} else {
-				val, err = updateMap(val, domain)
+				val, err = updateMap(val, domain, rewrite)
 				if err != nil {
 					return nil, err
 				}
@@ -340,7 +525,7 @@ func updateMap(docMap map[string]interface{}, domain string) (map[string]interfa
 			docMap[k] = val
 		}
 		if val, ok := v.([]interface{}); ok {
-			docMap[k], err = updateArray(val, domain)
+			docMap[k], err = updateArray(val, domain, rewrite)
 			if err != nil {
 				return nil, err
 			}
@@ -349,23 +534,180 @@ func updateMap(docMap map[string]interface{}, domain string) (map[string]interfa
 	return docMap, nil
 }
 
-func updateArray(docArray []interface{}, domain string) ([]interface{}, error) {
+func updateArray(docArray []interface{}, domain string, rewrite linkRewriter) ([]interface{}, error) {
 	var err error
 
 	for i, v := range docArray {
 		if val, ok := v.(map[string]interface{}); ok {
 			if field, ok := val[href].(string); ok {
-				val[href], err = getLink(field, domain)
+				val[href], err = rewrite(field, domain)
 				if err != nil {
 					return nil, err
 				}
 			}
 			docArray[i] = val
 		}
+		if val, ok := v.([]interface{}); ok {
+			docArray[i], err = updateArray(val, domain, rewrite)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 	return docArray, nil
 }
 
+// domainFor returns the public domain that links should be rewritten to for the provided request. The host that the
+// request was made to (X-Forwarded-Host, or Host) is only used when it is one of the permitted public hosts, otherwise
+// the domain the Transport was created with (i.e. ENV_HOST) is used. X-Forwarded-Host and X-Forwarded-Proto are only
+// used when the request was received from a trusted proxy, as any other client could set them.
+func (t *Transport) domainFor(req *http.Request) string {
+	if len(t.publicHosts) == 0 || req == nil {
+		return t.domain
+	}
+
+	matches := re.FindStringSubmatch(t.domain)
+	if matches == nil {
+		return t.domain
+	}
+
+	fromTrustedProxy := middleware.FromTrustedProxy(req)
+	host := req.Host
+	if forwardedHost := req.Header.Get("X-Forwarded-Host"); forwardedHost != "" && fromTrustedProxy {
+		// the first value is the host the client requested, where there are several proxies
+		host = strings.Split(forwardedHost, ",")[0]
+	}
+	host = strings.ToLower(strings.TrimSpace(host))
+
+	if !isPublicHost(host, t.publicHosts) {
+		return t.domain
+	}
+
+	scheme := matches[1]
+	if forwardedProto := strings.ToLower(req.Header.Get("X-Forwarded-Proto")); fromTrustedProxy && (forwardedProto == "http" || forwardedProto == "https") {
+		scheme = forwardedProto + "://"
+	}
+
+	// the domain is in the form of the environment host, which the api and download subdomains are then added to
+	return scheme + strings.TrimPrefix(host, "api.") + matches[3]
+}
+
+func isPublicHost(host string, publicHosts []string) bool {
+	for _, publicHost := range publicHosts {
+		if strings.EqualFold(host, publicHost) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateHeaders rewrites any upstream URLs found in the Location, Content-Location and Link response headers to the
+// domain. Only relative references and URLs on the host of an upstream are rewritten, so that redirects to other
+// sites are left as they are. Headers that can't be parsed are left unmodified.
+func (t *Transport) updateHeaders(req *http.Request, header http.Header, domain string) {
+	if header == nil {
+		return
+	}
+
+	ctx := req.Context()
+	domain = re.ReplaceAllString(domain, "${1}api.${2}${3}")
+	rewrite := func(field string) (string, error) {
+		return t.getHeaderLink(req, field, domain)
+	}
+
+	for _, key := range locationHeaders {
+		value := header.Get(key)
+		if value == "" {
+			continue
+		}
+		link, err := rewrite(value)
+		if err != nil {
+			log.Error(ctx, "could not update response header with correct link", err, log.Data{"header": key, "value": value})
+			continue
+		}
+		header.Set(key, link)
+	}
+
+	values := header.Values("Link")
+	if len(values) == 0 {
+		return
+	}
+	updated := make([]string, len(values))
+	for i, value := range values {
+		updated[i] = value
+		link, err := getLinkHeader(value, rewrite)
+		if err != nil {
+			log.Error(ctx, "could not update response header with correct links", err, log.Data{"header": "Link", "value": value})
+			continue
+		}
+		updated[i] = link
+	}
+	header["Link"] = updated
+}
+
+// getLinkHeader rewrites every URI-Reference in a Link header value (RFC 8288), leaving link parameters untouched
+func getLinkHeader(value string, rewrite func(field string) (string, error)) (string, error) {
+	var err error
+
+	updated := linkHeaderURI.ReplaceAllStringFunc(value, func(match string) string {
+		if err != nil {
+			return match
+		}
+		var link string
+		link, err = rewrite(match[1 : len(match)-1])
+		return "<" + link + ">"
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return updated, nil
+}
+
+// getHeaderLink rewrites a URL found in a response header to the domain, keeping its query and fragment, if it is a
+// relative reference or is on the host of the upstream that the request was proxied to, or of any other upstream.
+// Other absolute URLs are returned unmodified.
+func (t *Transport) getHeaderLink(req *http.Request, field, domain string) (string, error) {
+	// if the URL is already correct, return it
+	if strings.HasPrefix(field, domain) {
+		return field, nil
+	}
+
+	uri, err := url.Parse(field)
+	if err != nil {
+		return "", err
+	}
+	if (uri.IsAbs() || uri.Host != "") && !t.isUpstreamHost(req, uri.Host) {
+		return field, nil
+	}
+
+	link := domain + uri.Path
+	if uri.RawQuery != "" {
+		link += "?" + uri.RawQuery
+	}
+	if uri.Fragment != "" {
+		link += "#" + uri.EscapedFragment()
+	}
+	return link, nil
+}
+
+// isUpstreamHost returns true if the host is the host of the upstream that the request was proxied to, or of any
+// other upstream
+func (t *Transport) isUpstreamHost(req *http.Request, host string) bool {
+	if host == "" {
+		return false
+	}
+	if req.URL != nil && strings.EqualFold(host, req.URL.Host) {
+		return true
+	}
+	for _, upstreamHost := range t.upstreamHosts {
+		if strings.EqualFold(host, upstreamHost) {
+			return true
+		}
+	}
+	return false
+}
+
 func getLink(field, domain string) (string, error) {
 	// if the URL is already correct, return it
 	if strings.HasPrefix(field, domain) {
@@ -384,3 +726,32 @@ func getLink(field, domain string) (string, error) {
 	}
 	return fmt.Sprintf("%s%s?%s", domain, uri.Path, queries), nil
 }
+
+// getRelativeLink strips the public domain from a link, so that it can be stored by an upstream in its relative form.
+// Links that don't belong to the public domain are returned unmodified.
+func getRelativeLink(field, domain string) (string, error) {
+	if !strings.HasPrefix(field, domain) {
+		return field, nil
+	}
+
+	relative := strings.TrimPrefix(field, domain)
+	if relative != "" && relative[0] != '/' && relative[0] != '?' {
+		// the domain only matched part of a host or path segment, e.g. '/v1' and '/v10'
+		return field, nil
+	}
+
+	uri, err := url.Parse(relative)
+	if err != nil {
+		return "", err
+	}
+
+	path := uri.Path
+	if path == "" {
+		path = "/"
+	}
+
+	if uri.RawQuery == "" {
+		return path, nil
+	}
+	return fmt.Sprintf("%s?%s", path, uri.RawQuery), nil
+}
@@ -0,0 +1,84 @@
+package interceptor
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// fuzzCorpus is seeded from the documents used by the interceptor unit tests
+var fuzzCorpus = []string{
+	``,
+	`{"links":{"self":{"href":"https://api.beta.ons.gov.uk/v1/datasets/12345"}}}`,
+	`{"links":{"self":{"href":"/datasets/12345"}}}`,
+	`{"dataset_links":{"self":{"href":"/datasets/12345"}}}`,
+	`{"downloads":{"csv":{"href":"http://localhost:22000/myfile.csv"}}}`,
+	`{"dimensions":[{"href":"http://localhost:23000/code-lists/1234567"}]}`,
+	`{"items":[{"links":{"self":{"href":"/datasets/12345"}}}]}`,
+	`{"links":{"instances":[{"href":"/datasets/12345"}]}}`,
+	`{"dimensions":{"time":{"option":{"href":"/datasets/time"}}}}`,
+	`{"dimensions":{"time":{"option":{"href":"/datasets/time?hello=world&mobile=phone"}}}}`,
+	`[{"links":{"self":{"href":"/datasets/12345"}}}, {"links":{"self":{"href":"/datasets/12345"}}}]`,
+	`["a",1,true,null]`,
+	`[[{"links":{"self":{"href":"/datasets/12345"}}}],"a"]`,
+	`{"links":{"instances":[[{"href":"/datasets/12345"}],[1,"b"]]}}`,
+	`{"count":12345678901234567890,"ratio":0.1}`,
+	`{bla`,
+	`Annnnnnnnnnnnnnnnnn`,
+}
+
+// FuzzRoundTrip checks that the interceptor never fails or panics, whatever the upstream returns,
+// and that a valid JSON document is always rewritten to a valid JSON document.
+//
+// run with:
+// go test -run=XXX -fuzz=FuzzRoundTrip ./interceptor
+func FuzzRoundTrip(f *testing.F) {
+	for _, seed := range fuzzCorpus {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, testJSON string) {
+		rt := NewRoundTripper(testDomain, dummyRT{testJSON})
+
+		resp, err := rt.RoundTrip(&http.Request{RequestURI: "/v1/datasets"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("unexpected error reading body: %v", err)
+		}
+
+		if json.Valid([]byte(testJSON)) && !json.Valid(b) {
+			t.Fatalf("valid json %q was rewritten to invalid json %q", testJSON, b)
+		}
+	})
+}
+
+// FuzzRequestRoundTrip checks that the request interceptor never fails or panics, whatever the request body contains
+func FuzzRequestRoundTrip(f *testing.F) {
+	for _, seed := range fuzzCorpus {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, testJSON string) {
+		var upstreamBody string
+		rt := NewRoundTripperWithOptions(testDomain, captureRT{&upstreamBody}, Options{Request: true})
+
+		req, err := http.NewRequest(http.MethodPut, "/datasets", strings.NewReader(testJSON))
+		if err != nil {
+			t.Fatalf("unexpected error creating request: %v", err)
+		}
+
+		if _, err = rt.RoundTrip(req); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if json.Valid([]byte(testJSON)) && !json.Valid([]byte(upstreamBody)) {
+			t.Fatalf("valid json %q was rewritten to invalid json %q", testJSON, upstreamBody)
+		}
+	})
+}
@@ -4,14 +4,23 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 
+	"github.com/ONSdigital/dp-api-router/metrics/metricstest"
+	"github.com/ONSdigital/dp-api-router/middleware"
+	"github.com/gorilla/mux"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
 const testDomain = "https://beta.ons.gov.uk/v1"
 
+var (
+	oversizedRequestsTotal  = metricstest.NewCounter("interceptor_oversized_requests_total", "route", "upstream")
+	oversizedResponsesTotal = metricstest.NewCounter("interceptor_oversized_responses_total", "route", "upstream")
+)
+
 type dummyRT struct {
 	testJSON string
 }
@@ -25,6 +34,36 @@ func (t dummyRT) RoundTrip(req *http.Request) (resp *http.Response, err error) {
 
 var _ http.RoundTripper = dummyRT{}
 
+type dummyHeaderRT struct {
+	header http.Header
+}
+
+func (t dummyHeaderRT) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	_ = req // shut some linters up
+	resp = httptest.NewRecorder().Result()
+	resp.Header = t.header
+	resp.Body = io.NopCloser(strings.NewReader(""))
+	return
+}
+
+var _ http.RoundTripper = dummyHeaderRT{}
+
+// fromProxy returns the request as passed on by the client IP resolver, with the request received from the address
+// of a proxy that is only trusted if trusted is true
+func fromProxy(req *http.Request, trusted bool) *http.Request {
+	resolver, err := middleware.NewClientIPResolver([]string{"10.0.0.1"})
+	So(err, ShouldBeNil)
+	req.RemoteAddr = "10.0.0.2:1234"
+	if trusted {
+		req.RemoteAddr = "10.0.0.1:1234"
+	}
+	var resolved *http.Request
+	resolver.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resolved = r
+	})).ServeHTTP(httptest.NewRecorder(), req)
+	return resolved
+}
+
 func TestUnitInterceptor(t *testing.T) {
 	Convey("test interceptor doesn't throw an error for an empty response", t, func() {
 		testJSON := ``
@@ -254,6 +293,91 @@ func TestUnitInterceptor(t *testing.T) {
 		So(string(b), ShouldEqual, `[{"links":{"self":{"href":"https://api.beta.ons.gov.uk/v1/datasets/12345"}}},{"links":{"self":{"href":"https://api.beta.ons.gov.uk/v1/datasets/12345"}}}]`+"\n")
 	})
 
+	Convey("test interceptor doesn't throw an error for a top-level array of strings and numbers", t, func() {
+		testJSON := `["a",1,true,null]`
+		transp := dummyRT{testJSON}
+
+		t := NewRoundTripper(testDomain, transp)
+
+		resp, err := t.RoundTrip(&http.Request{RequestURI: "/v1/datasets"})
+		So(err, ShouldBeNil)
+
+		b, err := io.ReadAll(resp.Body)
+		So(err, ShouldBeNil)
+
+		err = resp.Body.Close()
+		So(err, ShouldBeNil)
+		So(string(b), ShouldEqual, `["a",1,true,null]`+"\n")
+	})
+
+	Convey("test interceptor correctly updates a href in links subdocs within nested arrays", t, func() {
+		testJSON := `[[{"links":{"self":{"href":"/datasets/12345"}}}],"a"]`
+		transp := dummyRT{testJSON}
+
+		t := NewRoundTripper(testDomain, transp)
+
+		resp, err := t.RoundTrip(&http.Request{RequestURI: "/v1/datasets"})
+		So(err, ShouldBeNil)
+
+		b, err := io.ReadAll(resp.Body)
+		So(err, ShouldBeNil)
+
+		err = resp.Body.Close()
+		So(err, ShouldBeNil)
+		So(string(b), ShouldEqual, `[[{"links":{"self":{"href":"https://api.beta.ons.gov.uk/v1/datasets/12345"}}}],"a"]`+"\n")
+	})
+
+	Convey("test interceptor correctly updates a nested array of arrays of links", t, func() {
+		testJSON := `{"links":{"instances":[[{"href":"/datasets/12345"}],[1,"b"]]}}`
+		transp := dummyRT{testJSON}
+
+		t := NewRoundTripper(testDomain, transp)
+
+		resp, err := t.RoundTrip(&http.Request{RequestURI: "/v1/datasets"})
+		So(err, ShouldBeNil)
+
+		b, err := io.ReadAll(resp.Body)
+		So(err, ShouldBeNil)
+
+		err = resp.Body.Close()
+		So(err, ShouldBeNil)
+		So(string(b), ShouldEqual, `{"links":{"instances":[[{"href":"https://api.beta.ons.gov.uk/v1/datasets/12345"}],[1,"b"]]}}`+"\n")
+	})
+
+	Convey("test interceptor doesn't round large numbers", t, func() {
+		testJSON := `{"count":12345678901234567890,"ratio":0.1}`
+		transp := dummyRT{testJSON}
+
+		t := NewRoundTripper(testDomain, transp)
+
+		resp, err := t.RoundTrip(&http.Request{RequestURI: "/v1/datasets"})
+		So(err, ShouldBeNil)
+
+		b, err := io.ReadAll(resp.Body)
+		So(err, ShouldBeNil)
+
+		err = resp.Body.Close()
+		So(err, ShouldBeNil)
+		So(string(b), ShouldEqual, `{"count":12345678901234567890,"ratio":0.1}`+"\n")
+	})
+
+	Convey("test interceptor returns the original body when there is data after the json document", t, func() {
+		testJSON := `{"links":{"self":{"href":"/datasets/12345"}}} {}`
+		transp := dummyRT{testJSON}
+
+		t := NewRoundTripper(testDomain, transp)
+
+		resp, err := t.RoundTrip(&http.Request{RequestURI: "/v1/datasets"})
+		So(err, ShouldBeNil)
+
+		b, err := io.ReadAll(resp.Body)
+		So(err, ShouldBeNil)
+
+		err = resp.Body.Close()
+		So(err, ShouldBeNil)
+		So(string(b), ShouldEqual, testJSON)
+	})
+
 	Convey("test interceptor correctly ignores non json and non map object that is 'maxBodyLengthToLog - 1'", t, func() {
 		testJSON := "A"
 		for i := 0; i < (maxBodyLengthToLog - 2); i++ {
@@ -357,3 +481,494 @@ func TestUnitInterceptor(t *testing.T) {
 		So(string(b), ShouldEqual, testJSON)
 	})
 }
+
+func TestUnitInterceptorHeaders(t *testing.T) {
+	Convey("test interceptor correctly updates a relative Location header", t, func() {
+		transp := dummyHeaderRT{http.Header{"Location": {"/datasets/12345"}}}
+
+		t := NewRoundTripper(testDomain, transp)
+
+		resp, err := t.RoundTrip(&http.Request{RequestURI: "/v1/datasets"})
+		So(err, ShouldBeNil)
+		So(resp.Header.Get("Location"), ShouldEqual, "https://api.beta.ons.gov.uk/v1/datasets/12345")
+	})
+
+	Convey("test interceptor correctly updates an absolute Location header pointing at the upstream host", t, func() {
+		transp := dummyHeaderRT{http.Header{"Location": {"http://dataset-api:22000/datasets/12345?hello=world"}}}
+
+		t := NewRoundTripper(testDomain, transp)
+
+		resp, err := t.RoundTrip(&http.Request{RequestURI: "/v1/datasets", URL: &url.URL{Scheme: "http", Host: "dataset-api:22000", Path: "/datasets"}})
+		So(err, ShouldBeNil)
+		So(resp.Header.Get("Location"), ShouldEqual, "https://api.beta.ons.gov.uk/v1/datasets/12345?hello=world")
+	})
+
+	Convey("test interceptor correctly updates an absolute Location header pointing at another configured upstream", t, func() {
+		transp := dummyHeaderRT{http.Header{"Location": {"http://localhost:22100/filters/12345"}}}
+
+		t := NewRoundTripper(testDomain, transp)
+
+		resp, err := t.RoundTrip(&http.Request{RequestURI: "/v1/datasets", URL: &url.URL{Scheme: "http", Host: "localhost:22000", Path: "/datasets"}})
+		So(err, ShouldBeNil)
+		So(resp.Header.Get("Location"), ShouldEqual, "https://api.beta.ons.gov.uk/v1/filters/12345")
+	})
+
+	Convey("test interceptor doesn't change a Location header redirecting to an external site", t, func() {
+		transp := dummyHeaderRT{http.Header{"Location": {"https://www.example.com/datasets/12345?hello=world"}}}
+
+		t := NewRoundTripper(testDomain, transp)
+
+		resp, err := t.RoundTrip(&http.Request{RequestURI: "/v1/datasets", URL: &url.URL{Scheme: "http", Host: "localhost:22000", Path: "/datasets"}})
+		So(err, ShouldBeNil)
+		So(resp.Header.Get("Location"), ShouldEqual, "https://www.example.com/datasets/12345?hello=world")
+	})
+
+	Convey("test interceptor keeps the fragment of a Location header", t, func() {
+		transp := dummyHeaderRT{http.Header{"Location": {"/datasets/12345?hello=world#editions"}}}
+
+		t := NewRoundTripper(testDomain, transp)
+
+		resp, err := t.RoundTrip(&http.Request{RequestURI: "/v1/datasets"})
+		So(err, ShouldBeNil)
+		So(resp.Header.Get("Location"), ShouldEqual, "https://api.beta.ons.gov.uk/v1/datasets/12345?hello=world#editions")
+	})
+
+	Convey("test interceptor doesn't change an already correct Location header", t, func() {
+		transp := dummyHeaderRT{http.Header{"Location": {"https://api.beta.ons.gov.uk/v1/datasets/12345"}}}
+
+		t := NewRoundTripper(testDomain, transp)
+
+		resp, err := t.RoundTrip(&http.Request{RequestURI: "/v1/datasets"})
+		So(err, ShouldBeNil)
+		So(resp.Header.Get("Location"), ShouldEqual, "https://api.beta.ons.gov.uk/v1/datasets/12345")
+	})
+
+	Convey("test interceptor correctly updates a Content-Location header", t, func() {
+		transp := dummyHeaderRT{http.Header{"Content-Location": {"http://localhost:22000/datasets/12345"}}}
+
+		t := NewRoundTripper(testDomain, transp)
+
+		resp, err := t.RoundTrip(&http.Request{RequestURI: "/v1/datasets"})
+		So(err, ShouldBeNil)
+		So(resp.Header.Get("Content-Location"), ShouldEqual, "https://api.beta.ons.gov.uk/v1/datasets/12345")
+	})
+
+	Convey("test interceptor correctly updates relative, upstream and already correct links in a Link header", t, func() {
+		transp := dummyHeaderRT{http.Header{"Link": {
+			`</datasets?offset=20>; rel="next", <http://localhost:22000/datasets?offset=0>; rel="prev"`,
+			`<https://api.beta.ons.gov.uk/v1/datasets?offset=100>; rel="last", <https://www.example.com/licence>; rel="license"`,
+		}}}
+
+		t := NewRoundTripper(testDomain, transp)
+
+		resp, err := t.RoundTrip(&http.Request{RequestURI: "/v1/datasets"})
+		So(err, ShouldBeNil)
+		So(resp.Header.Values("Link"), ShouldResemble, []string{
+			`<https://api.beta.ons.gov.uk/v1/datasets?offset=20>; rel="next", <https://api.beta.ons.gov.uk/v1/datasets?offset=0>; rel="prev"`,
+			`<https://api.beta.ons.gov.uk/v1/datasets?offset=100>; rel="last", <https://www.example.com/licence>; rel="license"`,
+		})
+	})
+
+	Convey("test interceptor leaves a Location header that can't be parsed unmodified", t, func() {
+		transp := dummyHeaderRT{http.Header{"Location": {"http://[::1"}}}
+
+		t := NewRoundTripper(testDomain, transp)
+
+		resp, err := t.RoundTrip(&http.Request{RequestURI: "/v1/datasets"})
+		So(err, ShouldBeNil)
+		So(resp.Header.Get("Location"), ShouldEqual, "http://[::1")
+	})
+
+	Convey("test interceptor updates headers on gzipped responses, whose body is not rewritten", t, func() {
+		transp := dummyHeaderRT{http.Header{"Content-Type": {"application/gzip"}, "Location": {"/datasets/12345"}}}
+
+		t := NewRoundTripper(testDomain, transp)
+
+		resp, err := t.RoundTrip(&http.Request{RequestURI: "/v1/datasets"})
+		So(err, ShouldBeNil)
+		So(resp.Header.Get("Location"), ShouldEqual, "https://api.beta.ons.gov.uk/v1/datasets/12345")
+	})
+}
+
+type captureRT struct {
+	body *string
+}
+
+func (t captureRT) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	b, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	*t.body = string(b)
+	resp = httptest.NewRecorder().Result()
+	resp.Body = io.NopCloser(strings.NewReader(""))
+	return
+}
+
+var _ http.RoundTripper = captureRT{}
+
+func TestUnitInterceptorRequest(t *testing.T) {
+	Convey("Given an interceptor that only rewrites requests", t, func() {
+		var upstreamBody string
+		transp := captureRT{&upstreamBody}
+
+		t := NewRoundTripperWithOptions(testDomain, transp, Options{Request: true})
+
+		Convey("test interceptor correctly updates a public href in a links subdoc to its relative form", func() {
+			testJSON := `{"links":{"self":{"href":"https://api.beta.ons.gov.uk/v1/datasets/12345?hello=world"}}}`
+			req := newJSONRequest(http.MethodPut, "/datasets/12345", testJSON)
+
+			_, err := t.RoundTrip(req)
+			So(err, ShouldBeNil)
+			So(upstreamBody, ShouldEqual, `{"links":{"self":{"href":"/datasets/12345?hello=world"}}}`+"\n")
+		})
+
+		Convey("test interceptor correctly updates a public href in a downloads subdoc to its relative form", func() {
+			testJSON := `{"downloads":{"csv":{"href":"https://download.beta.ons.gov.uk/myfile.csv"}}}`
+			req := newJSONRequest(http.MethodPut, "/datasets/12345", testJSON)
+
+			_, err := t.RoundTrip(req)
+			So(err, ShouldBeNil)
+			So(upstreamBody, ShouldEqual, `{"downloads":{"csv":{"href":"/myfile.csv"}}}`+"\n")
+		})
+
+		Convey("test interceptor correctly updates public hrefs in nested documents within an array", func() {
+			testJSON := `[{"dimensions":[{"href":"https://api.beta.ons.gov.uk/v1/code-lists/1234567"}]}]`
+			req := newJSONRequest(http.MethodPost, "/instances", testJSON)
+
+			_, err := t.RoundTrip(req)
+			So(err, ShouldBeNil)
+			So(upstreamBody, ShouldEqual, `[{"dimensions":[{"href":"/code-lists/1234567"}]}]`+"\n")
+		})
+
+		Convey("test interceptor doesn't change an internal or already relative href", func() {
+			testJSON := `{"links":{"self":{"href":"/datasets/12345"},"version":{"href":"http://localhost:22000/datasets/12345/editions/time-series/versions/1"}}}`
+			req := newJSONRequest(http.MethodPut, "/datasets/12345", testJSON)
+
+			_, err := t.RoundTrip(req)
+			So(err, ShouldBeNil)
+			So(upstreamBody, ShouldEqual, `{"links":{"self":{"href":"/datasets/12345"},"version":{"href":"http://localhost:22000/datasets/12345/editions/time-series/versions/1"}}}`+"\n")
+		})
+
+		Convey("test interceptor doesn't change an href that only partially matches the public domain", func() {
+			testJSON := `{"links":{"self":{"href":"https://api.beta.ons.gov.uk/v10/datasets/12345"}}}`
+			req := newJSONRequest(http.MethodPut, "/datasets/12345", testJSON)
+
+			_, err := t.RoundTrip(req)
+			So(err, ShouldBeNil)
+			So(upstreamBody, ShouldEqual, `{"links":{"self":{"href":"https://api.beta.ons.gov.uk/v10/datasets/12345"}}}`+"\n")
+		})
+
+		Convey("test interceptor sends a non json body unmodified", func() {
+			req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("hello world"))
+
+			_, err := t.RoundTrip(req)
+			So(err, ShouldBeNil)
+			So(upstreamBody, ShouldEqual, "hello world")
+		})
+
+		Convey("test interceptor sends a broken json body unmodified", func() {
+			req := newJSONRequest(http.MethodPost, "/datasets", "{bla")
+
+			_, err := t.RoundTrip(req)
+			So(err, ShouldBeNil)
+			So(upstreamBody, ShouldEqual, "{bla")
+		})
+
+		Convey("test interceptor sends a json body without a json content type unmodified", func() {
+			testJSON := `{"links":{"self":{"href":"https://api.beta.ons.gov.uk/v1/datasets/12345"}}}`
+			req := httptest.NewRequest(http.MethodPut, "/datasets/12345", strings.NewReader(testJSON))
+			req.Header.Set("Content-Type", "text/plain")
+
+			_, err := t.RoundTrip(req)
+			So(err, ShouldBeNil)
+			So(upstreamBody, ShouldEqual, testJSON)
+		})
+
+		Convey("test interceptor updates a body with a json media type suffix and parameters", func() {
+			testJSON := `{"links":{"self":{"href":"https://api.beta.ons.gov.uk/v1/datasets/12345"}}}`
+			req := httptest.NewRequest(http.MethodPut, "/datasets/12345", strings.NewReader(testJSON))
+			req.Header.Set("Content-Type", "application/merge-patch+json; charset=utf-8")
+
+			_, err := t.RoundTrip(req)
+			So(err, ShouldBeNil)
+			So(upstreamBody, ShouldEqual, `{"links":{"self":{"href":"/datasets/12345"}}}`+"\n")
+		})
+
+		Convey("test interceptor doesn't rewrite links in the response body", func() {
+			testJSON := `{"links":{"self":{"href":"/datasets/12345"}}}`
+			t := NewRoundTripperWithOptions(testDomain, dummyRT{testJSON}, Options{Request: true})
+
+			resp, err := t.RoundTrip(httptest.NewRequest(http.MethodGet, "/datasets/12345", http.NoBody))
+			So(err, ShouldBeNil)
+
+			b, err := io.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, testJSON)
+		})
+	})
+}
+
+func TestUnitInterceptorRequestMaxBodySize(t *testing.T) {
+	Convey("Given an interceptor that only rewrites requests, with a maximum body size", t, func() {
+		var upstreamBody string
+		t := NewRoundTripperWithOptions(testDomain, captureRT{&upstreamBody}, Options{Request: true})
+		testJSON := `{"links":{"self":{"href":"https://api.beta.ons.gov.uk/v1/datasets/12345"}}}`
+
+		Convey("test interceptor correctly updates a body within the maximum size", func() {
+			t.maxBodySize = int64(len(testJSON))
+
+			_, err := t.RoundTrip(newJSONRequest(http.MethodPut, "/datasets/12345", testJSON))
+			So(err, ShouldBeNil)
+			So(upstreamBody, ShouldEqual, `{"links":{"self":{"href":"/datasets/12345"}}}`+"\n")
+		})
+
+		Convey("test interceptor passes through a body that exceeds the maximum size while streaming", func() {
+			t.maxBodySize = int64(len(testJSON)) - 1
+			req := newJSONRequest(http.MethodPut, "/datasets/12345", testJSON)
+			req.ContentLength = -1
+			req.URL.Host = "localhost:22000"
+			before := oversizedRequestsTotal.Value("unknown", "localhost:22000")
+
+			_, err := t.RoundTrip(req)
+			So(err, ShouldBeNil)
+			So(upstreamBody, ShouldEqual, testJSON)
+			So(oversizedRequestsTotal.Value("unknown", "localhost:22000"), ShouldEqual, before+1)
+		})
+
+		Convey("test interceptor passes through a body with a Content-Length that exceeds the maximum size without reading it", func() {
+			t.maxBodySize = 10
+			body := &countingReader{Reader: strings.NewReader(testJSON)}
+			req := httptest.NewRequest(http.MethodPut, "/datasets/12345", body)
+			req.Header.Set("Content-Type", "application/json")
+			req.ContentLength = int64(len(testJSON))
+			req.URL.Host = "localhost:22000"
+			before := oversizedRequestsTotal.Value("unknown", "localhost:22000")
+
+			outReq, err := t.updateRequest(req, testDomain)
+			So(err, ShouldBeNil)
+			So(outReq, ShouldEqual, req)
+			So(body.read, ShouldEqual, 0)
+			So(oversizedRequestsTotal.Value("unknown", "localhost:22000"), ShouldEqual, before+1)
+		})
+	})
+}
+
+// newJSONRequest creates a test request with a JSON body and content type
+func newJSONRequest(method, target, body string) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+// countingReader counts the bytes read from the reader it wraps
+type countingReader struct {
+	io.Reader
+	read int
+}
+
+func (r *countingReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	r.read += n
+	return n, err
+}
+
+func TestUnitInterceptorPublicHosts(t *testing.T) {
+	Convey("Given an interceptor with a list of permitted public hosts", t, func() {
+		testJSON := `{"links":{"self":{"href":"/datasets/12345"}}}`
+		transp := dummyRT{testJSON}
+
+		t := NewRoundTripper(testDomain, transp)
+		t.publicHosts = []string{"api.beta.ons.gov.uk", "api.ons.gov.uk"}
+
+		Convey("test interceptor updates a href using a permitted X-Forwarded-Host and X-Forwarded-Proto from a trusted proxy", func() {
+			req := fromProxy(&http.Request{RequestURI: "/v1/datasets", Host: "localhost:23200", Header: http.Header{
+				"X-Forwarded-Host":  {"api.ons.gov.uk"},
+				"X-Forwarded-Proto": {"http"},
+			}}, true)
+
+			resp, err := t.RoundTrip(req)
+			So(err, ShouldBeNil)
+
+			b, err := io.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, `{"links":{"self":{"href":"http://api.ons.gov.uk/v1/datasets/12345"}}}`+"\n")
+		})
+
+		Convey("test interceptor ignores X-Forwarded-Host and X-Forwarded-Proto from a client that is not a trusted proxy", func() {
+			req := fromProxy(&http.Request{RequestURI: "/v1/datasets", Host: "api.beta.ons.gov.uk", Header: http.Header{
+				"X-Forwarded-Host":  {"api.ons.gov.uk"},
+				"X-Forwarded-Proto": {"http"},
+			}}, false)
+
+			resp, err := t.RoundTrip(req)
+			So(err, ShouldBeNil)
+
+			b, err := io.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, `{"links":{"self":{"href":"https://api.beta.ons.gov.uk/v1/datasets/12345"}}}`+"\n")
+		})
+
+		Convey("test interceptor ignores X-Forwarded-Host from a request that hasn't been through the client IP resolver", func() {
+			req := &http.Request{RequestURI: "/v1/datasets", Host: "localhost:23200", Header: http.Header{
+				"X-Forwarded-Host":  {"api.ons.gov.uk"},
+				"X-Forwarded-Proto": {"https"},
+			}}
+
+			resp, err := t.RoundTrip(req)
+			So(err, ShouldBeNil)
+
+			b, err := io.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, `{"links":{"self":{"href":"https://api.beta.ons.gov.uk/v1/datasets/12345"}}}`+"\n")
+		})
+
+		Convey("test interceptor updates a href using a permitted X-Forwarded-Host and the ENV_HOST scheme", func() {
+			req := fromProxy(&http.Request{RequestURI: "/v1/datasets", Host: "localhost:23200", Header: http.Header{
+				"X-Forwarded-Host": {"api.ons.gov.uk"},
+			}}, true)
+
+			resp, err := t.RoundTrip(req)
+			So(err, ShouldBeNil)
+
+			b, err := io.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, `{"links":{"self":{"href":"https://api.ons.gov.uk/v1/datasets/12345"}}}`+"\n")
+		})
+
+		Convey("test interceptor updates a href using the first of several X-Forwarded-Host values", func() {
+			req := fromProxy(&http.Request{RequestURI: "/v1/datasets", Header: http.Header{
+				"X-Forwarded-Host": {"api.ons.gov.uk, internal-lb.ons.gov.uk"},
+			}}, true)
+
+			resp, err := t.RoundTrip(req)
+			So(err, ShouldBeNil)
+
+			b, err := io.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, `{"links":{"self":{"href":"https://api.ons.gov.uk/v1/datasets/12345"}}}`+"\n")
+		})
+
+		Convey("test interceptor updates a href using a permitted Host when there is no X-Forwarded-Host", func() {
+			req := &http.Request{RequestURI: "/v1/datasets", Host: "API.ons.gov.uk", Header: http.Header{}}
+
+			resp, err := t.RoundTrip(req)
+			So(err, ShouldBeNil)
+
+			b, err := io.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, `{"links":{"self":{"href":"https://api.ons.gov.uk/v1/datasets/12345"}}}`+"\n")
+		})
+
+		Convey("test interceptor falls back to the configured domain for a host that is not permitted", func() {
+			req := fromProxy(&http.Request{RequestURI: "/v1/datasets", Host: "api.ons.gov.uk", Header: http.Header{
+				"X-Forwarded-Host":  {"evil.example.com"},
+				"X-Forwarded-Proto": {"http"},
+			}}, true)
+
+			resp, err := t.RoundTrip(req)
+			So(err, ShouldBeNil)
+
+			b, err := io.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, `{"links":{"self":{"href":"https://api.beta.ons.gov.uk/v1/datasets/12345"}}}`+"\n")
+		})
+
+		Convey("test interceptor updates the Location header using a permitted host", func() {
+			t := NewRoundTripper(testDomain, dummyHeaderRT{http.Header{"Location": {"/datasets/12345"}}})
+			t.publicHosts = []string{"api.ons.gov.uk"}
+			req := &http.Request{RequestURI: "/v1/datasets", Host: "api.ons.gov.uk", Header: http.Header{}}
+
+			resp, err := t.RoundTrip(req)
+			So(err, ShouldBeNil)
+			So(resp.Header.Get("Location"), ShouldEqual, "https://api.ons.gov.uk/v1/datasets/12345")
+		})
+	})
+
+	Convey("Given an interceptor without any permitted public hosts", t, func() {
+		testJSON := `{"links":{"self":{"href":"/datasets/12345"}}}`
+		t := NewRoundTripper(testDomain, dummyRT{testJSON})
+
+		Convey("test interceptor ignores the request host and uses the configured domain", func() {
+			req := &http.Request{RequestURI: "/v1/datasets", Host: "api.ons.gov.uk", Header: http.Header{}}
+
+			resp, err := t.RoundTrip(req)
+			So(err, ShouldBeNil)
+
+			b, err := io.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, `{"links":{"self":{"href":"https://api.beta.ons.gov.uk/v1/datasets/12345"}}}`+"\n")
+		})
+	})
+}
+
+func TestUnitInterceptorMaxBodySize(t *testing.T) {
+	Convey("Given an interceptor with a maximum body size", t, func() {
+		testJSON := `{"links":{"self":{"href":"/datasets/12345"}}}`
+
+		Convey("test interceptor correctly updates a body within the maximum size", func() {
+			t := NewRoundTripper(testDomain, dummyRT{testJSON})
+			t.maxBodySize = int64(len(testJSON))
+
+			resp, err := t.RoundTrip(&http.Request{RequestURI: "/v1/datasets", URL: &url.URL{Host: "localhost:22000"}})
+			So(err, ShouldBeNil)
+
+			b, err := io.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, `{"links":{"self":{"href":"https://api.beta.ons.gov.uk/v1/datasets/12345"}}}`+"\n")
+		})
+
+		Convey("test interceptor passes through a body that exceeds the maximum size while streaming", func() {
+			t := NewRoundTripper(testDomain, dummyRT{testJSON})
+			t.maxBodySize = int64(len(testJSON)) - 1
+			before := oversizedResponsesTotal.Value("unknown", "localhost:22000")
+
+			resp, err := t.RoundTrip(&http.Request{RequestURI: "/v1/datasets", URL: &url.URL{Host: "localhost:22000"}})
+			So(err, ShouldBeNil)
+
+			b, err := io.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+
+			err = resp.Body.Close()
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, testJSON)
+			So(oversizedResponsesTotal.Value("unknown", "localhost:22000"), ShouldEqual, before+1)
+		})
+
+		Convey("test interceptor passes through a body with a Content-Length that exceeds the maximum size, using the matched route", func() {
+			t := NewRoundTripper(testDomain, dummyLengthRT{testJSON})
+			t.maxBodySize = 10
+
+			var resp *http.Response
+			router := mux.NewRouter()
+			router.HandleFunc("/v1/datasets{rest:$|/.*}", func(w http.ResponseWriter, req *http.Request) {
+				req.URL.Host = "localhost:22000"
+				var err error
+				resp, err = t.RoundTrip(req)
+				So(err, ShouldBeNil)
+			})
+			before := oversizedResponsesTotal.Value("/v1/datasets{rest:$|/.*}", "localhost:22000")
+
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/datasets", http.NoBody))
+
+			b, err := io.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, testJSON)
+			So(oversizedResponsesTotal.Value("/v1/datasets{rest:$|/.*}", "localhost:22000"), ShouldEqual, before+1)
+		})
+	})
+}
+
+type dummyLengthRT struct {
+	testJSON string
+}
+
+func (t dummyLengthRT) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	_ = req // shut some linters up
+	resp = httptest.NewRecorder().Result()
+	resp.Body = io.NopCloser(strings.NewReader(t.testJSON))
+	resp.ContentLength = int64(len(t.testJSON))
+	return
+}
+
+var _ http.RoundTripper = dummyLengthRT{}
@@ -7,6 +7,7 @@ import (
 	"os/signal"
 
 	"github.com/ONSdigital/dp-api-router/config"
+	"github.com/ONSdigital/dp-api-router/metrics"
 	"github.com/ONSdigital/dp-api-router/service"
 	dpotelgo "github.com/ONSdigital/dp-otel-go"
 	"github.com/ONSdigital/log.go/v2/log"
@@ -65,6 +66,24 @@ func run(ctx context.Context) error {
 			err = goerrors.Join(err, otelShutdown(context.Background()))
 		}()
 	}
+
+	// Set up the metrics, exporting them to the OpenTelemetry endpoint if enabled
+	if cfg.OtelEnabled || cfg.EnableMetricsEndpoint {
+		metricsConfig := metrics.Config{ServiceName: cfg.OTServiceName}
+		if cfg.OtelEnabled {
+			metricsConfig.OTLPEndpoint = cfg.OTExporterOTLPEndpoint
+		}
+		metricsShutdown, mErr := metrics.Setup(ctx, metricsConfig)
+		if mErr != nil {
+			return errors.Wrap(mErr, "unable to set up metrics")
+		}
+		defer func() {
+			if mErr := metricsShutdown(context.Background()); mErr != nil {
+				log.Error(ctx, "error shutting down metrics", mErr)
+			}
+		}()
+	}
+
 	// Run the service
 	svc, err := service.Run(ctx, cfg, svcList, BuildTime, GitCommit, Version, svcErrors)
 	if err != nil {
@@ -0,0 +1,160 @@
+// Package metrics provides counters and gauges that are reported through OpenTelemetry, exported to the OTLP endpoint
+// and served in the Prometheus text exposition format by the metrics endpoint
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	otelprometheus "go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+)
+
+// MeterName is the name of the meter that the metrics are created by
+const MeterName = "github.com/ONSdigital/dp-api-router"
+
+var (
+	// registry is the prometheus registry that Handler serves the metrics from, once the meter provider is set up
+	registry atomic.Pointer[prometheus.Registry]
+
+	gaugesMu sync.Mutex
+	gauges   = map[string]*GaugeFunc{}
+)
+
+// Config holds the config used to set up the meter provider
+type Config struct {
+	ServiceName  string
+	OTLPEndpoint string
+}
+
+// Setup creates the meter provider that reports the metrics and sets it as the global meter provider, including for
+// the metrics that were created before it. The metrics are served by Handler and, if an OTLP endpoint is configured,
+// exported to it every OTEL_METRIC_EXPORT_INTERVAL. It must only be called once, and if it does not return an error,
+// make sure to call shutdown so that the last metrics are exported.
+func Setup(ctx context.Context, cfg Config) (shutdown func(context.Context) error, err error) {
+	res, err := resource.New(ctx,
+		resource.WithAttributes(
+			semconv.ServiceNameKey.String(cfg.ServiceName),
+			attribute.String("application", cfg.ServiceName),
+		),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	promRegistry := prometheus.NewRegistry()
+	promExporter, err := otelprometheus.New(otelprometheus.WithRegisterer(promRegistry), otelprometheus.WithoutScopeInfo())
+	if err != nil {
+		return nil, err
+	}
+	options := []sdkmetric.Option{sdkmetric.WithResource(res), sdkmetric.WithReader(promExporter)}
+
+	if cfg.OTLPEndpoint != "" {
+		otlpExporter, err := otlpmetricgrpc.New(ctx, otlpmetricgrpc.WithEndpoint(cfg.OTLPEndpoint), otlpmetricgrpc.WithInsecure())
+		if err != nil {
+			return nil, errors.Join(err, promExporter.Shutdown(ctx))
+		}
+		options = append(options, sdkmetric.WithReader(sdkmetric.NewPeriodicReader(otlpExporter)))
+	}
+
+	meterProvider := sdkmetric.NewMeterProvider(options...)
+	otel.SetMeterProvider(meterProvider)
+	registry.Store(promRegistry)
+	return meterProvider.Shutdown, nil
+}
+
+// Handler serves the metrics in the Prometheus text exposition format, or responds with 503 Service Unavailable if the
+// meter provider hasn't been set up
+func Handler(w http.ResponseWriter, req *http.Request) {
+	promRegistry := registry.Load()
+	if promRegistry == nil {
+		http.Error(w, "metrics are not set up", http.StatusServiceUnavailable)
+		return
+	}
+	promhttp.HandlerFor(promRegistry, promhttp.HandlerOpts{}).ServeHTTP(w, req)
+}
+
+// meter returns the meter that the metrics are created by, from the global meter provider
+func meter() metric.Meter {
+	return otel.Meter(MeterName)
+}
+
+// CounterVec is a monotonically increasing count, partitioned by a fixed set of labels
+type CounterVec struct {
+	labels  []string
+	counter metric.Int64Counter
+}
+
+// NewCounterVec creates a CounterVec with the provided label names. Counters with the same name are reported as one.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	// an invalid counter is returned as a no-op counter along with the error, so it can still be used
+	counter, _ := meter().Int64Counter(name, metric.WithDescription(help))
+	return &CounterVec{labels: labels, counter: counter}
+}
+
+// Inc increments the count for the provided label values by one
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increments the count for the provided label values by n
+func (c *CounterVec) Add(n int64, labelValues ...string) {
+	attributes := make([]attribute.KeyValue, len(c.labels))
+	for i, label := range c.labels {
+		value := ""
+		if i < len(labelValues) {
+			value = labelValues[i]
+		}
+		attributes[i] = attribute.String(label, value)
+	}
+	c.counter.Add(context.Background(), n, metric.WithAttributes(attributes...))
+}
+
+// GaugeFunc is a value that can go up and down, which is obtained by calling a function whenever it is reported
+type GaugeFunc struct {
+	mu sync.Mutex
+	fn func() float64
+}
+
+// NewGaugeFunc creates a GaugeFunc, or replaces the function of the gauge already created with the same name, so that
+// the latest instance of a component is the one reported.
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	gaugesMu.Lock()
+	defer gaugesMu.Unlock()
+
+	if g, ok := gauges[name]; ok {
+		g.mu.Lock()
+		g.fn = fn
+		g.mu.Unlock()
+		return g
+	}
+
+	g := &GaugeFunc{fn: fn}
+	// an invalid gauge is returned as a no-op gauge along with the error, and is never observed
+	_, _ = meter().Float64ObservableGauge(name, metric.WithDescription(help),
+		metric.WithFloat64Callback(func(_ context.Context, o metric.Float64Observer) error {
+			o.Observe(g.Value())
+			return nil
+		}))
+	gauges[name] = g
+	return g
+}
+
+// Value returns the current value of the gauge
+func (g *GaugeFunc) Value() float64 {
+	g.mu.Lock()
+	fn := g.fn
+	g.mu.Unlock()
+	return fn()
+}
@@ -0,0 +1,72 @@
+package metrics_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ONSdigital/dp-api-router/metrics"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// serveMetrics returns the response of the metrics handler
+func serveMetrics() *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	metrics.Handler(w, httptest.NewRequest(http.MethodGet, "/metrics", http.NoBody))
+	return w
+}
+
+func TestGaugeFunc(t *testing.T) {
+	Convey("Given a gauge function", t, func() {
+		depth := 5.0
+		g := metrics.NewGaugeFunc("test_gauge_value", "A test gauge", func() float64 { return depth })
+
+		Convey("Then its value is obtained from the function when it is read", func() {
+			So(g.Value(), ShouldEqual, 5)
+			depth = 7
+			So(g.Value(), ShouldEqual, 7)
+		})
+
+		Convey("When a gauge with the same name is created again, then the same gauge reports the new function", func() {
+			again := metrics.NewGaugeFunc("test_gauge_value", "A test gauge", func() float64 { return 9 })
+			So(again, ShouldEqual, g)
+			So(g.Value(), ShouldEqual, 9)
+		})
+	})
+}
+
+func TestHandler(t *testing.T) {
+	counter := metrics.NewCounterVec("test_counter_total", "A test counter", "route", "upstream")
+	metrics.NewGaugeFunc("test_gauge", "A test gauge", func() float64 { return 3 })
+
+	Convey("Given the meter provider hasn't been set up, then the handler responds with service unavailable", t, func() {
+		So(serveMetrics().Code, ShouldEqual, http.StatusServiceUnavailable)
+	})
+
+	Convey("Given metrics created before the meter provider is set up", t, func() {
+		shutdown, err := metrics.Setup(context.Background(), metrics.Config{ServiceName: "dp-api-router"})
+		So(err, ShouldBeNil)
+		defer func() { So(shutdown(context.Background()), ShouldBeNil) }()
+
+		Convey("When a counter is incremented for different label values", func() {
+			counter.Inc("/v1/datasets", "localhost:22000")
+			counter.Inc("/v1/datasets", "localhost:22000")
+			counter.Add(3, "/v1/code-lists", "localhost:22400")
+			counter.Inc(`/v1/"quoted"`, "localhost")
+			metrics.NewCounterVec("test_counter_total", "A test counter", "route", "upstream").Inc("/v1/datasets", "localhost:22000")
+
+			Convey("Then the counts and gauges are served in the prometheus text format, with escaped label values", func() {
+				w := serveMetrics()
+				So(w.Code, ShouldEqual, http.StatusOK)
+				So(w.Header().Get("Content-Type"), ShouldStartWith, "text/plain")
+				body := w.Body.String()
+				So(body, ShouldContainSubstring, "# HELP test_counter_total A test counter\n# TYPE test_counter_total counter\n")
+				So(body, ShouldContainSubstring, `test_counter_total{route="/v1/\"quoted\"",upstream="localhost"} 1`+"\n")
+				So(body, ShouldContainSubstring, `test_counter_total{route="/v1/code-lists",upstream="localhost:22400"} 3`+"\n")
+				So(body, ShouldContainSubstring, `test_counter_total{route="/v1/datasets",upstream="localhost:22000"} 3`+"\n")
+				So(body, ShouldContainSubstring, "# TYPE test_gauge gauge\ntest_gauge 3\n")
+			})
+		})
+	})
+}
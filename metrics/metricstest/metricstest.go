@@ -0,0 +1,65 @@
+// Package metricstest reads the values of the router's metrics in tests
+package metricstest
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ONSdigital/dp-api-router/metrics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+var (
+	setup  sync.Once
+	reader *sdkmetric.ManualReader
+)
+
+// Counter reads the value of a counter created by metrics.NewCounterVec
+type Counter struct {
+	name   string
+	labels []string
+}
+
+// NewCounter returns a Counter that reads the counter with the provided name and label names. The first time it is
+// called, a meter provider that can be read is set as the global meter provider, so that the metrics are recorded.
+func NewCounter(name string, labels ...string) *Counter {
+	setup.Do(func() {
+		reader = sdkmetric.NewManualReader()
+		otel.SetMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+	})
+	return &Counter{name: name, labels: labels}
+}
+
+// Value returns the current count for the provided label values
+func (c *Counter) Value(labelValues ...string) int64 {
+	attributes := make([]attribute.KeyValue, len(c.labels))
+	for i, label := range c.labels {
+		attributes[i] = attribute.String(label, labelValues[i])
+	}
+	want := attribute.NewSet(attributes...)
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		panic(err)
+	}
+	for _, sm := range rm.ScopeMetrics {
+		if sm.Scope.Name != metrics.MeterName {
+			continue
+		}
+		for _, m := range sm.Metrics {
+			sum, ok := m.Data.(metricdata.Sum[int64])
+			if m.Name != c.name || !ok {
+				continue
+			}
+			for _, dp := range sum.DataPoints {
+				if dp.Attributes.Equals(&want) {
+					return dp.Value
+				}
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,302 @@
+package middleware
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ONSdigital/dp-api-router/metrics"
+	dphttp "github.com/ONSdigital/dp-net/v3/http"
+	"github.com/ONSdigital/log.go/v2/log"
+	"github.com/pkg/errors"
+)
+
+// Possible results of requests made with an API key, as counted by the api_key_requests_total metric
+const (
+	APIKeyAllowed       = "allowed"
+	APIKeyUnknown       = "unknown"
+	APIKeyRateLimited   = "rate_limited"
+	APIKeyQuotaExceeded = "quota_exceeded"
+)
+
+// Daily quota response headers
+const (
+	QuotaLimitHeader     = "X-Quota-Limit"
+	QuotaRemainingHeader = "X-Quota-Remaining"
+	QuotaResetHeader     = "X-Quota-Reset"
+)
+
+var apiKeyRequests = metrics.NewCounterVec("api_key_requests_total",
+	"Requests made with an API key, by the owner of the key and whether they were allowed", "owner", "result")
+
+type apiKeysConfig []struct {
+	Owner     string `json:"owner"`
+	KeySHA256 string `json:"key_sha256"`
+	RateLimit *struct {
+		Requests int    `json:"requests"`
+		Period   string `json:"period"`
+		Burst    int    `json:"burst"`
+	} `json:"rate_limit"`
+	DailyQuota int `json:"daily_quota"`
+}
+
+// APIKey is a key that public consumers can identify themselves with, which may have a rate limit and daily quota
+type APIKey struct {
+	Owner      string
+	RateLimit  *RateLimit
+	DailyQuota int
+	hash       string
+}
+
+// LoadAPIKeys loads and validates API keys. It takes in a function that returns the loaded bytes (eg. a function that
+// loads content from disk), which contain a JSON array of keys. Keys are identified by the hex encoded SHA-256 hash of
+// the key, so that the keys themselves aren't stored in the config.
+func LoadAPIKeys(loader func() ([]byte, error)) ([]APIKey, error) {
+	configJSON, err := loader()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to load api keys config")
+	}
+	if len(configJSON) == 0 {
+		return nil, nil
+	}
+
+	var config apiKeysConfig
+	if err := json.Unmarshal(configJSON, &config); err != nil {
+		return nil, errors.Wrap(err, "invalid json in api keys config")
+	}
+
+	keys := make([]APIKey, len(config))
+	hashes := map[string]bool{}
+	for i, c := range config {
+		hash := strings.ToLower(c.KeySHA256)
+		if decoded, err := hex.DecodeString(hash); c.Owner == "" || err != nil || len(decoded) != 32 {
+			return nil, fmt.Errorf("api key %d requires an owner and the hex encoded sha256 hash of the key", i)
+		}
+		if hashes[hash] {
+			return nil, fmt.Errorf("api key of '%s' is configured more than once", c.Owner)
+		}
+		hashes[hash] = true
+		if c.DailyQuota < 0 {
+			return nil, fmt.Errorf("api key of '%s' has a negative daily quota", c.Owner)
+		}
+
+		keys[i] = APIKey{Owner: c.Owner, DailyQuota: c.DailyQuota, hash: hash}
+		if c.RateLimit != nil {
+			period, err := time.ParseDuration(c.RateLimit.Period)
+			if err != nil || period <= 0 || c.RateLimit.Requests <= 0 {
+				return nil, fmt.Errorf("api key of '%s' requires a positive number of requests and period for its rate limit", c.Owner)
+			}
+			if c.RateLimit.Burst <= 0 {
+				c.RateLimit.Burst = c.RateLimit.Requests
+			}
+			keys[i].RateLimit = &RateLimit{Requests: c.RateLimit.Requests, Period: period, Burst: c.RateLimit.Burst}
+		}
+	}
+	return keys, nil
+}
+
+// APIKeys identifies the consumers that make requests with an X-API-Key header, and applies the rate limits and
+// daily quotas of their keys. Requests without a key are passed on unchanged. Usage is counted in memory, so the daily
+// quotas apply to each instance of the router separately.
+type APIKeys struct {
+	keys  map[string]*APIKey
+	store RateLimitStore
+
+	mu    sync.Mutex
+	day   string
+	usage map[string]*apiKeyUsage
+}
+
+type apiKeyUsage struct {
+	requests int
+	rejected int
+}
+
+// APIKeyUsage is the usage of an API key on the current day, as returned by the usage admin endpoint
+type APIKeyUsage struct {
+	Owner      string `json:"owner"`
+	Key        string `json:"key"`
+	Requests   int    `json:"requests"`
+	Rejected   int    `json:"rejected"`
+	DailyQuota int    `json:"daily_quota,omitempty"`
+	Remaining  *int   `json:"remaining,omitempty"`
+}
+
+type apiKeyUsageResponse struct {
+	Date string        `json:"date"`
+	Keys []APIKeyUsage `json:"keys"`
+}
+
+// NewAPIKeys creates an APIKeys for the keys, keeping the state of their rate limits in the store
+func NewAPIKeys(keys []APIKey, store RateLimitStore) *APIKeys {
+	a := &APIKeys{keys: make(map[string]*APIKey, len(keys)), store: store, usage: map[string]*apiKeyUsage{}}
+	for i := range keys {
+		a.keys[keys[i].hash] = &keys[i]
+	}
+	return a
+}
+
+// Handler is a middleware handler that responds with 401 Unauthorized if the API key of a request is unknown, or 429
+// Too Many Requests if the key has exceeded its rate limit or daily quota. The owner of the key is logged and recorded
+// in the outbound audit event, and the RateLimit and X-Quota headers of the key are added to the response.
+func (a *APIKeys) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		apiKey := req.Header.Get(APIKeyHeader)
+		if apiKey == "" {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		ctx := req.Context()
+		logData := log.Data{"path": req.URL.Path, "method": req.Method}
+
+		key, ok := a.keys[hashToken(apiKey)]
+		if !ok {
+			apiKeyRequests.Inc("", APIKeyUnknown)
+			log.Info(ctx, "request rejected: unknown api key", logData)
+			dphttp.DrainBody(req)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		SetAPIKeyOwner(ctx, key.Owner)
+		logData["api_key_owner"] = key.Owner
+
+		// keep the validated key, so that rate limits keyed on API keys only apply to known keys
+		ctx = context.WithValue(ctx, apiKeyKey, key)
+		req = req.WithContext(ctx)
+
+		if key.RateLimit != nil {
+			result, err := a.store.Take(ctx, "api_key:"+key.hash, *key.RateLimit)
+			if err != nil {
+				// fail open, as the rate limits are only a protection against excessive use
+				log.Error(ctx, "api key rate limit could not be checked", err, logData)
+			} else {
+				setRateLimitHeaders(w.Header(), *key.RateLimit, result)
+				if !result.Allowed {
+					a.reject(ctx, w, req, key, APIKeyRateLimited, logData)
+					return
+				}
+			}
+		}
+
+		if key.DailyQuota > 0 {
+			used, reset := a.use(key)
+			remaining := max(key.DailyQuota-used, 0)
+			w.Header().Set(QuotaLimitHeader, strconv.Itoa(key.DailyQuota))
+			w.Header().Set(QuotaRemainingHeader, strconv.Itoa(remaining))
+			w.Header().Set(QuotaResetHeader, strconv.Itoa(ceilSeconds(reset)))
+			if used > key.DailyQuota {
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(reset)))
+				a.reject(ctx, w, req, key, APIKeyQuotaExceeded, logData)
+				return
+			}
+		} else {
+			a.use(key)
+		}
+
+		apiKeyRequests.Inc(key.Owner, APIKeyAllowed)
+		log.Info(ctx, "request made with api key", logData)
+		h.ServeHTTP(w, req)
+	})
+}
+
+// validatedAPIKey returns the API key of the request, if it was validated by the API keys handler
+func validatedAPIKey(ctx context.Context) (*APIKey, bool) {
+	key, ok := ctx.Value(apiKeyKey).(*APIKey)
+	return key, ok
+}
+
+// reject responds with 429 Too Many Requests for a request that exceeded the rate limit or quota of its key
+func (a *APIKeys) reject(ctx context.Context, w http.ResponseWriter, req *http.Request, key *APIKey, result string, logData log.Data) {
+	a.mu.Lock()
+	a.usageOf(key).rejected++
+	a.mu.Unlock()
+
+	apiKeyRequests.Inc(key.Owner, result)
+	logData["result"] = result
+	log.Info(ctx, "request rejected: api key limit exceeded", logData)
+	dphttp.DrainBody(req)
+	w.WriteHeader(http.StatusTooManyRequests)
+}
+
+// use counts a request made with the key today, returning the number of requests made including this one (which is
+// not counted if the quota has been exceeded) and how long until the quota is reset at midnight UTC
+func (a *APIKeys) use(key *APIKey) (used int, reset time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := Now().UTC()
+	usage := a.usageOf(key)
+	used = usage.requests + 1
+	if key.DailyQuota == 0 || used <= key.DailyQuota {
+		usage.requests = used
+	}
+	midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	return used, midnight.Sub(now)
+}
+
+// usageOf returns today's usage of the key, starting a new day if the day has changed. a.mu must be held.
+func (a *APIKeys) usageOf(key *APIKey) *apiKeyUsage {
+	if day := Now().UTC().Format(time.DateOnly); day != a.day {
+		a.day = day
+		a.usage = map[string]*apiKeyUsage{}
+	}
+	usage, ok := a.usage[key.hash]
+	if !ok {
+		usage = &apiKeyUsage{}
+		a.usage[key.hash] = usage
+	}
+	return usage
+}
+
+// Usage returns the date and the usage of every key that has been used on that day, ordered by owner
+func (a *APIKeys) Usage() (string, []APIKeyUsage) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if day := Now().UTC().Format(time.DateOnly); day != a.day {
+		a.day = day
+		a.usage = map[string]*apiKeyUsage{}
+	}
+
+	usage := make([]APIKeyUsage, 0, len(a.usage))
+	for hash, u := range a.usage {
+		key := a.keys[hash]
+		keyUsage := APIKeyUsage{
+			Owner:      key.Owner,
+			Key:        hash[:8],
+			Requests:   u.requests,
+			Rejected:   u.rejected,
+			DailyQuota: key.DailyQuota,
+		}
+		if key.DailyQuota > 0 {
+			remaining := max(key.DailyQuota-u.requests, 0)
+			keyUsage.Remaining = &remaining
+		}
+		usage = append(usage, keyUsage)
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Owner != usage[j].Owner {
+			return usage[i].Owner < usage[j].Owner
+		}
+		return usage[i].Key < usage[j].Key
+	})
+	return a.day, usage
+}
+
+// UsageHandler handles requests for the current usage of the API keys, responding with the date (in UTC) and the
+// usage of each key that has been used on that day, which is identified by its owner and the start of its hash
+func (a *APIKeys) UsageHandler(w http.ResponseWriter, req *http.Request) {
+	date, usage := a.Usage()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(apiKeyUsageResponse{Date: date, Keys: usage}); err != nil {
+		log.Error(req.Context(), "failed to write api key usage response", err)
+	}
+}
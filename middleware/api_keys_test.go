@@ -0,0 +1,189 @@
+package middleware_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/dp-api-router/event"
+	"github.com/ONSdigital/dp-api-router/middleware"
+	"github.com/ONSdigital/dp-api-router/schema"
+	"github.com/ONSdigital/dp-kafka/v2/kafkatest"
+	dprequest "github.com/ONSdigital/dp-net/v3/request"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	testAPIKey      = "myAPIKey"
+	testOtherAPIKey = "otherAPIKey"
+	testAPIKeys     = `[
+  {"owner": "myConsumer", "key_sha256": "B4512DF8A76E00BFE8DDD91C45C8631DA104DCB69A5A284BE9A5EB6D9326C75D", "daily_quota": 2},
+  {"owner": "otherConsumer", "key_sha256": "de6a13c5d50178abfbb15940f4b1c4ea3ec352300d6bc1ddcb87c59b63d0b7f5", "rate_limit": {"requests": 1, "period": "1m"}}
+]`
+)
+
+// loadAPIKeys loads API keys from the provided JSON
+func loadAPIKeys(config string) ([]middleware.APIKey, error) {
+	return middleware.LoadAPIKeys(func() ([]byte, error) {
+		return []byte(config), nil
+	})
+}
+
+func TestLoadAPIKeys(t *testing.T) {
+	Convey("Valid and empty configs are loaded", t, func() {
+		keys, err := loadAPIKeys(testAPIKeys)
+		So(err, ShouldBeNil)
+		So(keys, ShouldHaveLength, 2)
+		So(keys[0].Owner, ShouldEqual, "myConsumer")
+		So(keys[0].DailyQuota, ShouldEqual, 2)
+		So(keys[0].RateLimit, ShouldBeNil)
+		So(*keys[1].RateLimit, ShouldResemble, middleware.RateLimit{Requests: 1, Period: time.Minute, Burst: 1})
+
+		keys, err = loadAPIKeys("")
+		So(err, ShouldBeNil)
+		So(keys, ShouldBeEmpty)
+	})
+
+	Convey("An error loading the config is returned", t, func() {
+		_, err := middleware.LoadAPIKeys(func() ([]byte, error) {
+			return nil, errors.New("file not found")
+		})
+		So(err, ShouldNotBeNil)
+	})
+
+	hash := "b4512df8a76e00bfe8ddd91c45c8631da104dcb69a5a284be9a5eb6d9326c75d"
+	tests := map[string]string{
+		"invalid json":         `[{"owner":`,
+		"missing owner":        `[{"key_sha256": "` + hash + `"}]`,
+		"key that isn't hex":   `[{"owner": "a", "key_sha256": "myAPIKey"}]`,
+		"short hash":           `[{"owner": "a", "key_sha256": "b4512df8"}]`,
+		"duplicate key":        `[{"owner": "a", "key_sha256": "` + hash + `"}, {"owner": "b", "key_sha256": "` + hash + `"}]`,
+		"negative daily quota": `[{"owner": "a", "key_sha256": "` + hash + `", "daily_quota": -1}]`,
+		"invalid rate limit":   `[{"owner": "a", "key_sha256": "` + hash + `", "rate_limit": {"requests": 1, "period": "soon"}}]`,
+	}
+	for name, config := range tests {
+		Convey("A config with "+name+" is rejected", t, func() {
+			keys, err := loadAPIKeys(config)
+			So(err, ShouldNotBeNil)
+			So(keys, ShouldBeNil)
+		})
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	Convey("Given API keys with a daily quota and a rate limit", t, func() {
+		now := time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC)
+		middleware.Now = func() time.Time { return now }
+		keys, err := loadAPIKeys(testAPIKeys)
+		So(err, ShouldBeNil)
+		apiKeys := middleware.NewAPIKeys(keys, middleware.NewMemoryRateLimitStore())
+
+		proxied := 0
+		handler := apiKeys.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			proxied++
+		}))
+		serve := func(apiKey string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, "/v1/datasets", http.NoBody)
+			if apiKey != "" {
+				req.Header.Set(middleware.APIKeyHeader, apiKey)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			return w
+		}
+
+		Convey("When a request is made without a key, then it is proxied without quota headers", func() {
+			w := serve("")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(proxied, ShouldEqual, 1)
+			So(w.Header().Get(middleware.QuotaLimitHeader), ShouldBeEmpty)
+		})
+
+		Convey("When a request is made with an unknown key, then it is rejected as unauthorised", func() {
+			w := serve("unknownAPIKey")
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+			So(proxied, ShouldEqual, 0)
+		})
+
+		Convey("When the daily quota of a key is used up", func() {
+			So(serve(testAPIKey).Header().Get(middleware.QuotaRemainingHeader), ShouldEqual, "1")
+			w := serve(testAPIKey)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Header().Get(middleware.QuotaLimitHeader), ShouldEqual, "2")
+			So(w.Header().Get(middleware.QuotaRemainingHeader), ShouldEqual, "0")
+			So(w.Header().Get(middleware.QuotaResetHeader), ShouldEqual, "3600")
+
+			Convey("Then the next request is rejected until midnight UTC", func() {
+				w := serve(testAPIKey)
+				So(w.Code, ShouldEqual, http.StatusTooManyRequests)
+				So(w.Header().Get("Retry-After"), ShouldEqual, "3600")
+				So(proxied, ShouldEqual, 2)
+
+				now = now.Add(time.Hour)
+				w = serve(testAPIKey)
+				So(w.Code, ShouldEqual, http.StatusOK)
+				So(w.Header().Get(middleware.QuotaRemainingHeader), ShouldEqual, "1")
+			})
+
+			Convey("Then the usage of the key is returned by the usage handler", func() {
+				serve(testAPIKey)
+				serve(testOtherAPIKey)
+				w := httptest.NewRecorder()
+				apiKeys.UsageHandler(w, httptest.NewRequest(http.MethodGet, "/admin/api-keys/usage", http.NoBody))
+				So(w.Code, ShouldEqual, http.StatusOK)
+				So(w.Header().Get("Content-Type"), ShouldEqual, "application/json")
+
+				var usage map[string]interface{}
+				So(json.Unmarshal(w.Body.Bytes(), &usage), ShouldBeNil)
+				So(usage, ShouldResemble, map[string]interface{}{
+					"date": "2024-01-01",
+					"keys": []interface{}{
+						map[string]interface{}{"owner": "myConsumer", "key": "b4512df8", "requests": 2.0, "rejected": 1.0, "daily_quota": 2.0, "remaining": 0.0},
+						map[string]interface{}{"owner": "otherConsumer", "key": "de6a13c5", "requests": 1.0, "rejected": 0.0},
+					},
+				})
+			})
+		})
+
+		Convey("When the rate limit of a key is exceeded, then the request is rejected with the rate limit headers", func() {
+			So(serve(testOtherAPIKey).Code, ShouldEqual, http.StatusOK)
+			w := serve(testOtherAPIKey)
+			So(w.Code, ShouldEqual, http.StatusTooManyRequests)
+			So(w.Header().Get("RateLimit-Limit"), ShouldEqual, "1")
+			So(w.Header().Get("RateLimit-Remaining"), ShouldEqual, "0")
+			So(w.Header().Get("Retry-After"), ShouldEqual, "60")
+			So(w.Header().Get(middleware.QuotaLimitHeader), ShouldBeEmpty)
+			So(proxied, ShouldEqual, 1)
+		})
+	})
+}
+
+func TestAPIKeysAudit(t *testing.T) {
+	Convey("Given an audit handler followed by API keys", t, func(c C) {
+		keys, err := loadAPIKeys(testAPIKeys)
+		So(err, ShouldBeNil)
+		apiKeys := middleware.NewAPIKeys(keys, middleware.NewMemoryRateLimitStore())
+
+		p := kafkatest.NewMessageProducer(true)
+		auditProducer := event.NewAvroProducer(p.Channels().Output, schema.AuditEventV4)
+		auditHandler := middleware.AuditHandler(auditProducer, createHTTPClientMock(http.StatusOK, testIdentityResponse),
+			testZebedeeURL, testAuditRules, nil, true, nil, nil)(apiKeys.Handler(testHandler(http.StatusOK, testBody, c)))
+
+		Convey("When a request is made with a key", func(c C) {
+			req := httptest.NewRequest(http.MethodGet, "/v1/datasets", http.NoBody)
+			req.Header.Set(dprequest.FlorenceHeaderKey, testFlorenceToken)
+			req.Header.Set(middleware.APIKeyHeader, testAPIKey)
+			w := httptest.NewRecorder()
+			auditEvents := serveAndCaptureAuditV4(c, w, req, auditHandler, p.Channels().Output, 2)
+
+			Convey("Then the owner of the key is recorded in the outbound audit event", func() {
+				So(w.Code, ShouldEqual, http.StatusOK)
+				So(auditEvents[0].APIKeyOwner, ShouldBeEmpty)
+				So(auditEvents[1].APIKeyOwner, ShouldEqual, "myConsumer")
+			})
+		})
+	})
+}
@@ -1,25 +1,25 @@
 package middleware
 
 import (
-	"bytes"
+	"bufio"
 	"context"
-	"fmt"
+	"errors"
 	"io"
 	"math"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 
 	"github.com/ONSdigital/dp-api-clients-go/v2/headers"
-	"github.com/ONSdigital/dp-api-clients-go/v2/health"
-	clientsidentity "github.com/ONSdigital/dp-api-clients-go/v2/identity"
 	"github.com/ONSdigital/dp-api-router/event"
-	"github.com/ONSdigital/dp-authorisation/v2/authorisation"
 	dphttp "github.com/ONSdigital/dp-net/v3/http"
 	dprequest "github.com/ONSdigital/dp-net/v3/request"
+	permsdk "github.com/ONSdigital/dp-permissions-api/sdk"
 	"github.com/ONSdigital/log.go/v2/log"
 )
 
@@ -29,90 +29,91 @@ type Router interface {
 	Match(req *http.Request, match *mux.RouteMatch) bool
 }
 
-// paths that will skip auditing (note)
-// identity api paths being added until the auditing has been updated to work with new tokens
-var pathsToIgnore = []string{
-	"/ping",
-	"/clickEventLog",
-	"/health",
-}
+// Types of credentials used to identify the caller of a request, as recorded in audit events
+const (
+	AuthTypeJWT     = "jwt"
+	AuthTypeSession = "session"
+	AuthTypeService = "service"
+	AuthTypeNone    = "none"
+)
 
-// paths that will skip retrieveIdentity, and will be audited without identity
-var pathsSkipIdentity = []string{
-	"/login",
-	"/password",
-	"/hierarchies",
-	"/tokens",
-	"/password-reset",
-	"/users/self/password",
-}
+type contextKey string
 
-// Now is a time.Now wrapper specifically for testing purposes, and should not me unlambda'd - despite what golangci-lint says
-var Now = time.Now
+const (
+	upstreamKey    = contextKey("upstream")
+	apiKeyOwnerKey = contextKey("api-key-owner")
+	apiKeyKey      = contextKey("api-key")
+)
 
-func ShallSkipIdentity(versionPrefix, path string) bool {
-	// TODO need to revisit this if we start supporting multiple versions of the APIs.
-	path = strings.TrimPrefix(path, fmt.Sprintf("/%s", versionPrefix))
+// auditField holds a value of the outbound audit event that is only known once the request has been handled,
+// such as the upstream target set by SetUpstream
+type auditField struct {
+	mu    sync.Mutex
+	value string
+}
 
-	for _, pathSkipIdentity := range pathsSkipIdentity {
-		if strings.HasPrefix(path, pathSkipIdentity) {
-			return true
-		}
-	}
-	return false
+func (f *auditField) get() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.value
 }
 
-func shallIgnore(path string) bool {
-	for _, pathToIgnore := range pathsToIgnore {
-		if strings.HasPrefix(path, pathToIgnore) {
-			return true
-		}
+// setAuditField sets the audit field stored in the context with the key, if the request is being audited
+func setAuditField(ctx context.Context, key contextKey, value string) {
+	if f, ok := ctx.Value(key).(*auditField); ok {
+		f.mu.Lock()
+		f.value = value
+		f.mu.Unlock()
 	}
-	return false
 }
 
+// SetUpstream records the upstream target that the request is proxied to, so that it can be included in the
+// outbound audit event. It has no effect if the request is not being audited.
+func SetUpstream(ctx context.Context, target string) {
+	setAuditField(ctx, upstreamKey, target)
+}
+
+// SetAPIKeyOwner records the owner of the API key that the request was made with, so that it can be included in the
+// outbound audit event. It has no effect if the request is not being audited.
+func SetAPIKeyOwner(ctx context.Context, owner string) {
+	setAuditField(ctx, apiKeyOwnerKey, owner)
+}
+
+// Now is a time.Now wrapper specifically for testing purposes, and should not me unlambda'd - despite what golangci-lint says
+var Now = time.Now
+
 // AuditHandler is a middleware handler that keeps track of calls for auditing purposes,
 // before and after proxying calling the downstream service.
-// It obtains the user and caller information by calling Zebedee GET /identity
+// It obtains the user and caller information by calling Zebedee GET /identity, unless the rules skip it for the request.
+// If an identity cache is provided, the results of calling Zebedee are cached.
+// If a JWT verifier is provided, JWTs are verified by the router itself instead of by Zebedee.
 func AuditHandler(auditProducer *event.AvroProducer,
 	cli dphttp.Clienter,
-	zebedeeURL, versionPrefix string,
+	zebedeeURL string,
+	rules *AuditRules,
+	idCache *IdentityCache,
 	enableZebedeeAudit bool,
 	router Router,
-	auth authorisation.Config) func(h http.Handler) http.Handler {
+	jwtVerifier *JWTVerifier) func(h http.Handler) http.Handler {
 	// create Identity client that will be used by middleware to check callers identity
-	idClient := clientsidentity.NewWithHealthClient(&health.Client{
-		Client: cli,
-		URL:    zebedeeURL,
-		Name:   "identity",
-	})
+	idClient := NewIdentityChecker(cli, zebedeeURL, idCache)
 
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// if path does not need to be audited, ignore it and proceed to next handler
-			if shallIgnore(r.URL.Path) {
+			// Inbound audit event (before proxying). If the request does not need to be audited, proceed to next handler
+			auditEvent, audited := newInboundAuditEvent(r, rules, enableZebedeeAudit, router)
+			if !audited {
 				h.ServeHTTP(w, r)
 				return
 			}
 
-			if !enableZebedeeAudit {
-				// Zebedee is the fallback route, so we can only determine a request is for Zebedee
-				// if it does not match any of the configured routes.
-				var matchedRoute = &mux.RouteMatch{}
-				router.Match(r, matchedRoute) // bool return value still returns true for NotFoundHandler
-				if matchedRoute.MatchErr == mux.ErrNotFound {
-					h.ServeHTTP(w, r)
-					return
-				}
-			}
-
-			// Inbound audit event (before proxying).
-			auditEvent := GenerateAuditEvent(r)
+			// CORS preflight requests never have credentials, so they are audited without an identity
+			if !rules.ShallSkipIdentity(r) && !isPreflight(r) {
+				auditEvent.AuthType = getAuthType(r)
 
-			if !ShallSkipIdentity(versionPrefix, r.URL.Path) {
 				// Retrieve Identity from Zebedee, which is stored in context.
 				// if it fails, try to audit with the statusCode before returning
-				ctx, statusCode, err := retrieveIdentity(w, r, idClient, auth)
+				ctx, statusCode, err := retrieveIdentity(w, r, idClient, jwtVerifier)
 				if err != nil {
 					// error already handled in retrieveIdentity. Try to audit it.
 					auditEvent.StatusCode = int32(math.Min(math.Max(float64(statusCode), math.MinInt32), math.MaxInt32))
@@ -147,48 +148,177 @@ func AuditHandler(auditProducer *event.AvroProducer,
 				return
 			}
 
-			// Proxy the call with our responseRecorder
-			rec := &responseRecorder{w, http.StatusOK, &bytes.Buffer{}}
-			h.ServeHTTP(rec, r)
+			// Proxy the call with our responseRecorder, which streams the response straight through to the client,
+			// and let the proxy record the upstream target (and the API keys middleware the key owner) in the request context
+			rec := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+			upstream, apiKeyOwner := &auditField{}, &auditField{}
+			auditCtx := context.WithValue(context.WithValue(r.Context(), upstreamKey, upstream), apiKeyOwnerKey, apiKeyOwner)
+			h.ServeHTTP(rec, r.WithContext(auditCtx))
 
 			// Audit event (after proxying).
+			inboundCreatedAt := auditEvent.CreatedAt
 			auditEvent.CreatedAt = event.CreatedAtMillis(Now())
 			auditEvent.StatusCode = int32(math.Min(math.Max(float64(rec.statusCode), math.MinInt32), math.MaxInt32))
-			eventBytes, err := auditProducer.Marshal(auditEvent)
-			if err != nil {
-				handleError(r.Context(), w, r, http.StatusInternalServerError, "outbound audit event could not be sent", err, log.Data{"event": auditEvent})
-				return
-			}
+			auditEvent.DurationMillis = auditEvent.CreatedAt - inboundCreatedAt
+			auditEvent.ResponseBytes = rec.bytesWritten
+			auditEvent.Upstream = upstream.get()
+			auditEvent.APIKeyOwner = apiKeyOwner.get()
+			logData := log.Data{"event": auditEvent, "response_bytes": rec.bytesWritten}
 
-			// Copy the intercepted body and header to the original response writer
-			w.WriteHeader(rec.statusCode)
-			_, err = io.Copy(w, rec.body)
+			// The response has already been sent, so an outbound audit failure can only be logged
+			eventBytes, err := auditProducer.Marshal(auditEvent)
 			if err != nil {
-				handleError(r.Context(), w, r, http.StatusInternalServerError, "failed to copy intercepted response to original response writer", err, log.Data{"event": auditEvent})
+				log.Error(r.Context(), "outbound audit event could not be marshalled", err, logData)
 				return
 			}
 
 			// Finally send the outbound audit message
-			auditProducer.Send(eventBytes)
+			if err := auditProducer.Send(eventBytes); err != nil {
+				log.Error(r.Context(), "outbound audit event could not be sent", err, logData)
+			}
 		})
 	}
 }
 
-// responseRecorder implements ResponseWriter and intercepts status code and body
+// newInboundAuditEvent creates the inbound audit event for the request, with its route and redacted query, or returns
+// false if the request is not audited
+func newInboundAuditEvent(r *http.Request, rules *AuditRules, enableZebedeeAudit bool, router Router) (*event.Audit, bool) {
+	if rules.ShallIgnore(r) {
+		return nil, false
+	}
+
+	var matchedRoute = &mux.RouteMatch{}
+	if router != nil {
+		router.Match(r, matchedRoute) // bool return value still returns true for NotFoundHandler
+	}
+
+	// Zebedee is the fallback route, so we can only determine a request is for Zebedee
+	// if it does not match any of the configured routes.
+	if !enableZebedeeAudit && matchedRoute.MatchErr == mux.ErrNotFound {
+		return nil, false
+	}
+
+	auditEvent := GenerateAuditEvent(r)
+	if matchedRoute.Route != nil {
+		auditEvent.Route, _ = matchedRoute.Route.GetPathTemplate()
+	}
+	if rules.redaction != nil {
+		if query, redacted := rules.redaction.Redact(r); redacted {
+			auditEvent.QueryParam = query
+		}
+	}
+	return auditEvent, true
+}
+
+// RejectionAuditor audits requests that are rejected before they reach the audit handler, such as by the IP filter.
+// The rejection doesn't depend on who the caller is, so the requests are audited without looking up their identity.
+type RejectionAuditor struct {
+	auditProducer      *event.AvroProducer
+	rules              *AuditRules
+	enableZebedeeAudit bool
+	router             Router
+}
+
+// NewRejectionAuditor creates a RejectionAuditor that audits the same requests as an AuditHandler with the arguments
+func NewRejectionAuditor(auditProducer *event.AvroProducer, rules *AuditRules, enableZebedeeAudit bool, router Router) *RejectionAuditor {
+	return &RejectionAuditor{
+		auditProducer:      auditProducer,
+		rules:              rules,
+		enableZebedeeAudit: enableZebedeeAudit,
+		router:             router,
+	}
+}
+
+// Audit sends a single audit event for the request, which was rejected with the status code, unless the request is not
+// audited. It has no effect if the RejectionAuditor is nil.
+func (a *RejectionAuditor) Audit(r *http.Request, status int) {
+	if a == nil {
+		return
+	}
+	auditEvent, audited := newInboundAuditEvent(r, a.rules, a.enableZebedeeAudit, a.router)
+	if !audited {
+		return
+	}
+	if !a.rules.ShallSkipIdentity(r) && !isPreflight(r) {
+		auditEvent.AuthType = getAuthType(r)
+	}
+	auditEvent.StatusCode = int32(status)
+	if err := a.auditProducer.Audit(auditEvent); err != nil {
+		log.Error(r.Context(), "rejected request audit event could not be sent", err, log.Data{"event": auditEvent})
+	}
+}
+
+// responseRecorder implements ResponseWriter, passing the response straight through to the wrapped ResponseWriter
+// while keeping track of the status code and the number of body bytes written
 type responseRecorder struct {
 	http.ResponseWriter
-	statusCode int
-	body       *bytes.Buffer
+	statusCode   int
+	bytesWritten int64
+	wroteHeader  bool
 }
 
-// WriteHeader intercepts the status code and stores it in rec.statusCode instead of setting it to the wrapped responseWriter
+var (
+	_ http.Flusher  = &responseRecorder{}
+	_ http.Hijacker = &responseRecorder{}
+	_ io.ReaderFrom = &responseRecorder{}
+)
+
+// WriteHeader stores the status code in rec.statusCode and sets it on the wrapped responseWriter
 func (rec *responseRecorder) WriteHeader(status int) {
-	rec.statusCode = status
+	if !rec.wroteHeader {
+		rec.statusCode = status
+		// informational responses may be followed by the final status code
+		rec.wroteHeader = status >= http.StatusOK || status == http.StatusSwitchingProtocols
+	}
+	rec.ResponseWriter.WriteHeader(status)
 }
 
-// Write intercepts the body and stores it in rec.body instead of writing it to the wrapped responseWriter
+// Write writes the body to the wrapped responseWriter and counts the bytes written
 func (rec *responseRecorder) Write(b []byte) (int, error) {
-	return rec.body.Write(b)
+	rec.wroteHeader = true
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytesWritten += int64(n)
+	return n, err
+}
+
+// ReadFrom copies the body from src to the wrapped responseWriter, using its io.ReaderFrom implementation when available
+func (rec *responseRecorder) ReadFrom(src io.Reader) (int64, error) {
+	rec.wroteHeader = true
+	if rf, ok := rec.ResponseWriter.(io.ReaderFrom); ok {
+		n, err := rf.ReadFrom(src)
+		rec.bytesWritten += n
+		return n, err
+	}
+	// hide ReadFrom from io.Copy, to avoid recursion
+	return io.Copy(struct{ io.Writer }{rec}, src)
+}
+
+// Flush sends any buffered data to the client, if supported by the wrapped responseWriter
+func (rec *responseRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		rec.wroteHeader = true
+		f.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection, if supported by the wrapped responseWriter
+func (rec *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := hj.Hijack()
+	if err == nil && !rec.wroteHeader {
+		// the response is now written directly to the connection, which is only expected when switching protocols
+		rec.statusCode = http.StatusSwitchingProtocols
+		rec.wroteHeader = true
+	}
+	return conn, rw, err
+}
+
+// Unwrap returns the wrapped responseWriter, for use by http.ResponseController
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
 }
 
 // GenerateAuditEvent creates an audit event with the values from request and request context, if present.
@@ -197,6 +327,8 @@ func GenerateAuditEvent(req *http.Request) *event.Audit {
 		CreatedAt: event.CreatedAtMillis(Now()),
 		Path:      req.URL.Path,
 		Method:    req.Method,
+		ClientIP:  clientIPString(req),
+		UserAgent: req.UserAgent(),
 	}
 
 	// obtain collectionID from context
@@ -217,8 +349,29 @@ func GenerateAuditEvent(req *http.Request) *event.Audit {
 	return auditEvent
 }
 
+// getAuthType returns the type of credentials that were provided to identify the caller of the request
+func getAuthType(req *http.Request) string {
+	florenceToken, err := headers.GetUserAuthToken(req)
+	if err != nil {
+		if c, cookieErr := req.Cookie(dprequest.FlorenceCookieKey); cookieErr == nil {
+			florenceToken = c.Value
+		}
+	}
+	switch {
+	case strings.Contains(florenceToken, "."):
+		return AuthTypeJWT
+	case florenceToken != "":
+		return AuthTypeSession
+	}
+	if serviceAuthToken, err := headers.GetServiceAuthToken(req); err == nil && serviceAuthToken != "" {
+		return AuthTypeService
+	}
+	return AuthTypeNone
+}
+
 // retrieveIdentity requests the user and caller identity from Zebedee, using the provided client.
-func retrieveIdentity(w http.ResponseWriter, req *http.Request, idClient *clientsidentity.Client, auth authorisation.Config) (ctx context.Context, status int, err error) {
+// JWTs are verified with the provided verifier instead, if there is one.
+func retrieveIdentity(w http.ResponseWriter, req *http.Request, idClient IdentityChecker, jwtVerifier *JWTVerifier) (ctx context.Context, status int, err error) {
 	ctx = req.Context()
 
 	florenceToken, err := getFlorenceToken(ctx, req)
@@ -227,29 +380,23 @@ func retrieveIdentity(w http.ResponseWriter, req *http.Request, idClient *client
 		return ctx, http.StatusInternalServerError, err
 	}
 
-	if strings.Contains(florenceToken, ".") {
-		token := florenceToken
-		bearerPrefix := "Bearer "
-		if strings.HasPrefix(florenceToken, bearerPrefix) {
-			token = strings.TrimPrefix(florenceToken, bearerPrefix)
-		}
+	if jwtVerifier != nil && strings.Contains(florenceToken, ".") {
+		token := strings.TrimPrefix(florenceToken, dprequest.BearerPrefix)
 
-		authorisationMiddleware, authErr := authorisation.NewFeatureFlaggedMiddleware(ctx, &auth, nil)
-		if authErr != nil {
-			handleError(ctx, w, req, http.StatusInternalServerError, "error getting jwtRSAPublicKeys from request", authErr, nil)
-			return ctx, http.StatusInternalServerError, authErr
+		entityData, parseErr := jwtVerifier.Parse(ctx, token)
+		if errors.Is(parseErr, ErrNoJWTKeys) {
+			handleError(ctx, w, req, http.StatusInternalServerError, "jwt from request can't be verified without keys", parseErr, nil)
+			return ctx, http.StatusInternalServerError, parseErr
 		}
-
-		entityData, parseErr := authorisationMiddleware.Parse(token)
 		if parseErr != nil {
-			handleError(ctx, w, req, http.StatusInternalServerError, "error getting parsing token from request", parseErr, nil)
-			return ctx, http.StatusInternalServerError, parseErr
+			handleError(ctx, w, req, http.StatusUnauthorized, "error verifying jwt from request", parseErr, nil)
+			return ctx, http.StatusUnauthorized, parseErr
 		}
 
-		if entityData != nil {
-			ctx = context.WithValue(ctx, dprequest.UserIdentityKey, entityData.UserID)
-			return ctx, http.StatusOK, nil
-		}
+		// keep the verified entity data, so that edge authorisation doesn't need to verify the JWT again
+		ctx = context.WithValue(ctx, dprequest.UserIdentityKey, entityData.UserID)
+		ctx = context.WithValue(ctx, entityDataKey, entityData)
+		return ctx, http.StatusOK, nil
 	}
 
 	serviceAuthToken, err := getServiceAuthToken(ctx, req)
@@ -271,6 +418,8 @@ func retrieveIdentity(w http.ResponseWriter, req *http.Request, idClient *client
 		return ctx, statusCode, authFailure
 	}
 
+	// keep the caller identified by Zebedee, so that edge authorisation doesn't need to call Zebedee again
+	ctx = context.WithValue(ctx, entityDataKey, &permsdk.EntityData{UserID: dprequest.Caller(ctx)})
 	return ctx, http.StatusOK, nil
 }
 
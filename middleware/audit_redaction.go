@@ -0,0 +1,151 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// RedactedValue replaces the parts of query parameter values that match a redaction pattern
+const RedactedValue = "[REDACTED]"
+
+type queryRedactionConfig []struct {
+	Routes   []string `json:"routes"`
+	Drop     []string `json:"drop"`
+	Hash     []string `json:"hash"`
+	Patterns []string `json:"patterns"`
+}
+
+// QueryRedaction removes personal data from the query strings of audit events. Each rule applies to the requests that
+// match its routes (http.ServeMux patterns, or every request if it has none), and can drop parameters, replace their
+// values with a hash, or replace any part of a value that matches a regular expression.
+type QueryRedaction struct {
+	rules []redactionRule
+}
+
+type redactionRule struct {
+	routes   *http.ServeMux
+	drop     map[string]bool
+	hash     map[string]bool
+	patterns []*regexp.Regexp
+}
+
+// LoadQueryRedaction loads and validates query redaction rules. It takes in a function that returns the loaded bytes
+// (eg. a function that loads content from disk), which contain a JSON array of rules.
+func LoadQueryRedaction(loader func() ([]byte, error)) (*QueryRedaction, error) {
+	configJSON, err := loader()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to load query redaction config")
+	}
+
+	var config queryRedactionConfig
+	if len(configJSON) > 0 {
+		if err := json.Unmarshal(configJSON, &config); err != nil {
+			return nil, errors.Wrap(err, "invalid json in query redaction config")
+		}
+	}
+
+	redaction := &QueryRedaction{rules: make([]redactionRule, len(config))}
+	for i, c := range config {
+		rule := redactionRule{drop: lowerSet(c.Drop), hash: lowerSet(c.Hash)}
+		if len(c.Routes) > 0 {
+			if rule.routes, err = newRuleMux(c.Routes); err != nil {
+				return nil, errors.Wrap(err, "invalid routes in query redaction config")
+			}
+		}
+		for _, pattern := range c.Patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid pattern in query redaction config")
+			}
+			rule.patterns = append(rule.patterns, re)
+		}
+		redaction.rules[i] = rule
+	}
+	return redaction, nil
+}
+
+// lowerSet returns a set of the provided names in lower case, so that they can be matched regardless of case
+func lowerSet(names []string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[strings.ToLower(name)] = true
+	}
+	return set
+}
+
+// Redact returns the unescaped query string of the request, with the rules that match the request applied.
+// It returns false if no rules match the request, in which case the query doesn't need to be redacted.
+func (q *QueryRedaction) Redact(req *http.Request) (string, bool) {
+	var rules []redactionRule
+	for _, rule := range q.rules {
+		if rule.routes == nil || matches(rule.routes, req) {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == 0 {
+		return "", false
+	}
+
+	params := []string{}
+	for _, param := range strings.Split(req.URL.RawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		name, value, hasValue := strings.Cut(param, "=")
+		name, value = unescapeQuery(name), unescapeQuery(value)
+
+		if redacted, keep := redactParam(rules, name, value); keep {
+			if hasValue {
+				params = append(params, fmt.Sprintf("%s=%s", name, redacted))
+			} else {
+				params = append(params, name)
+			}
+		}
+	}
+	return strings.Join(params, "&"), true
+}
+
+// redactParam applies the rules to a single query parameter, returning its redacted value,
+// or false if the parameter must be dropped
+func redactParam(rules []redactionRule, name, value string) (string, bool) {
+	lowerName := strings.ToLower(name)
+	for _, rule := range rules {
+		if rule.drop[lowerName] {
+			return "", false
+		}
+	}
+	for _, rule := range rules {
+		if rule.hash[lowerName] {
+			return hashValue(value), true
+		}
+	}
+	for _, rule := range rules {
+		for _, re := range rule.patterns {
+			value = re.ReplaceAllLiteralString(value, RedactedValue)
+		}
+	}
+	return value, true
+}
+
+// hashValue returns a short hash of the value, so that requests with the same value can be correlated without
+// recording the value itself
+func hashValue(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// unescapeQuery unescapes part of a query string, returning it unchanged if it isn't correctly escaped
+func unescapeQuery(s string) string {
+	if unescaped, err := url.QueryUnescape(s); err == nil {
+		return unescaped
+	}
+	return s
+}
@@ -0,0 +1,132 @@
+package middleware_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/dp-api-router/event"
+	"github.com/ONSdigital/dp-api-router/middleware"
+	"github.com/ONSdigital/dp-api-router/schema"
+	"github.com/ONSdigital/dp-kafka/v2/kafkatest"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const testRedactionConfig = `[
+  {
+    "routes": ["GET /v1/search", "/v1/users/"],
+    "drop": ["token"],
+    "hash": ["Email"],
+    "patterns": ["[^@\\s]+@[^@\\s]+"]
+  },
+  {
+    "patterns": ["\\b\\d{16}\\b"]
+  }
+]`
+
+// loadRedaction loads query redaction rules from the provided JSON
+func loadRedaction(config string) (*middleware.QueryRedaction, error) {
+	return middleware.LoadQueryRedaction(func() ([]byte, error) {
+		return []byte(config), nil
+	})
+}
+
+func TestLoadQueryRedaction(t *testing.T) {
+	Convey("Valid and empty configs are loaded", t, func() {
+		for _, config := range []string{testRedactionConfig, "", "[]"} {
+			redaction, err := loadRedaction(config)
+			So(err, ShouldBeNil)
+			So(redaction, ShouldNotBeNil)
+		}
+	})
+
+	Convey("An error loading the config is returned", t, func() {
+		_, err := middleware.LoadQueryRedaction(func() ([]byte, error) {
+			return nil, errors.New("file not found")
+		})
+		So(err, ShouldNotBeNil)
+	})
+
+	tests := map[string]string{
+		"invalid json":    `{"routes":`,
+		"invalid route":   `[{"routes": ["/users/{id"]}]`,
+		"invalid pattern": `[{"patterns": ["[a-z"]}]`,
+	}
+	for name, config := range tests {
+		Convey("A config with an "+name+" is rejected", t, func() {
+			redaction, err := loadRedaction(config)
+			So(err, ShouldNotBeNil)
+			So(redaction, ShouldBeNil)
+		})
+	}
+}
+
+func TestQueryRedaction(t *testing.T) {
+	redaction, err := loadRedaction(testRedactionConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		expected string
+	}{
+		{"dropped parameters are removed", http.MethodGet, "/v1/search?q=cpi&token=abc123&limit=10", "q=cpi&limit=10"},
+		{"hashed parameters are matched regardless of case", http.MethodGet, "/v1/search?EMAIL=someone%40ons.gov.uk",
+			"EMAIL=sha256:ed3aea632140c3a7"},
+		{"patterns are redacted from escaped values", http.MethodGet, "/v1/search?q=contact%20someone%40ons.gov.uk%20today",
+			"q=contact [REDACTED] today"},
+		{"rules apply to the whole subtree of a route", http.MethodPost, "/v1/users/123?token=abc&id=1", "id=1"},
+		{"parameters without a value are kept", http.MethodGet, "/v1/search?flag&token", "flag"},
+		{"rules without routes apply to every request", http.MethodGet, "/v1/datasets?card=1234567812345678&email=a@b.c",
+			"card=[REDACTED]&email=a@b.c"},
+	}
+	for _, tc := range tests {
+		Convey("Given a request where "+tc.name, t, func() {
+			req := httptest.NewRequest(tc.method, tc.target, http.NoBody)
+
+			Convey("Then the query is redacted", func() {
+				query, redacted := redaction.Redact(req)
+				So(redacted, ShouldBeTrue)
+				So(query, ShouldEqual, tc.expected)
+			})
+		})
+	}
+
+	Convey("Given a request that doesn't match any rule, then the query is not redacted", t, func() {
+		redaction, err := loadRedaction(`[{"routes": ["/v1/search"], "drop": ["token"]}]`)
+		So(err, ShouldBeNil)
+		_, redacted := redaction.Redact(httptest.NewRequest(http.MethodGet, "/v1/datasets?token=abc", http.NoBody))
+		So(redacted, ShouldBeFalse)
+	})
+}
+
+func TestAuditHandlerQueryRedaction(t *testing.T) {
+	Convey("Given an audit handler with query redaction rules", t, func(c C) {
+		middleware.Now = func() time.Time { return testTimeInbound }
+		redaction, err := loadRedaction(`[{"routes": ["/v1/login"], "drop": ["token"], "hash": ["email"]}]`)
+		So(err, ShouldBeNil)
+		rules := newTestAuditRules(testVersionPrefix, nil, []string{"/login"})
+		rules.SetQueryRedaction(redaction)
+
+		p := kafkatest.NewMessageProducer(true)
+		auditProducer := event.NewAvroProducer(p.Channels().Output, schema.AuditEvent)
+		auditHandler := middleware.AuditHandler(auditProducer, createHTTPClientMock(http.StatusOK, testIdentityResponse),
+			testZebedeeURL, rules, nil, true, nil, nil)(testHandler(http.StatusOK, testBody, c))
+
+		Convey("When a request with personal data in its query is audited", func(c C) {
+			req := httptest.NewRequest(http.MethodPost, "/v1/login?email=someone%40ons.gov.uk&token=abc&lang=en", http.NoBody)
+			auditEvents := serveAndCaptureAudit(c, httptest.NewRecorder(), req, auditHandler, p.Channels().Output, 2)
+
+			Convey("Then both audit events contain the redacted query", func() {
+				for _, auditEvent := range auditEvents {
+					So(auditEvent.QueryParam, ShouldEqual, "email=sha256:ed3aea632140c3a7&lang=en")
+				}
+			})
+		})
+	})
+}
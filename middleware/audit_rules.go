@@ -0,0 +1,92 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// AuditRules determines which requests are not audited at all, and which are audited without retrieving the identity
+// of the caller. Rules are http.ServeMux patterns, optionally restricted to a method (e.g. "POST /tokens"). Patterns
+// match a single path unless they end with a slash, in which case they match the whole subtree (e.g. "/hierarchies/").
+type AuditRules struct {
+	versionPrefix string
+	ignore        *http.ServeMux
+	skipIdentity  *http.ServeMux
+	redaction     *QueryRedaction
+}
+
+// NewAuditRules validates the provided ignore and skip identity rules and returns the corresponding AuditRules.
+// Ignore rules are matched against the request path, whereas skip identity rules are matched against the request path
+// without the version prefix, so that they apply to both versioned and unversioned requests.
+func NewAuditRules(versionPrefix string, ignore, skipIdentity []string) (*AuditRules, error) {
+	ignoreMux, err := newRuleMux(ignore)
+	if err != nil {
+		return nil, fmt.Errorf("invalid audit ignore rules: %w", err)
+	}
+	skipIdentityMux, err := newRuleMux(skipIdentity)
+	if err != nil {
+		return nil, fmt.Errorf("invalid audit skip identity rules: %w", err)
+	}
+	return &AuditRules{
+		versionPrefix: versionPrefix,
+		ignore:        ignoreMux,
+		skipIdentity:  skipIdentityMux,
+	}, nil
+}
+
+// newRuleMux registers the rules in a http.ServeMux, which is only used to match requests against them.
+// http.ServeMux panics if it receives an invalid or conflicting pattern, so the panic is trapped and returned as an error.
+func newRuleMux(rules []string) (ruleMux *http.ServeMux, err error) {
+	ruleMux = http.NewServeMux()
+	for _, rule := range rules {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("invalid rule: '%s' (%v)", rule, r)
+				}
+			}()
+			ruleMux.HandleFunc(rule, func(_ http.ResponseWriter, _ *http.Request) {})
+		}()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ruleMux, nil
+}
+
+// matches returns true if the request matches any of the rules in ruleMux
+func matches(ruleMux *http.ServeMux, req *http.Request) bool {
+	_, pattern := ruleMux.Handler(req)
+	return pattern != ""
+}
+
+// ShallIgnore returns true if the request must not be audited
+func (rules *AuditRules) ShallIgnore(req *http.Request) bool {
+	return matches(rules.ignore, req)
+}
+
+// ShallSkipIdentity returns true if the request must be audited without retrieving the identity of the caller
+func (rules *AuditRules) ShallSkipIdentity(req *http.Request) bool {
+	// TODO need to revisit this if we start supporting multiple versions of the APIs.
+	prefix := "/" + rules.versionPrefix
+	if req.URL.Path == prefix || strings.HasPrefix(req.URL.Path, prefix+"/") {
+		unversioned := *req
+		unversioned.URL = &url.URL{Path: strings.TrimPrefix(req.URL.Path, prefix)}
+		if unversioned.URL.Path == "" {
+			unversioned.URL.Path = "/"
+		}
+		req = &unversioned
+	}
+	return matches(rules.skipIdentity, req)
+}
+
+// SetQueryRedaction sets the rules used to redact the query strings of audit events
+func (rules *AuditRules) SetQueryRedaction(redaction *QueryRedaction) {
+	rules.redaction = redaction
+}
@@ -0,0 +1,96 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/ONSdigital/dp-api-router/middleware"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNewAuditRules(t *testing.T) {
+	Convey("Valid rules, including empty ones, are accepted", t, func() {
+		rules, err := middleware.NewAuditRules("v1",
+			[]string{"/ping", "GET /health", " ", "/files/{id}/"},
+			[]string{"POST /tokens", "/password-reset/", ""})
+		So(err, ShouldBeNil)
+		So(rules, ShouldNotBeNil)
+	})
+
+	tests := []struct {
+		name         string
+		ignore       []string
+		skipIdentity []string
+	}{
+		{"an ignore rule without a path", []string{"GET"}, nil},
+		{"an ignore rule with a duplicate wildcard", []string{"/files/{id}/{id}"}, nil},
+		{"conflicting ignore rules", []string{"/ping", "/ping"}, nil},
+		{"a skip identity rule with an invalid wildcard", nil, []string{"/tokens/{id"}},
+		{"conflicting skip identity rules", nil, []string{"/{a}/tokens", "/users/{b}"}},
+	}
+	for _, tc := range tests {
+		Convey("Invalid rules are rejected: "+tc.name, t, func() {
+			rules, err := middleware.NewAuditRules("v1", tc.ignore, tc.skipIdentity)
+			So(err, ShouldNotBeNil)
+			So(rules, ShouldBeNil)
+		})
+	}
+}
+
+func TestAuditRules(t *testing.T) {
+	rules, err := middleware.NewAuditRules("v1",
+		[]string{"/ping", "/clickEventLog", "/health"},
+		[]string{"POST /tokens", "/tokens/self", "/password-reset/", "/login"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ignoreTests := []struct {
+		method   string
+		path     string
+		expected bool
+	}{
+		{http.MethodGet, "/ping", true},
+		{http.MethodHead, "/ping", true},
+		{http.MethodGet, "/health", true},
+		{http.MethodPost, "/clickEventLog", true},
+		{http.MethodGet, "/healthcheck", false},
+		{http.MethodGet, "/health/detail", false},
+		{http.MethodGet, "/pingdom", false},
+		{http.MethodGet, "/v1/ping", false},
+		{http.MethodGet, "/datasets", false},
+	}
+	for _, tc := range ignoreTests {
+		Convey("ShallIgnore returns "+strconv.FormatBool(tc.expected)+" for "+tc.method+" "+tc.path, t, func() {
+			So(rules.ShallIgnore(httptest.NewRequest(tc.method, tc.path, http.NoBody)), ShouldEqual, tc.expected)
+		})
+	}
+
+	skipIdentityTests := []struct {
+		method   string
+		path     string
+		expected bool
+	}{
+		{http.MethodPost, "/tokens", true},
+		{http.MethodPost, "/v1/tokens", true},
+		{http.MethodGet, "/tokens", false},
+		{http.MethodPut, "/tokens/self", true},
+		{http.MethodDelete, "/v1/tokens/self", true},
+		{http.MethodGet, "/tokens/other", false},
+		{http.MethodPost, "/password-reset", true},
+		{http.MethodPost, "/v1/password-reset/abc", true},
+		{http.MethodPost, "/login", true},
+		{http.MethodPost, "/loginx", false},
+		{http.MethodGet, "/v1/login/other", false},
+		{http.MethodGet, "/v1login", false},
+		{http.MethodGet, "/hierarchies/abc", false},
+		{http.MethodGet, "/v1", false},
+	}
+	for _, tc := range skipIdentityTests {
+		Convey("ShallSkipIdentity returns "+strconv.FormatBool(tc.expected)+" for "+tc.method+" "+tc.path, t, func() {
+			So(rules.ShallSkipIdentity(httptest.NewRequest(tc.method, tc.path, http.NoBody)), ShouldEqual, tc.expected)
+		})
+	}
+}
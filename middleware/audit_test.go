@@ -5,7 +5,6 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -13,8 +12,6 @@ import (
 	"testing"
 	"time"
 
-	"github.com/ONSdigital/dp-authorisation/v2/authorisation"
-
 	"github.com/ONSdigital/dp-api-router/middleware/mock"
 	"github.com/gorilla/mux"
 
@@ -48,6 +45,19 @@ var (
 	errMarshal                   = errors.New("avro marshal error")
 )
 
+// default audit rules for testing
+var testAuditRules = newTestAuditRules(testVersionPrefix,
+	[]string{"/ping", "/clickEventLog", "/health"},
+	[]string{"/login", "/password", "/tokens/", "/password-reset/", "/users/self/password"})
+
+func newTestAuditRules(versionPrefix string, ignore, skipIdentity []string) *middleware.AuditRules {
+	rules, err := middleware.NewAuditRules(versionPrefix, ignore, skipIdentity)
+	if err != nil {
+		panic(err)
+	}
+	return rules
+}
+
 // valid identity response for testing
 var testIdentityResponse = &dprequest.IdentityResponse{
 	Identifier: testIdentity,
@@ -68,8 +78,7 @@ func createValidAuditHandler() (kafka.IProducer, func(h http.Handler) http.Handl
 	p := kafkatest.NewMessageProducer(true)
 	auditProducer := event.NewAvroProducer(p.Channels().Output, schema.AuditEvent)
 	enableZebedeeAudit := true
-	auth := authorisation.Config{}
-	return p, middleware.AuditHandler(auditProducer, cliMock, testZebedeeURL, testVersionPrefix, enableZebedeeAudit, nil, auth)
+	return p, middleware.AuditHandler(auditProducer, cliMock, testZebedeeURL, testAuditRules, nil, enableZebedeeAudit, nil, nil)
 }
 
 // utility function to create a producer and an audit handler that fails to marshal and send events
@@ -83,8 +92,7 @@ func createFailingAuditHandler() (kafka.IProducer, func(h http.Handler) http.Han
 	p := kafkatest.NewMessageProducer(true)
 	auditProducer := event.NewAvroProducer(p.Channels().Output, failingMarshaller)
 	enableZebedeeAudit := true
-	auth := authorisation.Config{}
-	return p, middleware.AuditHandler(auditProducer, cliMock, testZebedeeURL, testVersionPrefix, enableZebedeeAudit, nil, auth)
+	return p, middleware.AuditHandler(auditProducer, cliMock, testZebedeeURL, testAuditRules, nil, enableZebedeeAudit, nil, nil)
 }
 
 // utility function to generate Clienter mocks
@@ -482,17 +490,16 @@ func TestAuditHandler(t *testing.T) {
 			p := kafkatest.NewMessageProducer(true)
 			a := event.NewAvroProducer(p.Channels().Output, failingMarshaller)
 			enableZebedeeAudit := true
-			auth := authorisation.Config{}
-			auditHandler := middleware.AuditHandler(a, cliMock, testZebedeeURL, testVersionPrefix, enableZebedeeAudit, nil, auth)(testHandler(http.StatusForbidden, testBody, c))
+			auditHandler := middleware.AuditHandler(a, cliMock, testZebedeeURL, testAuditRules, nil, enableZebedeeAudit, nil, nil)(testHandler(http.StatusForbidden, testBody, c))
 
 			// execute request and expect only 1 audit event
 			auditEvents := serveAndCaptureAudit(c, w, req, auditHandler, p.Channels().Output, 1)
 
-			Convey("Then status 500 and empty body is returned", func(c C) {
-				c.So(w.Code, ShouldEqual, http.StatusInternalServerError)
+			Convey("Then the downstream status Forbidden and body have already been streamed to the client", func(c C) {
+				c.So(w.Code, ShouldEqual, http.StatusForbidden)
 				b, err := io.ReadAll(w.Body)
 				So(err, ShouldBeNil)
-				c.So(b, ShouldResemble, []byte{})
+				c.So(b, ShouldResemble, testBody)
 			})
 
 			Convey("The expected audit event is sent before proxying the call", func(c C) {
@@ -540,16 +547,15 @@ func TestAuditHandlerJWTFlorenceToken(t *testing.T) {
 			p := kafkatest.NewMessageProducer(true)
 			a := event.NewAvroProducer(p.Channels().Output, failingMarshaller)
 			enableZebedeeAudit := true
-			auth := authorisation.Config{}
-			auditHandler := middleware.AuditHandler(a, cliMock, testZebedeeURL, testVersionPrefix, enableZebedeeAudit, nil, auth)(testHandler(http.StatusForbidden, testBody, c))
+			auditHandler := middleware.AuditHandler(a, cliMock, testZebedeeURL, testAuditRules, nil, enableZebedeeAudit, nil, nil)(testHandler(http.StatusForbidden, testBody, c))
 
 			// execute request and expect only 1 audit event
 			auditEvents := serveAndCaptureAudit(c, w, req, auditHandler, p.Channels().Output, 1)
-			Convey("Then status 500 and empty body is returned", func(c C) {
-				c.So(w.Code, ShouldEqual, http.StatusInternalServerError)
+			Convey("Then the downstream status Forbidden and body have already been streamed to the client", func(c C) {
+				c.So(w.Code, ShouldEqual, http.StatusForbidden)
 				b, err := io.ReadAll(w.Body)
 				So(err, ShouldBeNil)
-				c.So(b, ShouldResemble, []byte{})
+				c.So(b, ShouldResemble, testBody)
 			})
 
 			Convey("The expected audit event is sent before proxying the call", func(c C) {
@@ -559,6 +565,203 @@ func TestAuditHandlerJWTFlorenceToken(t *testing.T) {
 	})
 }
 
+func TestAuditHandlerStreaming(t *testing.T) {
+	Convey("Given deterministic inbound and outbound timestamps, and an incoming request with a valid Florence Token", t, func(c C) {
+		isInbound := true
+		middleware.Now = func() time.Time {
+			if isInbound {
+				isInbound = false
+				return testTimeInbound
+			}
+			return testTimeOutbound
+		}
+
+		req, err := http.NewRequest(http.MethodGet, "/v1/datasets", http.NoBody)
+		So(err, ShouldBeNil)
+		req.Header.Set(dprequest.FlorenceHeaderKey, testFlorenceToken)
+		w := httptest.NewRecorder()
+
+		Convey("And a valid audit handler with a downstream that checks the body is streamed to the client as it is written", func(c C) {
+			p, a := createValidAuditHandler()
+			auditHandler := a(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(http.StatusCreated)
+				_, err := rw.Write(testBody)
+				c.So(err, ShouldBeNil)
+				c.So(w.Code, ShouldEqual, http.StatusCreated)
+				c.So(w.Body.Bytes(), ShouldResemble, testBody)
+
+				flusher, ok := rw.(http.Flusher)
+				c.So(ok, ShouldBeTrue)
+				flusher.Flush()
+				c.So(w.Flushed, ShouldBeTrue)
+			}))
+
+			auditEvents := serveAndCaptureAudit(c, w, req, auditHandler, p.Channels().Output, 2)
+
+			Convey("Then the outbound audit event is sent with the downstream status code once the response completes", func(c C) {
+				c.So(auditEvents[1].StatusCode, ShouldEqual, int32(http.StatusCreated))
+				c.So(auditEvents[1].CreatedAt, ShouldEqual, testTimeMillisOutbound)
+			})
+		})
+
+		Convey("And a valid audit handler with a downstream that copies the body using ReadFrom", func(c C) {
+			p, a := createValidAuditHandler()
+			auditHandler := a(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				readerFrom, ok := rw.(io.ReaderFrom)
+				c.So(ok, ShouldBeTrue)
+				n, err := readerFrom.ReadFrom(bytes.NewReader(testBody))
+				c.So(err, ShouldBeNil)
+				c.So(n, ShouldEqual, len(testBody))
+			}))
+
+			auditEvents := serveAndCaptureAudit(c, w, req, auditHandler, p.Channels().Output, 2)
+
+			Convey("Then status OK and the expected body is returned, and audited", func(c C) {
+				c.So(w.Code, ShouldEqual, http.StatusOK)
+				c.So(w.Body.Bytes(), ShouldResemble, testBody)
+				c.So(auditEvents[1].StatusCode, ShouldEqual, int32(http.StatusOK))
+			})
+		})
+
+		Convey("And a valid audit handler with a downstream that tries to hijack a connection that doesn't support it", func(c C) {
+			p, a := createValidAuditHandler()
+			auditHandler := a(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				hijacker, ok := rw.(http.Hijacker)
+				c.So(ok, ShouldBeTrue)
+				_, _, err := hijacker.Hijack()
+				c.So(err, ShouldEqual, http.ErrNotSupported)
+			}))
+
+			serveAndCaptureAudit(c, w, req, auditHandler, p.Channels().Output, 2)
+		})
+
+		Convey("And a valid audit handler with a downstream that hijacks a real connection to switch protocols", func(c C) {
+			p, a := createValidAuditHandler()
+			server := httptest.NewServer(a(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				conn, buf, err := rw.(http.Hijacker).Hijack()
+				c.So(err, ShouldBeNil)
+				defer conn.Close()
+				_, err = buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n")
+				c.So(err, ShouldBeNil)
+				c.So(buf.Flush(), ShouldBeNil)
+			})))
+			defer server.Close()
+
+			serverReq, err := http.NewRequest(http.MethodGet, server.URL+"/v1/datasets", http.NoBody)
+			So(err, ShouldBeNil)
+			serverReq.Header.Set(dprequest.FlorenceHeaderKey, testFlorenceToken)
+			serverReq.Header.Set("Connection", "Upgrade")
+			serverReq.Header.Set("Upgrade", "test")
+
+			auditEvents := make(chan []event.Audit, 1)
+			go func() {
+				auditEvents <- []event.Audit{captureAuditEvent(c, p.Channels().Output), captureAuditEvent(c, p.Channels().Output)}
+			}()
+
+			resp, err := http.DefaultClient.Do(serverReq)
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+
+			Convey("Then the client receives the switching protocols response, which is audited", func(c C) {
+				So(resp.StatusCode, ShouldEqual, http.StatusSwitchingProtocols)
+				events := <-auditEvents
+				So(events[1].StatusCode, ShouldEqual, int32(http.StatusSwitchingProtocols))
+			})
+		})
+	})
+}
+
+func TestAuditHandlerIdentityCache(t *testing.T) {
+	Convey("Given an audit handler with an identity cache", t, func(c C) {
+		cliMock := createHTTPClientMock(http.StatusOK, testIdentityResponse)
+		p := kafkatest.NewMessageProducer(true)
+		auditProducer := event.NewAvroProducer(p.Channels().Output, schema.AuditEvent)
+		idCache := middleware.NewIdentityCache(time.Minute, time.Second, 10)
+		auditHandler := middleware.AuditHandler(auditProducer, cliMock, testZebedeeURL, testAuditRules, idCache, true, nil, nil)(testHandler(http.StatusOK, testBody, c))
+
+		Convey("When two requests with the same florence token are received", func(c C) {
+			var auditEvents []event.Audit
+			for i := 0; i < 2; i++ {
+				req, err := http.NewRequest(http.MethodGet, "/v1/datasets", http.NoBody)
+				So(err, ShouldBeNil)
+				req.Header.Set(dprequest.FlorenceHeaderKey, testFlorenceToken)
+				auditEvents = append(auditEvents, serveAndCaptureAudit(c, httptest.NewRecorder(), req, auditHandler, p.Channels().Output, 2)...)
+			}
+
+			Convey("Then Zebedee is only called once, and both requests are audited with the identity", func() {
+				So(cliMock.DoCalls(), ShouldHaveLength, 1)
+				for _, auditEvent := range auditEvents {
+					So(auditEvent.Identity, ShouldEqual, testIdentity)
+				}
+			})
+		})
+	})
+}
+
+func TestAuditHandlerJWTVerifier(t *testing.T) {
+	Convey("Given an audit handler with a JWT verifier", t, func(c C) {
+		key := newTestJWTKey(testJWTKeyID)
+		verifier := middleware.NewJWTVerifier(context.Background(), middleware.StaticKeyFetcher{testJWTKeyID: key.encodedPublicKey()}, 0, 0)
+		cliMock := createHTTPClientMock(http.StatusOK, testIdentityResponse)
+		p := kafkatest.NewMessageProducer(true)
+		auditProducer := event.NewAvroProducer(p.Channels().Output, schema.AuditEvent)
+		auditHandler := middleware.AuditHandler(auditProducer, cliMock, testZebedeeURL, testAuditRules, nil, true, nil, verifier)(testHandler(http.StatusOK, testBody, c))
+
+		Convey("When a request with a valid JWT is received", func(c C) {
+			req, err := http.NewRequest(http.MethodGet, "/v1/datasets", http.NoBody)
+			So(err, ShouldBeNil)
+			req.Header.Set(dprequest.FlorenceHeaderKey, dprequest.BearerPrefix+key.sign(testJWTUser, time.Now().Add(time.Hour)))
+			w := httptest.NewRecorder()
+			auditEvents := serveAndCaptureAudit(c, w, req, auditHandler, p.Channels().Output, 2)
+
+			Convey("Then the request is proxied and audited with the JWT user, without calling Zebedee", func() {
+				So(w.Code, ShouldEqual, http.StatusOK)
+				So(cliMock.DoCalls(), ShouldHaveLength, 0)
+				for _, auditEvent := range auditEvents {
+					So(auditEvent.Identity, ShouldEqual, testJWTUser)
+				}
+			})
+		})
+
+		Convey("When a request with an invalid JWT is received", func(c C) {
+			req, err := http.NewRequest(http.MethodGet, "/v1/datasets", http.NoBody)
+			So(err, ShouldBeNil)
+			req.Header.Set(dprequest.FlorenceHeaderKey, testJWTFlorenceToken)
+			w := httptest.NewRecorder()
+			auditEvents := serveAndCaptureAudit(c, w, req, auditHandler, p.Channels().Output, 1)
+
+			Convey("Then the request is rejected as unauthorised and audited, without calling Zebedee", func() {
+				So(w.Code, ShouldEqual, http.StatusUnauthorized)
+				So(cliMock.DoCalls(), ShouldHaveLength, 0)
+				So(auditEvents[0].StatusCode, ShouldEqual, int32(http.StatusUnauthorized))
+			})
+		})
+	})
+
+	Convey("Given an audit handler with a JWT verifier that has no keys", t, func(c C) {
+		key := newTestJWTKey(testJWTKeyID)
+		verifier := middleware.NewJWTVerifier(context.Background(), middleware.StaticKeyFetcher{}, 0, 0)
+		cliMock := createHTTPClientMock(http.StatusOK, testIdentityResponse)
+		p := kafkatest.NewMessageProducer(true)
+		auditProducer := event.NewAvroProducer(p.Channels().Output, schema.AuditEvent)
+		auditHandler := middleware.AuditHandler(auditProducer, cliMock, testZebedeeURL, testAuditRules, nil, true, nil, verifier)(testHandler(http.StatusOK, testBody, c))
+
+		Convey("When a request with a JWT is received", func(c C) {
+			req, err := http.NewRequest(http.MethodGet, "/v1/datasets", http.NoBody)
+			So(err, ShouldBeNil)
+			req.Header.Set(dprequest.FlorenceHeaderKey, dprequest.BearerPrefix+key.sign(testJWTUser, time.Now().Add(time.Hour)))
+			w := httptest.NewRecorder()
+			auditEvents := serveAndCaptureAudit(c, w, req, auditHandler, p.Channels().Output, 1)
+
+			Convey("Then an internal server error is returned and audited, rather than rejecting the JWT", func() {
+				So(w.Code, ShouldEqual, http.StatusInternalServerError)
+				So(cliMock.DoCalls(), ShouldHaveLength, 0)
+				So(auditEvents[0].StatusCode, ShouldEqual, int32(http.StatusInternalServerError))
+			})
+		})
+	})
+}
+
 func TestAuditIgnoreSkip(t *testing.T) {
 	Convey("Given an incoming request to an ignored path", t, func(c C) {
 		req, err := http.NewRequest(http.MethodGet, "/ping", http.NoBody)
@@ -614,14 +817,13 @@ func TestSkipZebedeeAudit(t *testing.T) {
 		p := kafkatest.NewMessageProducer(true)
 		auditProducer := event.NewAvroProducer(p.Channels().Output, schema.AuditEvent)
 		enableZebedeeAudit := false
-		auth := authorisation.Config{}
 		routerMock := &mock.RouterMock{
 			MatchFunc: func(req *http.Request, match *mux.RouteMatch) bool {
 				match.MatchErr = mux.ErrNotFound
 				return true
 			},
 		}
-		auditMiddleware := middleware.AuditHandler(auditProducer, cliMock, testZebedeeURL, testVersionPrefix, enableZebedeeAudit, routerMock, auth)
+		auditMiddleware := middleware.AuditHandler(auditProducer, cliMock, testZebedeeURL, testAuditRules, nil, enableZebedeeAudit, routerMock, nil)
 		auditHandler := auditMiddleware(testHandler(http.StatusOK, testBody, c))
 
 		Convey("When the handler receives a Zebedee request", func(c C) {
@@ -655,13 +857,12 @@ func TestSkipZebedeeAudit(t *testing.T) {
 		p := kafkatest.NewMessageProducer(true)
 		auditProducer := event.NewAvroProducer(p.Channels().Output, schema.AuditEvent)
 		enableZebedeeAudit := false
-		auth := authorisation.Config{}
 		routerMock := &mock.RouterMock{
 			MatchFunc: func(req *http.Request, match *mux.RouteMatch) bool {
 				return true
 			},
 		}
-		auditMiddleware := middleware.AuditHandler(auditProducer, cliMock, testZebedeeURL, testVersionPrefix, enableZebedeeAudit, routerMock, auth)
+		auditMiddleware := middleware.AuditHandler(auditProducer, cliMock, testZebedeeURL, testAuditRules, nil, enableZebedeeAudit, routerMock, nil)
 		auditHandler := auditMiddleware(testHandler(http.StatusOK, testBody, c))
 
 		Convey("When the handler receives a request for a known route (not zebedee)", func(c C) {
@@ -702,19 +903,111 @@ func TestSkipZebedeeAudit(t *testing.T) {
 	})
 }
 
-func TestShallSkipIdentity(t *testing.T) {
-	skipIdentityPaths := []string{"/password", "/login", "/hierarchies"}
+func TestAuditHandlerSchemaV4(t *testing.T) {
+	Convey("Given an audit handler that emits version 4 audit events for a known route", t, func(c C) {
+		isInbound := true
+		middleware.Now = func() time.Time {
+			if isInbound {
+				isInbound = false
+				return testTimeInbound
+			}
+			return testTimeOutbound
+		}
+
+		cliMock := createHTTPClientMock(http.StatusOK, testIdentityResponse)
+		p := kafkatest.NewMessageProducer(true)
+		auditProducer := event.NewAvroProducer(p.Channels().Output, schema.AuditEventV4)
+		route := mux.NewRouter().Path("/{version}/datasets")
+		routerMock := &mock.RouterMock{
+			MatchFunc: func(req *http.Request, match *mux.RouteMatch) bool {
+				match.Route = route
+				return true
+			},
+		}
+		auditMiddleware := middleware.AuditHandler(auditProducer, cliMock, testZebedeeURL, testAuditRules, nil, false, routerMock, nil)
+		resolver, err := middleware.NewClientIPResolver([]string{"192.0.2.1", "10.0.0.1"})
+		So(err, ShouldBeNil)
+		auditHandler := resolver.Handler(auditMiddleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			middleware.SetUpstream(req.Context(), "http://localhost:22000")
+			testHandler(http.StatusOK, testBody, c).ServeHTTP(w, req)
+		})))
+
+		Convey("When the handler receives a request from a client through a proxy", func(c C) {
+			req := httptest.NewRequest(http.MethodGet, "/v1/datasets?q1=v1", http.NoBody)
+			req.Header.Set(dprequest.FlorenceHeaderKey, testFlorenceToken)
+			req.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+			req.Header.Set("User-Agent", "curl/8.0")
+			w := httptest.NewRecorder()
+
+			// execute request and wait for the version 4 audit events
+			auditEvents := serveAndCaptureAuditV4(c, w, req, auditHandler, p.Channels().Output, 2)
+
+			Convey("Then the inbound audit event contains the client and route fields", func() {
+				So(auditEvents[0], ShouldResemble, event.Audit{
+					CreatedAt:  testTimeMillisInbound,
+					Path:       "/v1/datasets",
+					Method:     http.MethodGet,
+					QueryParam: "q1=v1",
+					Identity:   testIdentity,
+					ClientIP:   "203.0.113.7",
+					UserAgent:  "curl/8.0",
+					Route:      "/{version}/datasets",
+					AuthType:   middleware.AuthTypeSession,
+				})
+			})
 
-	for _, p := range skipIdentityPaths {
-		versionedPath := "/v1" + p
-		Convey(fmt.Sprintf("Should skip identity check for versioned %s requests", versionedPath), t, func() {
-			So(middleware.ShallSkipIdentity("v1", versionedPath), ShouldBeTrue)
+			Convey("Then the outbound audit event also contains the duration, response size and upstream target", func() {
+				So(auditEvents[1], ShouldResemble, event.Audit{
+					CreatedAt:      testTimeMillisOutbound,
+					StatusCode:     int32(http.StatusOK),
+					Path:           "/v1/datasets",
+					Method:         http.MethodGet,
+					QueryParam:     "q1=v1",
+					Identity:       testIdentity,
+					ClientIP:       "203.0.113.7",
+					UserAgent:      "curl/8.0",
+					Route:          "/{version}/datasets",
+					AuthType:       middleware.AuthTypeSession,
+					DurationMillis: testTimeMillisOutbound - testTimeMillisInbound,
+					ResponseBytes:  int64(len(testBody)),
+					Upstream:       "http://localhost:22000",
+				})
+			})
 		})
 
-		Convey(fmt.Sprintf("Should skip identity check for non versioned %s requests", p), t, func() {
-			So(middleware.ShallSkipIdentity("v1", p), ShouldBeTrue)
+		Convey("When the handler receives a request with a spoofed X-Forwarded-For from an untrusted address", func(c C) {
+			req := httptest.NewRequest(http.MethodGet, "/v1/datasets", http.NoBody)
+			req.RemoteAddr = "198.51.100.9:5678"
+			req.Header.Set(dprequest.FlorenceHeaderKey, testFlorenceToken)
+			req.Header.Set("X-Forwarded-For", "203.0.113.7")
+			w := httptest.NewRecorder()
+
+			// execute request and wait for the version 4 audit events
+			auditEvents := serveAndCaptureAuditV4(c, w, req, auditHandler, p.Channels().Output, 2)
+
+			Convey("Then the audit events contain the address the request was received from", func() {
+				for _, auditEvent := range auditEvents {
+					So(auditEvent.ClientIP, ShouldEqual, "198.51.100.9")
+				}
+			})
 		})
-	}
+
+		Convey("When the handler receives a request directly from a client with a JWT", func(c C) {
+			req := httptest.NewRequest(http.MethodGet, "/v1/datasets", http.NoBody)
+			req.Header.Set(dprequest.FlorenceHeaderKey, testJWTFlorenceToken)
+			w := httptest.NewRecorder()
+
+			// execute request and wait for the version 4 audit events
+			auditEvents := serveAndCaptureAuditV4(c, w, req, auditHandler, p.Channels().Output, 2)
+
+			Convey("Then the audit events contain the remote address and the JWT auth type", func() {
+				for _, auditEvent := range auditEvents {
+					So(auditEvent.ClientIP, ShouldEqual, "192.0.2.1")
+					So(auditEvent.AuthType, ShouldEqual, middleware.AuthTypeJWT)
+				}
+			})
+		})
+	})
 }
 
 // aux function for testing that serves HTTP, wrapping the provided handler with AuditHandler,
@@ -738,11 +1031,52 @@ func serveAndCaptureAudit(c C, w http.ResponseWriter, req *http.Request, auditHa
 	return auditEvents
 }
 
-// captureAuditEvent reads the provided channel and unmarshals the bytes to an auditEvent
+// aux function for testing that serves HTTP with the provided audit handler, which is expected to emit
+// version 4 audit events, and waits for the number of expected audit events, which are then returned in an array
+func serveAndCaptureAuditV4(c C, w http.ResponseWriter, req *http.Request, auditHandler http.Handler, outChan chan []byte, numExpectedMessages int) (auditEvents []event.Audit) {
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		auditHandler.ServeHTTP(w, req)
+	}()
+
+	auditEvents = make([]event.Audit, numExpectedMessages)
+	for i := range auditEvents {
+		err := schema.AuditEventV4.Unmarshal(<-outChan, &auditEvents[i])
+		c.So(err, ShouldBeNil)
+	}
+
+	wg.Wait()
+	return auditEvents
+}
+
+// auditV1 is the audit event struct used by consumers of the version 1 schema
+type auditV1 struct {
+	CreatedAt    int64  `avro:"created_at"`
+	RequestID    string `avro:"request_id"`
+	Identity     string `avro:"identity"`
+	CollectionID string `avro:"collection_id"`
+	Path         string `avro:"path"`
+	Method       string `avro:"method"`
+	StatusCode   int32  `avro:"status_code"`
+	QueryParam   string `avro:"query_param"`
+}
+
+// captureAuditEvent reads the provided channel and unmarshals the bytes to an auditEvent, using the version 1 schema
 func captureAuditEvent(c C, outChan chan []byte) event.Audit {
 	messageBytes := <-outChan
-	auditEvent := event.Audit{}
+	auditEvent := auditV1{}
 	err := schema.AuditEvent.Unmarshal(messageBytes, &auditEvent)
 	c.So(err, ShouldBeNil)
-	return auditEvent
+	return event.Audit{
+		CreatedAt:    auditEvent.CreatedAt,
+		RequestID:    auditEvent.RequestID,
+		Identity:     auditEvent.Identity,
+		CollectionID: auditEvent.CollectionID,
+		Path:         auditEvent.Path,
+		Method:       auditEvent.Method,
+		StatusCode:   auditEvent.StatusCode,
+		QueryParam:   auditEvent.QueryParam,
+	}
 }
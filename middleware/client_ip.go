@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const clientIPKey = contextKey("client-ip")
+
+// ClientIPResolver resolves the IP address of the client that made a request, following X-Forwarded-For only for as
+// long as the request was received from a trusted proxy, so that clients can't choose their own address by sending
+// their own X-Forwarded-For header
+type ClientIPResolver struct {
+	trustedProxies []netip.Prefix
+}
+
+// resolvedClientIP is the client IP address stored in the request context by the resolver, along with whether the
+// request was received from a trusted proxy
+type resolvedClientIP struct {
+	addr             netip.Addr
+	ok               bool
+	fromTrustedProxy bool
+}
+
+// NewClientIPResolver creates a resolver that trusts the X-Forwarded-For header added by the proxies in the CIDRs,
+// where a single IP address is treated as a CIDR of just that address
+func NewClientIPResolver(trustedProxies []string) (*ClientIPResolver, error) {
+	prefixes, err := parsePrefixes(trustedProxies)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid trusted proxies")
+	}
+	return &ClientIPResolver{trustedProxies: prefixes}, nil
+}
+
+// Handler is a middleware handler that resolves the client IP address of the request once and stores it in the
+// request context, so that every later handler (audit, IP filter, rate limits and concurrency limits) agrees on it
+func (r *ClientIPResolver) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		addr, ok := r.Resolve(req)
+		peer, peerOK := remoteAddr(req)
+		fromTrustedProxy := peerOK && containsAddr(r.trustedProxies, peer)
+		ctx := context.WithValue(req.Context(), clientIPKey, resolvedClientIP{addr: addr, ok: ok, fromTrustedProxy: fromTrustedProxy})
+		h.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// Resolve returns the IP address of the client that made the request. Starting from the address that the request was
+// received from, the addresses in X-Forwarded-For are followed from right to left for as long as the request was
+// received from a trusted proxy. It returns false if the address can't be determined.
+func (r *ClientIPResolver) Resolve(req *http.Request) (netip.Addr, bool) {
+	addr, ok := remoteAddr(req)
+	if !ok || r == nil {
+		return addr, ok
+	}
+
+	hops := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0 && containsAddr(r.trustedProxies, addr); i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		var err error
+		if addr, err = netip.ParseAddr(hop); err != nil {
+			return netip.Addr{}, false
+		}
+		addr = addr.Unmap()
+	}
+	return addr, true
+}
+
+// remoteAddr returns the IP address that the request was received from, or false if it can't be parsed
+func remoteAddr(req *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// ClientIP returns the client IP address of the request, as resolved by the ClientIPResolver handler. If the request
+// hasn't been through the handler, the address that the request was received from is used, without trusting any
+// proxies. It returns false if the address can't be determined.
+func ClientIP(req *http.Request) (netip.Addr, bool) {
+	if resolved, ok := req.Context().Value(clientIPKey).(resolvedClientIP); ok {
+		return resolved.addr, resolved.ok
+	}
+	var resolver *ClientIPResolver
+	return resolver.Resolve(req)
+}
+
+// FromTrustedProxy returns true if the request was received from one of the trusted proxies, as determined by the
+// ClientIPResolver handler, so that the other X-Forwarded headers added by the proxy can be trusted too. A request that
+// hasn't been through the handler is never from a trusted proxy.
+func FromTrustedProxy(req *http.Request) bool {
+	resolved, ok := req.Context().Value(clientIPKey).(resolvedClientIP)
+	return ok && resolved.fromTrustedProxy
+}
+
+// clientIPString returns the client IP address of the request as a string, or an empty string if it can't be determined
+func clientIPString(req *http.Request) string {
+	if addr, ok := ClientIP(req); ok {
+		return addr.String()
+	}
+	return ""
+}
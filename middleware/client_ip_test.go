@@ -0,0 +1,95 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ONSdigital/dp-api-router/middleware"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNewClientIPResolver(t *testing.T) {
+	Convey("Valid trusted proxies are accepted", t, func() {
+		resolver, err := middleware.NewClientIPResolver([]string{"10.0.0.1", "10.1.0.0/16", "2001:db8::/32"})
+		So(err, ShouldBeNil)
+		So(resolver, ShouldNotBeNil)
+	})
+
+	Convey("Invalid trusted proxies are rejected", t, func() {
+		_, err := middleware.NewClientIPResolver([]string{"10.0.0.0/33"})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestClientIP(t *testing.T) {
+	resolver, err := middleware.NewClientIPResolver([]string{"10.0.0.1", "10.1.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		remoteAddr    string
+		forwardedFor  []string
+		expected      string
+		expectedValid bool
+	}{
+		{"a direct request uses the remote address", "1.2.3.4:5678", nil, "1.2.3.4", true},
+		{"a direct request ignores a spoofed X-Forwarded-For", "1.2.3.4:5678", []string{"10.0.0.2"}, "1.2.3.4", true},
+		{"a request through a trusted proxy uses the address it forwarded", "10.0.0.1:5678", []string{"10.0.0.2, 1.2.3.4"}, "1.2.3.4", true},
+		{"a request through several trusted proxies uses the first untrusted address", "10.0.0.1:5678", []string{"10.0.0.2, 1.2.3.4", "10.1.2.3"}, "1.2.3.4", true},
+		{"a request through an untrusted proxy uses the proxy", "10.0.0.1:5678", []string{"1.2.3.4, 5.6.7.8"}, "5.6.7.8", true},
+		{"a request from a trusted proxy without X-Forwarded-For uses the proxy", "10.0.0.1:5678", nil, "10.0.0.1", true},
+		{"IPv4 mapped IPv6 addresses are unmapped", "[::ffff:1.2.3.4]:5678", nil, "1.2.3.4", true},
+		{"an invalid forwarded address is rejected", "10.0.0.1:5678", []string{"unknown"}, "invalid IP", false},
+		{"an invalid remote address is rejected", "pipe", nil, "invalid IP", false},
+	}
+	for _, tc := range tests {
+		Convey("Given "+tc.name, t, func() {
+			req := httptest.NewRequest(http.MethodGet, "/v1/datasets", http.NoBody)
+			req.RemoteAddr = tc.remoteAddr
+			for _, forwardedFor := range tc.forwardedFor {
+				req.Header.Add("X-Forwarded-For", forwardedFor)
+			}
+
+			Convey("Then the resolver handler stores the client IP address for later handlers", func() {
+				var clientIP string
+				var ok bool
+				resolver.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+					addr, valid := middleware.ClientIP(req)
+					clientIP, ok = addr.String(), valid
+				})).ServeHTTP(httptest.NewRecorder(), req)
+				So(ok, ShouldEqual, tc.expectedValid)
+				So(clientIP, ShouldEqual, tc.expected)
+			})
+		})
+	}
+
+	Convey("Given a request that hasn't been through the resolver handler, then X-Forwarded-For is not trusted", t, func() {
+		req := httptest.NewRequest(http.MethodGet, "/v1/datasets", http.NoBody)
+		req.RemoteAddr = "10.0.0.1:5678"
+		req.Header.Set("X-Forwarded-For", "1.2.3.4")
+		clientIP, ok := middleware.ClientIP(req)
+		So(ok, ShouldBeTrue)
+		So(clientIP.String(), ShouldEqual, "10.0.0.1")
+		So(middleware.FromTrustedProxy(req), ShouldBeFalse)
+	})
+
+	Convey("Given requests received from a trusted proxy and from another client", t, func() {
+		fromTrustedProxy := map[string]bool{}
+		handler := resolver.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			fromTrustedProxy[req.RemoteAddr] = middleware.FromTrustedProxy(req)
+		}))
+		for _, remoteAddr := range []string{"10.1.2.3:5678", "1.2.3.4:5678"} {
+			req := httptest.NewRequest(http.MethodGet, "/v1/datasets", http.NoBody)
+			req.RemoteAddr = remoteAddr
+			req.Header.Set("X-Forwarded-For", "10.0.0.1")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		Convey("Then only the request from the trusted proxy is from a trusted proxy", func() {
+			So(fromTrustedProxy, ShouldResemble, map[string]bool{"10.1.2.3:5678": true, "1.2.3.4:5678": false})
+		})
+	})
+}
@@ -0,0 +1,242 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/ONSdigital/dp-api-router/metrics"
+	dprequest "github.com/ONSdigital/dp-net/v3/request"
+	"github.com/ONSdigital/log.go/v2/log"
+	pkgerrors "github.com/pkg/errors"
+)
+
+// Possible limits that requests are rejected by, as counted by the concurrency_limited_requests_total metric
+const (
+	ConcurrencyLimitIP       = "ip"
+	ConcurrencyLimitIdentity = "identity"
+)
+
+// concurrencyAnyService exempts every service identity from the limits
+const concurrencyAnyService = "*"
+
+var concurrencyLimitedRequests = metrics.NewCounterVec("concurrency_limited_requests_total",
+	"Requests that were rejected because the client had too many requests in flight", "limit")
+
+type concurrencyLimitConfig struct {
+	Routes         []string `json:"routes"`
+	PerIP          int      `json:"per_ip"`
+	PerIdentity    int      `json:"per_identity"`
+	Status         int      `json:"status"`
+	ExemptServices []string `json:"exempt_services"`
+}
+
+// ConcurrencyLimiter limits the number of requests that each client IP address and identity can have in flight at once,
+// so that a few clients making many slow requests in parallel can't starve everyone else
+type ConcurrencyLimiter struct {
+	routes      *http.ServeMux
+	perIP       int
+	perIdentity int
+	status      int
+	exempt      map[string]bool
+
+	mu       sync.Mutex
+	total    int
+	inFlight map[string]int
+}
+
+// ConcurrencyUsage is the number of requests that a client has in flight, as returned by the admin endpoint
+type ConcurrencyUsage struct {
+	Client   string `json:"client"`
+	InFlight int    `json:"in_flight"`
+}
+
+type concurrencyUsageResponse struct {
+	InFlight int                `json:"in_flight"`
+	Clients  []ConcurrencyUsage `json:"clients"`
+}
+
+// LoadConcurrencyLimiter loads and validates the concurrency limits. It takes in a function that returns the loaded
+// bytes (eg. a function that loads content from disk), which contain a JSON object of the limits. Nil is returned if
+// the config is empty.
+func LoadConcurrencyLimiter(loader func() ([]byte, error)) (*ConcurrencyLimiter, error) {
+	configJSON, err := loader()
+	if err != nil {
+		return nil, pkgerrors.Wrap(err, "unable to load concurrency limit config")
+	}
+	if len(configJSON) == 0 {
+		return nil, nil
+	}
+
+	var config concurrencyLimitConfig
+	if err := json.Unmarshal(configJSON, &config); err != nil {
+		return nil, pkgerrors.Wrap(err, "invalid json in concurrency limit config")
+	}
+
+	if config.PerIP < 0 || config.PerIdentity < 0 || config.PerIP+config.PerIdentity == 0 {
+		return nil, errors.New("concurrency limits require a positive per_ip or per_identity limit")
+	}
+	switch config.Status {
+	case 0:
+		config.Status = http.StatusTooManyRequests
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+	default:
+		return nil, fmt.Errorf("invalid status %d in concurrency limit config, expected %d or %d", config.Status, http.StatusTooManyRequests, http.StatusServiceUnavailable)
+	}
+
+	limiter := NewConcurrencyLimiter(config.PerIP, config.PerIdentity, config.Status, config.ExemptServices)
+	if len(config.Routes) > 0 {
+		if limiter.routes, err = newRuleMux(config.Routes); err != nil {
+			return nil, pkgerrors.Wrap(err, "invalid routes in concurrency limit config")
+		}
+	}
+	return limiter, nil
+}
+
+// NewConcurrencyLimiter creates a ConcurrencyLimiter that applies to every request, which allows each client IP address and
+// identity to have perIP and perIdentity requests in flight (0 for no limit), rejecting any more with the status.
+// Requests from the exempt service identities, or any service identity if it contains "*", are not limited.
+func NewConcurrencyLimiter(perIP, perIdentity, status int, exemptServices []string) *ConcurrencyLimiter {
+	limiter := &ConcurrencyLimiter{
+		perIP:       perIP,
+		perIdentity: perIdentity,
+		status:      status,
+		exempt:      make(map[string]bool, len(exemptServices)),
+		inFlight:    map[string]int{},
+	}
+	for _, service := range exemptServices {
+		limiter.exempt[service] = true
+	}
+
+	metrics.NewGaugeFunc("concurrency_limited_requests_in_flight", "Requests in flight that are subject to the concurrency limits", func() float64 {
+		return float64(limiter.InFlight())
+	})
+
+	return limiter
+}
+
+// Handler is a middleware handler that counts the requests in flight for the client IP address and identity of the
+// request, rejecting the request if either of them is at its limit. The identity of the caller is only known if the
+// request has been audited, so requests without one are only limited by their client IP address, if it is known.
+func (l *ConcurrencyLimiter) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if (l.routes != nil && !matches(l.routes, req)) || l.isExempt(req) {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		keys := l.keys(req)
+		if limit, ok := l.acquire(keys); !ok {
+			concurrencyLimitedRequests.Inc(limit)
+			log.Info(req.Context(), "request rejected by concurrency limit", log.Data{"limit": limit, "path": req.URL.Path})
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(l.status)
+			return
+		}
+		defer l.release(keys)
+
+		h.ServeHTTP(w, req)
+	})
+}
+
+// isExempt returns true if the request was made by an exempt service identity
+func (l *ConcurrencyLimiter) isExempt(req *http.Request) bool {
+	ctx := req.Context()
+	if dprequest.User(ctx) != "" {
+		return false
+	}
+	caller := dprequest.Caller(ctx)
+	return caller != "" && (l.exempt[caller] || l.exempt[concurrencyAnyService])
+}
+
+// keys returns the keys of the limits that apply to the request, in the order of its limits. The client IP address
+// limit doesn't apply if the address can't be determined, rather than every such client sharing one limit.
+func (l *ConcurrencyLimiter) keys(req *http.Request) (keys [2]string) {
+	if clientIP := clientIPString(req); l.perIP > 0 && clientIP != "" {
+		keys[0] = "ip:" + clientIP
+	}
+	if l.perIdentity > 0 {
+		if user := dprequest.User(req.Context()); user != "" {
+			keys[1] = "user:" + user
+		} else if caller := dprequest.Caller(req.Context()); caller != "" {
+			keys[1] = "service:" + caller
+		}
+	}
+	return keys
+}
+
+// acquire adds a request in flight for the keys if neither of them is at its limit, otherwise returning the limit that
+// was reached
+func (l *ConcurrencyLimiter) acquire(keys [2]string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if keys[0] != "" && l.inFlight[keys[0]] >= l.perIP {
+		return ConcurrencyLimitIP, false
+	}
+	if keys[1] != "" && l.inFlight[keys[1]] >= l.perIdentity {
+		return ConcurrencyLimitIdentity, false
+	}
+	for _, key := range keys {
+		if key != "" {
+			l.inFlight[key]++
+		}
+	}
+	l.total++
+	return "", true
+}
+
+// release removes a request in flight for the keys, removing the keys that have none left
+func (l *ConcurrencyLimiter) release(keys [2]string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total--
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if l.inFlight[key]--; l.inFlight[key] <= 0 {
+			delete(l.inFlight, key)
+		}
+	}
+}
+
+// InFlight returns the number of limited requests in flight
+func (l *ConcurrencyLimiter) InFlight() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.total
+}
+
+// Usage returns the number of limited requests in flight, and the clients that have requests in flight ordered by the
+// most requests first. Requests are counted for both their client IP address and identity, if they are limited by both.
+func (l *ConcurrencyLimiter) Usage() (int, []ConcurrencyUsage) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	clients := make([]ConcurrencyUsage, 0, len(l.inFlight))
+	for key, inFlight := range l.inFlight {
+		clients = append(clients, ConcurrencyUsage{Client: key, InFlight: inFlight})
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		if clients[i].InFlight != clients[j].InFlight {
+			return clients[i].InFlight > clients[j].InFlight
+		}
+		return clients[i].Client < clients[j].Client
+	})
+	return l.total, clients
+}
+
+// UsageHandler handles requests for the current number of requests in flight, responding with the total and the
+// number for each client IP address and identity that has requests in flight
+func (l *ConcurrencyLimiter) UsageHandler(w http.ResponseWriter, req *http.Request) {
+	total, clients := l.Usage()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(concurrencyUsageResponse{InFlight: total, Clients: clients}); err != nil {
+		log.Error(req.Context(), "failed to write concurrency usage response", err)
+	}
+}
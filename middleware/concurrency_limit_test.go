@@ -0,0 +1,179 @@
+package middleware_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ONSdigital/dp-api-router/middleware"
+	dprequest "github.com/ONSdigital/dp-net/v3/request"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// loadConcurrencyLimiter loads concurrency limits from the provided JSON
+func loadConcurrencyLimiter(config string) (*middleware.ConcurrencyLimiter, error) {
+	return middleware.LoadConcurrencyLimiter(func() ([]byte, error) {
+		return []byte(config), nil
+	})
+}
+
+func TestLoadConcurrencyLimiter(t *testing.T) {
+	Convey("Valid and empty configs are loaded", t, func() {
+		limiter, err := loadConcurrencyLimiter(`{"routes": ["GET /v1/datasets/"], "per_ip": 2, "status": 503, "exempt_services": ["*"]}`)
+		So(err, ShouldBeNil)
+		So(limiter, ShouldNotBeNil)
+
+		limiter, err = loadConcurrencyLimiter("")
+		So(err, ShouldBeNil)
+		So(limiter, ShouldBeNil)
+	})
+
+	Convey("An error loading the config is returned", t, func() {
+		_, err := middleware.LoadConcurrencyLimiter(func() ([]byte, error) {
+			return nil, errors.New("file not found")
+		})
+		So(err, ShouldNotBeNil)
+	})
+
+	tests := map[string]string{
+		"invalid json":   `{"per_ip":`,
+		"no limits":      `{"status": 429}`,
+		"negative limit": `{"per_ip": -1, "per_identity": 2}`,
+		"invalid status": `{"per_ip": 2, "status": 500}`,
+		"invalid route":  `{"routes": ["/v1/{id"], "per_ip": 2}`,
+	}
+	for name, config := range tests {
+		Convey("A config with "+name+" is rejected", t, func() {
+			limiter, err := loadConcurrencyLimiter(config)
+			So(err, ShouldNotBeNil)
+			So(limiter, ShouldBeNil)
+		})
+	}
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	Convey("Given a concurrency limiter of 1 request per client IP and 2 per identity, and a slow upstream", t, func() {
+		limiter := middleware.NewConcurrencyLimiter(1, 2, http.StatusServiceUnavailable, []string{"dp-exempt-service"})
+		started := make(chan struct{})
+		finish := make(chan struct{})
+		handler := limiter.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			started <- struct{}{}
+			<-finish
+		}))
+
+		newRequest := func(ip string, identity context.Context) *http.Request {
+			req := httptest.NewRequest(http.MethodGet, "/v1/datasets", http.NoBody)
+			req.RemoteAddr = ip + ":1234"
+			if identity != nil {
+				req = req.WithContext(identity)
+			}
+			return req
+		}
+		serve := func(req *http.Request) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			return w
+		}
+		serveInBackground := func(req *http.Request) chan *httptest.ResponseRecorder {
+			done := make(chan *httptest.ResponseRecorder, 1)
+			go func() {
+				done <- serve(req)
+			}()
+			<-started
+			return done
+		}
+		user := context.WithValue(context.Background(), dprequest.UserIdentityKey, "user@ons.gov.uk")
+
+		Convey("When a client IP address has a request in flight", func() {
+			done := serveInBackground(newRequest("203.0.113.1", nil))
+			finished := false
+			finishFirst := func() *httptest.ResponseRecorder {
+				finished = true
+				finish <- struct{}{}
+				return <-done
+			}
+
+			Convey("Then another request from it is rejected with the configured status", func() {
+				w := serve(newRequest("203.0.113.1", nil))
+				So(w.Code, ShouldEqual, http.StatusServiceUnavailable)
+				So(w.Header().Get("Retry-After"), ShouldEqual, "1")
+			})
+
+			Convey("Then another request from it with a spoofed X-Forwarded-For is also rejected", func() {
+				req := newRequest("203.0.113.1", nil)
+				req.Header.Set("X-Forwarded-For", "198.51.100.9")
+				So(serve(req).Code, ShouldEqual, http.StatusServiceUnavailable)
+			})
+
+			Convey("Then the current counts are returned by the usage handler", func() {
+				w := httptest.NewRecorder()
+				limiter.UsageHandler(w, httptest.NewRequest(http.MethodGet, "/admin/concurrency", http.NoBody))
+				So(w.Code, ShouldEqual, http.StatusOK)
+
+				var usage map[string]interface{}
+				So(json.Unmarshal(w.Body.Bytes(), &usage), ShouldBeNil)
+				So(usage, ShouldResemble, map[string]interface{}{
+					"in_flight": 1.0,
+					"clients":   []interface{}{map[string]interface{}{"client": "ip:203.0.113.1", "in_flight": 1.0}},
+				})
+			})
+
+			Convey("Then another request from it is allowed once the first has finished", func() {
+				So(finishFirst().Code, ShouldEqual, http.StatusOK)
+				So(limiter.InFlight(), ShouldEqual, 0)
+
+				next := serveInBackground(newRequest("203.0.113.1", nil))
+				finish <- struct{}{}
+				So((<-next).Code, ShouldEqual, http.StatusOK)
+			})
+
+			if !finished {
+				finishFirst()
+			}
+		})
+
+		Convey("When an identity has 2 requests in flight from different IP addresses", func() {
+			first := serveInBackground(newRequest("203.0.113.1", user))
+			second := serveInBackground(newRequest("203.0.113.2", user))
+
+			Convey("Then another request for the identity from a third IP address is rejected", func() {
+				w := serve(newRequest("203.0.113.3", user))
+				So(w.Code, ShouldEqual, http.StatusServiceUnavailable)
+				So(limiter.InFlight(), ShouldEqual, 2)
+			})
+
+			finish <- struct{}{}
+			finish <- struct{}{}
+			<-first
+			<-second
+		})
+
+		Convey("When requests whose client IP address can't be determined are in flight, then they aren't limited by IP", func() {
+			first := serveInBackground(newRequest("unknown", nil))
+			second := serveInBackground(newRequest("unknown", nil))
+			So(limiter.InFlight(), ShouldEqual, 2)
+			_, clients := limiter.Usage()
+			So(clients, ShouldBeEmpty)
+
+			finish <- struct{}{}
+			finish <- struct{}{}
+			So((<-first).Code, ShouldEqual, http.StatusOK)
+			So((<-second).Code, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("When an exempt service has a request in flight, then another request from it is allowed", func() {
+			service := context.WithValue(context.Background(), dprequest.CallerIdentityKey, "dp-exempt-service")
+			first := serveInBackground(newRequest("203.0.113.1", service))
+			second := serveInBackground(newRequest("203.0.113.1", service))
+			So(limiter.InFlight(), ShouldEqual, 0)
+
+			finish <- struct{}{}
+			finish <- struct{}{}
+			So((<-first).Code, ShouldEqual, http.StatusOK)
+			So((<-second).Code, ShouldEqual, http.StatusOK)
+		})
+	})
+}
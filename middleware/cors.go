@@ -0,0 +1,267 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+)
+
+// CORS request and response headers
+const (
+	headerOrigin           = "Origin"
+	headerVary             = "Vary"
+	headerRequestMethod    = "Access-Control-Request-Method"
+	headerRequestHeaders   = "Access-Control-Request-Headers"
+	headerAllowOrigin      = "Access-Control-Allow-Origin"
+	headerAllowMethods     = "Access-Control-Allow-Methods"
+	headerAllowHeaders     = "Access-Control-Allow-Headers"
+	headerAllowCredentials = "Access-Control-Allow-Credentials"
+	headerExposeHeaders    = "Access-Control-Expose-Headers"
+	headerMaxAge           = "Access-Control-Max-Age"
+)
+
+const (
+	corsAnyValue          = "*"
+	corsWildcardSubdomain = "://*."
+)
+
+// defaultCORSMethods are the methods allowed by policies that don't configure any
+var defaultCORSMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+
+type corsConfig []struct {
+	Routes         []string `json:"routes"`
+	Origins        []string `json:"origins"`
+	Methods        []string `json:"methods"`
+	Headers        []string `json:"headers"`
+	ExposedHeaders []string `json:"exposed_headers"`
+	Credentials    bool     `json:"credentials"`
+	MaxAge         string   `json:"max_age"`
+}
+
+// CORSPolicy is the CORS policy of the requests that match its routes
+type CORSPolicy struct {
+	routes         *http.ServeMux
+	anyOrigin      bool
+	origins        map[string]bool
+	originSuffixes []originSuffix
+	methods        map[string]bool
+	anyHeader      bool
+	headers        map[string]bool
+	allowMethods   string
+	exposedHeaders string
+	credentials    bool
+	maxAge         string
+}
+
+// originSuffix matches the origins of any subdomain of a domain, e.g. https://*.ons.gov.uk
+type originSuffix struct {
+	scheme string
+	suffix string
+}
+
+// LoadCORSPolicies loads and validates per-route CORS policies. It takes in a function that returns the loaded bytes
+// (eg. a function that loads content from disk), which contain a JSON array of policies.
+func LoadCORSPolicies(loader func() ([]byte, error)) ([]CORSPolicy, error) {
+	configJSON, err := loader()
+	if err != nil {
+		return nil, pkgerrors.Wrap(err, "unable to load cors config")
+	}
+	if len(configJSON) == 0 {
+		return nil, nil
+	}
+
+	var config corsConfig
+	if err := json.Unmarshal(configJSON, &config); err != nil {
+		return nil, pkgerrors.Wrap(err, "invalid json in cors config")
+	}
+
+	policies := make([]CORSPolicy, len(config))
+	for i, c := range config {
+		if len(c.Routes) == 0 || len(c.Origins) == 0 {
+			return nil, errors.New("cors policies require at least one route and origin")
+		}
+		policy := CORSPolicy{
+			origins:        map[string]bool{},
+			methods:        map[string]bool{},
+			headers:        lowerSet(c.Headers),
+			exposedHeaders: strings.Join(c.ExposedHeaders, ","),
+			credentials:    c.Credentials,
+		}
+		if policy.routes, err = newRuleMux(c.Routes); err != nil {
+			return nil, pkgerrors.Wrap(err, "invalid routes in cors config")
+		}
+
+		for _, origin := range c.Origins {
+			origin = strings.ToLower(strings.TrimSpace(origin))
+			switch {
+			case origin == corsAnyValue:
+				policy.anyOrigin = true
+			case strings.Contains(origin, corsWildcardSubdomain):
+				scheme, domain, _ := strings.Cut(origin, corsWildcardSubdomain)
+				if scheme == "" || domain == "" || strings.Contains(domain, corsAnyValue) {
+					return nil, fmt.Errorf("invalid origin '%s' in cors config", origin)
+				}
+				policy.originSuffixes = append(policy.originSuffixes, originSuffix{scheme: scheme + "://", suffix: "." + domain})
+			case strings.Contains(origin, corsAnyValue):
+				return nil, fmt.Errorf("invalid origin '%s' in cors config, wildcards are only supported for subdomains", origin)
+			default:
+				policy.origins[origin] = true
+			}
+		}
+		if policy.anyOrigin && policy.credentials {
+			return nil, errors.New("cors policies can't allow any origin with credentials")
+		}
+
+		methods := defaultCORSMethods
+		if len(c.Methods) > 0 {
+			methods = make([]string, len(c.Methods))
+			for j, method := range c.Methods {
+				methods[j] = strings.ToUpper(strings.TrimSpace(method))
+			}
+		}
+		for _, method := range methods {
+			policy.methods[method] = true
+		}
+		policy.allowMethods = strings.Join(methods, ",")
+
+		if policy.headers[corsAnyValue] {
+			if policy.credentials {
+				return nil, errors.New("cors policies can't allow any header with credentials")
+			}
+			policy.anyHeader = true
+		}
+
+		if c.MaxAge != "" {
+			maxAge, err := time.ParseDuration(c.MaxAge)
+			if err != nil || maxAge < 0 {
+				return nil, fmt.Errorf("invalid max age '%s' in cors config", c.MaxAge)
+			}
+			policy.maxAge = strconv.Itoa(int(maxAge.Seconds()))
+		}
+		policies[i] = policy
+	}
+	return policies, nil
+}
+
+// CORS returns a middleware handler that applies the first of the policies that matches the request, or the fallback
+// middleware (e.g. the global CORS configuration) if none of them match. Preflight requests that match a policy are
+// answered by the router without being proxied. For other requests, any CORS headers set by the upstream are replaced
+// by the headers of the policy.
+func CORS(policies []CORSPolicy, fallback func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		fallbackHandler := fallback(h)
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			// preflight requests are matched using the method of the request that they are for
+			matchReq := req
+			if isPreflight(req) {
+				matchReq = req.Clone(req.Context())
+				matchReq.Method = strings.ToUpper(req.Header.Get(headerRequestMethod))
+			}
+			for i := range policies {
+				if matches(policies[i].routes, matchReq) {
+					policies[i].serve(w, req, h)
+					return
+				}
+			}
+			fallbackHandler.ServeHTTP(w, req)
+		})
+	}
+}
+
+// serve handles the request according to the policy
+func (p *CORSPolicy) serve(w http.ResponseWriter, req *http.Request, h http.Handler) {
+	origin := req.Header.Get(headerOrigin)
+	if isPreflight(req) {
+		w.Header().Add(headerVary, headerOrigin)
+		w.Header().Add(headerVary, headerRequestMethod)
+		w.Header().Add(headerVary, headerRequestHeaders)
+		if p.allowsPreflight(origin, req) {
+			p.setAllowOrigin(w.Header(), origin)
+			w.Header().Set(headerAllowMethods, p.allowMethods)
+			if requestHeaders := req.Header.Get(headerRequestHeaders); requestHeaders != "" {
+				w.Header().Set(headerAllowHeaders, requestHeaders)
+			}
+			if p.maxAge != "" {
+				w.Header().Set(headerMaxAge, p.maxAge)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	allowed := origin != "" && p.allowsOrigin(origin)
+	setCORSHeaders := func(header http.Header) {
+		for name := range header {
+			if strings.HasPrefix(name, "Access-Control-") {
+				header.Del(name)
+			}
+		}
+		if allowed {
+			p.setAllowOrigin(header, origin)
+			if p.exposedHeaders != "" {
+				header.Set(headerExposeHeaders, p.exposedHeaders)
+			}
+		}
+		if !p.anyOrigin {
+			header.Add(headerVary, headerOrigin)
+		}
+	}
+	serveWithHeaders(w, req, h, setCORSHeaders)
+}
+
+// isPreflight returns true if the request is a CORS preflight request
+func isPreflight(req *http.Request) bool {
+	return req.Method == http.MethodOptions && req.Header.Get(headerOrigin) != "" && req.Header.Get(headerRequestMethod) != ""
+}
+
+// setAllowOrigin sets the headers that allow the origin
+func (p *CORSPolicy) setAllowOrigin(header http.Header, origin string) {
+	if p.anyOrigin {
+		header.Set(headerAllowOrigin, corsAnyValue)
+		return
+	}
+	header.Set(headerAllowOrigin, origin)
+	if p.credentials {
+		header.Set(headerAllowCredentials, "true")
+	}
+}
+
+// allowsOrigin returns true if the origin is allowed by the policy
+func (p *CORSPolicy) allowsOrigin(origin string) bool {
+	if p.anyOrigin {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if p.origins[origin] {
+		return true
+	}
+	for _, s := range p.originSuffixes {
+		if strings.HasPrefix(origin, s.scheme) && strings.HasSuffix(origin, s.suffix) &&
+			len(origin) > len(s.scheme)+len(s.suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsPreflight returns true if the origin, method and headers of the preflight request are allowed by the policy
+func (p *CORSPolicy) allowsPreflight(origin string, req *http.Request) bool {
+	if !p.allowsOrigin(origin) || !p.methods[strings.ToUpper(req.Header.Get(headerRequestMethod))] {
+		return false
+	}
+	if p.anyHeader {
+		return true
+	}
+	for _, header := range strings.Split(req.Header.Get(headerRequestHeaders), ",") {
+		if header = strings.ToLower(strings.TrimSpace(header)); header != "" && !p.headers[header] {
+			return false
+		}
+	}
+	return true
+}
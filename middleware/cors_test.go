@@ -0,0 +1,207 @@
+package middleware_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ONSdigital/dp-api-router/event"
+	"github.com/ONSdigital/dp-api-router/middleware"
+	"github.com/ONSdigital/dp-api-router/schema"
+	"github.com/ONSdigital/dp-kafka/v2/kafkatest"
+	"github.com/gorilla/handlers"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const testCORSConfig = `[
+  {
+    "routes": ["/v1/identity/", "/v1/permissions/"],
+    "origins": ["https://publishing.ons.gov.uk", "https://*.florence.ons.gov.uk"],
+    "methods": ["get", "POST", "PUT"],
+    "headers": ["Content-Type", "X-Florence-Token"],
+    "exposed_headers": ["ETag"],
+    "credentials": true,
+    "max_age": "10m"
+  },
+  {
+    "routes": ["GET /v1/"],
+    "origins": ["*"],
+    "headers": ["*"]
+  }
+]`
+
+// loadCORSPolicies loads CORS policies from the provided JSON
+func loadCORSPolicies(config string) ([]middleware.CORSPolicy, error) {
+	return middleware.LoadCORSPolicies(func() ([]byte, error) {
+		return []byte(config), nil
+	})
+}
+
+func TestLoadCORSPolicies(t *testing.T) {
+	Convey("Valid and empty configs are loaded", t, func() {
+		policies, err := loadCORSPolicies(testCORSConfig)
+		So(err, ShouldBeNil)
+		So(policies, ShouldHaveLength, 2)
+
+		policies, err = loadCORSPolicies("")
+		So(err, ShouldBeNil)
+		So(policies, ShouldBeEmpty)
+	})
+
+	Convey("An error loading the config is returned", t, func() {
+		_, err := middleware.LoadCORSPolicies(func() ([]byte, error) {
+			return nil, errors.New("file not found")
+		})
+		So(err, ShouldNotBeNil)
+	})
+
+	tests := map[string]string{
+		"invalid json":                   `[{"routes":`,
+		"missing routes":                 `[{"origins": ["*"]}]`,
+		"missing origins":                `[{"routes": ["/v1/"]}]`,
+		"invalid route":                  `[{"routes": ["/v1/{id"], "origins": ["*"]}]`,
+		"wildcard in the middle":         `[{"routes": ["/v1/"], "origins": ["https://ons*.gov.uk"]}]`,
+		"wildcard without a domain":      `[{"routes": ["/v1/"], "origins": ["https://*."]}]`,
+		"any origin with credentials":    `[{"routes": ["/v1/"], "origins": ["*"], "credentials": true}]`,
+		"any header with credentials":    `[{"routes": ["/v1/"], "origins": ["https://ons.gov.uk"], "headers": ["*"], "credentials": true}]`,
+		"invalid max age":                `[{"routes": ["/v1/"], "origins": ["*"], "max_age": "forever"}]`,
+		"wildcard subdomain of wildcard": `[{"routes": ["/v1/"], "origins": ["https://*.*.gov.uk"]}]`,
+	}
+	for name, config := range tests {
+		Convey("A config with "+name+" is rejected", t, func() {
+			policies, err := loadCORSPolicies(config)
+			So(err, ShouldNotBeNil)
+			So(policies, ShouldBeNil)
+		})
+	}
+}
+
+func TestCORSAudit(t *testing.T) {
+	Convey("Given an audit handler followed by per-route CORS policies", t, func(c C) {
+		policies, err := loadCORSPolicies(testCORSConfig)
+		So(err, ShouldBeNil)
+
+		p := kafkatest.NewMessageProducer(true)
+		auditProducer := event.NewAvroProducer(p.Channels().Output, schema.AuditEvent)
+		auditHandler := middleware.AuditHandler(auditProducer, createHTTPClientMock(http.StatusOK, testIdentityResponse),
+			testZebedeeURL, testAuditRules, nil, true, nil, nil)(middleware.CORS(policies, handlers.CORS())(testHandler(http.StatusOK, testBody, c)))
+
+		Convey("When a preflight request without credentials is made for a private route", func(c C) {
+			req := httptest.NewRequest(http.MethodOptions, "/v1/identity/tokens", http.NoBody)
+			req.Header.Set("Origin", "https://publishing.ons.gov.uk")
+			req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			w := httptest.NewRecorder()
+			auditEvents := serveAndCaptureAudit(c, w, req, auditHandler, p.Channels().Output, 2)
+
+			Convey("Then it is answered by the router and audited without an identity", func() {
+				So(w.Code, ShouldEqual, http.StatusNoContent)
+				So(w.Header().Get("Access-Control-Allow-Origin"), ShouldEqual, "https://publishing.ons.gov.uk")
+				So(auditEvents[0].Identity, ShouldBeEmpty)
+				So(auditEvents[1].StatusCode, ShouldEqual, int32(http.StatusNoContent))
+			})
+		})
+	})
+}
+
+func TestCORS(t *testing.T) {
+	policies, err := loadCORSPolicies(testCORSConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fallback := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("X-Fallback", "true")
+			h.ServeHTTP(w, req)
+		})
+	}
+
+	Convey("Given per-route CORS policies and an upstream that sets its own CORS headers", t, func() {
+		proxied := false
+		handler := middleware.CORS(policies, fallback)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			proxied = true
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("ETag", "abc")
+		}))
+
+		serve := func(method, target string, headers map[string]string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, target, http.NoBody)
+			for name, value := range headers {
+				req.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			return w
+		}
+
+		Convey("When an allowed preflight request for a private route is received", func() {
+			w := serve(http.MethodOptions, "/v1/identity/tokens", map[string]string{
+				"Origin":                         "https://preview.florence.ons.gov.uk",
+				"Access-Control-Request-Method":  "PUT",
+				"Access-Control-Request-Headers": "content-type, x-florence-token",
+			})
+
+			Convey("Then it is answered by the router with the policy", func() {
+				So(proxied, ShouldBeFalse)
+				So(w.Code, ShouldEqual, http.StatusNoContent)
+				So(w.Header().Get("Access-Control-Allow-Origin"), ShouldEqual, "https://preview.florence.ons.gov.uk")
+				So(w.Header().Get("Access-Control-Allow-Credentials"), ShouldEqual, "true")
+				So(w.Header().Get("Access-Control-Allow-Methods"), ShouldEqual, "GET,POST,PUT")
+				So(w.Header().Get("Access-Control-Allow-Headers"), ShouldEqual, "content-type, x-florence-token")
+				So(w.Header().Get("Access-Control-Max-Age"), ShouldEqual, "600")
+				So(w.Header().Values("Vary"), ShouldContain, "Origin")
+			})
+		})
+
+		preflights := map[string]map[string]string{
+			"an origin that isn't allowed":    {"Origin": "https://evil.example.com", "Access-Control-Request-Method": "GET"},
+			"the parent of a wildcard domain": {"Origin": "https://florence.ons.gov.uk", "Access-Control-Request-Method": "GET"},
+			"a method that isn't allowed":     {"Origin": "https://publishing.ons.gov.uk", "Access-Control-Request-Method": "DELETE"},
+			"a header that isn't allowed":     {"Origin": "https://publishing.ons.gov.uk", "Access-Control-Request-Method": "GET", "Access-Control-Request-Headers": "X-Other"},
+		}
+		for name, headers := range preflights {
+			Convey("When a preflight request with "+name+" is received, then it is answered without allowing it", func() {
+				w := serve(http.MethodOptions, "/v1/permissions/bundles", headers)
+				So(proxied, ShouldBeFalse)
+				So(w.Code, ShouldEqual, http.StatusNoContent)
+				So(w.Header().Get("Access-Control-Allow-Origin"), ShouldBeEmpty)
+			})
+		}
+
+		Convey("When a request for a private route is received from an allowed origin", func() {
+			w := serve(http.MethodGet, "/v1/identity/users", map[string]string{"Origin": "https://publishing.ons.gov.uk"})
+
+			Convey("Then the CORS headers of the upstream are replaced by the policy", func() {
+				So(proxied, ShouldBeTrue)
+				So(w.Header().Values("Access-Control-Allow-Origin"), ShouldResemble, []string{"https://publishing.ons.gov.uk"})
+				So(w.Header().Get("Access-Control-Allow-Credentials"), ShouldEqual, "true")
+				So(w.Header().Get("Access-Control-Expose-Headers"), ShouldEqual, "ETag")
+			})
+		})
+
+		Convey("When a request for a private route is received from another origin, then the CORS headers are removed", func() {
+			w := serve(http.MethodGet, "/v1/identity/users", map[string]string{"Origin": "https://www.ons.gov.uk"})
+			So(proxied, ShouldBeTrue)
+			So(w.Header().Get("Access-Control-Allow-Origin"), ShouldBeEmpty)
+		})
+
+		Convey("When a request for a public route is received from any origin, then any origin is allowed", func() {
+			w := serve(http.MethodOptions, "/v1/datasets", map[string]string{
+				"Origin":                         "https://www.example.com",
+				"Access-Control-Request-Method":  "GET",
+				"Access-Control-Request-Headers": "X-Anything",
+			})
+			So(w.Header().Get("Access-Control-Allow-Origin"), ShouldEqual, "*")
+			So(w.Header().Get("Access-Control-Allow-Credentials"), ShouldBeEmpty)
+			So(w.Header().Get("Access-Control-Allow-Methods"), ShouldEqual, "GET,HEAD,POST")
+			So(w.Header().Get("X-Fallback"), ShouldBeEmpty)
+		})
+
+		Convey("When a request doesn't match any policy, then the fallback is used", func() {
+			w := serve(http.MethodPost, "/v1/datasets", map[string]string{"Origin": "http://localhost:8081"})
+			So(proxied, ShouldBeTrue)
+			So(w.Header().Get("X-Fallback"), ShouldEqual, "true")
+			So(w.Header().Get("Access-Control-Allow-Origin"), ShouldEqual, "*")
+		})
+	})
+}
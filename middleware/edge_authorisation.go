@@ -0,0 +1,220 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/ONSdigital/dp-api-router/metrics"
+	"github.com/ONSdigital/dp-authorisation/v2/authorisation"
+	dphttp "github.com/ONSdigital/dp-net/v3/http"
+	dprequest "github.com/ONSdigital/dp-net/v3/request"
+	permsdk "github.com/ONSdigital/dp-permissions-api/sdk"
+	"github.com/ONSdigital/log.go/v2/log"
+	pkgerrors "github.com/pkg/errors"
+)
+
+// Possible edge authorisation decisions, as counted by the edge_authorisation_decisions_total metric
+const (
+	DecisionAllowed         = "allowed"
+	DecisionUnauthenticated = "unauthenticated"
+	DecisionForbidden       = "forbidden"
+	DecisionError           = "error"
+)
+
+const entityDataKey = contextKey("entity-data")
+
+var edgeAuthorisationDecisions = metrics.NewCounterVec("edge_authorisation_decisions_total",
+	"Requests to private routes that were allowed or rejected by edge authorisation", "decision")
+
+type permissionRulesConfig []struct {
+	Routes     []string `json:"routes"`
+	Permission string   `json:"permission"`
+}
+
+// PermissionRule requires callers to have the permission for requests that match its routes
+type PermissionRule struct {
+	Routes     []string
+	Permission string
+	mux        *http.ServeMux
+}
+
+// LoadPermissionRules loads and validates the permissions required by private routes. It takes in a function that
+// returns the loaded bytes (eg. a function that loads content from disk), which contain a JSON array of rules.
+// Routes are http.ServeMux patterns, optionally restricted to a method (e.g. "PUT /v1/datasets/").
+func LoadPermissionRules(loader func() ([]byte, error)) ([]PermissionRule, error) {
+	configJSON, err := loader()
+	if err != nil {
+		return nil, pkgerrors.Wrap(err, "unable to load edge authorisation config")
+	}
+	if len(configJSON) == 0 {
+		return nil, nil
+	}
+
+	var config permissionRulesConfig
+	if err := json.Unmarshal(configJSON, &config); err != nil {
+		return nil, pkgerrors.Wrap(err, "invalid json in edge authorisation config")
+	}
+
+	rules := make([]PermissionRule, len(config))
+	for i, c := range config {
+		if c.Permission == "" || len(c.Routes) == 0 {
+			return nil, errors.New("edge authorisation rules require a permission and at least one route")
+		}
+		ruleMux, err := newRuleMux(c.Routes)
+		if err != nil {
+			return nil, pkgerrors.Wrap(err, "invalid routes in edge authorisation config")
+		}
+		rules[i] = PermissionRule{Routes: c.Routes, Permission: c.Permission, mux: ruleMux}
+	}
+	return rules, nil
+}
+
+// EdgeAuthorisation rejects requests to private routes before they are proxied, unless the caller has the permissions
+// required by the route. This protects private APIs even if an upstream fails to check tokens itself.
+type EdgeAuthorisation struct {
+	rules       []PermissionRule
+	jwtVerifier *JWTVerifier
+	identity    IdentityChecker
+	permissions authorisation.PermissionsChecker
+}
+
+// NewEdgeAuthorisation creates an EdgeAuthorisation that enforces the rules. JWTs are verified by the jwtVerifier,
+// other tokens are checked with Zebedee by the identity checker, and permissions are checked by the permissions
+// checker.
+func NewEdgeAuthorisation(rules []PermissionRule, jwtVerifier *JWTVerifier, identity IdentityChecker, permissions authorisation.PermissionsChecker) *EdgeAuthorisation {
+	return &EdgeAuthorisation{
+		rules:       rules,
+		jwtVerifier: jwtVerifier,
+		identity:    identity,
+		permissions: permissions,
+	}
+}
+
+// Handler is a middleware handler that responds with 401 Unauthorized if the caller of a request to a private route
+// can't be identified, or 403 Forbidden if their service token is rejected or they don't have the required
+// permissions. If Zebedee can't be reached or fails, it responds with 502 Bad Gateway. Requests that don't match any
+// of the rules are passed on unchanged. As it runs inside the audit handler, rejected requests are audited with the
+// status code of the decision.
+func (a *EdgeAuthorisation) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		permissions := a.requiredPermissions(req)
+		if len(permissions) == 0 {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		ctx := req.Context()
+		logData := log.Data{"path": req.URL.Path, "method": req.Method, "permissions": permissions}
+
+		entityData, status, err := a.identify(ctx, req)
+		if err != nil {
+			edgeAuthorisationDecisions.Inc(decisionForStatus(status))
+			handleError(ctx, w, req, status, "edge authorisation failed: caller could not be identified", err, logData)
+			return
+		}
+		logData["caller"] = entityData.UserID
+
+		attributes, err := authorisation.GetCollectionIDAttribute(req)
+		if err != nil {
+			edgeAuthorisationDecisions.Inc(DecisionError)
+			handleError(ctx, w, req, http.StatusInternalServerError, "edge authorisation failed: request attributes could not be retrieved", err, logData)
+			return
+		}
+
+		for _, permission := range permissions {
+			hasPermission, err := a.permissions.HasPermission(ctx, *entityData, permission, attributes)
+			if err != nil {
+				edgeAuthorisationDecisions.Inc(DecisionError)
+				handleError(ctx, w, req, http.StatusInternalServerError, "edge authorisation failed: permissions lookup error", err, logData)
+				return
+			}
+			if !hasPermission {
+				edgeAuthorisationDecisions.Inc(DecisionForbidden)
+				logData["permission"] = permission
+				log.Info(ctx, "edge authorisation failed: caller does not have the required permission", logData)
+				dphttp.DrainBody(req)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+
+		edgeAuthorisationDecisions.Inc(DecisionAllowed)
+		h.ServeHTTP(w, req)
+	})
+}
+
+// requiredPermissions returns the permissions required by the rules that match the request
+func (a *EdgeAuthorisation) requiredPermissions(req *http.Request) []string {
+	var permissions []string
+	for _, rule := range a.rules {
+		if matches(rule.mux, req) {
+			permissions = append(permissions, rule.Permission)
+		}
+	}
+	return permissions
+}
+
+// identify returns the entity data of the caller. A caller that has already been identified by the audit handler,
+// by verifying their JWT or calling Zebedee, is not identified again. Otherwise the florence token is used if present, falling back to the service auth token. As in
+// dp-authorisation, a rejected florence token is unauthorised (401) and a rejected service token is forbidden (403),
+// while an error calling Zebedee is a bad gateway (502).
+func (a *EdgeAuthorisation) identify(ctx context.Context, req *http.Request) (*permsdk.EntityData, int, error) {
+	if entityData, ok := ctx.Value(entityDataKey).(*permsdk.EntityData); ok {
+		return entityData, http.StatusOK, nil
+	}
+
+	florenceToken, err := getFlorenceToken(ctx, req)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	token, serviceAuthToken := florenceToken, ""
+	if token == "" {
+		if serviceAuthToken, err = getServiceAuthToken(ctx, req); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		token = serviceAuthToken
+	}
+	token = strings.TrimPrefix(token, dprequest.BearerPrefix)
+	if token == "" {
+		return nil, http.StatusUnauthorized, errors.New("no token in request")
+	}
+
+	if strings.Contains(token, ".") {
+		entityData, err := a.jwtVerifier.Parse(ctx, token)
+		if errors.Is(err, ErrNoJWTKeys) {
+			return nil, http.StatusInternalServerError, err
+		}
+		if err != nil {
+			return nil, http.StatusUnauthorized, err
+		}
+		return entityData, http.StatusOK, nil
+	}
+
+	idCtx, status, authFailure, err := a.identity.CheckRequest(req, florenceToken, serviceAuthToken)
+	if err != nil {
+		return nil, http.StatusBadGateway, err
+	}
+	if authFailure != nil {
+		switch {
+		case status >= http.StatusInternalServerError:
+			return nil, http.StatusBadGateway, authFailure
+		case florenceToken != "":
+			return nil, http.StatusUnauthorized, authFailure
+		default:
+			return nil, http.StatusForbidden, authFailure
+		}
+	}
+	return &permsdk.EntityData{UserID: dprequest.Caller(idCtx)}, http.StatusOK, nil
+}
+
+// decisionForStatus returns the decision corresponding to the status code of a failure to identify the caller, where
+// a rejected token is unauthenticated and anything else is an error
+func decisionForStatus(status int) string {
+	if status == http.StatusUnauthorized || status == http.StatusForbidden {
+		return DecisionUnauthenticated
+	}
+	return DecisionError
+}
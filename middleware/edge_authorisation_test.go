@@ -0,0 +1,262 @@
+package middleware_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/dp-api-router/event"
+	"github.com/ONSdigital/dp-api-router/metrics/metricstest"
+	"github.com/ONSdigital/dp-api-router/middleware"
+	"github.com/ONSdigital/dp-api-router/middleware/mock"
+	"github.com/ONSdigital/dp-api-router/schema"
+	authmock "github.com/ONSdigital/dp-authorisation/v2/authorisation/mock"
+	"github.com/ONSdigital/dp-kafka/v2/kafkatest"
+	dprequest "github.com/ONSdigital/dp-net/v3/request"
+	permsdk "github.com/ONSdigital/dp-permissions-api/sdk"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	testEditPermission   = "datasets:edit"
+	testServiceToken     = "myServiceToken"
+	testServiceIdentity  = "myService"
+	testPermissionConfig = `[{"routes": ["PUT /v1/datasets/", "POST /v1/datasets"], "permission": "datasets:edit"}]`
+)
+
+var (
+	errPermissionsAPI          = errors.New("permissions api unavailable")
+	edgeAuthorisationDecisions = metricstest.NewCounter("edge_authorisation_decisions_total", "decision")
+)
+
+// loadPermissionRules loads permission rules from the provided JSON
+func loadPermissionRules(config string) ([]middleware.PermissionRule, error) {
+	return middleware.LoadPermissionRules(func() ([]byte, error) {
+		return []byte(config), nil
+	})
+}
+
+func TestLoadPermissionRules(t *testing.T) {
+	Convey("Valid and empty configs are loaded", t, func() {
+		rules, err := loadPermissionRules(testPermissionConfig)
+		So(err, ShouldBeNil)
+		So(rules, ShouldHaveLength, 1)
+		So(rules[0].Permission, ShouldEqual, testEditPermission)
+
+		rules, err = loadPermissionRules("")
+		So(err, ShouldBeNil)
+		So(rules, ShouldBeEmpty)
+	})
+
+	Convey("An error loading the config is returned", t, func() {
+		_, err := middleware.LoadPermissionRules(func() ([]byte, error) {
+			return nil, errors.New("file not found")
+		})
+		So(err, ShouldNotBeNil)
+	})
+
+	tests := map[string]string{
+		"invalid json":       `[{"routes":`,
+		"missing permission": `[{"routes": ["/v1/datasets"]}]`,
+		"missing routes":     `[{"permission": "datasets:edit"}]`,
+		"invalid route":      `[{"routes": ["/v1/datasets/{id"], "permission": "datasets:edit"}]`,
+		"conflicting routes": `[{"routes": ["/v1/datasets", "/v1/datasets"], "permission": "datasets:edit"}]`,
+	}
+	for name, config := range tests {
+		Convey("A config with "+name+" is rejected", t, func() {
+			rules, err := loadPermissionRules(config)
+			So(err, ShouldNotBeNil)
+			So(rules, ShouldBeNil)
+		})
+	}
+}
+
+func TestEdgeAuthorisation(t *testing.T) {
+	Convey("Given edge authorisation for a private route", t, func() {
+		rules, err := loadPermissionRules(testPermissionConfig)
+		So(err, ShouldBeNil)
+		key := newTestJWTKey(testJWTKeyID)
+		verifier := middleware.NewJWTVerifier(context.Background(), middleware.StaticKeyFetcher{testJWTKeyID: key.encodedPublicKey()}, 0, 0)
+		identity := identityCheckerMock(testServiceIdentity, http.StatusOK, nil, nil)
+		hasPermission := true
+		permissions := &authmock.PermissionsCheckerMock{
+			HasPermissionFunc: func(ctx context.Context, entityData permsdk.EntityData, permission string, attributes map[string]string) (bool, error) {
+				return hasPermission, nil
+			},
+		}
+		proxied := false
+		handler := middleware.NewEdgeAuthorisation(rules, verifier, identity, permissions).Handler(
+			http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				proxied = true
+			}))
+
+		serve := func(method, target string, headers map[string]string) int {
+			req := httptest.NewRequest(method, target, http.NoBody)
+			for name, value := range headers {
+				req.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			return w.Code
+		}
+		validJWT := map[string]string{
+			dprequest.FlorenceHeaderKey:     dprequest.BearerPrefix + key.sign(testJWTUser, time.Now().Add(time.Hour)),
+			dprequest.CollectionIDHeaderKey: "myCollection",
+		}
+		serviceToken := map[string]string{dprequest.AuthHeaderKey: dprequest.BearerPrefix + testServiceToken}
+
+		Convey("When a request doesn't match any rule, then it is proxied without any checks", func() {
+			So(serve(http.MethodGet, "/v1/datasets/cpih", nil), ShouldEqual, http.StatusOK)
+			So(proxied, ShouldBeTrue)
+			So(permissions.HasPermissionCalls(), ShouldBeEmpty)
+		})
+
+		Convey("When a request without a token is received, then it is rejected as unauthorised", func() {
+			So(serve(http.MethodPut, "/v1/datasets/cpih", nil), ShouldEqual, http.StatusUnauthorized)
+			So(proxied, ShouldBeFalse)
+		})
+
+		Convey("When a request with an invalid JWT is received, then it is rejected as unauthorised", func() {
+			So(serve(http.MethodPut, "/v1/datasets/cpih", map[string]string{dprequest.FlorenceHeaderKey: testJWTFlorenceToken}), ShouldEqual, http.StatusUnauthorized)
+			So(proxied, ShouldBeFalse)
+			So(permissions.HasPermissionCalls(), ShouldBeEmpty)
+		})
+
+		Convey("When a request with a valid JWT is received from a user with the permission", func() {
+			So(serve(http.MethodPut, "/v1/datasets/cpih", validJWT), ShouldEqual, http.StatusOK)
+
+			Convey("Then the permission is checked for the user and collection, and the request is proxied", func() {
+				So(proxied, ShouldBeTrue)
+				So(permissions.HasPermissionCalls(), ShouldHaveLength, 1)
+				call := permissions.HasPermissionCalls()[0]
+				So(call.EntityData.UserID, ShouldEqual, testJWTUser)
+				So(call.EntityData.Groups, ShouldResemble, []string{"role-admin"})
+				So(call.Permission, ShouldEqual, testEditPermission)
+				So(call.Attributes, ShouldResemble, map[string]string{"collection_id": "myCollection"})
+			})
+		})
+
+		Convey("When a request with a valid JWT is received from a user without the permission, then it is forbidden", func() {
+			hasPermission = false
+			So(serve(http.MethodPost, "/v1/datasets", validJWT), ShouldEqual, http.StatusForbidden)
+			So(proxied, ShouldBeFalse)
+		})
+
+		Convey("When a request with a service token is received, then the service is identified by Zebedee", func() {
+			So(serve(http.MethodPost, "/v1/datasets", serviceToken), ShouldEqual, http.StatusOK)
+			So(proxied, ShouldBeTrue)
+			So(identity.CheckRequestCalls()[0].ServiceAuthToken, ShouldEqual, testServiceToken)
+			So(permissions.HasPermissionCalls()[0].EntityData.UserID, ShouldEqual, testServiceIdentity)
+		})
+
+		Convey("When a request with an unknown service token is received, then it is forbidden", func() {
+			identity.CheckRequestFunc = identityCheckerMock("", http.StatusUnauthorized, errAuthFailure, nil).CheckRequestFunc
+			unauthenticated := edgeAuthorisationDecisions.Value(middleware.DecisionUnauthenticated)
+			So(serve(http.MethodPost, "/v1/datasets", serviceToken), ShouldEqual, http.StatusForbidden)
+			So(proxied, ShouldBeFalse)
+			So(edgeAuthorisationDecisions.Value(middleware.DecisionUnauthenticated), ShouldEqual, unauthenticated+1)
+		})
+
+		Convey("When a request with an unknown florence token is received, then it is rejected as unauthorised", func() {
+			identity.CheckRequestFunc = identityCheckerMock("", http.StatusUnauthorized, errAuthFailure, nil).CheckRequestFunc
+			So(serve(http.MethodPost, "/v1/datasets", map[string]string{dprequest.FlorenceHeaderKey: testFlorenceToken}), ShouldEqual, http.StatusUnauthorized)
+			So(proxied, ShouldBeFalse)
+			So(identity.CheckRequestCalls()[0].FlorenceToken, ShouldEqual, testFlorenceToken)
+		})
+
+		Convey("When Zebedee can't be called, then a bad gateway error is returned", func() {
+			identity.CheckRequestFunc = identityCheckerMock("", http.StatusInternalServerError, nil, errIdentity).CheckRequestFunc
+			failures := edgeAuthorisationDecisions.Value(middleware.DecisionError)
+			So(serve(http.MethodPost, "/v1/datasets", serviceToken), ShouldEqual, http.StatusBadGateway)
+			So(proxied, ShouldBeFalse)
+			So(edgeAuthorisationDecisions.Value(middleware.DecisionError), ShouldEqual, failures+1)
+		})
+
+		Convey("When Zebedee fails, then a bad gateway error is returned", func() {
+			identity.CheckRequestFunc = identityCheckerMock("", http.StatusServiceUnavailable, errAuthFailure, nil).CheckRequestFunc
+			failures := edgeAuthorisationDecisions.Value(middleware.DecisionError)
+			So(serve(http.MethodPost, "/v1/datasets", serviceToken), ShouldEqual, http.StatusBadGateway)
+			So(proxied, ShouldBeFalse)
+			So(edgeAuthorisationDecisions.Value(middleware.DecisionError), ShouldEqual, failures+1)
+		})
+
+		Convey("When the permissions can't be checked, then an internal server error is returned", func() {
+			permissions.HasPermissionFunc = func(ctx context.Context, entityData permsdk.EntityData, permission string, attributes map[string]string) (bool, error) {
+				return false, errPermissionsAPI
+			}
+			So(serve(http.MethodPost, "/v1/datasets", validJWT), ShouldEqual, http.StatusInternalServerError)
+			So(proxied, ShouldBeFalse)
+		})
+	})
+}
+
+func TestEdgeAuthorisationAudit(t *testing.T) {
+	Convey("Given an audit handler followed by edge authorisation", t, func(c C) {
+		rules, err := loadPermissionRules(testPermissionConfig)
+		So(err, ShouldBeNil)
+		key := newTestJWTKey(testJWTKeyID)
+		fetcher := keyFetcherMock(key)
+		verifier := middleware.NewJWTVerifier(context.Background(), fetcher, 0, 0)
+		permissions := &authmock.PermissionsCheckerMock{
+			HasPermissionFunc: func(ctx context.Context, entityData permsdk.EntityData, permission string, attributes map[string]string) (bool, error) {
+				return false, nil
+			},
+		}
+		edgeAuthorisation := middleware.NewEdgeAuthorisation(rules, verifier, &mock.IdentityCheckerMock{}, permissions)
+
+		p := kafkatest.NewMessageProducer(true)
+		auditProducer := event.NewAvroProducer(p.Channels().Output, schema.AuditEvent)
+		auditHandler := middleware.AuditHandler(auditProducer, createHTTPClientMock(http.StatusOK, testIdentityResponse),
+			testZebedeeURL, testAuditRules, nil, true, nil, verifier)(edgeAuthorisation.Handler(testHandler(http.StatusOK, testBody, c)))
+
+		Convey("When a user without the required permission makes a request", func(c C) {
+			req := httptest.NewRequest(http.MethodPut, "/v1/datasets/cpih", http.NoBody)
+			req.Header.Set(dprequest.FlorenceHeaderKey, dprequest.BearerPrefix+key.sign(testJWTUser, time.Now().Add(time.Hour)))
+			w := httptest.NewRecorder()
+			auditEvents := serveAndCaptureAudit(c, w, req, auditHandler, p.Channels().Output, 2)
+
+			Convey("Then the forbidden decision is audited for the user", func() {
+				So(w.Code, ShouldEqual, http.StatusForbidden)
+				So(auditEvents[0].Identity, ShouldEqual, testJWTUser)
+				So(auditEvents[1].Identity, ShouldEqual, testJWTUser)
+				So(auditEvents[1].StatusCode, ShouldEqual, int32(http.StatusForbidden))
+				So(permissions.HasPermissionCalls()[0].EntityData.UserID, ShouldEqual, testJWTUser)
+			})
+		})
+	})
+
+	Convey("Given an audit handler that identifies callers with Zebedee, followed by edge authorisation", t, func(c C) {
+		rules, err := loadPermissionRules(testPermissionConfig)
+		So(err, ShouldBeNil)
+		verifier := middleware.NewJWTVerifier(context.Background(), middleware.StaticKeyFetcher{}, 0, 0)
+		identity := &mock.IdentityCheckerMock{}
+		permissions := &authmock.PermissionsCheckerMock{
+			HasPermissionFunc: func(ctx context.Context, entityData permsdk.EntityData, permission string, attributes map[string]string) (bool, error) {
+				return true, nil
+			},
+		}
+		edgeAuthorisation := middleware.NewEdgeAuthorisation(rules, verifier, identity, permissions)
+
+		p := kafkatest.NewMessageProducer(true)
+		auditProducer := event.NewAvroProducer(p.Channels().Output, schema.AuditEvent)
+		cliMock := createHTTPClientMock(http.StatusOK, testIdentityResponse)
+		auditHandler := middleware.AuditHandler(auditProducer, cliMock, testZebedeeURL, testAuditRules, nil, true, nil, verifier)(edgeAuthorisation.Handler(testHandler(http.StatusOK, testBody, c)))
+
+		Convey("When a service makes a request with a service token", func(c C) {
+			req := httptest.NewRequest(http.MethodPut, "/v1/datasets/cpih", http.NoBody)
+			req.Header.Set(dprequest.AuthHeaderKey, dprequest.BearerPrefix+testServiceToken)
+			w := httptest.NewRecorder()
+			serveAndCaptureAudit(c, w, req, auditHandler, p.Channels().Output, 2)
+
+			Convey("Then the caller identified by the audit handler is authorised, without calling Zebedee again", func() {
+				So(w.Code, ShouldEqual, http.StatusOK)
+				So(cliMock.DoCalls(), ShouldHaveLength, 1)
+				So(identity.CheckRequestCalls(), ShouldBeEmpty)
+				So(permissions.HasPermissionCalls()[0].EntityData.UserID, ShouldEqual, testIdentity)
+			})
+		})
+	})
+}
@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+)
+
+// headerWriter calls setHeaders just before the status code is written to the wrapped responseWriter, so that headers
+// can be added to (or replace) the headers set by the handler, such as an upstream response proxied by the router
+type headerWriter struct {
+	http.ResponseWriter
+	setHeaders  func(http.Header)
+	wroteHeader bool
+}
+
+// serveWithHeaders serves the request with a headerWriter that calls setHeaders, making sure that it is called even if
+// the handler doesn't write a response
+func serveWithHeaders(w http.ResponseWriter, req *http.Request, h http.Handler, setHeaders func(http.Header)) {
+	hw := &headerWriter{ResponseWriter: w, setHeaders: setHeaders}
+	h.ServeHTTP(hw, req)
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+}
+
+var (
+	_ http.Flusher  = &headerWriter{}
+	_ http.Hijacker = &headerWriter{}
+)
+
+// WriteHeader sets the headers before writing the status code to the wrapped responseWriter
+func (hw *headerWriter) WriteHeader(status int) {
+	hw.setHeaders(hw.Header())
+	// informational responses may be followed by the final status code
+	hw.wroteHeader = status >= http.StatusOK || status == http.StatusSwitchingProtocols
+	hw.ResponseWriter.WriteHeader(status)
+}
+
+// Write sets the headers if the status code hasn't been written yet, before writing the body to the wrapped
+// responseWriter
+func (hw *headerWriter) Write(b []byte) (int, error) {
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	return hw.ResponseWriter.Write(b)
+}
+
+// Flush sends any buffered data to the client, if supported by the wrapped responseWriter
+func (hw *headerWriter) Flush() {
+	if f, ok := hw.ResponseWriter.(http.Flusher); ok {
+		if !hw.wroteHeader {
+			hw.WriteHeader(http.StatusOK)
+		}
+		f.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection, if supported by the wrapped responseWriter
+func (hw *headerWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := hw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := hj.Hijack()
+	if err == nil {
+		// the response is now written directly to the connection
+		hw.wroteHeader = true
+	}
+	return conn, rw, err
+}
+
+// Unwrap returns the wrapped responseWriter, for use by http.ResponseController
+func (hw *headerWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
@@ -0,0 +1,275 @@
+package middleware
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ONSdigital/dp-api-clients-go/v2/headers"
+	"github.com/ONSdigital/dp-api-clients-go/v2/health"
+	clientsidentity "github.com/ONSdigital/dp-api-clients-go/v2/identity"
+	"github.com/ONSdigital/dp-api-router/metrics"
+	dphttp "github.com/ONSdigital/dp-net/v3/http"
+	dprequest "github.com/ONSdigital/dp-net/v3/request"
+	"github.com/ONSdigital/log.go/v2/log"
+)
+
+//go:generate moq -out ./mock/identity_checker.go -pkg mock . IdentityChecker
+
+// IdentityChecker checks the identity of the caller of a request, as implemented by the identity client
+type IdentityChecker interface {
+	CheckRequest(req *http.Request, florenceToken, serviceAuthToken string) (context.Context, int, clientsidentity.AuthFailure, error)
+}
+
+// NewIdentityChecker creates an identity client that checks callers with Zebedee GET /identity, caching the results
+// if an identity cache is provided
+func NewIdentityChecker(cli dphttp.Clienter, zebedeeURL string, idCache *IdentityCache) IdentityChecker {
+	var checker IdentityChecker = clientsidentity.NewWithHealthClient(&health.Client{
+		Client: cli,
+		URL:    zebedeeURL,
+		Name:   "identity",
+	})
+	if idCache != nil {
+		checker = idCache.Checker(checker)
+	}
+	return checker
+}
+
+var identityCacheRequests = metrics.NewCounterVec("identity_cache_requests_total",
+	"Identity checks that were served from the cache (hit) or had to call Zebedee (miss)", "result")
+
+// IdentityCache caches the results of identity checks, keyed by a hash of the florence and service tokens, so that
+// repeated requests with the same tokens don't need to call Zebedee GET /identity every time. Successful checks are
+// cached for ttl and auth failures (4xx responses from Zebedee) for negativeTTL. Once the cache holds maxSize results,
+// the least recently used is evicted. Errors calling Zebedee, including 5xx responses, are never cached.
+type IdentityCache struct {
+	ttl         time.Duration
+	negativeTTL time.Duration
+	maxSize     int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type identityCacheEntry struct {
+	key           string
+	florenceHash  string
+	serviceHash   string
+	expiresAt     time.Time
+	callerID      string
+	statusCode    int
+	authFailure   clientsidentity.AuthFailure
+	isUserRequest bool
+}
+
+// NewIdentityCache creates an IdentityCache with the provided TTLs and maximum number of results
+func NewIdentityCache(ttl, negativeTTL time.Duration, maxSize int) *IdentityCache {
+	cache := &IdentityCache{
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		maxSize:     maxSize,
+		entries:     map[string]*list.Element{},
+		lru:         list.New(),
+	}
+
+	metrics.NewGaugeFunc("identity_cache_entries", "Identity check results held in the cache", func() float64 {
+		return float64(cache.Len())
+	})
+
+	return cache
+}
+
+// hashToken returns a hex encoded hash of the token, without any bearer prefix,
+// so that tokens are never held in memory by the cache
+func hashToken(token string) string {
+	token = strings.TrimPrefix(token, dprequest.BearerPrefix)
+	if token == "" {
+		return ""
+	}
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// CheckRequest returns the cached result of checking the identity for the tokens, if there is one.
+// Otherwise it checks the identity with the provided checker and caches the result.
+func (c *IdentityCache) CheckRequest(checker IdentityChecker, req *http.Request, florenceToken, serviceAuthToken string) (context.Context, int, clientsidentity.AuthFailure, error) {
+	// requests without tokens are rejected without calling Zebedee, so there is nothing to cache
+	if florenceToken == "" && serviceAuthToken == "" {
+		return checker.CheckRequest(req, florenceToken, serviceAuthToken)
+	}
+
+	florenceHash, serviceHash := hashToken(florenceToken), hashToken(serviceAuthToken)
+	key := florenceHash + ":" + serviceHash
+
+	if entry, ok := c.get(key); ok {
+		identityCacheRequests.Inc("hit")
+		return entry.replay(req)
+	}
+	identityCacheRequests.Inc("miss")
+
+	ctx, statusCode, authFailure, err := checker.CheckRequest(req, florenceToken, serviceAuthToken)
+	// the identity client returns any other response from Zebedee as an auth failure, so only 4xx responses are known
+	// to be rejected tokens, rather than Zebedee failing
+	if err != nil || (authFailure != nil && !isClientError(statusCode)) {
+		return ctx, statusCode, authFailure, err
+	}
+
+	entry := &identityCacheEntry{
+		key:           key,
+		florenceHash:  florenceHash,
+		serviceHash:   serviceHash,
+		statusCode:    statusCode,
+		authFailure:   authFailure,
+		isUserRequest: florenceToken != "",
+	}
+	if authFailure != nil {
+		entry.expiresAt = Now().Add(c.negativeTTL)
+	} else {
+		entry.callerID = dprequest.Caller(ctx)
+		entry.expiresAt = Now().Add(c.ttl)
+	}
+	c.add(entry)
+
+	return ctx, statusCode, authFailure, err
+}
+
+// isClientError returns true if the status code is a 4xx client error
+func isClientError(statusCode int) bool {
+	return statusCode >= http.StatusBadRequest && statusCode < http.StatusInternalServerError
+}
+
+// Checker returns an IdentityChecker that checks identities with the provided checker, using the cache
+func (c *IdentityCache) Checker(checker IdentityChecker) IdentityChecker {
+	return &cachedIdentityChecker{cache: c, checker: checker}
+}
+
+type cachedIdentityChecker struct {
+	cache   *IdentityCache
+	checker IdentityChecker
+}
+
+func (c *cachedIdentityChecker) CheckRequest(req *http.Request, florenceToken, serviceAuthToken string) (context.Context, int, clientsidentity.AuthFailure, error) {
+	return c.cache.CheckRequest(c.checker, req, florenceToken, serviceAuthToken)
+}
+
+// replay returns the result of an identity check from the cached entry, in the same way as the identity client
+func (entry *identityCacheEntry) replay(req *http.Request) (context.Context, int, clientsidentity.AuthFailure, error) {
+	ctx := req.Context()
+	if entry.authFailure != nil {
+		return ctx, entry.statusCode, entry.authFailure, nil
+	}
+
+	// the user identity of a service request is forwarded by the caller, so it is not cached
+	userID := entry.callerID
+	if !entry.isUserRequest {
+		userID, _ = headers.GetUserIdentity(req)
+	}
+
+	ctx = context.WithValue(ctx, dprequest.UserIdentityKey, userID)
+	ctx = context.WithValue(ctx, dprequest.CallerIdentityKey, entry.callerID)
+	return ctx, http.StatusOK, nil, nil
+}
+
+// get returns the unexpired entry for the key, if present, marking it as the most recently used
+func (c *IdentityCache) get(key string) (*identityCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*identityCacheEntry)
+	if Now().After(entry.expiresAt) {
+		c.remove(elem)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry, true
+}
+
+// add caches the entry, evicting the least recently used entries if the cache is full
+func (c *IdentityCache) add(entry *identityCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[entry.key]; ok {
+		c.remove(elem)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+
+	for c.maxSize > 0 && c.lru.Len() > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove removes the element from the cache. The caller must hold the lock.
+func (c *IdentityCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*identityCacheEntry).key)
+}
+
+// Invalidate removes every cached result for the florence or service token, returning the number of results removed
+func (c *IdentityCache) Invalidate(token string) int {
+	tokenHash := hashToken(token)
+	if tokenHash == "" {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	for _, elem := range c.entries {
+		entry := elem.Value.(*identityCacheEntry)
+		if entry.florenceHash == tokenHash || entry.serviceHash == tokenHash {
+			c.remove(elem)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Len returns the number of results held in the cache, including any that have expired but not yet been removed
+func (c *IdentityCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// invalidateRequest is the body of a request to invalidate a token in the identity cache
+type invalidateRequest struct {
+	Token string `json:"token"`
+}
+
+// invalidateResponse is the body of the response to a request to invalidate a token in the identity cache
+type invalidateResponse struct {
+	Invalidated int `json:"invalidated"`
+}
+
+// InvalidateHandler handles requests to invalidate a token in the identity cache, which provide the token as
+// {"token": "..."} and receive the number of cached results that were removed as {"invalidated": n}
+func (c *IdentityCache) InvalidateHandler(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	var body invalidateRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64*1024)).Decode(&body); err != nil || body.Token == "" {
+		http.Error(w, "a token to invalidate is required", http.StatusBadRequest)
+		return
+	}
+
+	invalidated := c.Invalidate(body.Token)
+	log.Info(ctx, "identity cache token invalidated", log.Data{"invalidated": invalidated})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(invalidateResponse{Invalidated: invalidated}); err != nil {
+		log.Error(ctx, "failed to write identity cache invalidation response", err)
+	}
+}
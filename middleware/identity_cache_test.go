@@ -0,0 +1,255 @@
+package middleware_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	clientsidentity "github.com/ONSdigital/dp-api-clients-go/v2/identity"
+	"github.com/ONSdigital/dp-api-router/metrics/metricstest"
+	"github.com/ONSdigital/dp-api-router/middleware"
+	"github.com/ONSdigital/dp-api-router/middleware/mock"
+	dprequest "github.com/ONSdigital/dp-net/v3/request"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var (
+	errIdentity     = errors.New("zebedee unavailable")
+	errAuthFailure  = clientsidentity.AuthFailure(errors.New("unauthorised"))
+	testCacheTime   = time.Date(2020, time.April, 26, 7, 5, 52, 0, time.UTC)
+	identityCacheRQ = metricstest.NewCounter("identity_cache_requests_total", "result")
+)
+
+// identityCheckerMock returns a checker that identifies the caller with the provided identity, in the same way as the
+// identity client, or fails with the provided status code, auth failure and error
+func identityCheckerMock(callerID string, statusCode int, authFailure clientsidentity.AuthFailure, err error) *mock.IdentityCheckerMock {
+	return &mock.IdentityCheckerMock{
+		CheckRequestFunc: func(req *http.Request, florenceToken, serviceAuthToken string) (context.Context, int, clientsidentity.AuthFailure, error) {
+			ctx := req.Context()
+			if authFailure != nil || err != nil {
+				return ctx, statusCode, authFailure, err
+			}
+			userID := callerID
+			if florenceToken == "" {
+				userID = req.Header.Get(dprequest.UserHeaderKey)
+			}
+			ctx = context.WithValue(ctx, dprequest.UserIdentityKey, userID)
+			ctx = context.WithValue(ctx, dprequest.CallerIdentityKey, callerID)
+			return ctx, http.StatusOK, nil, nil
+		},
+	}
+}
+
+func TestIdentityCache(t *testing.T) {
+	Convey("Given an identity cache with a mocked time and a successful identity checker", t, func() {
+		now := testCacheTime
+		middleware.Now = func() time.Time { return now }
+		cache := middleware.NewIdentityCache(time.Minute, 5*time.Second, 2)
+		checker := identityCheckerMock(testIdentity, http.StatusOK, nil, nil)
+		cachedChecker := cache.Checker(checker)
+		req := httptest.NewRequest(http.MethodGet, "/datasets", http.NoBody)
+
+		Convey("When the same user tokens are checked twice, Zebedee is only called once and the cached identity is returned", func() {
+			hits, misses := identityCacheRQ.Value("hit"), identityCacheRQ.Value("miss")
+
+			_, status, authFailure, err := cachedChecker.CheckRequest(req, testFlorenceToken, "")
+			So(err, ShouldBeNil)
+			So(authFailure, ShouldBeNil)
+			So(status, ShouldEqual, http.StatusOK)
+
+			ctx, status, authFailure, err := cachedChecker.CheckRequest(req, testFlorenceToken, "")
+			So(err, ShouldBeNil)
+			So(authFailure, ShouldBeNil)
+			So(status, ShouldEqual, http.StatusOK)
+			So(dprequest.User(ctx), ShouldEqual, testIdentity)
+			So(dprequest.Caller(ctx), ShouldEqual, testIdentity)
+
+			So(checker.CheckRequestCalls(), ShouldHaveLength, 1)
+			So(cache.Len(), ShouldEqual, 1)
+			So(identityCacheRQ.Value("hit"), ShouldEqual, hits+1)
+			So(identityCacheRQ.Value("miss"), ShouldEqual, misses+1)
+		})
+
+		Convey("When the same service token is checked twice, the user identity is still taken from each request", func() {
+			_, _, _, err := cachedChecker.CheckRequest(req, "", testServiceAuthToken)
+			So(err, ShouldBeNil)
+
+			forwardedReq := httptest.NewRequest(http.MethodGet, "/datasets", http.NoBody)
+			forwardedReq.Header.Set(dprequest.UserHeaderKey, "forwardedUser")
+			ctx, status, _, err := cachedChecker.CheckRequest(forwardedReq, "", testServiceAuthToken)
+			So(err, ShouldBeNil)
+			So(status, ShouldEqual, http.StatusOK)
+			So(dprequest.User(ctx), ShouldEqual, "forwardedUser")
+			So(dprequest.Caller(ctx), ShouldEqual, testIdentity)
+			So(checker.CheckRequestCalls(), ShouldHaveLength, 1)
+		})
+
+		Convey("When different tokens are checked, they are cached separately", func() {
+			_, _, _, err := cachedChecker.CheckRequest(req, testFlorenceToken, "")
+			So(err, ShouldBeNil)
+			_, _, _, err = cachedChecker.CheckRequest(req, testFlorenceToken, testServiceAuthToken)
+			So(err, ShouldBeNil)
+			So(checker.CheckRequestCalls(), ShouldHaveLength, 2)
+			So(cache.Len(), ShouldEqual, 2)
+		})
+
+		Convey("When a request without tokens is checked, it is not cached", func() {
+			_, _, _, err := cachedChecker.CheckRequest(req, "", "")
+			So(err, ShouldBeNil)
+			_, _, _, err = cachedChecker.CheckRequest(req, "", "")
+			So(err, ShouldBeNil)
+			So(checker.CheckRequestCalls(), ShouldHaveLength, 2)
+			So(cache.Len(), ShouldEqual, 0)
+		})
+
+		Convey("When the TTL expires, Zebedee is called again", func() {
+			_, _, _, err := cachedChecker.CheckRequest(req, testFlorenceToken, "")
+			So(err, ShouldBeNil)
+			now = now.Add(time.Minute + time.Second)
+			_, _, _, err = cachedChecker.CheckRequest(req, testFlorenceToken, "")
+			So(err, ShouldBeNil)
+			So(checker.CheckRequestCalls(), ShouldHaveLength, 2)
+		})
+
+		Convey("When more tokens are checked than the maximum size, the least recently used are evicted", func() {
+			for _, token := range []string{"token1", "token2", "token1", "token3", "token1", "token2"} {
+				_, _, _, err := cachedChecker.CheckRequest(req, token, "")
+				So(err, ShouldBeNil)
+			}
+			// token2 was evicted by token3, as token1 had been used more recently
+			So(checker.CheckRequestCalls(), ShouldHaveLength, 4)
+			So(cache.Len(), ShouldEqual, 2)
+		})
+
+		Convey("When a token is invalidated, every result for it is removed and Zebedee is called again", func() {
+			_, _, _, err := cachedChecker.CheckRequest(req, testFlorenceToken, "")
+			So(err, ShouldBeNil)
+			_, _, _, err = cachedChecker.CheckRequest(req, testFlorenceToken, dprequest.BearerPrefix+testServiceAuthToken)
+			So(err, ShouldBeNil)
+
+			So(cache.Invalidate(testFlorenceToken), ShouldEqual, 2)
+			So(cache.Invalidate(testFlorenceToken), ShouldEqual, 0)
+			So(cache.Invalidate(""), ShouldEqual, 0)
+			So(cache.Len(), ShouldEqual, 0)
+
+			_, _, _, err = cachedChecker.CheckRequest(req, testFlorenceToken, "")
+			So(err, ShouldBeNil)
+			So(checker.CheckRequestCalls(), ShouldHaveLength, 3)
+		})
+
+		Convey("When a token is invalidated, results for other tokens are kept", func() {
+			_, _, _, err := cachedChecker.CheckRequest(req, testFlorenceToken, "")
+			So(err, ShouldBeNil)
+			_, _, _, err = cachedChecker.CheckRequest(req, "otherToken", "")
+			So(err, ShouldBeNil)
+
+			So(cache.Invalidate(testFlorenceToken), ShouldEqual, 1)
+			So(cache.Len(), ShouldEqual, 1)
+		})
+
+		Convey("When a service token is invalidated, results for it are removed regardless of the bearer prefix", func() {
+			_, _, _, err := cachedChecker.CheckRequest(req, "", dprequest.BearerPrefix+testServiceAuthToken)
+			So(err, ShouldBeNil)
+			So(cache.Invalidate(testServiceAuthToken), ShouldEqual, 1)
+		})
+	})
+
+	Convey("Given an identity cache with a mocked time and an identity checker that fails authentication", t, func() {
+		now := testCacheTime
+		middleware.Now = func() time.Time { return now }
+		cache := middleware.NewIdentityCache(time.Minute, 5*time.Second, 10)
+		checker := identityCheckerMock("", http.StatusUnauthorized, errAuthFailure, nil)
+		cachedChecker := cache.Checker(checker)
+		req := httptest.NewRequest(http.MethodGet, "/datasets", http.NoBody)
+
+		Convey("When the same tokens are checked twice, the failure is cached", func() {
+			_, status, authFailure, err := cachedChecker.CheckRequest(req, testFlorenceToken, "")
+			So(err, ShouldBeNil)
+			So(authFailure, ShouldEqual, errAuthFailure)
+			So(status, ShouldEqual, http.StatusUnauthorized)
+
+			ctx, status, authFailure, err := cachedChecker.CheckRequest(req, testFlorenceToken, "")
+			So(err, ShouldBeNil)
+			So(authFailure, ShouldEqual, errAuthFailure)
+			So(status, ShouldEqual, http.StatusUnauthorized)
+			So(dprequest.User(ctx), ShouldBeEmpty)
+			So(checker.CheckRequestCalls(), ShouldHaveLength, 1)
+		})
+
+		Convey("When the negative TTL expires, Zebedee is called again", func() {
+			_, _, _, err := cachedChecker.CheckRequest(req, testFlorenceToken, "")
+			So(err, ShouldBeNil)
+			now = now.Add(6 * time.Second)
+			_, _, _, err = cachedChecker.CheckRequest(req, testFlorenceToken, "")
+			So(err, ShouldBeNil)
+			So(checker.CheckRequestCalls(), ShouldHaveLength, 2)
+		})
+	})
+
+	Convey("Given an identity cache and an identity checker that fails to call Zebedee", t, func() {
+		cache := middleware.NewIdentityCache(time.Minute, 5*time.Second, 10)
+		checker := identityCheckerMock("", http.StatusInternalServerError, nil, errIdentity)
+		cachedChecker := cache.Checker(checker)
+		req := httptest.NewRequest(http.MethodGet, "/datasets", http.NoBody)
+
+		Convey("When the same tokens are checked twice, the error is returned and not cached", func() {
+			for i := 0; i < 2; i++ {
+				_, status, _, err := cachedChecker.CheckRequest(req, testFlorenceToken, "")
+				So(err, ShouldEqual, errIdentity)
+				So(status, ShouldEqual, http.StatusInternalServerError)
+			}
+			So(checker.CheckRequestCalls(), ShouldHaveLength, 2)
+			So(cache.Len(), ShouldEqual, 0)
+		})
+	})
+
+	Convey("Given an identity cache and an identity checker that gets an error response from Zebedee", t, func() {
+		cache := middleware.NewIdentityCache(time.Minute, 5*time.Second, 10)
+		checker := identityCheckerMock("", http.StatusInternalServerError, errAuthFailure, nil)
+		cachedChecker := cache.Checker(checker)
+		req := httptest.NewRequest(http.MethodGet, "/datasets", http.NoBody)
+
+		Convey("When the same tokens are checked twice, the failure is returned and not cached", func() {
+			for i := 0; i < 2; i++ {
+				_, status, authFailure, err := cachedChecker.CheckRequest(req, testFlorenceToken, "")
+				So(err, ShouldBeNil)
+				So(authFailure, ShouldEqual, errAuthFailure)
+				So(status, ShouldEqual, http.StatusInternalServerError)
+			}
+			So(checker.CheckRequestCalls(), ShouldHaveLength, 2)
+			So(cache.Len(), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestIdentityCacheInvalidateHandler(t *testing.T) {
+	Convey("Given an identity cache with a cached result", t, func() {
+		cache := middleware.NewIdentityCache(time.Minute, 5*time.Second, 10)
+		req := httptest.NewRequest(http.MethodGet, "/datasets", http.NoBody)
+		_, _, _, err := cache.Checker(identityCheckerMock(testIdentity, http.StatusOK, nil, nil)).CheckRequest(req, testFlorenceToken, "")
+		So(err, ShouldBeNil)
+
+		Convey("When a request to invalidate the token is handled, the result is removed and the count is returned", func() {
+			w := httptest.NewRecorder()
+			cache.InvalidateHandler(w, httptest.NewRequest(http.MethodPost, "/admin/identity-cache/invalidate",
+				strings.NewReader(`{"token": "`+testFlorenceToken+`"}`)))
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Header().Get("Content-Type"), ShouldEqual, "application/json")
+			So(w.Body.String(), ShouldEqual, `{"invalidated":1}`+"\n")
+			So(cache.Len(), ShouldEqual, 0)
+		})
+
+		for _, body := range []string{"", "{not json", `{"token": ""}`} {
+			Convey("When a request without a valid token is handled, status BadRequest is returned: "+body, func() {
+				w := httptest.NewRecorder()
+				cache.InvalidateHandler(w, httptest.NewRequest(http.MethodPost, "/admin/identity-cache/invalidate", strings.NewReader(body)))
+				So(w.Code, ShouldEqual, http.StatusBadRequest)
+				So(cache.Len(), ShouldEqual, 1)
+			})
+		}
+	})
+}
@@ -0,0 +1,179 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/ONSdigital/dp-api-router/metrics"
+	dphttp "github.com/ONSdigital/dp-net/v3/http"
+	"github.com/ONSdigital/log.go/v2/log"
+	"github.com/pkg/errors"
+)
+
+// Possible reasons for requests to be rejected by the IP filter, as counted by the ip_filtered_requests_total metric
+const (
+	IPFilterDenied     = "denied"
+	IPFilterNotAllowed = "not_allowed"
+)
+
+var ipFilteredRequests = metrics.NewCounterVec("ip_filtered_requests_total",
+	"Requests that were rejected because of the IP address of the client", "reason")
+
+type ipFilterConfig struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+	Rules []struct {
+		Routes []string `json:"routes"`
+		Allow  []string `json:"allow"`
+		Deny   []string `json:"deny"`
+	} `json:"rules"`
+}
+
+// IPFilter rejects requests from client IP addresses that are denied, or not allowed, globally or by the rules that
+// match the request. The client IP address is resolved by the ClientIPResolver handler, so that it can't be spoofed
+// by the client.
+type IPFilter struct {
+	global  ipFilterRule
+	rules   []ipFilterRule
+	auditor *RejectionAuditor
+}
+
+type ipFilterRule struct {
+	routes *http.ServeMux
+	allow  []netip.Prefix
+	deny   []netip.Prefix
+}
+
+// LoadIPFilter loads and validates IP allow and deny lists. It takes in a function that returns the loaded bytes
+// (eg. a function that loads content from disk), which contain a JSON object of the global lists and the rules with
+// lists for routes.
+func LoadIPFilter(loader func() ([]byte, error)) (*IPFilter, error) {
+	configJSON, err := loader()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to load ip filter config")
+	}
+
+	var config ipFilterConfig
+	if len(configJSON) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(configJSON))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&config); err != nil {
+			return nil, errors.Wrap(err, "invalid json in ip filter config")
+		}
+	}
+
+	filter := &IPFilter{rules: make([]ipFilterRule, len(config.Rules))}
+	if filter.global, err = newIPFilterRule(nil, config.Allow, config.Deny); err != nil {
+		return nil, err
+	}
+	for i, c := range config.Rules {
+		if len(c.Routes) == 0 {
+			return nil, errors.New("ip filter rules require at least one route")
+		}
+		if filter.rules[i], err = newIPFilterRule(c.Routes, c.Allow, c.Deny); err != nil {
+			return nil, err
+		}
+	}
+	return filter, nil
+}
+
+// newIPFilterRule creates a rule from its routes (or none for the global lists) and its allow and deny lists
+func newIPFilterRule(routes, allow, deny []string) (rule ipFilterRule, err error) {
+	if len(routes) > 0 {
+		if rule.routes, err = newRuleMux(routes); err != nil {
+			return rule, errors.Wrap(err, "invalid routes in ip filter config")
+		}
+	}
+	if rule.allow, err = parsePrefixes(allow); err != nil {
+		return rule, errors.Wrap(err, "invalid allow list in ip filter config")
+	}
+	if rule.deny, err = parsePrefixes(deny); err != nil {
+		return rule, errors.Wrap(err, "invalid deny list in ip filter config")
+	}
+	return rule, nil
+}
+
+// parsePrefixes parses a list of CIDRs, where a single IP address is treated as a CIDR of just that address
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// containsAddr returns true if any of the prefixes contains the address
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetAuditor sets the auditor of the requests that are rejected. The IP filter runs before the audit handler, so that
+// rejected requests don't cause identity lookups, which means it audits the requests it rejects itself.
+func (f *IPFilter) SetAuditor(auditor *RejectionAuditor) {
+	f.auditor = auditor
+}
+
+// Handler is a middleware handler that responds with 403 Forbidden if the client IP address of a request is in any
+// deny list that applies to it, or isn't in every allow list that applies to it. Rejected requests are audited by the
+// auditor, if there is one.
+func (f *IPFilter) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		clientIP, ok := ClientIP(req)
+
+		reason := f.global.check(clientIP, ok)
+		for i := 0; reason == "" && i < len(f.rules); i++ {
+			if matches(f.rules[i].routes, req) {
+				reason = f.rules[i].check(clientIP, ok)
+			}
+		}
+
+		if reason != "" {
+			ipFilteredRequests.Inc(reason)
+			log.Info(req.Context(), "request rejected by ip filter", log.Data{
+				"client_ip": clientIP.String(),
+				"reason":    reason,
+				"path":      req.URL.Path,
+				"method":    req.Method,
+			})
+			f.auditor.Audit(req, http.StatusForbidden)
+			dphttp.DrainBody(req)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
+
+// check returns the reason that the client IP address is rejected by the rule, or an empty string if it isn't.
+// An address that couldn't be determined is only rejected if the rule has an allow list.
+func (rule ipFilterRule) check(clientIP netip.Addr, ok bool) string {
+	if ok && containsAddr(rule.deny, clientIP) {
+		return IPFilterDenied
+	}
+	if len(rule.allow) > 0 && (!ok || !containsAddr(rule.allow, clientIP)) {
+		return IPFilterNotAllowed
+	}
+	return ""
+}
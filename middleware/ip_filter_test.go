@@ -0,0 +1,137 @@
+package middleware_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ONSdigital/dp-api-router/event"
+	"github.com/ONSdigital/dp-api-router/middleware"
+	"github.com/ONSdigital/dp-api-router/schema"
+	"github.com/ONSdigital/dp-kafka/v2/kafkatest"
+	dprequest "github.com/ONSdigital/dp-net/v3/request"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const testIPFilterConfig = `{
+  "deny": ["203.0.113.0/24"],
+  "rules": [
+    {"routes": ["/v1/jobs", "/v1/instances/"], "allow": ["10.0.0.0/8", "192.168.1.1"]},
+    {"routes": ["GET /v1/search"], "deny": ["198.51.100.7", "2001:db8::/32"]}
+  ]
+}`
+
+// loadIPFilter loads an IP filter from the provided JSON
+func loadIPFilter(config string) (*middleware.IPFilter, error) {
+	return middleware.LoadIPFilter(func() ([]byte, error) {
+		return []byte(config), nil
+	})
+}
+
+func TestLoadIPFilter(t *testing.T) {
+	Convey("Valid and empty configs are loaded", t, func() {
+		for _, config := range []string{testIPFilterConfig, "", "{}"} {
+			filter, err := loadIPFilter(config)
+			So(err, ShouldBeNil)
+			So(filter, ShouldNotBeNil)
+		}
+	})
+
+	Convey("An error loading the config is returned", t, func() {
+		_, err := middleware.LoadIPFilter(func() ([]byte, error) {
+			return nil, errors.New("file not found")
+		})
+		So(err, ShouldNotBeNil)
+	})
+
+	tests := map[string]string{
+		"invalid json":        `{"deny":`,
+		"unknown field":       `{"trusted_proxies": ["10.0.0.1"]}`,
+		"invalid global cidr": `{"allow": ["10.0.0"]}`,
+		"invalid rule cidr":   `{"rules": [{"routes": ["/v1/jobs"], "deny": ["my-host"]}]}`,
+		"rule without routes": `{"rules": [{"deny": ["10.0.0.0/8"]}]}`,
+		"invalid route":       `{"rules": [{"routes": ["/v1/jobs/{id"], "deny": ["10.0.0.0/8"]}]}`,
+	}
+	for name, config := range tests {
+		Convey("A config with an "+name+" is rejected", t, func() {
+			filter, err := loadIPFilter(config)
+			So(err, ShouldNotBeNil)
+			So(filter, ShouldBeNil)
+		})
+	}
+}
+
+func TestIPFilter(t *testing.T) {
+	filter, err := loadIPFilter(testIPFilterConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := filter.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		remoteAddr string
+		expected   int
+	}{
+		{"a public route from any address is allowed", http.MethodGet, "/v1/datasets", "1.2.3.4:5678", http.StatusOK},
+		{"a globally denied address is forbidden", http.MethodGet, "/v1/datasets", "203.0.113.9:5678", http.StatusForbidden},
+		{"a private route from an allowed range is allowed", http.MethodPost, "/v1/jobs", "10.2.3.4:5678", http.StatusOK},
+		{"a private route from an allowed address is allowed", http.MethodGet, "/v1/instances/123", "192.168.1.1:5678", http.StatusOK},
+		{"a private route from another address is forbidden", http.MethodGet, "/v1/instances/123", "192.168.1.2:5678", http.StatusForbidden},
+		{"a private route from an unknown address is forbidden", http.MethodGet, "/v1/jobs", "pipe", http.StatusForbidden},
+		{"a route's denied address is forbidden", http.MethodGet, "/v1/search?q=cpi", "198.51.100.7:5678", http.StatusForbidden},
+		{"a route's denied IPv6 range is forbidden", http.MethodGet, "/v1/search", "[2001:db8::1]:5678", http.StatusForbidden},
+		{"a route's denied address is allowed on other methods", http.MethodPost, "/v1/search", "198.51.100.7:5678", http.StatusOK},
+	}
+	for _, tc := range tests {
+		Convey("Given "+tc.name, t, func() {
+			req := httptest.NewRequest(tc.method, tc.target, http.NoBody)
+			req.RemoteAddr = tc.remoteAddr
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, tc.expected)
+		})
+	}
+}
+
+func TestIPFilterAudit(t *testing.T) {
+	Convey("Given an IP filter with an auditor, followed by an audit handler", t, func(c C) {
+		filter, err := loadIPFilter(testIPFilterConfig)
+		So(err, ShouldBeNil)
+
+		p := kafkatest.NewMessageProducer(true)
+		auditProducer := event.NewAvroProducer(p.Channels().Output, schema.AuditEvent)
+		filter.SetAuditor(middleware.NewRejectionAuditor(auditProducer, testAuditRules, true, nil))
+		cliMock := createHTTPClientMock(http.StatusOK, testIdentityResponse)
+		auditHandler := middleware.AuditHandler(auditProducer, cliMock, testZebedeeURL, testAuditRules, nil, true, nil, nil)
+		handler := filter.Handler(auditHandler(testHandler(http.StatusOK, testBody, c)))
+
+		Convey("When a request to a private route is made from outside the allowed range", func(c C) {
+			req := httptest.NewRequest(http.MethodGet, "/v1/jobs", http.NoBody)
+			req.RemoteAddr = "1.2.3.4:5678"
+			req.Header.Set(dprequest.FlorenceHeaderKey, testFlorenceToken)
+			w := httptest.NewRecorder()
+			auditEvents := serveAndCaptureAudit(c, w, req, handler, p.Channels().Output, 1)
+
+			Convey("Then the forbidden response is audited once, without looking up the identity", func() {
+				So(w.Code, ShouldEqual, http.StatusForbidden)
+				So(auditEvents[0].Path, ShouldEqual, "/v1/jobs")
+				So(auditEvents[0].Identity, ShouldBeEmpty)
+				So(auditEvents[0].StatusCode, ShouldEqual, int32(http.StatusForbidden))
+				So(cliMock.DoCalls(), ShouldBeEmpty)
+			})
+		})
+
+		Convey("When a request to an ignored path is made from a denied address, then it is not audited", func() {
+			req := httptest.NewRequest(http.MethodGet, "/ping", http.NoBody)
+			req.RemoteAddr = "203.0.113.9:5678"
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+			So(p.Channels().Output, ShouldBeEmpty)
+		})
+	})
+}
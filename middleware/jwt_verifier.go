@@ -0,0 +1,244 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	authjwt "github.com/ONSdigital/dp-authorisation/v2/jwt"
+	"github.com/ONSdigital/dp-healthcheck/healthcheck"
+	dphttp "github.com/ONSdigital/dp-net/v3/http"
+	permsdk "github.com/ONSdigital/dp-permissions-api/sdk"
+	"github.com/ONSdigital/log.go/v2/log"
+	"github.com/pkg/errors"
+)
+
+//go:generate moq -out ./mock/jwt_key_fetcher.go -pkg mock . JWTKeyFetcher
+
+// identityJWTKeysPath is the identity API endpoint that provides the JWT public signing keys
+const identityJWTKeysPath = "/v1/jwt-keys"
+
+// unknownKeyRefreshInterval is the minimum time between refreshes triggered by JWTs signed with an unknown key,
+// so that tokens with made-up key IDs can't be used to flood the identity API
+const unknownKeyRefreshInterval = 30 * time.Second
+
+// Health check messages for the JWT verification keys
+const (
+	msgJWTKeysOK      = "jwt verification keys are up to date"
+	msgJWTKeysStale   = "jwt verification keys have not been refreshed since %s"
+	msgJWTKeysMissing = "no jwt verification keys have been loaded"
+)
+
+// ErrNoJWTKeys is returned when a JWT is verified before any public keys have been loaded
+var ErrNoJWTKeys = errors.New("no jwt verification keys have been loaded")
+
+// JWTKeyFetcher fetches the base64 encoded RSA public keys used to verify JWTs, keyed by key ID
+type JWTKeyFetcher interface {
+	FetchKeys(ctx context.Context) (map[string]string, error)
+}
+
+// IdentityKeyFetcher fetches the JWT public keys from the identity API
+type IdentityKeyFetcher struct {
+	client dphttp.Clienter
+	url    string
+}
+
+// NewIdentityKeyFetcher creates a JWTKeyFetcher for the identity API at identityAPIURL
+func NewIdentityKeyFetcher(client dphttp.Clienter, identityAPIURL string) *IdentityKeyFetcher {
+	return &IdentityKeyFetcher{
+		client: client,
+		url:    strings.TrimSuffix(identityAPIURL, "/") + identityJWTKeysPath,
+	}
+}
+
+// FetchKeys requests the current JWT public keys from the identity API
+func (f *IdentityKeyFetcher) FetchKeys(ctx context.Context) (map[string]string, error) {
+	resp, err := f.client.Get(ctx, f.url)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to request jwt keys from identity api")
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("identity api responded to jwt keys request with unexpected status code %d", resp.StatusCode)
+	}
+
+	keys := map[string]string{}
+	if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+		return nil, errors.Wrap(err, "failed to decode jwt keys from identity api")
+	}
+	return keys, nil
+}
+
+// StaticKeyFetcher always provides the same JWT public keys. It stands in for the identity API when running locally
+// and in tests.
+type StaticKeyFetcher map[string]string
+
+// FetchKeys returns the static keys
+func (f StaticKeyFetcher) FetchKeys(ctx context.Context) (map[string]string, error) {
+	return f, nil
+}
+
+// JWTVerifier verifies JWTs against a set of public keys, which are refreshed in the background so that keys can be
+// rotated without restarting the router. A JWT signed with a key that is not yet known also triggers a refresh, so
+// tokens signed with a newly rotated key are accepted before the next scheduled refresh.
+type JWTVerifier struct {
+	fetcher         JWTKeyFetcher
+	refreshInterval time.Duration
+	maxKeyAge       time.Duration
+
+	parser atomic.Pointer[authjwt.CognitoRSAParser]
+
+	mu                 sync.Mutex
+	lastRefreshed      time.Time
+	lastUnknownRefresh time.Time
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// NewJWTVerifier creates a JWTVerifier and loads its keys with the provided fetcher. If the keys can't be loaded the
+// error is logged, and they are loaded by the next refresh. Keys are refreshed every refreshInterval once the verifier
+// is started, and are reported as stale by the health check once they have not been refreshed for maxKeyAge.
+func NewJWTVerifier(ctx context.Context, fetcher JWTKeyFetcher, refreshInterval, maxKeyAge time.Duration) *JWTVerifier {
+	v := &JWTVerifier{
+		fetcher:         fetcher,
+		refreshInterval: refreshInterval,
+		maxKeyAge:       maxKeyAge,
+		stop:            make(chan struct{}),
+	}
+	if err := v.Refresh(ctx); err != nil {
+		log.Error(ctx, "failed to load jwt verification keys", err)
+	}
+	return v
+}
+
+// Refresh fetches the current keys and replaces the keys used to verify JWTs with them
+func (v *JWTVerifier) Refresh(ctx context.Context) error {
+	keys, err := v.fetcher.FetchKeys(ctx)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return ErrNoJWTKeys
+	}
+
+	parser, err := authjwt.NewCognitoRSAParser(keys)
+	if err != nil {
+		return err
+	}
+	v.parser.Store(parser)
+
+	v.mu.Lock()
+	v.lastRefreshed = Now()
+	v.mu.Unlock()
+
+	log.Info(ctx, "jwt verification keys refreshed", log.Data{"key_count": len(keys)})
+	return nil
+}
+
+// Start refreshes the keys every refresh interval, until the verifier is stopped
+func (v *JWTVerifier) Start(ctx context.Context) {
+	if v.refreshInterval <= 0 {
+		return
+	}
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+		ticker := time.NewTicker(v.refreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := v.Refresh(ctx); err != nil {
+					log.Error(ctx, "failed to refresh jwt verification keys", err)
+				}
+			case <-v.stop:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops refreshing the keys, waiting for any refresh in progress to finish
+func (v *JWTVerifier) Stop() {
+	v.stopOnce.Do(func() {
+		close(v.stop)
+	})
+	v.wg.Wait()
+}
+
+// Parse verifies the JWT and returns the entity data it contains. If no keys have been loaded yet, or the JWT is
+// signed with an unknown key, the keys are refreshed (at most once every unknownKeyRefreshInterval) and the JWT is
+// verified again.
+func (v *JWTVerifier) Parse(ctx context.Context, token string) (*permsdk.EntityData, error) {
+	parser := v.parser.Load()
+	if parser == nil {
+		if !v.allowUnknownKeyRefresh() {
+			return nil, ErrNoJWTKeys
+		}
+		if err := v.Refresh(ctx); err != nil {
+			log.Error(ctx, "failed to load jwt verification keys", err)
+			return nil, ErrNoJWTKeys
+		}
+		return v.parser.Load().Parse(token)
+	}
+
+	entityData, err := parser.Parse(token)
+	if !errors.Is(err, authjwt.ErrJWTKeySet) || !v.allowUnknownKeyRefresh() {
+		return entityData, err
+	}
+
+	if refreshErr := v.Refresh(ctx); refreshErr != nil {
+		log.Error(ctx, "failed to refresh jwt verification keys for unknown key", refreshErr)
+		return nil, err
+	}
+	return v.parser.Load().Parse(token)
+}
+
+// allowUnknownKeyRefresh returns true, and records the time, if no refresh has been triggered by an unknown key, or by
+// there being no keys, within the last unknownKeyRefreshInterval
+func (v *JWTVerifier) allowUnknownKeyRefresh() bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := Now()
+	if !v.lastUnknownRefresh.IsZero() && now.Sub(v.lastUnknownRefresh) < unknownKeyRefreshInterval {
+		return false
+	}
+	v.lastUnknownRefresh = now
+	return true
+}
+
+// Checker reports the freshness of the keys. It is critical if no keys have been loaded, and a warning if they have
+// not been refreshed for longer than the maximum key age.
+func (v *JWTVerifier) Checker(ctx context.Context, state *healthcheck.CheckState) error {
+	v.mu.Lock()
+	lastRefreshed := v.lastRefreshed
+	v.mu.Unlock()
+
+	status, message := healthcheck.StatusOK, msgJWTKeysOK
+	switch {
+	case lastRefreshed.IsZero():
+		status, message = healthcheck.StatusCritical, msgJWTKeysMissing
+	case v.maxKeyAge > 0 && Now().Sub(lastRefreshed) > v.maxKeyAge:
+		status, message = healthcheck.StatusWarning, fmt.Sprintf(msgJWTKeysStale, lastRefreshed.UTC().Format(time.RFC3339))
+	}
+
+	if err := state.Update(status, message, 0); err != nil {
+		log.Error(ctx, "failed to update jwt verification keys health state", err)
+		return err
+	}
+	return nil
+}
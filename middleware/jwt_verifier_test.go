@@ -0,0 +1,251 @@
+package middleware_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/dp-api-router/middleware"
+	"github.com/ONSdigital/dp-api-router/middleware/mock"
+	"github.com/ONSdigital/dp-healthcheck/healthcheck"
+	dphttp "github.com/ONSdigital/dp-net/v3/http"
+	"github.com/golang-jwt/jwt/v4"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	testJWTKeyID        = "key-1"
+	testRotatedJWTKeyID = "key-2"
+	testJWTUser         = "jwt-user@ons.gov.uk"
+)
+
+var (
+	errFetchKeys = errors.New("identity api unavailable")
+	testKeyTime  = time.Date(2020, time.April, 26, 7, 5, 52, 0, time.UTC)
+)
+
+// testJWTKey is an RSA key pair used to sign test JWTs
+type testJWTKey struct {
+	id      string
+	private *rsa.PrivateKey
+}
+
+func newTestJWTKey(id string) *testJWTKey {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	So(err, ShouldBeNil)
+	return &testJWTKey{id: id, private: private}
+}
+
+// encodedPublicKey returns the public key in the format provided by the identity API
+func (k *testJWTKey) encodedPublicKey() string {
+	b, err := x509.MarshalPKIXPublicKey(&k.private.PublicKey)
+	So(err, ShouldBeNil)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// sign returns a JWT for the user, signed with the key, that expires at the provided time
+func (k *testJWTKey) sign(username string, expiresAt time.Time) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"username":       username,
+		"cognito:groups": []string{"role-admin"},
+		"exp":            expiresAt.Unix(),
+	})
+	token.Header["kid"] = k.id
+	signed, err := token.SignedString(k.private)
+	So(err, ShouldBeNil)
+	return signed
+}
+
+// keyFetcherMock returns a fetcher that provides the public keys of the provided keys
+func keyFetcherMock(keys ...*testJWTKey) *mock.JWTKeyFetcherMock {
+	return &mock.JWTKeyFetcherMock{
+		FetchKeysFunc: func(ctx context.Context) (map[string]string, error) {
+			encoded := map[string]string{}
+			for _, key := range keys {
+				encoded[key.id] = key.encodedPublicKey()
+			}
+			return encoded, nil
+		},
+	}
+}
+
+// checkState runs the verifier health check and returns the resulting state
+func checkState(verifier *middleware.JWTVerifier) *healthcheck.CheckState {
+	state := healthcheck.NewCheckState("JWT Verification Keys")
+	So(verifier.Checker(context.Background(), state), ShouldBeNil)
+	return state
+}
+
+func TestJWTVerifier(t *testing.T) {
+	Convey("Given a JWT verifier with a single key", t, func() {
+		now := testKeyTime
+		middleware.Now = func() time.Time { return now }
+
+		key := newTestJWTKey(testJWTKeyID)
+		fetcher := keyFetcherMock(key)
+		verifier := middleware.NewJWTVerifier(context.Background(), fetcher, time.Minute, 10*time.Minute)
+
+		Convey("When a valid JWT is verified, then the user is returned", func() {
+			entityData, err := verifier.Parse(context.Background(), key.sign(testJWTUser, time.Now().Add(time.Hour)))
+			So(err, ShouldBeNil)
+			So(entityData.UserID, ShouldEqual, testJWTUser)
+			So(fetcher.FetchKeysCalls(), ShouldHaveLength, 1)
+		})
+
+		Convey("When an expired JWT is verified, then an error is returned without refreshing the keys", func() {
+			_, err := verifier.Parse(context.Background(), key.sign(testJWTUser, time.Now().Add(-time.Hour)))
+			So(err, ShouldNotBeNil)
+			So(fetcher.FetchKeysCalls(), ShouldHaveLength, 1)
+		})
+
+		Convey("When the key is rotated by the identity API", func() {
+			rotatedKey := newTestJWTKey(testRotatedJWTKeyID)
+			fetcher.FetchKeysFunc = keyFetcherMock(rotatedKey).FetchKeysFunc
+
+			Convey("Then a JWT signed with the new key is accepted after refreshing the keys", func() {
+				entityData, err := verifier.Parse(context.Background(), rotatedKey.sign(testJWTUser, time.Now().Add(time.Hour)))
+				So(err, ShouldBeNil)
+				So(entityData.UserID, ShouldEqual, testJWTUser)
+				So(fetcher.FetchKeysCalls(), ShouldHaveLength, 2)
+
+				Convey("And a JWT signed with the old key is no longer accepted", func() {
+					_, err := verifier.Parse(context.Background(), key.sign(testJWTUser, time.Now().Add(time.Hour)))
+					So(err, ShouldNotBeNil)
+				})
+			})
+
+			Convey("Then JWTs signed with unknown keys only trigger a refresh once every 30 seconds", func() {
+				unknownKey := newTestJWTKey("unknown")
+				for i := 0; i < 3; i++ {
+					_, err := verifier.Parse(context.Background(), unknownKey.sign(testJWTUser, time.Now().Add(time.Hour)))
+					So(err, ShouldNotBeNil)
+				}
+				So(fetcher.FetchKeysCalls(), ShouldHaveLength, 2)
+
+				now = now.Add(31 * time.Second)
+				_, err := verifier.Parse(context.Background(), unknownKey.sign(testJWTUser, time.Now().Add(time.Hour)))
+				So(err, ShouldNotBeNil)
+				So(fetcher.FetchKeysCalls(), ShouldHaveLength, 3)
+			})
+		})
+
+		Convey("Then the health check is OK until the keys are older than the maximum key age", func() {
+			So(checkState(verifier).Status(), ShouldEqual, healthcheck.StatusOK)
+
+			now = now.Add(11 * time.Minute)
+			state := checkState(verifier)
+			So(state.Status(), ShouldEqual, healthcheck.StatusWarning)
+			So(state.Message(), ShouldContainSubstring, testKeyTime.Format(time.RFC3339))
+
+			Convey("And OK again once the keys are refreshed", func() {
+				So(verifier.Refresh(context.Background()), ShouldBeNil)
+				So(checkState(verifier).Status(), ShouldEqual, healthcheck.StatusOK)
+			})
+		})
+	})
+
+	Convey("Given a JWT verifier whose keys can't be fetched", t, func() {
+		now := testKeyTime
+		middleware.Now = func() time.Time { return now }
+
+		fetcher := &mock.JWTKeyFetcherMock{
+			FetchKeysFunc: func(ctx context.Context) (map[string]string, error) {
+				return nil, errFetchKeys
+			},
+		}
+		verifier := middleware.NewJWTVerifier(context.Background(), fetcher, time.Minute, 10*time.Minute)
+
+		Convey("When JWTs are verified, then they fail because there are no keys, with a refresh once every 30 seconds", func() {
+			for i := 0; i < 3; i++ {
+				_, err := verifier.Parse(context.Background(), "a.b.c")
+				So(err, ShouldEqual, middleware.ErrNoJWTKeys)
+			}
+			So(fetcher.FetchKeysCalls(), ShouldHaveLength, 2)
+
+			Convey("And a JWT is accepted once the keys can be fetched", func() {
+				key := newTestJWTKey(testJWTKeyID)
+				fetcher.FetchKeysFunc = keyFetcherMock(key).FetchKeysFunc
+				now = now.Add(31 * time.Second)
+
+				entityData, err := verifier.Parse(context.Background(), key.sign(testJWTUser, time.Now().Add(time.Hour)))
+				So(err, ShouldBeNil)
+				So(entityData.UserID, ShouldEqual, testJWTUser)
+				So(fetcher.FetchKeysCalls(), ShouldHaveLength, 3)
+			})
+		})
+
+		Convey("Then the health check is critical", func() {
+			state := checkState(verifier)
+			So(state.Status(), ShouldEqual, healthcheck.StatusCritical)
+		})
+	})
+
+	Convey("Given a started JWT verifier with a short refresh interval", t, func() {
+		middleware.Now = time.Now
+		var mu sync.Mutex
+		refreshed := make(chan struct{})
+		calls := 0
+		keys := middleware.StaticKeyFetcher{testJWTKeyID: newTestJWTKey(testJWTKeyID).encodedPublicKey()}
+		fetcher := &mock.JWTKeyFetcherMock{
+			FetchKeysFunc: func(ctx context.Context) (map[string]string, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				calls++
+				if calls == 3 {
+					close(refreshed)
+				}
+				return keys, nil
+			},
+		}
+		verifier := middleware.NewJWTVerifier(context.Background(), fetcher, 10*time.Millisecond, time.Minute)
+		verifier.Start(context.Background())
+
+		Convey("Then the keys are refreshed in the background until it is stopped", func() {
+			select {
+			case <-refreshed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("keys were not refreshed in the background")
+			}
+			verifier.Stop()
+
+			mu.Lock()
+			stoppedCalls := calls
+			mu.Unlock()
+			time.Sleep(50 * time.Millisecond)
+			So(fetcher.FetchKeysCalls(), ShouldHaveLength, stoppedCalls)
+		})
+	})
+}
+
+func TestIdentityKeyFetcher(t *testing.T) {
+	Convey("Given an identity API that provides JWT keys", t, func(c C) {
+		statusCode := http.StatusOK
+		identityAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			c.So(req.URL.Path, ShouldEqual, "/v1/jwt-keys")
+			w.WriteHeader(statusCode)
+			_, _ = w.Write([]byte(`{"key-1":"abc","key-2":"def"}`))
+		}))
+		defer identityAPI.Close()
+		fetcher := middleware.NewIdentityKeyFetcher(dphttp.NewClient(), identityAPI.URL+"/")
+
+		Convey("When the keys are fetched, then they are returned", func() {
+			keys, err := fetcher.FetchKeys(context.Background())
+			So(err, ShouldBeNil)
+			So(keys, ShouldResemble, map[string]string{"key-1": "abc", "key-2": "def"})
+		})
+
+		Convey("When the identity API responds with an error status, then an error is returned", func() {
+			statusCode = http.StatusNotFound
+			_, err := fetcher.FetchKeys(context.Background())
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
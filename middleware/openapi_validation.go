@@ -0,0 +1,298 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ONSdigital/dp-api-router/metrics"
+	"github.com/ONSdigital/dp-api-router/openapi"
+	dphttp "github.com/ONSdigital/dp-net/v3/http"
+	"github.com/ONSdigital/log.go/v2/log"
+	"github.com/pkg/errors"
+)
+
+// defaultOpenAPIMaxBodySize is the size in bytes of the largest bodies that are validated, unless configured
+const defaultOpenAPIMaxBodySize = 10 * 1024 * 1024
+
+// Directions of the OpenAPI validation failures, as counted by the openapi_validation_failures_total metric
+const (
+	OpenAPIRequest  = "request"
+	OpenAPIResponse = "response"
+)
+
+var openAPIValidationFailures = metrics.NewCounterVec("openapi_validation_failures_total",
+	"Requests and responses that didn't match the OpenAPI spec of their API", "api", "direction")
+
+type openAPIValidationConfig struct {
+	ValidateResponses bool  `json:"validate_responses"`
+	MaxBodySize       int64 `json:"max_body_size"`
+	APIs              []struct {
+		Name     string   `json:"name"`
+		Routes   []string `json:"routes"`
+		Spec     string   `json:"spec"`
+		BasePath *string  `json:"base_path"`
+	} `json:"apis"`
+}
+
+// OpenAPIValidator validates requests, and optionally responses, against the OpenAPI specs of the APIs they are for
+type OpenAPIValidator struct {
+	apis              []openAPI
+	validateResponses bool
+	maxBodySize       int64
+}
+
+// openAPI is the spec of the API for the requests that match its routes
+type openAPI struct {
+	name     string
+	routes   *http.ServeMux
+	spec     *openapi.Spec
+	basePath string
+}
+
+// problem is an RFC 9457 problem details response, with the violations of the request
+type problem struct {
+	Type     string              `json:"type"`
+	Title    string              `json:"title"`
+	Status   int                 `json:"status"`
+	Detail   string              `json:"detail"`
+	Instance string              `json:"instance"`
+	Errors   []openapi.Violation `json:"errors"`
+}
+
+// LoadOpenAPIValidator loads and validates the OpenAPI validation config. It takes in a function that returns the
+// loaded bytes (eg. a function that loads content from disk), which contain a JSON object of the APIs with the routes
+// they serve, and a function that reads the OpenAPI spec files of the APIs. Response validation buffers a copy of every
+// response body, so it is only for non-production environments and the config is rejected if it enables it without
+// allowResponseValidation. Nil is returned if the config is empty.
+func LoadOpenAPIValidator(loader func() ([]byte, error), readSpec func(path string) ([]byte, error), allowResponseValidation bool) (*OpenAPIValidator, error) {
+	configJSON, err := loader()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to load openapi validation config")
+	}
+	if len(configJSON) == 0 {
+		return nil, nil
+	}
+
+	var config openAPIValidationConfig
+	if err := json.Unmarshal(configJSON, &config); err != nil {
+		return nil, errors.Wrap(err, "invalid json in openapi validation config")
+	}
+	if config.ValidateResponses && !allowResponseValidation {
+		return nil, errors.New("validate_responses in openapi validation config is only allowed in non-production environments, with ENABLE_OPENAPI_RESPONSE_VALIDATION")
+	}
+
+	validator := &OpenAPIValidator{
+		apis:              make([]openAPI, len(config.APIs)),
+		validateResponses: config.ValidateResponses,
+		maxBodySize:       config.MaxBodySize,
+	}
+	switch {
+	case validator.maxBodySize == 0:
+		validator.maxBodySize = defaultOpenAPIMaxBodySize
+	case validator.maxBodySize < 0:
+		return nil, errors.New("invalid negative max body size in openapi validation config")
+	}
+
+	for i, c := range config.APIs {
+		if c.Name == "" {
+			c.Name = strconv.Itoa(i)
+		}
+		if len(c.Routes) == 0 || c.Spec == "" {
+			return nil, fmt.Errorf("openapi validation of api '%s' requires at least one route and a spec", c.Name)
+		}
+
+		api := openAPI{name: c.Name}
+		if api.routes, err = newRuleMux(c.Routes); err != nil {
+			return nil, errors.Wrapf(err, "invalid routes in openapi validation of api '%s'", c.Name)
+		}
+		specBytes, err := readSpec(c.Spec)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to load openapi spec of api '%s'", c.Name)
+		}
+		if api.spec, err = openapi.LoadSpec(specBytes); err != nil {
+			return nil, errors.Wrapf(err, "invalid openapi spec of api '%s'", c.Name)
+		}
+		api.basePath = api.spec.BasePath()
+		if c.BasePath != nil {
+			api.basePath = strings.TrimSuffix(*c.BasePath, "/")
+		}
+		validator.apis[i] = api
+	}
+	return validator, nil
+}
+
+// Handler is a middleware handler that validates the requests for operations documented by the spec of their API,
+// rejecting invalid requests with a 400 Bad Request problem details response. Requests for operations that aren't
+// documented are passed on without being validated. If response validation is enabled, the responses are validated
+// too and any violations are logged, but the responses are passed on unchanged.
+func (v *OpenAPIValidator) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		api := v.apiFor(req)
+		if api == nil {
+			h.ServeHTTP(w, req)
+			return
+		}
+		path, ok := strings.CutPrefix(req.URL.Path, api.basePath)
+		if !ok {
+			h.ServeHTTP(w, req)
+			return
+		}
+		if path == "" {
+			path = "/"
+		}
+		op, ok := api.spec.FindOperation(req.Method, path)
+		if !ok {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		ctx := req.Context()
+		logData := log.Data{"api": api.name, "path": req.URL.Path, "method": req.Method, "operation": op.OperationID}
+
+		var body []byte
+		bodyComplete := true
+		if op.HasRequestBody() {
+			body, bodyComplete = v.readBody(req)
+		}
+		if violations := op.ValidateRequest(req, body, bodyComplete); len(violations) > 0 {
+			openAPIValidationFailures.Inc(api.name, OpenAPIRequest)
+			logData["violations"] = violations
+			log.Info(ctx, "request rejected: does not match openapi spec", logData)
+			writeProblem(w, req, violations)
+			return
+		}
+
+		if !v.validateResponses {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		rc := &responseCapture{ResponseWriter: w, status: http.StatusOK, maxBodySize: v.maxBodySize}
+		h.ServeHTTP(rc, req)
+		if rc.hijacked {
+			return
+		}
+		if violations := op.ValidateResponse(req, rc.status, w.Header(), rc.body.Bytes(), !rc.truncated); len(violations) > 0 {
+			openAPIValidationFailures.Inc(api.name, OpenAPIResponse)
+			logData["status"] = rc.status
+			logData["violations"] = violations
+			log.Warn(ctx, "response does not match openapi spec", logData)
+		}
+	})
+}
+
+// apiFor returns the first API with routes that match the request, or nil if there isn't one
+func (v *OpenAPIValidator) apiFor(req *http.Request) *openAPI {
+	for i := range v.apis {
+		if matches(v.apis[i].routes, req) {
+			return &v.apis[i]
+		}
+	}
+	return nil
+}
+
+// readBody reads the body of the request up to the max body size, replacing it so that it can still be proxied, and
+// returns whether the whole body was read
+func (v *OpenAPIValidator) readBody(req *http.Request) ([]byte, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, v.maxBodySize+1))
+	complete := err == nil && int64(len(body)) <= v.maxBodySize
+	if err != nil {
+		log.Error(req.Context(), "failed to read request body for openapi validation", err)
+	}
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+	return body, complete
+}
+
+// writeProblem writes a 400 Bad Request problem details response for the violations of the request
+func writeProblem(w http.ResponseWriter, req *http.Request, violations []openapi.Violation) {
+	dphttp.DrainBody(req)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(http.StatusBadRequest)
+	err := json.NewEncoder(w).Encode(problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(http.StatusBadRequest),
+		Status:   http.StatusBadRequest,
+		Detail:   "the request does not match the api specification",
+		Instance: req.URL.Path,
+		Errors:   violations,
+	})
+	if err != nil {
+		log.Error(req.Context(), "failed to write problem response", err)
+	}
+}
+
+// responseCapture records the status code of the response and a copy of its body, up to maxBodySize, as it is written
+// to the wrapped responseWriter
+type responseCapture struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+	truncated   bool
+	hijacked    bool
+	maxBodySize int64
+}
+
+var (
+	_ http.Flusher  = &responseCapture{}
+	_ http.Hijacker = &responseCapture{}
+)
+
+// WriteHeader records the status code before writing it to the wrapped responseWriter
+func (rc *responseCapture) WriteHeader(status int) {
+	if !rc.wroteHeader && status >= http.StatusOK {
+		rc.status = status
+		rc.wroteHeader = true
+	}
+	rc.ResponseWriter.WriteHeader(status)
+}
+
+// Write copies the body, until it is larger than maxBodySize, before writing it to the wrapped responseWriter
+func (rc *responseCapture) Write(b []byte) (int, error) {
+	rc.wroteHeader = true
+	if !rc.truncated {
+		if int64(rc.body.Len()+len(b)) > rc.maxBodySize {
+			rc.truncated = true
+			rc.body.Reset()
+		} else {
+			rc.body.Write(b)
+		}
+	}
+	return rc.ResponseWriter.Write(b)
+}
+
+// Flush sends any buffered data to the client, if supported by the wrapped responseWriter
+func (rc *responseCapture) Flush() {
+	if f, ok := rc.ResponseWriter.(http.Flusher); ok {
+		rc.wroteHeader = true
+		f.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection, if supported by the wrapped responseWriter
+func (rc *responseCapture) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := rc.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	rc.hijacked = true
+	return hj.Hijack()
+}
+
+// Unwrap returns the wrapped responseWriter, for use by http.ResponseController
+func (rc *responseCapture) Unwrap() http.ResponseWriter {
+	return rc.ResponseWriter
+}
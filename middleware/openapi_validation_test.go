@@ -0,0 +1,184 @@
+package middleware_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ONSdigital/dp-api-router/metrics/metricstest"
+	"github.com/ONSdigital/dp-api-router/middleware"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const testOpenAPISpec = `{
+  "openapi": "3.0.3",
+  "info": {"title": "Dataset API", "version": "1.0.0"},
+  "paths": {
+    "/datasets": {
+      "get": {
+        "parameters": [{"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1}}],
+        "responses": {
+          "200": {
+            "description": "OK",
+            "content": {"application/json": {"schema": {"type": "object", "required": ["items"]}}}
+          }
+        }
+      },
+      "post": {
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {"type": "object", "required": ["title"], "properties": {"title": {"type": "string"}}}
+            }
+          }
+        },
+        "responses": {"201": {"description": "Created"}}
+      }
+    }
+  }
+}`
+
+var openAPIValidationFailures = metricstest.NewCounter("openapi_validation_failures_total", "api", "direction")
+
+// loadOpenAPIValidator loads an OpenAPI validator from the provided JSON, with the test spec for every API, as for a
+// non-production environment
+func loadOpenAPIValidator(config string) (*middleware.OpenAPIValidator, error) {
+	return middleware.LoadOpenAPIValidator(func() ([]byte, error) {
+		return []byte(config), nil
+	}, func(path string) ([]byte, error) {
+		if path != "dataset-api.json" {
+			return nil, errors.New("file not found")
+		}
+		return []byte(testOpenAPISpec), nil
+	}, true)
+}
+
+func TestLoadOpenAPIValidator(t *testing.T) {
+	Convey("Valid and empty configs are loaded", t, func() {
+		validator, err := loadOpenAPIValidator(`{"apis": [{"routes": ["/v1/datasets"], "spec": "dataset-api.json", "base_path": "/v1"}]}`)
+		So(err, ShouldBeNil)
+		So(validator, ShouldNotBeNil)
+
+		validator, err = loadOpenAPIValidator("")
+		So(err, ShouldBeNil)
+		So(validator, ShouldBeNil)
+	})
+
+	Convey("An error loading the config is returned", t, func() {
+		_, err := middleware.LoadOpenAPIValidator(func() ([]byte, error) {
+			return nil, errors.New("file not found")
+		}, nil, true)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("A config that validates responses is rejected unless response validation is allowed", t, func() {
+		validator, err := middleware.LoadOpenAPIValidator(func() ([]byte, error) {
+			return []byte(`{"validate_responses": true, "apis": []}`), nil
+		}, nil, false)
+		So(err, ShouldNotBeNil)
+		So(validator, ShouldBeNil)
+
+		validator, err = middleware.LoadOpenAPIValidator(func() ([]byte, error) {
+			return []byte(`{"validate_responses": false, "apis": []}`), nil
+		}, nil, false)
+		So(err, ShouldBeNil)
+		So(validator, ShouldNotBeNil)
+	})
+
+	tests := map[string]string{
+		"invalid json":           `{"apis":`,
+		"missing routes":         `{"apis": [{"spec": "dataset-api.json"}]}`,
+		"missing spec":           `{"apis": [{"routes": ["/v1/datasets"]}]}`,
+		"spec that isn't found":  `{"apis": [{"routes": ["/v1/datasets"], "spec": "other-api.json"}]}`,
+		"invalid route":          `{"apis": [{"routes": ["/v1/{id"], "spec": "dataset-api.json"}]}`,
+		"negative max body size": `{"max_body_size": -1, "apis": []}`,
+	}
+	for name, config := range tests {
+		Convey("A config with "+name+" is rejected", t, func() {
+			validator, err := loadOpenAPIValidator(config)
+			So(err, ShouldNotBeNil)
+			So(validator, ShouldBeNil)
+		})
+	}
+}
+
+func TestOpenAPIValidator(t *testing.T) {
+	Convey("Given an OpenAPI validator for the dataset API", t, func() {
+		validator, err := loadOpenAPIValidator(`{
+		  "validate_responses": true,
+		  "apis": [{"name": "dataset-api", "routes": ["/v1/datasets"], "spec": "dataset-api.json", "base_path": "/v1"}]
+		}`)
+		So(err, ShouldBeNil)
+
+		var proxiedBody string
+		upstreamBody := `{"items": []}`
+		proxied := false
+		handler := validator.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			proxied = true
+			body, _ := io.ReadAll(req.Body)
+			proxiedBody = string(body)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(upstreamBody))
+		}))
+		serve := func(method, target, body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, target, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			return w
+		}
+
+		Convey("When a valid request is received, then it is proxied with its body", func() {
+			w := serve(http.MethodPost, "/v1/datasets", `{"title": "CPIH"}`)
+			So(proxied, ShouldBeTrue)
+			So(proxiedBody, ShouldEqual, `{"title": "CPIH"}`)
+			So(w.Code, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("When an invalid request is received", func() {
+			w := serve(http.MethodGet, "/v1/datasets?limit=0", "")
+
+			Convey("Then it is rejected with a problem response listing the violations", func() {
+				So(proxied, ShouldBeFalse)
+				So(w.Code, ShouldEqual, http.StatusBadRequest)
+				So(w.Header().Get("Content-Type"), ShouldEqual, "application/problem+json")
+
+				var problem map[string]interface{}
+				So(json.Unmarshal(w.Body.Bytes(), &problem), ShouldBeNil)
+				So(problem, ShouldResemble, map[string]interface{}{
+					"type":     "about:blank",
+					"title":    "Bad Request",
+					"status":   400.0,
+					"detail":   "the request does not match the api specification",
+					"instance": "/v1/datasets",
+					"errors":   []interface{}{map[string]interface{}{"location": "query.limit", "message": "number must be at least 1"}},
+				})
+			})
+		})
+
+		Convey("When a request with an invalid body is received, then it is rejected", func() {
+			w := serve(http.MethodPost, "/v1/datasets", `{"title": 1}`)
+			So(proxied, ShouldBeFalse)
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("When a request for an operation that isn't documented is received, then it is proxied", func() {
+			serve(http.MethodDelete, "/v1/datasets", "")
+			So(proxied, ShouldBeTrue)
+		})
+
+		Convey("When the upstream responds with an invalid response, then it is counted and passed on unchanged", func() {
+			failures := openAPIValidationFailures.Value("dataset-api", middleware.OpenAPIResponse)
+			upstreamBody = `{"count": 0}`
+			w := serve(http.MethodGet, "/v1/datasets", "")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldEqual, upstreamBody)
+			So(openAPIValidationFailures.Value("dataset-api", middleware.OpenAPIResponse), ShouldEqual, failures+1)
+		})
+	})
+}
@@ -1,7 +1,11 @@
 package middleware
 
 import (
+	"crypto/subtle"
 	"net/http"
+	"strings"
+
+	dprequest "github.com/ONSdigital/dp-net/v3/request"
 )
 
 // Allowed provides a list of methods for which the handler should be executed
@@ -42,6 +46,45 @@ var VersionedHealthCheckFilter = func(version string, hcHandler func(w http.Resp
 	})
 }
 
+// MetricsFilter is a middleware that executes the metrics endpoint directly (handler provided as a parameter),
+// skipping any further middleware handlers. As for the admin endpoints, requests must provide the metrics auth token
+// as a bearer token in the Authorization header, otherwise they are rejected with status Unauthorized.
+var MetricsFilter = func(authToken string, metricsHandler func(w http.ResponseWriter, req *http.Request)) func(h http.Handler) http.Handler {
+	return AdminFilter(authToken, map[string]Allowed{
+		"/metrics": {
+			Methods: []string{http.MethodGet},
+			Handler: metricsHandler,
+		},
+	})
+}
+
+// AdminFilter is a middleware that executes the admin endpoints directly (handlers provided as a parameter),
+// skipping any further middleware handlers. Requests to admin endpoints must provide the admin auth token
+// as a bearer token in the Authorization header, otherwise they are rejected with status Unauthorized.
+var AdminFilter = func(authToken string, endpoints map[string]Allowed) func(h http.Handler) http.Handler {
+	protected := make(map[string]Allowed, len(endpoints))
+	for path, allowed := range endpoints {
+		handler := allowed.Handler
+		protected[path] = Allowed{
+			Methods: allowed.Methods,
+			Handler: func(w http.ResponseWriter, req *http.Request) {
+				if !isAdminAuthorised(req, authToken) {
+					http.Error(w, "unauthorised", http.StatusUnauthorized)
+					return
+				}
+				handler(w, req)
+			},
+		}
+	}
+	return PathFilter(protected)
+}
+
+// isAdminAuthorised determines if the request provides the admin auth token, which must not be empty
+func isAdminAuthorised(req *http.Request, authToken string) bool {
+	token, ok := strings.CutPrefix(req.Header.Get(dprequest.AuthHeaderKey), dprequest.BearerPrefix)
+	return ok && authToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(authToken)) == 1
+}
+
 // PathFilter is a middleware that executes allowed endpoints, skipping any further middleware handler
 func PathFilter(allowedMap map[string]Allowed) func(h http.Handler) http.Handler {
 	return func(nextHandler http.Handler) http.Handler {
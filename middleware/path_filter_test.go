@@ -96,3 +96,102 @@ func TestVersionedHealthCheckFilterHandler(t *testing.T) {
 		})
 	})
 }
+
+func TestMetricsFilterHandler(t *testing.T) {
+	Convey("Given a MetricsFilter handler with a metrics handler", t, func(c C) {
+		// prepare request
+		req, err := http.NewRequest(http.MethodGet, "/metrics", http.NoBody)
+		So(err, ShouldBeNil)
+		w := httptest.NewRecorder()
+
+		// middleware handler under test
+		metricsFilterHandler := middleware.MetricsFilter("myMetricsToken", testHcHandler(http.StatusOK, testBodyHc, c))(nil)
+
+		Convey("Then a request with '/metrics' path and the metrics token results in status OK and metrics body, as provided by the metrics handler", func(c C) {
+			req.Header.Set("Authorization", "Bearer myMetricsToken")
+			metricsFilterHandler.ServeHTTP(w, req)
+			c.So(w.Code, ShouldEqual, http.StatusOK)
+			b, err := io.ReadAll(w.Body)
+			So(err, ShouldBeNil)
+			c.So(b, ShouldResemble, testBodyHc)
+		})
+
+		Convey("Then a request with '/metrics' path without the metrics token results in status Unauthorized", func(c C) {
+			req.Header.Set("Authorization", "Bearer otherToken")
+			metricsFilterHandler.ServeHTTP(w, req)
+			c.So(w.Code, ShouldEqual, http.StatusUnauthorized)
+		})
+	})
+
+	Convey("Given a generic handler returning Forbidden status, wrapped by a MetricsFilter handler", t, func(c C) {
+		// prepare request
+		req, err := http.NewRequest(http.MethodPost, "/metrics", http.NoBody)
+		So(err, ShouldBeNil)
+		w := httptest.NewRecorder()
+
+		// middleware handler under test
+		metricsFilterHandler := middleware.MetricsFilter("myMetricsToken", nil)(testHandler(http.StatusForbidden, testBody, c))
+
+		Convey("Then a request with a method other than GET results in status Forbidden and test body, as provided by the generic handler", func(c C) {
+			metricsFilterHandler.ServeHTTP(w, req)
+			c.So(w.Code, ShouldEqual, http.StatusForbidden)
+			b, err := io.ReadAll(w.Body)
+			So(err, ShouldBeNil)
+			c.So(b, ShouldResemble, testBody)
+		})
+	})
+}
+
+func TestAdminFilterHandler(t *testing.T) {
+	Convey("Given an AdminFilter handler with an admin endpoint, wrapping a generic handler returning Forbidden status", t, func(c C) {
+		adminFilterHandler := middleware.AdminFilter("myAdminToken", map[string]middleware.Allowed{
+			"/admin/test": {
+				Methods: []string{http.MethodPost},
+				Handler: testHcHandler(http.StatusOK, testBodyHc, c),
+			},
+		})(testHandler(http.StatusForbidden, testBody, c))
+
+		tests := []struct {
+			name           string
+			method         string
+			path           string
+			authorization  string
+			expectedStatus int
+		}{
+			{"the admin token results in status OK, as provided by the admin handler", http.MethodPost, "/admin/test", "Bearer myAdminToken", http.StatusOK},
+			{"no token results in status Unauthorized", http.MethodPost, "/admin/test", "", http.StatusUnauthorized},
+			{"a wrong token results in status Unauthorized", http.MethodPost, "/admin/test", "Bearer otherToken", http.StatusUnauthorized},
+			{"the admin token without the bearer prefix results in status Unauthorized", http.MethodPost, "/admin/test", "myAdminToken", http.StatusUnauthorized},
+			{"a method other than POST results in status Forbidden, as provided by the generic handler", http.MethodGet, "/admin/test", "Bearer myAdminToken", http.StatusForbidden},
+			{"another path results in status Forbidden, as provided by the generic handler", http.MethodPost, "/admin/other", "Bearer myAdminToken", http.StatusForbidden},
+		}
+		for _, tc := range tests {
+			Convey("Then a request with "+tc.name, func(c C) {
+				req := httptest.NewRequest(tc.method, tc.path, http.NoBody)
+				if tc.authorization != "" {
+					req.Header.Set("Authorization", tc.authorization)
+				}
+				w := httptest.NewRecorder()
+				adminFilterHandler.ServeHTTP(w, req)
+				c.So(w.Code, ShouldEqual, tc.expectedStatus)
+			})
+		}
+	})
+
+	Convey("Given an AdminFilter handler with an empty admin token", t, func(c C) {
+		adminFilterHandler := middleware.AdminFilter("", map[string]middleware.Allowed{
+			"/admin/test": {
+				Methods: []string{http.MethodPost},
+				Handler: testHcHandler(http.StatusOK, testBodyHc, c),
+			},
+		})(nil)
+
+		Convey("Then a request with an empty bearer token results in status Unauthorized", func(c C) {
+			req := httptest.NewRequest(http.MethodPost, "/admin/test", http.NoBody)
+			req.Header.Set("Authorization", "Bearer ")
+			w := httptest.NewRecorder()
+			adminFilterHandler.ServeHTTP(w, req)
+			c.So(w.Code, ShouldEqual, http.StatusUnauthorized)
+		})
+	})
+}
@@ -0,0 +1,320 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ONSdigital/dp-api-router/metrics"
+	dprequest "github.com/ONSdigital/dp-net/v3/request"
+	"github.com/ONSdigital/log.go/v2/log"
+	"github.com/pkg/errors"
+)
+
+//go:generate moq -out ./mock/rate_limit_store.go -pkg mock . RateLimitStore
+
+// Possible keys that rate limits are applied to
+const (
+	// RateLimitKeyIP limits each client IP address
+	RateLimitKeyIP = "ip"
+	// RateLimitKeyIdentity limits each authenticated user or service, falling back to the client IP
+	RateLimitKeyIdentity = "identity"
+	// RateLimitKeyAPIKey limits each API key that was validated by the API keys handler, falling back to the client IP
+	RateLimitKeyAPIKey = "api_key"
+)
+
+// APIKeyHeader is the request header that carries API keys
+const APIKeyHeader = "X-API-Key"
+
+// rateLimitSweepInterval is how often the memory store removes buckets that have refilled
+const rateLimitSweepInterval = time.Minute
+
+var rateLimitedRequests = metrics.NewCounterVec("rate_limited_requests_total",
+	"Requests that were rejected because they exceeded a rate limit", "rule")
+
+// RateLimit is a token bucket limit of Requests per Period, which allows bursts of up to Burst requests
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+	Burst    int
+}
+
+// rate returns the number of tokens added to the bucket per second
+func (l RateLimit) rate() float64 {
+	return float64(l.Requests) / l.Period.Seconds()
+}
+
+// RateLimitResult is the result of taking a token from a bucket
+type RateLimitResult struct {
+	Allowed bool
+	// Remaining is the number of requests that can be made immediately
+	Remaining int
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is how long until the next request will be allowed, if this one wasn't
+	RetryAfter time.Duration
+}
+
+// RateLimitStore holds the state of the token buckets, so that it can be shared between instances
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error)
+}
+
+type rateLimitConfig []struct {
+	Name     string   `json:"name"`
+	Routes   []string `json:"routes"`
+	Key      string   `json:"key"`
+	Requests int      `json:"requests"`
+	Period   string   `json:"period"`
+	Burst    int      `json:"burst"`
+}
+
+// RateLimitRule applies a rate limit to the requests that match its routes (or every request if it has none),
+// keyed on the client IP, identity or API key
+type RateLimitRule struct {
+	Name  string
+	Key   string
+	Limit RateLimit
+	mux   *http.ServeMux
+}
+
+// LoadRateLimitRules loads and validates rate limit rules. It takes in a function that returns the loaded bytes
+// (eg. a function that loads content from disk), which contain a JSON array of rules.
+func LoadRateLimitRules(loader func() ([]byte, error)) ([]RateLimitRule, error) {
+	configJSON, err := loader()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to load rate limit config")
+	}
+	if len(configJSON) == 0 {
+		return nil, nil
+	}
+
+	var config rateLimitConfig
+	if err := json.Unmarshal(configJSON, &config); err != nil {
+		return nil, errors.Wrap(err, "invalid json in rate limit config")
+	}
+
+	rules := make([]RateLimitRule, len(config))
+	for i, c := range config {
+		if c.Name == "" {
+			c.Name = strconv.Itoa(i)
+		}
+		switch c.Key {
+		case "":
+			c.Key = RateLimitKeyIP
+		case RateLimitKeyIP, RateLimitKeyIdentity, RateLimitKeyAPIKey:
+		default:
+			return nil, fmt.Errorf("invalid key '%s' in rate limit rule '%s', expected one of: %s, %s, %s", c.Key, c.Name, RateLimitKeyIP, RateLimitKeyIdentity, RateLimitKeyAPIKey)
+		}
+
+		period, err := time.ParseDuration(c.Period)
+		if err != nil || period <= 0 || c.Requests <= 0 {
+			return nil, fmt.Errorf("rate limit rule '%s' requires a positive number of requests and period", c.Name)
+		}
+		if c.Burst <= 0 {
+			c.Burst = c.Requests
+		}
+
+		rules[i] = RateLimitRule{
+			Name:  c.Name,
+			Key:   c.Key,
+			Limit: RateLimit{Requests: c.Requests, Period: period, Burst: c.Burst},
+		}
+		if len(c.Routes) > 0 {
+			if rules[i].mux, err = newRuleMux(c.Routes); err != nil {
+				return nil, errors.Wrapf(err, "invalid routes in rate limit rule '%s'", c.Name)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// RateLimiter rejects requests with 429 Too Many Requests once a client has exceeded the rate limit of a route
+type RateLimiter struct {
+	rules []RateLimitRule
+	store RateLimitStore
+}
+
+// NewRateLimiter creates a RateLimiter that applies the rules, keeping the state of the limits in the store
+func NewRateLimiter(rules []RateLimitRule, store RateLimitStore) *RateLimiter {
+	return &RateLimiter{rules: rules, store: store}
+}
+
+// Handler is a middleware handler that applies every rule that matches the request, in order, stopping at the first
+// rule that rejects it so that the later rules don't use up a request that wasn't made. The RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers of the most restrictive rule are added to the response, along with
+// Retry-After if the request is rejected. The identity of the caller is only known if the request has been audited.
+func (l *RateLimiter) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+
+		var limiting *RateLimitRule
+		var result RateLimitResult
+		for i := range l.rules {
+			rule := &l.rules[i]
+			if rule.mux != nil && !matches(rule.mux, req) {
+				continue
+			}
+
+			key, ok := rateLimitKey(rule.Key, req)
+			if !ok {
+				// rather than every client whose IP address is unknown sharing a bucket, the rule isn't applied
+				log.Warn(ctx, "rate limit not applied, as the client ip address could not be determined", log.Data{"rule": rule.Name})
+				continue
+			}
+			ruleResult, err := l.store.Take(ctx, rule.Name+":"+key, rule.Limit)
+			if err != nil {
+				// fail open, as the rate limits are only a protection against excessive use
+				log.Error(ctx, "rate limit could not be checked", err, log.Data{"rule": rule.Name})
+				continue
+			}
+			if limiting == nil || !ruleResult.Allowed || ruleResult.Remaining < result.Remaining {
+				limiting, result = rule, ruleResult
+			}
+			if !result.Allowed {
+				break
+			}
+		}
+
+		if limiting == nil {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		setRateLimitHeaders(w.Header(), limiting.Limit, result)
+
+		if !result.Allowed {
+			rateLimitedRequests.Inc(limiting.Name)
+			log.Info(ctx, "request rejected by rate limit", log.Data{"rule": limiting.Name, "path": req.URL.Path})
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
+
+// rateLimitKey returns the value that the rate limit of the request is keyed on. Only values that the client can't
+// choose freely are used, so that clients can't get a new bucket for each request. It returns false if the request
+// is keyed on the client IP address, which can't be determined.
+func rateLimitKey(key string, req *http.Request) (string, bool) {
+	switch key {
+	case RateLimitKeyIdentity:
+		if user := dprequest.User(req.Context()); user != "" {
+			return "user:" + user, true
+		}
+		if caller := dprequest.Caller(req.Context()); caller != "" {
+			return "service:" + caller, true
+		}
+	case RateLimitKeyAPIKey:
+		if apiKey, ok := validatedAPIKey(req.Context()); ok {
+			return "api_key:" + apiKey.hash, true
+		}
+	}
+	clientIP := clientIPString(req)
+	return "ip:" + clientIP, clientIP != ""
+}
+
+// setRateLimitHeaders sets the RateLimit headers of the result, and Retry-After if the request isn't allowed
+func setRateLimitHeaders(header http.Header, limit RateLimit, result RateLimitResult) {
+	header.Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+	header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+	if !result.Allowed {
+		header.Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+	}
+}
+
+// ceilSeconds returns the duration as a whole number of seconds, rounded up
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// MemoryRateLimitStore holds token buckets in memory, so limits apply to each instance of the router separately
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	limit   RateLimit
+}
+
+// NewMemoryRateLimitStore creates an empty MemoryRateLimitStore
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	store := &MemoryRateLimitStore{buckets: map[string]*tokenBucket{}, lastSweep: Now()}
+
+	metrics.NewGaugeFunc("rate_limit_buckets", "Rate limit token buckets held in memory", func() float64 {
+		return float64(store.Len())
+	})
+
+	return store
+}
+
+// Take takes a token from the bucket for the key, which is created full if it doesn't exist
+func (s *MemoryRateLimitStore) Take(_ context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := Now()
+	if now.Sub(s.lastSweep) >= rateLimitSweepInterval {
+		s.sweep(now)
+	}
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), updated: now, limit: limit}
+		s.buckets[key] = bucket
+	}
+	bucket.refill(now)
+
+	result := RateLimitResult{}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = seconds((1 - bucket.tokens) / limit.rate())
+	}
+	result.Remaining = int(bucket.tokens)
+	result.Reset = seconds((float64(limit.Burst) - bucket.tokens) / limit.rate())
+	return result, nil
+}
+
+// Len returns the number of buckets in the store
+func (s *MemoryRateLimitStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.buckets)
+}
+
+// sweep removes the buckets that have refilled, as they are the same as a new bucket
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	for key, bucket := range s.buckets {
+		if bucket.refill(now); bucket.tokens >= float64(bucket.limit.Burst) {
+			delete(s.buckets, key)
+		}
+	}
+	s.lastSweep = now
+}
+
+// refill adds the tokens that have accumulated since the bucket was last updated
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.updated).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(float64(b.limit.Burst), b.tokens+elapsed*b.limit.rate())
+		b.updated = now
+	}
+}
+
+// seconds converts a number of seconds to a time.Duration
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,262 @@
+package middleware_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/dp-api-router/middleware"
+	"github.com/ONSdigital/dp-api-router/middleware/mock"
+	dprequest "github.com/ONSdigital/dp-net/v3/request"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const testRateLimitConfig = `[
+  {"name": "search", "routes": ["GET /v1/search"], "requests": 1, "period": "1s", "burst": 2},
+  {"name": "global", "key": "identity", "requests": 100, "period": "1m"}
+]`
+
+// loadRateLimitRules loads rate limit rules from the provided JSON
+func loadRateLimitRules(config string) ([]middleware.RateLimitRule, error) {
+	return middleware.LoadRateLimitRules(func() ([]byte, error) {
+		return []byte(config), nil
+	})
+}
+
+func TestLoadRateLimitRules(t *testing.T) {
+	Convey("A valid config is loaded with defaults for the optional fields", t, func() {
+		rules, err := loadRateLimitRules(`[{"routes": ["/v1/search"], "requests": 10, "period": "1m"}]`)
+		So(err, ShouldBeNil)
+		So(rules, ShouldHaveLength, 1)
+		So(rules[0].Name, ShouldEqual, "0")
+		So(rules[0].Key, ShouldEqual, middleware.RateLimitKeyIP)
+		So(rules[0].Limit, ShouldResemble, middleware.RateLimit{Requests: 10, Period: time.Minute, Burst: 10})
+
+		rules, err = loadRateLimitRules("")
+		So(err, ShouldBeNil)
+		So(rules, ShouldBeEmpty)
+	})
+
+	Convey("An error loading the config is returned", t, func() {
+		_, err := middleware.LoadRateLimitRules(func() ([]byte, error) {
+			return nil, errors.New("file not found")
+		})
+		So(err, ShouldNotBeNil)
+	})
+
+	tests := map[string]string{
+		"invalid json":      `[{"routes":`,
+		"invalid key":       `[{"key": "cookie", "requests": 10, "period": "1m"}]`,
+		"invalid period":    `[{"requests": 10, "period": "soon"}]`,
+		"no requests":       `[{"period": "1m"}]`,
+		"invalid route":     `[{"routes": ["/v1/datasets/{id"], "requests": 10, "period": "1m"}]`,
+		"negative period":   `[{"requests": 10, "period": "-1m"}]`,
+		"negative requests": `[{"requests": -1, "period": "1m"}]`,
+	}
+	for name, config := range tests {
+		Convey("A config with "+name+" is rejected", t, func() {
+			rules, err := loadRateLimitRules(config)
+			So(err, ShouldNotBeNil)
+			So(rules, ShouldBeNil)
+		})
+	}
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	Convey("Given a memory store and a limit of 1 request per second with a burst of 2", t, func() {
+		now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+		middleware.Now = func() time.Time { return now }
+		store := middleware.NewMemoryRateLimitStore()
+		limit := middleware.RateLimit{Requests: 1, Period: time.Second, Burst: 2}
+		ctx := context.Background()
+
+		Convey("When the burst is used up, then the next request is rejected until a token is added", func() {
+			result, err := store.Take(ctx, "a", limit)
+			So(err, ShouldBeNil)
+			So(result, ShouldResemble, middleware.RateLimitResult{Allowed: true, Remaining: 1, Reset: time.Second})
+
+			result, _ = store.Take(ctx, "a", limit)
+			So(result, ShouldResemble, middleware.RateLimitResult{Allowed: true, Remaining: 0, Reset: 2 * time.Second})
+
+			result, _ = store.Take(ctx, "a", limit)
+			So(result, ShouldResemble, middleware.RateLimitResult{Allowed: false, Remaining: 0, Reset: 2 * time.Second, RetryAfter: time.Second})
+
+			now = now.Add(time.Second)
+			result, _ = store.Take(ctx, "a", limit)
+			So(result.Allowed, ShouldBeTrue)
+		})
+
+		Convey("When requests are made for different keys, then they have separate buckets", func() {
+			store.Take(ctx, "a", limit)
+			store.Take(ctx, "a", limit)
+			result, _ := store.Take(ctx, "b", limit)
+			So(result.Allowed, ShouldBeTrue)
+			So(store.Len(), ShouldEqual, 2)
+		})
+
+		Convey("When the buckets have refilled, then they are swept from the store", func() {
+			store.Take(ctx, "a", limit)
+			now = now.Add(time.Hour)
+			store.Take(ctx, "b", limit)
+			So(store.Len(), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestRateLimiter(t *testing.T) {
+	Convey("Given a rate limiter with a memory store", t, func() {
+		middleware.Now = func() time.Time { return testTimeInbound }
+		rules, err := loadRateLimitRules(testRateLimitConfig)
+		So(err, ShouldBeNil)
+		proxied := 0
+		handler := middleware.NewRateLimiter(rules, middleware.NewMemoryRateLimitStore()).Handler(
+			http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				proxied++
+			}))
+
+		serve := func(req *http.Request) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			return w
+		}
+		search := func(clientIP string) *http.Request {
+			req := httptest.NewRequest(http.MethodGet, "/v1/search?q=cpi", http.NoBody)
+			req.RemoteAddr = clientIP + ":5678"
+			return req
+		}
+
+		Convey("When a client makes more requests than the route allows", func() {
+			serve(search("1.2.3.4"))
+			w := serve(search("1.2.3.4"))
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Header().Get("RateLimit-Limit"), ShouldEqual, "2")
+			So(w.Header().Get("RateLimit-Remaining"), ShouldEqual, "0")
+			So(w.Header().Get("RateLimit-Reset"), ShouldEqual, "2")
+
+			w = serve(search("1.2.3.4"))
+
+			Convey("Then the request is rejected with the headers of the most restrictive rule", func() {
+				So(w.Code, ShouldEqual, http.StatusTooManyRequests)
+				So(w.Header().Get("RateLimit-Limit"), ShouldEqual, "2")
+				So(w.Header().Get("Retry-After"), ShouldEqual, "1")
+				So(proxied, ShouldEqual, 2)
+			})
+
+			Convey("Then requests from other clients are still allowed", func() {
+				So(serve(search("5.6.7.8")).Code, ShouldEqual, http.StatusOK)
+			})
+		})
+
+		Convey("When a request only matches a rule without routes, then its headers are returned", func() {
+			req := httptest.NewRequest(http.MethodGet, "/v1/datasets", http.NoBody)
+			w := serve(req.WithContext(dprequest.SetUser(req.Context(), "someone@ons.gov.uk")))
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Header().Get("RateLimit-Limit"), ShouldEqual, "100")
+			So(w.Header().Get("RateLimit-Remaining"), ShouldEqual, "99")
+		})
+	})
+
+	Convey("Given a rate limiter with a mock store", t, func() {
+		store := &mock.RateLimitStoreMock{
+			TakeFunc: func(ctx context.Context, key string, limit middleware.RateLimit) (middleware.RateLimitResult, error) {
+				return middleware.RateLimitResult{Allowed: true}, nil
+			},
+		}
+		rules, err := loadRateLimitRules(`[
+		  {"name": "ip", "requests": 10, "period": "1m"},
+		  {"name": "identity", "key": "identity", "requests": 10, "period": "1m"},
+		  {"name": "api", "key": "api_key", "requests": 10, "period": "1m"}
+		]`)
+		So(err, ShouldBeNil)
+		proxied := false
+		handler := middleware.NewRateLimiter(rules, store).Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			proxied = true
+		}))
+		req := httptest.NewRequest(http.MethodGet, "/v1/datasets", http.NoBody)
+		req.RemoteAddr = "1.2.3.4:5678"
+
+		Convey("When an anonymous request without an API key is made, then every rule is keyed on the client IP", func() {
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			So(store.TakeCalls(), ShouldHaveLength, 3)
+			So(store.TakeCalls()[0].Key, ShouldEqual, "ip:ip:1.2.3.4")
+			So(store.TakeCalls()[1].Key, ShouldEqual, "identity:ip:1.2.3.4")
+			So(store.TakeCalls()[2].Key, ShouldEqual, "api:ip:1.2.3.4")
+		})
+
+		Convey("When an identified request with a known API key is made, then the rules are keyed on the caller and API key", func() {
+			keys, err := loadAPIKeys(testAPIKeys)
+			So(err, ShouldBeNil)
+			req = req.WithContext(dprequest.SetCaller(req.Context(), "myService"))
+			req.Header.Set(middleware.APIKeyHeader, testAPIKey)
+			middleware.NewAPIKeys(keys, middleware.NewMemoryRateLimitStore()).Handler(handler).ServeHTTP(httptest.NewRecorder(), req)
+			So(store.TakeCalls()[1].Key, ShouldEqual, "identity:service:myService")
+			So(store.TakeCalls()[2].Key, ShouldStartWith, "api:api_key:")
+			So(store.TakeCalls()[2].Key, ShouldNotContainSubstring, testAPIKey)
+		})
+
+		Convey("When a request with an API key that hasn't been validated is made, then it is keyed on the client IP", func() {
+			req.Header.Set(middleware.APIKeyHeader, "randomKey")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			So(store.TakeCalls()[2].Key, ShouldEqual, "api:ip:1.2.3.4")
+		})
+
+		Convey("When a request with a spoofed X-Forwarded-For is made, then it is keyed on the address it was received from", func() {
+			req.Header.Set("X-Forwarded-For", "5.6.7.8")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			So(store.TakeCalls()[0].Key, ShouldEqual, "ip:ip:1.2.3.4")
+		})
+
+		Convey("When the first rule rejects the request, then the later rules don't take a token", func() {
+			store.TakeFunc = func(ctx context.Context, key string, limit middleware.RateLimit) (middleware.RateLimitResult, error) {
+				return middleware.RateLimitResult{Allowed: false, RetryAfter: time.Second}, nil
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, http.StatusTooManyRequests)
+			So(proxied, ShouldBeFalse)
+			So(store.TakeCalls(), ShouldHaveLength, 1)
+		})
+
+		Convey("When a later rule rejects the request, then it is rejected with the headers of that rule", func() {
+			store.TakeFunc = func(ctx context.Context, key string, limit middleware.RateLimit) (middleware.RateLimitResult, error) {
+				return middleware.RateLimitResult{Allowed: !strings.HasPrefix(key, "identity:"), Remaining: 5}, nil
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, http.StatusTooManyRequests)
+			So(w.Header().Get("RateLimit-Remaining"), ShouldEqual, "5")
+			So(store.TakeCalls(), ShouldHaveLength, 2)
+		})
+
+		Convey("When the client IP address of an anonymous request can't be determined, then the rules aren't applied", func() {
+			req.RemoteAddr = "pipe"
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(proxied, ShouldBeTrue)
+			So(store.TakeCalls(), ShouldBeEmpty)
+		})
+
+		Convey("When the client IP address of an identified request can't be determined, then only the identity rule is applied", func() {
+			req.RemoteAddr = "pipe"
+			handler.ServeHTTP(httptest.NewRecorder(), req.WithContext(dprequest.SetCaller(req.Context(), "myService")))
+			So(store.TakeCalls(), ShouldHaveLength, 1)
+			So(store.TakeCalls()[0].Key, ShouldEqual, "identity:service:myService")
+		})
+
+		Convey("When the store returns an error, then the request is allowed without headers", func() {
+			store.TakeFunc = func(ctx context.Context, key string, limit middleware.RateLimit) (middleware.RateLimitResult, error) {
+				return middleware.RateLimitResult{}, errors.New("store unavailable")
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(proxied, ShouldBeTrue)
+			So(w.Header().Get("RateLimit-Limit"), ShouldBeEmpty)
+		})
+	})
+}
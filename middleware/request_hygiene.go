@@ -0,0 +1,162 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ONSdigital/dp-api-router/metrics"
+	dphttp "github.com/ONSdigital/dp-net/v3/http"
+	"github.com/ONSdigital/log.go/v2/log"
+	"github.com/pkg/errors"
+)
+
+// Rules of the request hygiene filter that requests can be rejected by, as counted by the
+// request_hygiene_rejections_total metric
+const (
+	HygieneURLLength        = "url_length"
+	HygieneHeaderCount      = "header_count"
+	HygieneHeaderSize       = "header_size"
+	HygieneEncodedTraversal = "encoded_traversal"
+	HygieneNullByte         = "null_byte"
+	HygieneInvalidUTF8      = "invalid_utf8"
+)
+
+// maxTraversalDecodes is the number of times a path segment is decoded when looking for traversal, so that double
+// encoding such as %252e%252e is caught too
+const maxTraversalDecodes = 3
+
+var requestHygieneRejections = metrics.NewCounterVec("request_hygiene_rejections_total",
+	"Requests that were rejected because they were malformed or contained malicious patterns", "rule")
+
+type requestHygieneConfig struct {
+	MaxURLLength           int  `json:"max_url_length"`
+	MaxHeaderCount         int  `json:"max_header_count"`
+	MaxHeaderSize          int  `json:"max_header_size"`
+	RejectEncodedTraversal bool `json:"reject_encoded_traversal"`
+	RejectNullBytes        bool `json:"reject_null_bytes"`
+	RejectInvalidUTF8      bool `json:"reject_invalid_utf8"`
+}
+
+// RequestHygiene rejects requests with URLs or headers that are too large, or with paths that contain encoded
+// traversal, null bytes or invalid UTF-8. Each rule is disabled unless it is configured.
+type RequestHygiene struct {
+	config requestHygieneConfig
+}
+
+// LoadRequestHygiene loads and validates the request hygiene rules. It takes in a function that returns the loaded
+// bytes (eg. a function that loads content from disk), which contain a JSON object of the limits and the patterns to
+// reject.
+func LoadRequestHygiene(loader func() ([]byte, error)) (*RequestHygiene, error) {
+	configJSON, err := loader()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to load request hygiene config")
+	}
+
+	var config requestHygieneConfig
+	if len(configJSON) > 0 {
+		if err := json.Unmarshal(configJSON, &config); err != nil {
+			return nil, errors.Wrap(err, "invalid json in request hygiene config")
+		}
+	}
+	if config.MaxURLLength < 0 || config.MaxHeaderCount < 0 || config.MaxHeaderSize < 0 {
+		return nil, errors.New("invalid negative limit in request hygiene config")
+	}
+	return &RequestHygiene{config: config}, nil
+}
+
+// Handler is a middleware handler that responds with 400 Bad Request if a request breaks any of the enabled rules
+func (rh *RequestHygiene) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if rule := rh.check(req); rule != "" {
+			requestHygieneRejections.Inc(rule)
+			log.Info(req.Context(), "request rejected by request hygiene filter", log.Data{
+				"rule":   rule,
+				"method": req.Method,
+				// the path may be very long or contain anything, so only the start of it is logged
+				"path": truncate(req.URL.EscapedPath(), 256),
+			})
+			dphttp.DrainBody(req)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		h.ServeHTTP(w, req)
+	})
+}
+
+// check returns the first enabled rule that the request breaks, or an empty string if it doesn't break any
+func (rh *RequestHygiene) check(req *http.Request) string {
+	c := rh.config
+	if c.MaxURLLength > 0 && len(requestURI(req)) > c.MaxURLLength {
+		return HygieneURLLength
+	}
+	if c.MaxHeaderCount > 0 || c.MaxHeaderSize > 0 {
+		count, size := headerCountAndSize(req.Header)
+		if c.MaxHeaderCount > 0 && count > c.MaxHeaderCount {
+			return HygieneHeaderCount
+		}
+		if c.MaxHeaderSize > 0 && size > c.MaxHeaderSize {
+			return HygieneHeaderSize
+		}
+	}
+	if c.RejectEncodedTraversal && hasEncodedTraversal(req.URL.EscapedPath()) {
+		return HygieneEncodedTraversal
+	}
+	if c.RejectNullBytes && strings.ContainsRune(req.URL.Path, 0) {
+		return HygieneNullByte
+	}
+	if c.RejectInvalidUTF8 && !utf8.ValidString(req.URL.Path) {
+		return HygieneInvalidUTF8
+	}
+	return ""
+}
+
+// requestURI returns the URI of the request as it was received, or as it would be sent if it isn't a server request
+func requestURI(req *http.Request) string {
+	if req.RequestURI != "" {
+		return req.RequestURI
+	}
+	return req.URL.RequestURI()
+}
+
+// headerCountAndSize returns the number of header values and their total size, including the size of their names
+func headerCountAndSize(header http.Header) (count, size int) {
+	for name, values := range header {
+		for _, value := range values {
+			count++
+			size += len(name) + len(value)
+		}
+	}
+	return count, size
+}
+
+// hasEncodedTraversal returns true if any segment of the escaped path contains percent encoding that decodes to a
+// traversal ('..' between separators), e.g. %2e%2e, .%2e or ..%2f
+func hasEncodedTraversal(escapedPath string) bool {
+	for _, segment := range strings.Split(escapedPath, "/") {
+		for i := 0; i < maxTraversalDecodes && strings.Contains(segment, "%"); i++ {
+			decoded, err := url.PathUnescape(segment)
+			if err != nil {
+				break
+			}
+			segment = decoded
+			for _, part := range strings.FieldsFunc(segment, func(r rune) bool { return r == '/' || r == '\\' }) {
+				if part == ".." {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// truncate returns the string cut to at most n bytes
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
@@ -0,0 +1,128 @@
+package middleware_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ONSdigital/dp-api-router/metrics/metricstest"
+	"github.com/ONSdigital/dp-api-router/middleware"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const testRequestHygieneConfig = `{
+  "max_url_length": 64,
+  "max_header_count": 4,
+  "max_header_size": 128,
+  "reject_encoded_traversal": true,
+  "reject_null_bytes": true,
+  "reject_invalid_utf8": true
+}`
+
+var requestHygieneRejections = metricstest.NewCounter("request_hygiene_rejections_total", "rule")
+
+// loadRequestHygiene loads a request hygiene filter from the provided JSON
+func loadRequestHygiene(config string) (*middleware.RequestHygiene, error) {
+	return middleware.LoadRequestHygiene(func() ([]byte, error) {
+		return []byte(config), nil
+	})
+}
+
+func TestLoadRequestHygiene(t *testing.T) {
+	Convey("Valid and empty configs are loaded", t, func() {
+		for _, config := range []string{testRequestHygieneConfig, "", "{}"} {
+			hygiene, err := loadRequestHygiene(config)
+			So(err, ShouldBeNil)
+			So(hygiene, ShouldNotBeNil)
+		}
+	})
+
+	Convey("An error loading the config is returned", t, func() {
+		_, err := middleware.LoadRequestHygiene(func() ([]byte, error) {
+			return nil, errors.New("file not found")
+		})
+		So(err, ShouldNotBeNil)
+	})
+
+	tests := map[string]string{
+		"invalid json":   `{"max_url_length":`,
+		"negative limit": `{"max_header_count": -1}`,
+	}
+	for name, config := range tests {
+		Convey("A config with an "+name+" is rejected", t, func() {
+			hygiene, err := loadRequestHygiene(config)
+			So(err, ShouldNotBeNil)
+			So(hygiene, ShouldBeNil)
+		})
+	}
+}
+
+func TestRequestHygiene(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		headers map[string]string
+		rule    string
+	}{
+		{"a normal request is allowed", "/v1/datasets/cpih01/editions?limit=10", nil, ""},
+		{"an unencoded dot segment is allowed", "/v1/datasets/cpih01.v2/..json", nil, ""},
+		{"a long url is rejected", "/v1/datasets?q=" + strings.Repeat("a", 64), nil, middleware.HygieneURLLength},
+		{"too many headers are rejected", "/v1/datasets", map[string]string{"A": "1", "B": "2", "C": "3", "D": "4", "E": "5"}, middleware.HygieneHeaderCount},
+		{"large headers are rejected", "/v1/datasets", map[string]string{"Cookie": strings.Repeat("a", 128)}, middleware.HygieneHeaderSize},
+		{"an encoded traversal is rejected", "/v1/datasets/%2e%2e/secret", nil, middleware.HygieneEncodedTraversal},
+		{"a partly encoded traversal is rejected", "/v1/datasets/.%2E/secret", nil, middleware.HygieneEncodedTraversal},
+		{"a traversal with an encoded slash is rejected", "/v1/datasets/..%2fsecret", nil, middleware.HygieneEncodedTraversal},
+		{"a double encoded traversal is rejected", "/v1/datasets/%252e%252e/secret", nil, middleware.HygieneEncodedTraversal},
+		{"a null byte is rejected", "/v1/datasets/cpih01%00.json", nil, middleware.HygieneNullByte},
+		{"invalid utf-8 is rejected", "/v1/datasets/%ff%fe", nil, middleware.HygieneInvalidUTF8},
+	}
+
+	hygiene, err := loadRequestHygiene(testRequestHygieneConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		Convey("Given a request hygiene filter with every rule enabled, "+test.name, t, func() {
+			proxied := false
+			handler := hygiene.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				proxied = true
+			}))
+			req := httptest.NewRequest(http.MethodGet, test.target, http.NoBody)
+			for name, value := range test.headers {
+				req.Header.Set(name, value)
+			}
+			rejections := requestHygieneRejections.Value(test.rule)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if test.rule == "" {
+				So(proxied, ShouldBeTrue)
+				So(w.Code, ShouldEqual, http.StatusOK)
+				return
+			}
+			So(proxied, ShouldBeFalse)
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+			So(requestHygieneRejections.Value(test.rule), ShouldEqual, rejections+1)
+		})
+	}
+
+	Convey("Given a request hygiene filter with no rules enabled, then every request is allowed", t, func() {
+		hygiene, err := loadRequestHygiene("{}")
+		So(err, ShouldBeNil)
+		proxied := 0
+		handler := hygiene.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			proxied++
+		}))
+		for _, test := range tests {
+			req := httptest.NewRequest(http.MethodGet, test.target, http.NoBody)
+			for name, value := range test.headers {
+				req.Header.Set(name, value)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+		So(proxied, ShouldEqual, len(tests))
+	})
+}
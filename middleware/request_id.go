@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"net/http"
+	"regexp"
+
+	dprequest "github.com/ONSdigital/dp-net/v3/request"
+	"github.com/ONSdigital/log.go/v2/log"
+)
+
+// RequestIDSize is the length of the request IDs generated by the router
+const RequestIDSize = 16
+
+// validRequestID matches the request IDs accepted from clients, which are written to logs and audit events as they are
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// RequestID is a middleware handler that makes sure every request has an ID. The X-Request-Id header sent by the client
+// is used if it is valid, otherwise a new ID is generated. The ID is stored in the request context (where it is used by
+// log.go and audit events), forwarded to upstreams in the X-Request-Id header and returned in the response.
+func RequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requestID := req.Header.Get(dprequest.RequestHeaderKey)
+		if !validRequestID.MatchString(requestID) {
+			if requestID != "" {
+				log.Warn(req.Context(), "invalid request id replaced", log.Data{"request_id_length": len(requestID)})
+			}
+			requestID = dprequest.NewRequestID(RequestIDSize)
+		}
+		req.Header.Set(dprequest.RequestHeaderKey, requestID)
+
+		// the ID replaces any ID echoed by the upstream
+		setRequestID := func(header http.Header) {
+			header.Set(dprequest.RequestHeaderKey, requestID)
+		}
+		serveWithHeaders(w, req.WithContext(dprequest.WithRequestId(req.Context(), requestID)), h, setRequestID)
+	})
+}
@@ -0,0 +1,77 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ONSdigital/dp-api-router/middleware"
+	dprequest "github.com/ONSdigital/dp-net/v3/request"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRequestID(t *testing.T) {
+	Convey("Given the request ID middleware and an upstream that echoes the request ID", t, func() {
+		var upstreamRequestID, contextRequestID, auditRequestID string
+		handler := middleware.RequestID(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			upstreamRequestID = req.Header.Get(dprequest.RequestHeaderKey)
+			contextRequestID = dprequest.GetRequestId(req.Context())
+			auditRequestID = middleware.GenerateAuditEvent(req).RequestID
+			w.Header().Add(dprequest.RequestHeaderKey, upstreamRequestID)
+			w.WriteHeader(http.StatusCreated)
+		}))
+
+		serve := func(requestID string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, "/v1/datasets", http.NoBody)
+			if requestID != "" {
+				req.Header.Set(dprequest.RequestHeaderKey, requestID)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			return w
+		}
+
+		Convey("When a request without an ID is received", func() {
+			w := serve("")
+
+			Convey("Then an ID is generated and used for the context, audit, upstream and response", func() {
+				So(contextRequestID, ShouldHaveLength, middleware.RequestIDSize)
+				So(auditRequestID, ShouldEqual, contextRequestID)
+				So(upstreamRequestID, ShouldEqual, contextRequestID)
+				So(w.Code, ShouldEqual, http.StatusCreated)
+				So(w.Header().Values(dprequest.RequestHeaderKey), ShouldResemble, []string{contextRequestID})
+			})
+		})
+
+		Convey("When a request with a valid ID is received, then the ID is used", func() {
+			w := serve("3f6c1e2a-7b4d-4c1e-9a3b-0d2f5e6a7b8c")
+			So(contextRequestID, ShouldEqual, "3f6c1e2a-7b4d-4c1e-9a3b-0d2f5e6a7b8c")
+			So(upstreamRequestID, ShouldEqual, contextRequestID)
+			So(w.Header().Get(dprequest.RequestHeaderKey), ShouldEqual, contextRequestID)
+		})
+
+		for name, requestID := range map[string]string{
+			"invalid characters": "abc\ndef",
+			"too many":           strings.Repeat("a", 129),
+		} {
+			Convey("When a request with an ID of "+name+" is received, then it is replaced", func() {
+				w := serve(requestID)
+				So(contextRequestID, ShouldHaveLength, middleware.RequestIDSize)
+				So(upstreamRequestID, ShouldEqual, contextRequestID)
+				So(w.Header().Get(dprequest.RequestHeaderKey), ShouldEqual, contextRequestID)
+			})
+		}
+	})
+
+	Convey("Given the request ID middleware and a handler that only writes a body, then the ID is returned", t, func() {
+		handler := middleware.RequestID(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte("ok"))
+		}))
+		req := httptest.NewRequest(http.MethodGet, "/health", http.NoBody)
+		req.Header.Set(dprequest.RequestHeaderKey, "myRequestID")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		So(w.Header().Get(dprequest.RequestHeaderKey), ShouldEqual, "myRequestID")
+	})
+}
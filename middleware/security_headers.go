@@ -0,0 +1,141 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// validHeaderName matches the header names that can be configured, which are HTTP tokens
+var validHeaderName = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+type securityHeadersConfig struct {
+	Headers map[string]string `json:"headers"`
+	Force   bool              `json:"force"`
+	Rules   []struct {
+		Routes  []string          `json:"routes"`
+		Headers map[string]string `json:"headers"`
+		Force   *bool             `json:"force"`
+	} `json:"rules"`
+}
+
+// SecurityHeaders adds security headers, such as Strict-Transport-Security or X-Content-Type-Options, to responses.
+// The global headers apply to every response, and can be overridden by rules for the requests that match their routes.
+// Headers that were already set (e.g. by an upstream) are kept, unless the header is forced.
+type SecurityHeaders struct {
+	global securityHeadersRule
+	rules  []securityHeadersRule
+}
+
+type securityHeadersRule struct {
+	routes  *http.ServeMux
+	headers map[string]securityHeader
+}
+
+type securityHeader struct {
+	value string
+	force bool
+}
+
+// LoadSecurityHeaders loads and validates the security headers. It takes in a function that returns the loaded bytes
+// (eg. a function that loads content from disk), which contain a JSON object of the global headers and the rules with
+// headers for routes.
+func LoadSecurityHeaders(loader func() ([]byte, error)) (*SecurityHeaders, error) {
+	configJSON, err := loader()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to load security headers config")
+	}
+
+	var config securityHeadersConfig
+	if len(configJSON) > 0 {
+		if err := json.Unmarshal(configJSON, &config); err != nil {
+			return nil, errors.Wrap(err, "invalid json in security headers config")
+		}
+	}
+
+	securityHeaders := &SecurityHeaders{rules: make([]securityHeadersRule, len(config.Rules))}
+	if securityHeaders.global, err = newSecurityHeadersRule(nil, config.Headers, config.Force); err != nil {
+		return nil, err
+	}
+	for i, c := range config.Rules {
+		if len(c.Routes) == 0 {
+			return nil, errors.New("security headers rules require at least one route")
+		}
+		force := config.Force
+		if c.Force != nil {
+			force = *c.Force
+		}
+		if securityHeaders.rules[i], err = newSecurityHeadersRule(c.Routes, c.Headers, force); err != nil {
+			return nil, err
+		}
+	}
+	return securityHeaders, nil
+}
+
+// newSecurityHeadersRule creates a rule from its routes (or none for the global headers) and its headers
+func newSecurityHeadersRule(routes []string, headers map[string]string, force bool) (rule securityHeadersRule, err error) {
+	if len(routes) > 0 {
+		if rule.routes, err = newRuleMux(routes); err != nil {
+			return rule, errors.Wrap(err, "invalid routes in security headers config")
+		}
+	}
+	rule.headers = make(map[string]securityHeader, len(headers))
+	for name, value := range headers {
+		if !validHeaderName.MatchString(name) || strings.ContainsAny(value, "\r\n") {
+			return rule, fmt.Errorf("invalid header '%s' in security headers config", name)
+		}
+		rule.headers[http.CanonicalHeaderKey(name)] = securityHeader{value: value, force: force}
+	}
+	return rule, nil
+}
+
+// Handler is a middleware handler that adds the security headers for the request to the response, just before it is
+// written so that any headers set by the upstream are known. Rules are applied in order after the global headers, so a
+// later rule overrides the headers of an earlier one. A header with an empty value isn't added, and is removed from
+// the response if it is forced.
+func (s *SecurityHeaders) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		headers := s.headersFor(req)
+		if len(headers) == 0 {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		setSecurityHeaders := func(header http.Header) {
+			for name, securityHeader := range headers {
+				switch {
+				case securityHeader.force && securityHeader.value == "":
+					header.Del(name)
+				case securityHeader.force || header.Get(name) == "":
+					header.Set(name, securityHeader.value)
+				}
+			}
+		}
+		serveWithHeaders(w, req, h, setSecurityHeaders)
+	})
+}
+
+// headersFor returns the security headers that apply to the request
+func (s *SecurityHeaders) headersFor(req *http.Request) map[string]securityHeader {
+	headers := make(map[string]securityHeader, len(s.global.headers))
+	for name, header := range s.global.headers {
+		headers[name] = header
+	}
+	for _, rule := range s.rules {
+		if matches(rule.routes, req) {
+			for name, header := range rule.headers {
+				headers[name] = header
+			}
+		}
+	}
+	for name, header := range headers {
+		if header.value == "" && !header.force {
+			delete(headers, name)
+		}
+	}
+	return headers
+}
@@ -0,0 +1,136 @@
+package middleware_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ONSdigital/dp-api-router/middleware"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const testSecurityHeadersConfig = `{
+  "headers": {
+    "Strict-Transport-Security": "max-age=31536000; includeSubDomains",
+    "x-content-type-options": "nosniff",
+    "Referrer-Policy": "no-referrer",
+    "Cross-Origin-Resource-Policy": "same-site"
+  },
+  "rules": [
+    {"routes": ["/v1/images/"], "headers": {"Cross-Origin-Resource-Policy": "cross-origin", "Referrer-Policy": ""}},
+    {"routes": ["/v1/search"], "headers": {"Referrer-Policy": "same-origin", "X-Powered-By": ""}, "force": true}
+  ]
+}`
+
+// loadSecurityHeaders loads security headers from the provided JSON
+func loadSecurityHeaders(config string) (*middleware.SecurityHeaders, error) {
+	return middleware.LoadSecurityHeaders(func() ([]byte, error) {
+		return []byte(config), nil
+	})
+}
+
+func TestLoadSecurityHeaders(t *testing.T) {
+	Convey("Valid and empty configs are loaded", t, func() {
+		for _, config := range []string{testSecurityHeadersConfig, "", "{}"} {
+			securityHeaders, err := loadSecurityHeaders(config)
+			So(err, ShouldBeNil)
+			So(securityHeaders, ShouldNotBeNil)
+		}
+	})
+
+	Convey("An error loading the config is returned", t, func() {
+		_, err := middleware.LoadSecurityHeaders(func() ([]byte, error) {
+			return nil, errors.New("file not found")
+		})
+		So(err, ShouldNotBeNil)
+	})
+
+	tests := map[string]string{
+		"invalid json":         `{"headers":`,
+		"invalid header name":  `{"headers": {"X Frame Options": "DENY"}}`,
+		"invalid header value": `{"headers": {"X-Frame-Options": "DENY\r\nSet-Cookie: a=b"}}`,
+		"rule without routes":  `{"rules": [{"headers": {"X-Frame-Options": "DENY"}}]}`,
+		"invalid route":        `{"rules": [{"routes": ["/v1/images/{id"], "headers": {"X-Frame-Options": "DENY"}}]}`,
+	}
+	for name, config := range tests {
+		Convey("A config with an "+name+" is rejected", t, func() {
+			securityHeaders, err := loadSecurityHeaders(config)
+			So(err, ShouldNotBeNil)
+			So(securityHeaders, ShouldBeNil)
+		})
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	securityHeaders, err := loadSecurityHeaders(testSecurityHeadersConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// upstream sets its own referrer policy and X-Powered-By header
+	handler := securityHeaders.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Referrer-Policy", "strict-origin")
+		w.Header().Set("X-Powered-By", "Express")
+		w.Write([]byte("{}"))
+	}))
+	serve := func(target string) http.Header {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, http.NoBody))
+		return w.Header()
+	}
+
+	Convey("Given a response to a route without any rules", t, func() {
+		header := serve("/v1/datasets")
+
+		Convey("Then the global headers are added, and headers set by the upstream are kept", func() {
+			So(header.Get("Strict-Transport-Security"), ShouldEqual, "max-age=31536000; includeSubDomains")
+			So(header.Get("X-Content-Type-Options"), ShouldEqual, "nosniff")
+			So(header.Get("Cross-Origin-Resource-Policy"), ShouldEqual, "same-site")
+			So(header.Get("Referrer-Policy"), ShouldEqual, "strict-origin")
+			So(header.Get("X-Powered-By"), ShouldEqual, "Express")
+		})
+	})
+
+	Convey("Given a response to a route with a rule that overrides global headers", t, func() {
+		header := serve("/v1/images/123")
+
+		Convey("Then the headers of the rule replace the global headers", func() {
+			So(header.Get("Cross-Origin-Resource-Policy"), ShouldEqual, "cross-origin")
+			So(header.Get("X-Content-Type-Options"), ShouldEqual, "nosniff")
+			So(header.Get("Referrer-Policy"), ShouldEqual, "strict-origin")
+		})
+	})
+
+	Convey("Given a response to a route with a rule that forces headers", t, func() {
+		header := serve("/v1/search")
+
+		Convey("Then the headers set by the upstream are replaced or removed", func() {
+			So(header.Get("Referrer-Policy"), ShouldEqual, "same-origin")
+			So(header.Values("Referrer-Policy"), ShouldHaveLength, 1)
+			So(header, ShouldNotContainKey, "X-Powered-By")
+			So(header.Get("Strict-Transport-Security"), ShouldEqual, "max-age=31536000; includeSubDomains")
+		})
+	})
+
+	Convey("Given globally forced headers and a response from the router itself", t, func() {
+		securityHeaders, err := loadSecurityHeaders(`{"headers": {"X-Frame-Options": "DENY"}, "force": true,
+		  "rules": [{"routes": ["/v1/embed/"], "headers": {"X-Frame-Options": "SAMEORIGIN"}, "force": false}]}`)
+		So(err, ShouldBeNil)
+		handler := securityHeaders.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("X-Frame-Options", "ALLOWALL")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}))
+
+		Convey("Then the forced header replaces the header set by the handler, unless a rule doesn't force it", func() {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/datasets", http.NoBody))
+			So(w.Code, ShouldEqual, http.StatusTooManyRequests)
+			So(w.Header().Get("X-Frame-Options"), ShouldEqual, "DENY")
+
+			w = httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/embed/chart", http.NoBody))
+			So(w.Header().Get("X-Frame-Options"), ShouldEqual, "ALLOWALL")
+		})
+	})
+}
@@ -0,0 +1,193 @@
+package openapi
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+)
+
+// maxViolations is the maximum number of violations that are reported for a request or response
+const maxViolations = 20
+
+// Violation is a part of a request or response that doesn't match the spec
+type Violation struct {
+	// Location is where the violation is, e.g. "query.limit" or "body.dimensions[0].name"
+	Location string `json:"location"`
+	Message  string `json:"message"`
+}
+
+// Operation is an operation on a path of the API, found for a request, which documents its parameters, request body
+// and responses
+type Operation struct {
+	OperationID string
+
+	route      *routers.Route
+	pathValues map[string]string
+}
+
+// HasRequestBody returns true if the operation documents a request body
+func (op *Operation) HasRequestBody() bool {
+	return op.route.Operation.RequestBody != nil
+}
+
+// options returns the options that requests and responses are validated with. Authentication is checked by the
+// router and the upstreams rather than by the security requirements of the spec, and defaults aren't added to
+// requests, as they are proxied unchanged.
+func options() *openapi3filter.Options {
+	return &openapi3filter.Options{
+		MultiError:            true,
+		IncludeResponseStatus: true,
+		SkipSettingDefaults:   true,
+		AuthenticationFunc:    openapi3filter.NoopAuthenticationFunc,
+	}
+}
+
+// ValidateRequest returns the violations of the operation by the request, with the body of the request. The body
+// isn't validated if it is incomplete, e.g. if it was too large to be read.
+func (op *Operation) ValidateRequest(req *http.Request, body []byte, bodyComplete bool) []Violation {
+	input := op.requestInput(req, body)
+	input.Options.ExcludeRequestBody = !bodyComplete
+	return violationsOf(openapi3filter.ValidateRequest(req.Context(), input))
+}
+
+// ValidateResponse returns the violations of the operation by a response to the request, with the status code,
+// headers and body. The body isn't validated if it is incomplete, e.g. if it was too large to be read, or compressed.
+func (op *Operation) ValidateResponse(req *http.Request, status int, header http.Header, body []byte, bodyComplete bool) []Violation {
+	encoding := header.Get("Content-Encoding")
+	input := &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: op.requestInput(req, nil),
+		Status:                 status,
+		Header:                 header,
+		Options:                options(),
+	}
+	input.Options.ExcludeResponseBody = len(body) == 0 || !bodyComplete || (encoding != "" && encoding != "identity")
+	input.SetBodyBytes(body)
+	return violationsOf(openapi3filter.ValidateResponse(req.Context(), input))
+}
+
+// requestInput returns the input to validate the request with, using a copy of the request with the body so that
+// the request itself is unchanged
+func (op *Operation) requestInput(req *http.Request, body []byte) *openapi3filter.RequestValidationInput {
+	r := *req
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return &openapi3filter.RequestValidationInput{
+		Request:    &r,
+		PathParams: op.pathValues,
+		Route:      op.route,
+		Options:    options(),
+	}
+}
+
+// violations collects the violations of a request or response, up to maxViolations
+type violations []Violation
+
+func (v *violations) add(location, message string) {
+	if len(*v) < maxViolations {
+		*v = append(*v, Violation{Location: location, Message: message})
+	}
+}
+
+// violationsOf returns the violations reported by the validation error, if there is one
+func violationsOf(err error) []Violation {
+	var v violations
+	v.addError("", err)
+	return v
+}
+
+// addError adds the violations reported by the validation error, at the location of the request or response that
+// they are for. Only the reasons of the errors are reported, as the errors themselves may include the invalid values.
+func (v *violations) addError(location string, err error) {
+	switch e := err.(type) {
+	case nil:
+	case openapi3.MultiError:
+		for _, err := range e {
+			v.addError(location, err)
+		}
+	case *openapi3filter.RequestError:
+		switch {
+		case e.Parameter != nil:
+			location = e.Parameter.In + "." + e.Parameter.Name
+		case e.RequestBody != nil:
+			location = "body"
+		case location == "":
+			location = "request"
+		}
+		v.addCause(location, e.Reason, e.Err)
+	case *openapi3filter.ResponseError:
+		switch {
+		case e.Err != nil:
+			location = "body"
+		case location == "":
+			location = "response"
+		}
+		v.addCause(location, e.Reason, e.Err)
+	case *openapi3filter.ParseError:
+		switch {
+		case e.Reason != "":
+			v.add(location, e.Reason)
+		case isParseError(e.Cause):
+			v.addError(location, e.Cause)
+		default:
+			v.add(location, "could not be parsed")
+		}
+	case *openapi3.SchemaError:
+		v.add(location+pointerLocation(e.JSONPointer()), e.Reason)
+	default:
+		// any other error may include the invalid value, so only the messages of the known errors are reported
+		if knownError(err) {
+			v.add(location, err.Error())
+		} else {
+			v.add(location, "is invalid")
+		}
+	}
+}
+
+// knownError returns whether the error is one of the validation errors with a fixed message, which can be reported
+func knownError(err error) bool {
+	for _, known := range []error{
+		openapi3filter.ErrInvalidRequired,
+		openapi3filter.ErrInvalidEmptyValue,
+		openapi3.ErrOneOfConflict,
+		openapi3.ErrSchemaInputNaN,
+		openapi3.ErrSchemaInputInf,
+	} {
+		if err == known {
+			return true
+		}
+	}
+	return false
+}
+
+// isParseError returns whether the cause of a parse error is a parse error itself, with its own reason
+func isParseError(err error) bool {
+	_, ok := err.(*openapi3filter.ParseError)
+	return ok
+}
+
+// addCause adds the violations of the error that caused a request or response error, or of its reason if it doesn't
+// have a cause
+func (v *violations) addCause(location, reason string, cause error) {
+	if cause == nil {
+		v.add(location, reason)
+		return
+	}
+	v.addError(location, cause)
+}
+
+// pointerLocation returns the location of the JSON pointer within a body, e.g. ".dimensions[0].name"
+func pointerLocation(pointer []string) string {
+	var location string
+	for _, key := range pointer {
+		if _, err := strconv.Atoi(key); err == nil {
+			location += "[" + key + "]"
+		} else {
+			location += "." + key
+		}
+	}
+	return location
+}
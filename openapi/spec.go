@@ -0,0 +1,204 @@
+package openapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi2"
+	"github.com/getkin/kin-openapi/openapi2conv"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// pathParamPattern matches the parameters of path templates, e.g. {id}
+var pathParamPattern = regexp.MustCompile(`\{([^{}/]+)\}`)
+
+// Spec is the OpenAPI 3.0 document of an API, which the requests to the API and its responses are validated against.
+// Swagger 2.0 documents are converted to OpenAPI 3.0 when they are loaded.
+type Spec struct {
+	doc      *openapi3.T
+	basePath string
+	paths    []*specPath
+}
+
+// specPath is a path template of the spec, compiled to match request paths
+type specPath struct {
+	template string
+	pattern  *regexp.Regexp
+	params   []string
+	item     *openapi3.PathItem
+}
+
+// LoadSpec parses and validates an OpenAPI 3.0 or Swagger 2.0 document, in either JSON or YAML. References are only
+// supported within the document itself, e.g. "#/components/schemas/Dataset" or "#/definitions/Dataset".
+func LoadSpec(data []byte) (*Spec, error) {
+	// YAML is a superset of JSON, so both are decoded as YAML
+	var version struct {
+		Swagger string `yaml:"swagger"`
+		OpenAPI string `yaml:"openapi"`
+	}
+	if err := yaml.Unmarshal(data, &version); err != nil {
+		return nil, errors.Wrap(err, "invalid openapi document")
+	}
+
+	var spec *Spec
+	var err error
+	switch {
+	case version.Swagger == "2.0":
+		spec, err = loadSwagger(data)
+	case strings.HasPrefix(version.OpenAPI, "3.0"):
+		spec, err = loadOpenAPI(data)
+	default:
+		return nil, fmt.Errorf("unsupported openapi version '%s', expected openapi 3.0 or swagger 2.0", version.OpenAPI)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid openapi document")
+	}
+
+	// examples are documentation, so they aren't required to match their schemas
+	if err := spec.doc.Validate(context.Background(), openapi3.DisableExamplesValidation()); err != nil {
+		return nil, errors.Wrap(err, "invalid openapi document")
+	}
+	if err := spec.compilePaths(); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// loadOpenAPI loads an OpenAPI 3.0 document, with the base path of its first server
+func loadOpenAPI(data []byte) (*Spec, error) {
+	doc, err := openapi3.NewLoader().LoadFromData(data)
+	if err != nil {
+		return nil, err
+	}
+	spec := &Spec{doc: doc}
+	if len(doc.Servers) > 0 {
+		spec.basePath = serverPath(doc.Servers[0].URL)
+	}
+	return spec, nil
+}
+
+// loadSwagger converts a Swagger 2.0 document to OpenAPI 3.0, with its base path
+func loadSwagger(data []byte) (*Spec, error) {
+	var document map[string]interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	// the version may have been decoded as a number if it wasn't quoted
+	document["swagger"] = "2.0"
+	documentJSON, err := json.Marshal(jsonCompatible(document))
+	if err != nil {
+		return nil, err
+	}
+	var doc2 openapi2.T
+	if err := json.Unmarshal(documentJSON, &doc2); err != nil {
+		return nil, err
+	}
+	doc, err := openapi2conv.ToV3(&doc2)
+	if err != nil {
+		return nil, err
+	}
+	return &Spec{doc: doc, basePath: strings.TrimSuffix(doc2.BasePath, "/")}, nil
+}
+
+// jsonCompatible converts the maps decoded from YAML, which may have keys that aren't strings (e.g. response codes), to
+// maps with string keys
+func jsonCompatible(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = jsonCompatible(item)
+		}
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[fmt.Sprint(key)] = jsonCompatible(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range v {
+			v[i] = jsonCompatible(item)
+		}
+	}
+	return value
+}
+
+// serverPath returns the path of a server URL, which may be absolute or relative
+func serverPath(u string) string {
+	if i := strings.Index(u, "://"); i >= 0 {
+		u = u[i+3:]
+		if j := strings.Index(u, "/"); j >= 0 {
+			u = u[j:]
+		} else {
+			u = ""
+		}
+	}
+	return strings.TrimSuffix(u, "/")
+}
+
+// BasePath returns the path that prefixes the paths of the operations of the spec, which is the path of its first
+// server for OpenAPI 3.0 or its basePath for Swagger 2.0
+func (s *Spec) BasePath() string {
+	return s.basePath
+}
+
+// FindOperation returns the operation for the method and path, which is relative to the base path. Paths without
+// parameters take precedence over templated paths that also match.
+func (s *Spec) FindOperation(method, path string) (*Operation, bool) {
+	for _, p := range s.paths {
+		match := p.pattern.FindStringSubmatch(path)
+		if match == nil {
+			continue
+		}
+		op := p.item.GetOperation(method)
+		if op == nil {
+			continue
+		}
+		values := make(map[string]string, len(p.params))
+		for i, name := range p.params {
+			values[name] = match[i+1]
+		}
+		return &Operation{
+			OperationID: op.OperationID,
+			route:       &routers.Route{Spec: s.doc, Path: p.template, PathItem: p.item, Method: method, Operation: op},
+			pathValues:  values,
+		}, true
+	}
+	return nil, false
+}
+
+// compilePaths compiles the path templates to regular expressions, ordered so that the paths with the fewest
+// parameters are matched first
+func (s *Spec) compilePaths() error {
+	items := s.doc.Paths.Map()
+	s.paths = make([]*specPath, 0, len(items))
+	for template, item := range items {
+		if !strings.HasPrefix(template, "/") || item == nil {
+			return fmt.Errorf("invalid path '%s' in openapi document", template)
+		}
+		p := &specPath{template: template, item: item}
+		pattern := "^"
+		last := 0
+		for _, loc := range pathParamPattern.FindAllStringSubmatchIndex(template, -1) {
+			pattern += regexp.QuoteMeta(template[last:loc[0]]) + "([^/]+)"
+			p.params = append(p.params, template[loc[2]:loc[3]])
+			last = loc[1]
+		}
+		pattern += regexp.QuoteMeta(template[last:]) + "$"
+		p.pattern = regexp.MustCompile(pattern)
+		s.paths = append(s.paths, p)
+	}
+	sort.Slice(s.paths, func(i, j int) bool {
+		if len(s.paths[i].params) != len(s.paths[j].params) {
+			return len(s.paths[i].params) < len(s.paths[j].params)
+		}
+		return s.paths[i].template < s.paths[j].template
+	})
+	return nil
+}
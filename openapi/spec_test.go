@@ -0,0 +1,324 @@
+package openapi
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3filter"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const testSpec = `
+openapi: 3.0.3
+info:
+  title: Dataset API
+  version: 1.0.0
+servers:
+  - url: http://localhost:22000/v1
+paths:
+  /datasets:
+    get:
+      operationId: getDatasets
+      parameters:
+        - $ref: '#/components/parameters/limit'
+        - name: is_based_on
+          in: query
+          schema:
+            type: array
+            items:
+              type: string
+      responses:
+        200:
+          description: OK
+          content:
+            application/json:
+              schema:
+                $ref: '#/components/schemas/Datasets'
+        4XX:
+          description: Client error
+  /datasets/latest:
+    get:
+      operationId: getLatestDataset
+      responses:
+        default:
+          description: Any
+  /datasets/{id}:
+    parameters:
+      - name: id
+        in: path
+        required: true
+        schema:
+          type: string
+          pattern: '^[a-z0-9-]+$'
+    put:
+      operationId: putDataset
+      parameters:
+        - name: If-Match
+          in: header
+          required: true
+          schema:
+            type: string
+      requestBody:
+        $ref: '#/components/requestBodies/Dataset'
+      responses:
+        200:
+          $ref: '#/components/responses/Dataset'
+components:
+  parameters:
+    limit:
+      name: limit
+      in: query
+      schema:
+        type: integer
+        minimum: 1
+        maximum: 1000
+  requestBodies:
+    Dataset:
+      required: true
+      content:
+        application/json:
+          schema:
+            $ref: '#/components/schemas/Dataset'
+  responses:
+    Dataset:
+      description: The dataset
+      content:
+        application/json:
+          schema:
+            $ref: '#/components/schemas/Dataset'
+  schemas:
+    Datasets:
+      type: object
+      required: [items]
+      properties:
+        items:
+          type: array
+          items:
+            $ref: '#/components/schemas/Dataset'
+    Dataset:
+      type: object
+      required: [id, title]
+      additionalProperties: false
+      properties:
+        id:
+          type: string
+          readOnly: true
+        title:
+          type: string
+          minLength: 1
+        state:
+          type: string
+          enum: [created, published]
+        related:
+          type: array
+          items:
+            $ref: '#/components/schemas/Dataset'
+`
+
+const testSwaggerSpec = `
+swagger: 2.0
+info:
+  title: Dataset API
+  version: 1.0.0
+host: localhost:22000
+basePath: /v1
+paths:
+  /datasets:
+    post:
+      operationId: postDataset
+      consumes: [application/json]
+      parameters:
+        - name: dataset
+          in: body
+          required: true
+          schema:
+            $ref: '#/definitions/Dataset'
+      responses:
+        201:
+          description: Created
+definitions:
+  Dataset:
+    type: object
+    required: [title]
+    properties:
+      title:
+        type: string
+`
+
+func TestLoadSpec(t *testing.T) {
+	Convey("Given a YAML spec with references to its components", t, func() {
+		spec, err := LoadSpec([]byte(testSpec))
+		So(err, ShouldBeNil)
+
+		Convey("Then the base path is the path of its first server", func() {
+			So(spec.BasePath(), ShouldEqual, "/v1")
+		})
+
+		Convey("Then operations are found by their method and path, preferring paths without parameters", func() {
+			op, ok := spec.FindOperation(http.MethodGet, "/datasets/latest")
+			So(ok, ShouldBeTrue)
+			So(op.OperationID, ShouldEqual, "getLatestDataset")
+			So(op.pathValues, ShouldBeEmpty)
+			So(op.HasRequestBody(), ShouldBeFalse)
+
+			op, ok = spec.FindOperation(http.MethodPut, "/datasets/cpih01")
+			So(ok, ShouldBeTrue)
+			So(op.OperationID, ShouldEqual, "putDataset")
+			So(op.pathValues, ShouldResemble, map[string]string{"id": "cpih01"})
+			So(op.HasRequestBody(), ShouldBeTrue)
+		})
+
+		Convey("Then operations that aren't documented are not found", func() {
+			_, ok := spec.FindOperation(http.MethodDelete, "/datasets/cpih01")
+			So(ok, ShouldBeFalse)
+			_, ok = spec.FindOperation(http.MethodGet, "/datasets/cpih01/editions")
+			So(ok, ShouldBeFalse)
+		})
+	})
+
+	Convey("A JSON spec is loaded", t, func() {
+		spec, err := LoadSpec([]byte(`{"openapi": "3.0.0", "info": {"title": "Ping", "version": "1"}, "paths": {"/ping": {"get": {"responses": {"200": {"description": "OK"}}}}}}`))
+		So(err, ShouldBeNil)
+		So(spec.BasePath(), ShouldBeEmpty)
+		_, ok := spec.FindOperation(http.MethodGet, "/ping")
+		So(ok, ShouldBeTrue)
+	})
+
+	Convey("Given a Swagger 2.0 spec", t, func() {
+		spec, err := LoadSpec([]byte(testSwaggerSpec))
+		So(err, ShouldBeNil)
+
+		Convey("Then the base path is its basePath", func() {
+			So(spec.BasePath(), ShouldEqual, "/v1")
+		})
+
+		Convey("Then its operations are found, with their body parameters converted to request bodies", func() {
+			op, ok := spec.FindOperation(http.MethodPost, "/datasets")
+			So(ok, ShouldBeTrue)
+			So(op.OperationID, ShouldEqual, "postDataset")
+			So(op.HasRequestBody(), ShouldBeTrue)
+		})
+	})
+
+	tests := map[string]string{
+		"invalid yaml":          "openapi: [3.0.0",
+		"unsupported version":   `{"openapi": "3.1.0", "paths": {}}`,
+		"unsupported swagger":   `{"swagger": "1.2", "paths": {}}`,
+		"missing info":          `{"openapi": "3.0.0", "paths": {}}`,
+		"invalid swagger":       `{"swagger": "2.0", "info": {"title": "Ping", "version": "1"}, "host": "localhost:22000/v1", "paths": {}}`,
+		"external reference":    `{"openapi": "3.0.0", "info": {"title": "Ping", "version": "1"}, "paths": {"/a": {"get": {"requestBody": {"$ref": "other.yaml#/Body"}}}}}`,
+		"missing reference":     `{"openapi": "3.0.0", "info": {"title": "Ping", "version": "1"}, "paths": {"/a": {"get": {"parameters": [{"$ref": "#/components/parameters/missing"}]}}}}`,
+		"invalid pattern":       `{"openapi": "3.0.0", "info": {"title": "Ping", "version": "1"}, "components": {"schemas": {"a": {"type": "string", "pattern": "["}}}}`,
+		"path without a slash":  `{"openapi": "3.0.0", "info": {"title": "Ping", "version": "1"}, "paths": {"datasets": {}}}`,
+		"invalid schema fields": `{"openapi": "3.0.0", "info": {"title": "Ping", "version": "1"}, "components": {"schemas": {"a": {"minLength": "one"}}}}`,
+	}
+	for name, spec := range tests {
+		Convey("A spec with "+name+" is rejected", t, func() {
+			_, err := LoadSpec([]byte(spec))
+			So(err, ShouldNotBeNil)
+		})
+	}
+}
+
+func TestValidateRequest(t *testing.T) {
+	spec, err := LoadSpec([]byte(testSpec))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	validate := func(method, target, body string, headers map[string]string) []Violation {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		op, ok := spec.FindOperation(method, req.URL.Path)
+		So(ok, ShouldBeTrue)
+		return op.ValidateRequest(req, []byte(body), true)
+	}
+	jsonHeaders := map[string]string{"Content-Type": "application/json", "If-Match": "*"}
+
+	Convey("Valid requests have no violations", t, func() {
+		So(validate(http.MethodGet, "/datasets?limit=20&is_based_on=a&is_based_on=b", "", nil), ShouldBeEmpty)
+		So(validate(http.MethodPut, "/datasets/cpih01", `{"title": "CPIH", "state": "created"}`, jsonHeaders), ShouldBeEmpty)
+	})
+
+	Convey("Invalid parameters are reported", t, func() {
+		So(validate(http.MethodGet, "/datasets?limit=ten", "", nil), ShouldResemble, []Violation{
+			{Location: "query.limit", Message: "an invalid integer"},
+		})
+		So(validate(http.MethodGet, "/datasets?limit=0", "", nil), ShouldResemble, []Violation{
+			{Location: "query.limit", Message: "number must be at least 1"},
+		})
+		So(validate(http.MethodPut, "/datasets/CPIH", `{"title": "CPIH"}`, map[string]string{"Content-Type": "application/json"}), ShouldResemble, []Violation{
+			{Location: "path.id", Message: `string doesn't match the regular expression "^[a-z0-9-]+$"`},
+			{Location: "header.If-Match", Message: "value is required but missing"},
+		})
+	})
+
+	Convey("Invalid bodies are reported, without requiring read only properties", t, func() {
+		So(validate(http.MethodPut, "/datasets/cpih01", `{"title": "", "state": "deleted", "other": 1, "related": [{"title": 1}]}`, jsonHeaders), ShouldResemble, []Violation{
+			{Location: "body", Message: `property "other" is unsupported`},
+			{Location: "body.related[0].title", Message: "value must be a string"},
+			{Location: "body.state", Message: `value is not one of the allowed values ["created","published"]`},
+			{Location: "body.title", Message: "minimum string length is 1"},
+		})
+		So(validate(http.MethodPut, "/datasets/cpih01", `{"title": `, jsonHeaders), ShouldResemble, []Violation{
+			{Location: "body", Message: "could not be parsed"},
+		})
+		So(validate(http.MethodPut, "/datasets/cpih01", "", jsonHeaders), ShouldResemble, []Violation{
+			{Location: "body", Message: "value is required but missing"},
+		})
+		So(validate(http.MethodPut, "/datasets/cpih01", "title=CPIH", map[string]string{"Content-Type": "text/plain", "If-Match": "*"}), ShouldResemble, []Violation{
+			{Location: "body", Message: `header Content-Type has unexpected value "text/plain"`},
+		})
+	})
+
+	Convey("Incomplete bodies are not validated", t, func() {
+		req := httptest.NewRequest(http.MethodPut, "/datasets/cpih01", http.NoBody)
+		req.Header.Set("If-Match", "*")
+		op, _ := spec.FindOperation(http.MethodPut, "/datasets/cpih01")
+		So(op.ValidateRequest(req, []byte(`{"title": `), false), ShouldBeEmpty)
+	})
+
+	Convey("Other errors are reported without their details, as they may include the invalid values", t, func() {
+		So(violationsOf(errors.New(`invalid value "secret"`)), ShouldResemble, []Violation{
+			{Location: "", Message: "is invalid"},
+		})
+		So(violationsOf(&openapi3filter.RequestError{Err: errors.New(`invalid value "secret"`)}), ShouldResemble, []Violation{
+			{Location: "request", Message: "is invalid"},
+		})
+	})
+}
+
+func TestValidateResponse(t *testing.T) {
+	spec, err := LoadSpec([]byte(testSpec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	op, _ := spec.FindOperation(http.MethodGet, "/datasets")
+	req := httptest.NewRequest(http.MethodGet, "/datasets", http.NoBody)
+	jsonHeader := http.Header{"Content-Type": []string{"application/json; charset=utf-8"}}
+
+	Convey("Valid responses have no violations", t, func() {
+		So(op.ValidateResponse(req, http.StatusOK, jsonHeader, []byte(`{"items": [{"id": "cpih01", "title": "CPIH"}]}`), true), ShouldBeEmpty)
+		So(op.ValidateResponse(req, http.StatusNotFound, http.Header{}, []byte("not found"), true), ShouldBeEmpty)
+	})
+
+	Convey("Responses are validated against their status code, requiring read only properties", t, func() {
+		So(op.ValidateResponse(req, http.StatusOK, jsonHeader, []byte(`{"items": [{"title": "CPIH"}]}`), true), ShouldResemble, []Violation{
+			{Location: "body.items[0].id", Message: `property "id" is missing`},
+		})
+		So(op.ValidateResponse(req, http.StatusInternalServerError, http.Header{}, nil, true), ShouldResemble, []Violation{
+			{Location: "response", Message: "status is not supported"},
+		})
+	})
+
+	Convey("Compressed or incomplete bodies are not validated", t, func() {
+		gzipHeader := http.Header{"Content-Type": []string{"application/json"}, "Content-Encoding": []string{"gzip"}}
+		So(op.ValidateResponse(req, http.StatusOK, gzipHeader, []byte("compressed"), true), ShouldBeEmpty)
+		So(op.ValidateResponse(req, http.StatusOK, jsonHeader, []byte(`{"items": `), false), ShouldBeEmpty)
+	})
+}
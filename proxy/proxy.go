@@ -37,7 +37,8 @@ var NewSingleHostReverseProxyWithTransport = func(target *url.URL, transport htt
 
 // Options is a struct that allows optional parameters to be supplied when initialising an API proxy
 type Options struct {
-	Interceptor bool
+	Interceptor        bool
+	RequestInterceptor bool
 }
 
 // NewAPIProxy creates a new APIProxy with a new ReverseProxy for the provided target
@@ -54,8 +55,11 @@ func NewAPIProxyWithOptions(ctx context.Context, target, version, envHost string
 	}
 
 	var transport http.RoundTripper
-	if options.Interceptor {
-		transport = interceptor.NewRoundTripper(envHost+"/"+version, http.DefaultTransport)
+	if options.Interceptor || options.RequestInterceptor {
+		transport = interceptor.NewRoundTripperWithOptions(envHost+"/"+version, http.DefaultTransport, interceptor.Options{
+			Response: options.Interceptor,
+			Request:  options.RequestInterceptor,
+		})
 	}
 
 	pxy := NewSingleHostReverseProxyWithTransport(targetURL, transport)
@@ -68,12 +72,14 @@ func NewAPIProxyWithOptions(ctx context.Context, target, version, envHost string
 
 // Handle is a wrapper for proxy ServeHTTP
 func (p *APIProxy) Handle(w http.ResponseWriter, r *http.Request) {
+	middleware.SetUpstream(r.Context(), p.target.String())
 	p.proxy.ServeHTTP(w, r)
 }
 
 // LegacyHandle removes the /v1 path item from the URL and then calls the proxy's ServeHTTP
 func (p *APIProxy) LegacyHandle(w http.ResponseWriter, r *http.Request) {
 	r.URL.Path = strings.Replace(r.URL.Path, "/v1", "", 1)
+	middleware.SetUpstream(r.Context(), p.target.String())
 
 	middleware.BetaAPIHandler(p.enableBetaRestriction, p.proxy, p.Version).ServeHTTP(w, r)
 }
@@ -1,6 +1,8 @@
 package schema
 
 import (
+	"fmt"
+
 	"github.com/ONSdigital/go-ns/avro"
 )
 
@@ -23,7 +25,118 @@ var audit = `{
   ]
 }`
 
+// auditV2 represents the version 2 schema for an audit message.
+// New fields are only ever appended after the version 1 fields, with defaults,
+// so that consumers using the version 1 schema can still decode version 2 messages
+var auditV2 = `{
+  "type": "record",
+  "name": "audit",
+  "fields": [
+    {"name": "created_at", "type": "long", "logicalType": "timestamp-millis"},
+    {"name": "request_id", "type": "string", "default": ""},
+    {"name": "identity", "type": "string", "default": ""},
+    {"name": "collection_id", "type": "string", "default": ""},
+    {"name": "path", "type": "string", "default": ""},
+    {"name": "method", "type": "string", "default": ""},
+    {"name": "status_code", "type": "int", "default": 0},
+    {"name": "query_param", "type": "string", "default": ""},
+    {"name": "duration_ms", "type": "long", "default": 0},
+    {"name": "response_bytes", "type": "long", "default": 0},
+    {"name": "client_ip", "type": "string", "default": ""},
+    {"name": "user_agent", "type": "string", "default": ""},
+    {"name": "route", "type": "string", "default": ""},
+    {"name": "upstream", "type": "string", "default": ""},
+    {"name": "auth_type", "type": "string", "default": ""}
+  ]
+}`
+
+// auditV3 represents the version 3 schema for an audit message, which appends the tamper-evident chain fields
+var auditV3 = `{
+  "type": "record",
+  "name": "audit",
+  "fields": [
+    {"name": "created_at", "type": "long", "logicalType": "timestamp-millis"},
+    {"name": "request_id", "type": "string", "default": ""},
+    {"name": "identity", "type": "string", "default": ""},
+    {"name": "collection_id", "type": "string", "default": ""},
+    {"name": "path", "type": "string", "default": ""},
+    {"name": "method", "type": "string", "default": ""},
+    {"name": "status_code", "type": "int", "default": 0},
+    {"name": "query_param", "type": "string", "default": ""},
+    {"name": "duration_ms", "type": "long", "default": 0},
+    {"name": "response_bytes", "type": "long", "default": 0},
+    {"name": "client_ip", "type": "string", "default": ""},
+    {"name": "user_agent", "type": "string", "default": ""},
+    {"name": "route", "type": "string", "default": ""},
+    {"name": "upstream", "type": "string", "default": ""},
+    {"name": "auth_type", "type": "string", "default": ""},
+    {"name": "instance_id", "type": "string", "default": ""},
+    {"name": "sequence", "type": "long", "default": 0},
+    {"name": "previous_hmac", "type": "string", "default": ""},
+    {"name": "hmac", "type": "string", "default": ""}
+  ]
+}`
+
+// auditV4 represents the version 4 schema for an audit message, which appends the owner of the API key of the request
+var auditV4 = `{
+  "type": "record",
+  "name": "audit",
+  "fields": [
+    {"name": "created_at", "type": "long", "logicalType": "timestamp-millis"},
+    {"name": "request_id", "type": "string", "default": ""},
+    {"name": "identity", "type": "string", "default": ""},
+    {"name": "collection_id", "type": "string", "default": ""},
+    {"name": "path", "type": "string", "default": ""},
+    {"name": "method", "type": "string", "default": ""},
+    {"name": "status_code", "type": "int", "default": 0},
+    {"name": "query_param", "type": "string", "default": ""},
+    {"name": "duration_ms", "type": "long", "default": 0},
+    {"name": "response_bytes", "type": "long", "default": 0},
+    {"name": "client_ip", "type": "string", "default": ""},
+    {"name": "user_agent", "type": "string", "default": ""},
+    {"name": "route", "type": "string", "default": ""},
+    {"name": "upstream", "type": "string", "default": ""},
+    {"name": "auth_type", "type": "string", "default": ""},
+    {"name": "instance_id", "type": "string", "default": ""},
+    {"name": "sequence", "type": "long", "default": 0},
+    {"name": "previous_hmac", "type": "string", "default": ""},
+    {"name": "hmac", "type": "string", "default": ""},
+    {"name": "api_key_owner", "type": "string", "default": ""}
+  ]
+}`
+
 // AuditEvent is the Avro schema for Audit messages.
 var AuditEvent = &avro.Schema{
 	Definition: audit,
 }
+
+// AuditEventV2 is the version 2 Avro schema for Audit messages, which adds timing, size and client fields.
+var AuditEventV2 = &avro.Schema{
+	Definition: auditV2,
+}
+
+// AuditEventV3 is the version 3 Avro schema for Audit messages, which adds the tamper-evident chain fields.
+var AuditEventV3 = &avro.Schema{
+	Definition: auditV3,
+}
+
+// AuditEventV4 is the version 4 Avro schema for Audit messages, which adds the API key owner.
+var AuditEventV4 = &avro.Schema{
+	Definition: auditV4,
+}
+
+// AuditEventVersion returns the Avro schema for the provided version of Audit messages
+func AuditEventVersion(version int) (*avro.Schema, error) {
+	switch version {
+	case 1:
+		return AuditEvent, nil
+	case 2:
+		return AuditEventV2, nil
+	case 3:
+		return AuditEventV3, nil
+	case 4:
+		return AuditEventV4, nil
+	default:
+		return nil, fmt.Errorf("unsupported audit schema version %d, expected 1, 2, 3 or 4", version)
+	}
+}
@@ -0,0 +1,156 @@
+package schema_test
+
+import (
+	"testing"
+
+	"github.com/ONSdigital/dp-api-router/event"
+	"github.com/ONSdigital/dp-api-router/schema"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// auditV1 is the audit event struct used by consumers of the version 1 schema
+type auditV1 struct {
+	CreatedAt    int64  `avro:"created_at"`
+	RequestID    string `avro:"request_id"`
+	Identity     string `avro:"identity"`
+	CollectionID string `avro:"collection_id"`
+	Path         string `avro:"path"`
+	Method       string `avro:"method"`
+	StatusCode   int32  `avro:"status_code"`
+	QueryParam   string `avro:"query_param"`
+}
+
+var testAuditEvent = event.Audit{
+	CreatedAt:      1587884752123,
+	RequestID:      "myRequest",
+	Identity:       "myIdentity",
+	CollectionID:   "myCollection",
+	Path:           "/v1/datasets",
+	Method:         "GET",
+	StatusCode:     200,
+	QueryParam:     "q1=v1",
+	DurationMillis: 333,
+	ResponseBytes:  1024,
+	ClientIP:       "203.0.113.7",
+	UserAgent:      "curl/8.0",
+	Route:          "/{version}/datasets",
+	Upstream:       "http://localhost:22000",
+	AuthType:       "jwt",
+	InstanceID:     "router-1",
+	Sequence:       42,
+	PreviousHMAC:   "abc123",
+	HMAC:           "def456",
+	APIKeyOwner:    "myConsumer",
+}
+
+var expectedAuditV1 = auditV1{
+	CreatedAt:    1587884752123,
+	RequestID:    "myRequest",
+	Identity:     "myIdentity",
+	CollectionID: "myCollection",
+	Path:         "/v1/datasets",
+	Method:       "GET",
+	StatusCode:   200,
+	QueryParam:   "q1=v1",
+}
+
+func TestAuditEventSchema(t *testing.T) {
+	Convey("Given an audit event with all fields populated", t, func() {
+		Convey("When it is marshalled with the version 4 schema", func() {
+			b, err := schema.AuditEventV4.Marshal(&testAuditEvent)
+			So(err, ShouldBeNil)
+
+			Convey("Then it can be unmarshalled with the version 4 schema, including the API key owner", func() {
+				decoded := event.Audit{}
+				err := schema.AuditEventV4.Unmarshal(b, &decoded)
+				So(err, ShouldBeNil)
+				So(decoded, ShouldResemble, testAuditEvent)
+			})
+
+			Convey("Then a consumer using the version 1 schema can still unmarshal the version 1 fields", func() {
+				decoded := auditV1{}
+				err := schema.AuditEvent.Unmarshal(b, &decoded)
+				So(err, ShouldBeNil)
+				So(decoded, ShouldResemble, expectedAuditV1)
+			})
+		})
+
+		Convey("When it is marshalled with the version 3 schema", func() {
+			b, err := schema.AuditEventV3.Marshal(&testAuditEvent)
+			So(err, ShouldBeNil)
+
+			Convey("Then the API key owner is not emitted", func() {
+				v4Bytes, err := schema.AuditEventV4.Marshal(&testAuditEvent)
+				So(err, ShouldBeNil)
+				So(len(b), ShouldBeLessThan, len(v4Bytes))
+			})
+
+			Convey("Then a consumer using the version 1 schema can still unmarshal the version 1 fields", func() {
+				decoded := auditV1{}
+				err := schema.AuditEvent.Unmarshal(b, &decoded)
+				So(err, ShouldBeNil)
+				So(decoded, ShouldResemble, expectedAuditV1)
+			})
+		})
+
+		Convey("When it is marshalled with the version 2 schema", func() {
+			b, err := schema.AuditEventV2.Marshal(&testAuditEvent)
+			So(err, ShouldBeNil)
+
+			Convey("Then the chain fields are not emitted", func() {
+				v3Bytes, err := schema.AuditEventV3.Marshal(&testAuditEvent)
+				So(err, ShouldBeNil)
+				So(len(b), ShouldBeLessThan, len(v3Bytes))
+			})
+
+			Convey("Then a consumer using the version 1 schema can still unmarshal the version 1 fields", func() {
+				decoded := auditV1{}
+				err := schema.AuditEvent.Unmarshal(b, &decoded)
+				So(err, ShouldBeNil)
+				So(decoded, ShouldResemble, expectedAuditV1)
+			})
+		})
+
+		Convey("When it is marshalled with the version 1 schema", func() {
+			b, err := schema.AuditEvent.Marshal(&testAuditEvent)
+			So(err, ShouldBeNil)
+
+			Convey("Then only the version 1 fields are emitted", func() {
+				decoded := auditV1{}
+				err := schema.AuditEvent.Unmarshal(b, &decoded)
+				So(err, ShouldBeNil)
+				So(decoded, ShouldResemble, expectedAuditV1)
+
+				v2Bytes, err := schema.AuditEventV2.Marshal(&testAuditEvent)
+				So(err, ShouldBeNil)
+				So(len(b), ShouldBeLessThan, len(v2Bytes))
+			})
+		})
+	})
+}
+
+func TestAuditEventVersion(t *testing.T) {
+	Convey("The expected schema is returned for each supported version", t, func() {
+		s, err := schema.AuditEventVersion(1)
+		So(err, ShouldBeNil)
+		So(s, ShouldEqual, schema.AuditEvent)
+
+		s, err = schema.AuditEventVersion(2)
+		So(err, ShouldBeNil)
+		So(s, ShouldEqual, schema.AuditEventV2)
+
+		s, err = schema.AuditEventVersion(3)
+		So(err, ShouldBeNil)
+		So(s, ShouldEqual, schema.AuditEventV3)
+
+		s, err = schema.AuditEventVersion(4)
+		So(err, ShouldBeNil)
+		So(s, ShouldEqual, schema.AuditEventV4)
+	})
+
+	Convey("An error is returned for an unsupported version", t, func() {
+		s, err := schema.AuditEventVersion(5)
+		So(err, ShouldNotBeNil)
+		So(s, ShouldBeNil)
+	})
+}
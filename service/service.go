@@ -2,17 +2,24 @@ package service
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/ONSdigital/dp-api-clients-go/v2/health"
 	"github.com/ONSdigital/dp-api-router/config"
 	"github.com/ONSdigital/dp-api-router/deprecation"
 	"github.com/ONSdigital/dp-api-router/event"
+	"github.com/ONSdigital/dp-api-router/metrics"
 	"github.com/ONSdigital/dp-api-router/middleware"
 	"github.com/ONSdigital/dp-api-router/proxy"
 	"github.com/ONSdigital/dp-api-router/schema"
+	"github.com/ONSdigital/dp-authorisation/v2/authorisation"
+	"github.com/ONSdigital/dp-authorisation/v2/permissions"
 	kafka "github.com/ONSdigital/dp-kafka/v3"
 	dphttp "github.com/ONSdigital/dp-net/v3/http"
 	"github.com/ONSdigital/log.go/v2/log"
@@ -29,6 +36,23 @@ type Service struct {
 	Config             *config.Config
 	ServiceList        *ExternalServiceList
 	KafkaAuditProducer kafka.IProducer
+	AuditProducer      *event.AvroProducer
+	AuditSpool         *event.SpoolSink
+	EdgeAuthorisation  *middleware.EdgeAuthorisation
+	CORSPolicies       []middleware.CORSPolicy
+	SecurityHeaders    *middleware.SecurityHeaders
+	ClientIPResolver   *middleware.ClientIPResolver
+	IPFilter           *middleware.IPFilter
+	RateLimiter        *middleware.RateLimiter
+	RateLimitStore     middleware.RateLimitStore
+	APIKeys            *middleware.APIKeys
+	ConcurrencyLimiter *middleware.ConcurrencyLimiter
+	OpenAPIValidator   *middleware.OpenAPIValidator
+	RequestHygiene     *middleware.RequestHygiene
+	PermissionsChecker authorisation.PermissionsChecker
+	AuditRules         *middleware.AuditRules
+	IdentityCache      *middleware.IdentityCache
+	JWTVerifier        *middleware.JWTVerifier
 	Server             *dphttp.Server
 	HealthCheck        HealthChecker
 	ZebedeeClient      *health.Client
@@ -43,6 +67,18 @@ func Run(ctx context.Context, cfg *config.Config, serviceList *ExternalServiceLi
 		ServiceList: serviceList,
 	}
 
+	if cfg.EnableAdminEndpoints && cfg.AdminAuthToken == "" {
+		err = errors.New("ADMIN_AUTH_TOKEN is required when admin endpoints are enabled")
+		log.Fatal(ctx, "invalid admin configuration", err)
+		return nil, err
+	}
+
+	if cfg.EnableMetricsEndpoint && cfg.MetricsAuthToken == "" {
+		err = errors.New("METRICS_AUTH_TOKEN is required when the metrics endpoint is enabled")
+		log.Fatal(ctx, "invalid metrics configuration", err)
+		return nil, err
+	}
+
 	if cfg.EnableV1BetaRestriction {
 		log.Info(ctx, "beta route restriction is active, /v1 api requests will only be permitted against beta domains")
 	}
@@ -50,13 +86,173 @@ func Run(ctx context.Context, cfg *config.Config, serviceList *ExternalServiceLi
 	// Create Zebedee client
 	svc.ZebedeeClient = health.NewClientWithClienter("Zebedee", cfg.ZebedeeURL, dphttp.ClientWithTimeout(dphttp.NewClient(), cfg.ZebedeeClientTimeout))
 
-	// Get Kafka Audit Producer (only if audit is enabled)
+	// Get Audit Producer and its sinks (only if audit is enabled)
 	if cfg.EnableAudit {
-		svc.KafkaAuditProducer, err = serviceList.GetKafkaAuditProducer(ctx, cfg)
+		auditSchema, err := schema.AuditEventVersion(cfg.AuditSchemaVersion)
+		if err != nil {
+			log.Fatal(ctx, "could not get audit schema", err)
+			return nil, err
+		}
+
+		auditSink, err := svc.newAuditSink(ctx, cfg, auditSchema.Definition)
+		if err != nil {
+			log.Fatal(ctx, "could not instantiate audit sinks", err, log.Data{"audit_sinks": cfg.AuditSinks})
+			return nil, err
+		}
+
+		svc.AuditProducer, err = newAuditProducer(cfg, auditSink, auditSchema)
 		if err != nil {
-			log.Fatal(ctx, "could not instantiate kafka audit producer", err)
+			log.Fatal(ctx, "could not instantiate audit producer", err)
 			return nil, err
 		}
+
+		svc.AuditRules, err = middleware.NewAuditRules(cfg.Version, cfg.AuditIgnoreRules, cfg.AuditSkipIdentityRules)
+		if err != nil {
+			log.Fatal(ctx, "could not load audit rules", err)
+			return nil, err
+		}
+
+		if redactionConfigFilePath := cfg.AuditRedactionConfigFilePath; redactionConfigFilePath != "" {
+			redaction, err := middleware.LoadQueryRedaction(func() ([]byte, error) {
+				return os.ReadFile(redactionConfigFilePath)
+			})
+			if err != nil {
+				log.Fatal(ctx, "could not load audit query redaction config", err)
+				return nil, errors.Wrap(err, "could not load audit query redaction config")
+			}
+			svc.AuditRules.SetQueryRedaction(redaction)
+		}
+
+		if cfg.IdentityCacheTTL > 0 {
+			svc.IdentityCache = middleware.NewIdentityCache(cfg.IdentityCacheTTL, cfg.IdentityCacheNegativeTTL, cfg.IdentityCacheMaxSize)
+		}
+	}
+
+	// Load the permissions required by private routes, which are then enforced by the router itself
+	var permissionRules []middleware.PermissionRule
+	if edgeConfigFilePath := cfg.EdgeAuthorisationConfigFilePath; cfg.EnablePrivateEndpoints && edgeConfigFilePath != "" {
+		permissionRules, err = middleware.LoadPermissionRules(func() ([]byte, error) {
+			return os.ReadFile(edgeConfigFilePath)
+		})
+		if err != nil {
+			log.Fatal(ctx, "could not load edge authorisation config", err)
+			return nil, errors.Wrap(err, "could not load edge authorisation config")
+		}
+		log.Info(ctx, "loaded edge authorisation config", log.Data{"rules": len(permissionRules)})
+	}
+
+	// JWTs are verified by the router itself once authorisation is enabled for audit, or edge authorisation is
+	// configured, with keys refreshed in the background. Audit only uses the verifier if authorisation is enabled.
+	if (cfg.EnableAudit && cfg.Auth.Enabled) || len(permissionRules) > 0 {
+		svc.JWTVerifier = middleware.NewJWTVerifier(ctx, newJWTKeyFetcher(cfg), cfg.JWTKeysRefreshInterval, cfg.JWTKeysMaxAge)
+		svc.JWTVerifier.Start(ctx)
+	}
+
+	if len(permissionRules) > 0 {
+		svc.PermissionsChecker = permissions.NewChecker(ctx, cfg.PermissionsAPIURL, cfg.Auth.PermissionsCacheUpdateInterval, cfg.Auth.PermissionsMaxCacheTime)
+		svc.EdgeAuthorisation = middleware.NewEdgeAuthorisation(permissionRules, svc.JWTVerifier, middleware.NewIdentityChecker(svc.ZebedeeClient.Client, cfg.ZebedeeURL, svc.IdentityCache), svc.PermissionsChecker)
+	}
+
+	if corsConfigFilePath := cfg.CORSConfigFilePath; corsConfigFilePath != "" {
+		svc.CORSPolicies, err = middleware.LoadCORSPolicies(func() ([]byte, error) {
+			return os.ReadFile(corsConfigFilePath)
+		})
+		if err != nil {
+			log.Fatal(ctx, "could not load cors config", err)
+			return nil, errors.Wrap(err, "could not load cors config")
+		}
+		log.Info(ctx, "loaded cors config", log.Data{"policies": len(svc.CORSPolicies)})
+	}
+
+	if securityHeadersConfigFilePath := cfg.SecurityHeadersConfigFilePath; securityHeadersConfigFilePath != "" {
+		svc.SecurityHeaders, err = middleware.LoadSecurityHeaders(func() ([]byte, error) {
+			return os.ReadFile(securityHeadersConfigFilePath)
+		})
+		if err != nil {
+			log.Fatal(ctx, "could not load security headers config", err)
+			return nil, errors.Wrap(err, "could not load security headers config")
+		}
+		log.Info(ctx, "loaded security headers config")
+	}
+
+	if requestHygieneConfigFilePath := cfg.RequestHygieneConfigFilePath; requestHygieneConfigFilePath != "" {
+		svc.RequestHygiene, err = middleware.LoadRequestHygiene(func() ([]byte, error) {
+			return os.ReadFile(requestHygieneConfigFilePath)
+		})
+		if err != nil {
+			log.Fatal(ctx, "could not load request hygiene config", err)
+			return nil, errors.Wrap(err, "could not load request hygiene config")
+		}
+		log.Info(ctx, "loaded request hygiene config")
+	}
+
+	svc.ClientIPResolver, err = middleware.NewClientIPResolver(cfg.TrustedProxies)
+	if err != nil {
+		log.Fatal(ctx, "invalid trusted proxies", err, log.Data{"trusted_proxies": cfg.TrustedProxies})
+		return nil, err
+	}
+
+	if ipFilterConfigFilePath := cfg.IPFilterConfigFilePath; ipFilterConfigFilePath != "" {
+		svc.IPFilter, err = middleware.LoadIPFilter(func() ([]byte, error) {
+			return os.ReadFile(ipFilterConfigFilePath)
+		})
+		if err != nil {
+			log.Fatal(ctx, "could not load ip filter config", err)
+			return nil, errors.Wrap(err, "could not load ip filter config")
+		}
+		log.Info(ctx, "loaded ip filter config")
+	}
+
+	if rateLimitConfigFilePath := cfg.RateLimitConfigFilePath; rateLimitConfigFilePath != "" {
+		rateLimitRules, err := middleware.LoadRateLimitRules(func() ([]byte, error) {
+			return os.ReadFile(rateLimitConfigFilePath)
+		})
+		if err != nil {
+			log.Fatal(ctx, "could not load rate limit config", err)
+			return nil, errors.Wrap(err, "could not load rate limit config")
+		}
+		log.Info(ctx, "loaded rate limit config", log.Data{"rules": len(rateLimitRules)})
+		svc.RateLimiter = middleware.NewRateLimiter(rateLimitRules, svc.rateLimitStore())
+	}
+
+	if apiKeysConfigFilePath := cfg.APIKeysConfigFilePath; apiKeysConfigFilePath != "" {
+		apiKeys, err := middleware.LoadAPIKeys(func() ([]byte, error) {
+			return os.ReadFile(apiKeysConfigFilePath)
+		})
+		if err != nil {
+			log.Fatal(ctx, "could not load api keys config", err)
+			return nil, errors.Wrap(err, "could not load api keys config")
+		}
+		log.Info(ctx, "loaded api keys config", log.Data{"keys": len(apiKeys)})
+		svc.APIKeys = middleware.NewAPIKeys(apiKeys, svc.rateLimitStore())
+	}
+
+	if concurrencyLimitConfigFilePath := cfg.ConcurrencyLimitConfigFilePath; concurrencyLimitConfigFilePath != "" {
+		svc.ConcurrencyLimiter, err = middleware.LoadConcurrencyLimiter(func() ([]byte, error) {
+			return os.ReadFile(concurrencyLimitConfigFilePath)
+		})
+		if err != nil {
+			log.Fatal(ctx, "could not load concurrency limit config", err)
+			return nil, errors.Wrap(err, "could not load concurrency limit config")
+		}
+		log.Info(ctx, "loaded concurrency limit config")
+	}
+
+	if openAPIValidationConfigFilePath := cfg.OpenAPIValidationConfigFilePath; openAPIValidationConfigFilePath != "" {
+		svc.OpenAPIValidator, err = middleware.LoadOpenAPIValidator(func() ([]byte, error) {
+			return os.ReadFile(openAPIValidationConfigFilePath)
+		}, func(specPath string) ([]byte, error) {
+			// spec paths are relative to the config file
+			if !filepath.IsAbs(specPath) {
+				specPath = filepath.Join(filepath.Dir(openAPIValidationConfigFilePath), specPath)
+			}
+			return os.ReadFile(specPath)
+		}, cfg.EnableOpenAPIResponseValidation)
+		if err != nil {
+			log.Fatal(ctx, "could not load openapi validation config", err)
+			return nil, errors.Wrap(err, "could not load openapi validation config")
+		}
+		log.Info(ctx, "loaded openapi validation config")
 	}
 
 	// Healthcheck
@@ -104,8 +300,8 @@ func Run(ctx context.Context, cfg *config.Config, serviceList *ExternalServiceLi
 		svc.Server.WriteTimeout = *cfg.HTTPWriteTimeout
 	}
 
-	// kafka error channel logging go-routine
-	if cfg.EnableAudit {
+	// kafka error channel logging go-routine, unless undelivered messages are spooled
+	if svc.ServiceList.KafkaAuditProducer && svc.AuditSpool == nil {
 		svc.KafkaAuditProducer.LogErrors(ctx)
 	}
 
@@ -120,24 +316,176 @@ func Run(ctx context.Context, cfg *config.Config, serviceList *ExternalServiceLi
 	return svc, nil
 }
 
+// newAuditSink creates the configured sinks for audit events, combining them if there is more than one.
+// The Kafka Audit Producer is only created if the kafka sink is configured.
+func (svc *Service) newAuditSink(ctx context.Context, cfg *config.Config, schemaDefinition string) (event.AuditSink, error) {
+	sinks := event.MultiSink{}
+	for _, name := range cfg.AuditSinks {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "kafka":
+			kafkaAuditProducer, err := svc.ServiceList.GetKafkaAuditProducer(ctx, cfg)
+			if err != nil {
+				return nil, errors.Wrap(err, "could not instantiate kafka audit producer")
+			}
+			svc.KafkaAuditProducer = kafkaAuditProducer
+			if cfg.AuditSpoolPath == "" {
+				sinks = append(sinks, event.ChannelSink(kafkaAuditProducer.Channels().Output))
+				continue
+			}
+
+			// spool messages to disk while kafka is unavailable, and replay them once it is available again
+			kafkaSink := event.NewKafkaSink(kafkaAuditProducer, cfg.AuditSpoolSendTimeout)
+			svc.AuditSpool, err = event.NewSpoolSink(kafkaSink, kafkaSink.Available, cfg.AuditSpoolPath, cfg.AuditSpoolMaxBytes)
+			if err != nil {
+				return nil, errors.Wrap(err, "could not open audit spool")
+			}
+			kafkaSink.HandleErrors(ctx, svc.AuditSpool.Spool)
+			svc.AuditSpool.Start(ctx, cfg.AuditSpoolReplayInterval)
+			sinks = append(sinks, svc.AuditSpool)
+		case "file":
+			fileSink, err := event.NewFileSink(cfg.AuditFilePath, cfg.AuditFileMaxBytes, cfg.AuditFileMaxBackups, schemaDefinition)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, fileSink)
+		case "stdout":
+			stdoutSink, err := event.NewJSONSink(os.Stdout, schemaDefinition)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, stdoutSink)
+		case "webhook":
+			if cfg.AuditWebhookURL == "" {
+				return nil, errors.New("AUDIT_WEBHOOK_URL is required by the webhook audit sink")
+			}
+			client := dphttp.ClientWithTimeout(dphttp.NewClient(), cfg.AuditWebhookTimeout)
+			webhookSink, err := event.NewWebhookSink(client, cfg.AuditWebhookURL, schemaDefinition)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, webhookSink)
+		default:
+			return nil, fmt.Errorf("invalid audit sink '%s', expected kafka, file, stdout or webhook", name)
+		}
+	}
+
+	switch len(sinks) {
+	case 0:
+		return nil, errors.New("no audit sinks configured")
+	case 1:
+		return sinks[0], nil
+	default:
+		return sinks, nil
+	}
+}
+
+// newJWTKeyFetcher creates the fetcher for JWT verification keys, which uses the statically configured keys if
+// there are any (e.g. when running locally), or otherwise the identity API
+func newJWTKeyFetcher(cfg *config.Config) middleware.JWTKeyFetcher {
+	if len(cfg.Auth.JWTVerificationPublicKeys) > 0 {
+		return middleware.StaticKeyFetcher(cfg.Auth.JWTVerificationPublicKeys)
+	}
+	return middleware.NewIdentityKeyFetcher(dphttp.ClientWithTimeout(dphttp.NewClient(), cfg.ZebedeeClientTimeout), cfg.IdentityAPIURL)
+}
+
+// newAuditProducer creates the producer for audit events, which is asynchronous unless the queue size is zero
+func newAuditProducer(cfg *config.Config, sink event.AuditSink, marshaller event.Marshaller) (*event.AvroProducer, error) {
+	if cfg.AuditChainKey != "" && cfg.AuditSchemaVersion < 3 {
+		return nil, fmt.Errorf("audit chain requires audit schema version 3 or later, but version %d is configured", cfg.AuditSchemaVersion)
+	}
+	// the owner of the api key of a request is only audited from version 4
+	if cfg.APIKeysConfigFilePath != "" && cfg.AuditSchemaVersion < 4 {
+		return nil, fmt.Errorf("api keys require audit schema version 4 or later, but version %d is configured", cfg.AuditSchemaVersion)
+	}
+
+	var producer *event.AvroProducer
+	if cfg.AuditQueueSize <= 0 {
+		producer = event.NewAvroProducerWithSink(sink, marshaller)
+	} else {
+		policy, err := event.ParseOverflowPolicy(cfg.AuditQueueOverflowPolicy)
+		if err != nil {
+			return nil, err
+		}
+		producer = event.NewAsyncAvroProducerWithSink(sink, marshaller, cfg.AuditQueueSize, policy)
+	}
+
+	if cfg.AuditChainKey != "" {
+		producer.SetChain(event.NewChain([]byte(cfg.AuditChainKey), newInstanceID()))
+	}
+	return producer, nil
+}
+
+// newInstanceID returns an ID that is unique to this run of the router, made of the hostname and a random suffix
+func newInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "dp-api-router"
+	}
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	return hostname + "-" + hex.EncodeToString(suffix)
+}
+
 // CreateMiddleware creates an Alice middleware chain of handlers in the required order
 func (svc *Service) CreateMiddleware(cfg *config.Config, router *mux.Router) alice.Chain {
+	// Make sure every request has an ID, which is logged, audited, forwarded to upstreams and returned to the client
+	m := alice.New(middleware.RequestID)
+
+	// Resolve the client IP address once, so that audit, the IP filter and the limits all agree on it
+	if svc.ClientIPResolver != nil {
+		m = m.Append(svc.ClientIPResolver.Handler)
+	}
+
+	// Security headers - add them to every response, including responses from the router itself
+	if svc.SecurityHeaders != nil {
+		m = m.Append(svc.SecurityHeaders.Handler)
+	}
+
+	// Request hygiene - reject malformed or malicious requests before they reach any other handler
+	if svc.RequestHygiene != nil {
+		m = m.Append(svc.RequestHygiene.Handler)
+	}
+
 	// Allow health check endpoint to skip any further middleware
 	healthCheckFilter := middleware.HealthcheckFilter(svc.HealthCheck.Handler)
 	versionedHealthCheckFilter := middleware.VersionedHealthCheckFilter(cfg.Version, svc.HealthCheck.Handler)
-	m := alice.New(healthCheckFilter, versionedHealthCheckFilter)
+	m = m.Append(healthCheckFilter, versionedHealthCheckFilter)
+
+	// Allow metrics endpoint to skip any further middleware
+	if cfg.EnableMetricsEndpoint {
+		m = m.Append(middleware.MetricsFilter(cfg.MetricsAuthToken, metrics.Handler))
+	}
+
+	// Allow admin endpoints to skip any further middleware
+	if cfg.EnableAdminEndpoints {
+		m = m.Append(middleware.AdminFilter(cfg.AdminAuthToken, svc.adminEndpoints()))
+	}
+
+	// IP filter - reject clients that are denied or not allowed access, before looking up their identity to audit them,
+	// so it audits the requests it rejects itself
+	if svc.IPFilter != nil {
+		if cfg.EnableAudit {
+			svc.IPFilter.SetAuditor(middleware.NewRejectionAuditor(svc.AuditProducer, svc.AuditRules, cfg.EnableZebedeeAudit, router))
+		}
+		m = m.Append(svc.IPFilter.Handler)
+	}
 
 	// Audit - send kafka message to track user requests
 	if cfg.EnableAudit {
-		auditProducer := event.NewAvroProducer(svc.KafkaAuditProducer.Channels().Output, schema.AuditEvent)
+		// the verifier may only exist for edge authorisation, in which case audit still checks JWTs with Zebedee
+		var auditJWTVerifier *middleware.JWTVerifier
+		if cfg.Auth.Enabled {
+			auditJWTVerifier = svc.JWTVerifier
+		}
 		m = m.Append(middleware.AuditHandler(
-			auditProducer,
+			svc.AuditProducer,
 			svc.ZebedeeClient.Client,
 			cfg.ZebedeeURL,
-			cfg.Version,
+			svc.AuditRules,
+			svc.IdentityCache,
 			cfg.EnableZebedeeAudit,
 			router,
-			cfg.Auth,
+			auditJWTVerifier,
 		))
 	}
 
@@ -145,11 +493,73 @@ func (svc *Service) CreateMiddleware(cfg *config.Config, router *mux.Router) ali
 	headersOk := handlers.AllowedHeaders(cfg.AllowedHeaders)
 	originsOk := handlers.AllowedOrigins(cfg.AllowedOrigins)
 
-	m = m.Append(handlers.CORS(originsOk, headersOk, methodsOk))
+	// per-route CORS policies take precedence over the global CORS configuration
+	cors := handlers.CORS(originsOk, headersOk, methodsOk)
+	if len(svc.CORSPolicies) > 0 {
+		cors = middleware.CORS(svc.CORSPolicies, cors)
+	}
+	m = m.Append(cors)
+
+	// API keys - reject unknown keys and keys over their limits, after auditing them so the owner is recorded
+	if svc.APIKeys != nil {
+		m = m.Append(svc.APIKeys.Handler)
+	}
+
+	// Rate limiting - reject clients that exceed the rate limits, after auditing them so their identity is known
+	if svc.RateLimiter != nil {
+		m = m.Append(svc.RateLimiter.Handler)
+	}
+
+	// Concurrency limiting - reject clients with too many requests in flight, after auditing them for their identity
+	if svc.ConcurrencyLimiter != nil {
+		m = m.Append(svc.ConcurrencyLimiter.Handler)
+	}
+
+	// Edge authorisation - reject requests to private routes without the required permissions, after auditing them
+	if svc.EdgeAuthorisation != nil {
+		m = m.Append(svc.EdgeAuthorisation.Handler)
+	}
+
+	// OpenAPI validation - reject requests that don't match the spec of their API, once they are known to be allowed
+	if svc.OpenAPIValidator != nil {
+		m = m.Append(svc.OpenAPIValidator.Handler)
+	}
 
 	return m
 }
 
+// adminEndpoints returns the admin endpoints for the features that are enabled
+func (svc *Service) adminEndpoints() map[string]middleware.Allowed {
+	endpoints := map[string]middleware.Allowed{}
+	if svc.IdentityCache != nil {
+		endpoints["/admin/identity-cache/invalidate"] = middleware.Allowed{
+			Methods: []string{http.MethodPost},
+			Handler: svc.IdentityCache.InvalidateHandler,
+		}
+	}
+	if svc.ConcurrencyLimiter != nil {
+		endpoints["/admin/concurrency"] = middleware.Allowed{
+			Methods: []string{http.MethodGet},
+			Handler: svc.ConcurrencyLimiter.UsageHandler,
+		}
+	}
+	if svc.APIKeys != nil {
+		endpoints["/admin/api-keys/usage"] = middleware.Allowed{
+			Methods: []string{http.MethodGet},
+			Handler: svc.APIKeys.UsageHandler,
+		}
+	}
+	return endpoints
+}
+
+// rateLimitStore returns the store shared by the rate limits of the router, creating it if needed
+func (svc *Service) rateLimitStore() middleware.RateLimitStore {
+	if svc.RateLimitStore == nil {
+		svc.RateLimitStore = middleware.NewMemoryRateLimitStore()
+	}
+	return svc.RateLimitStore
+}
+
 // CreateRouter creates the router with the required endpoints for proxied APIs
 // The preferred approach for new APIs is to use `addVersionedHandlers` and include the version on downstream API routes
 func CreateRouter(ctx context.Context, cfg *config.Config) *mux.Router {
@@ -165,8 +575,11 @@ func CreateRouter(ctx context.Context, cfg *config.Config) *mux.Router {
 	addTransitionalHandler(router, topic, "/topics")
 	addTransitionalHandler(router, topic, "/navigation")
 
+	// Public links in request bodies are only rewritten for APIs that accept documents from publishing tools
+	enableRequestInterceptor := cfg.EnablePrivateEndpoints && cfg.EnableRequestInterceptor
+
 	codeList := proxy.NewAPIProxyWithOptions(ctx, cfg.CodelistAPIURL, cfg.Version, cfg.EnvironmentHost, cfg.EnableV1BetaRestriction, proxy.Options{Interceptor: cfg.EnableInterceptor})
-	dataset := proxy.NewAPIProxyWithOptions(ctx, cfg.DatasetAPIURL, cfg.Version, cfg.EnvironmentHost, cfg.EnableV1BetaRestriction, proxy.Options{Interceptor: cfg.EnableInterceptor})
+	dataset := proxy.NewAPIProxyWithOptions(ctx, cfg.DatasetAPIURL, cfg.Version, cfg.EnvironmentHost, cfg.EnableV1BetaRestriction, proxy.Options{Interceptor: cfg.EnableInterceptor, RequestInterceptor: enableRequestInterceptor})
 	filter := proxy.NewAPIProxyWithOptions(ctx, cfg.FilterAPIURL, cfg.Version, cfg.EnvironmentHost, cfg.EnableV1BetaRestriction, proxy.Options{Interceptor: cfg.EnableInterceptor})
 	filterFlex := proxy.NewAPIProxy(ctx, cfg.FilterFlexAPIURL, cfg.Version, cfg.EnvironmentHost, cfg.EnableV1BetaRestriction)
 	filterFlexIntercepted := proxy.NewAPIProxyWithOptions(ctx, cfg.FilterFlexAPIURL, cfg.Version, cfg.EnvironmentHost, cfg.EnableV1BetaRestriction, proxy.Options{Interceptor: cfg.EnableInterceptor})
@@ -221,8 +634,8 @@ func CreateRouter(ctx context.Context, cfg *config.Config) *mux.Router {
 
 	// Private APIs
 	if cfg.EnablePrivateEndpoints {
-		recipe := proxy.NewAPIProxy(ctx, cfg.RecipeAPIURL, cfg.Version, cfg.EnvironmentHost, cfg.EnableV1BetaRestriction)
-		importAPI := proxy.NewAPIProxyWithOptions(ctx, cfg.ImportAPIURL, cfg.Version, cfg.EnvironmentHost, cfg.EnableV1BetaRestriction, proxy.Options{Interceptor: true})
+		recipe := proxy.NewAPIProxyWithOptions(ctx, cfg.RecipeAPIURL, cfg.Version, cfg.EnvironmentHost, cfg.EnableV1BetaRestriction, proxy.Options{RequestInterceptor: enableRequestInterceptor})
+		importAPI := proxy.NewAPIProxyWithOptions(ctx, cfg.ImportAPIURL, cfg.Version, cfg.EnvironmentHost, cfg.EnableV1BetaRestriction, proxy.Options{Interceptor: true, RequestInterceptor: enableRequestInterceptor})
 		uploadServiceAPI := proxy.NewAPIProxy(ctx, cfg.UploadServiceAPIURL, cfg.Version, cfg.EnvironmentHost, cfg.EnableV1BetaRestriction)
 		identityAPI := proxy.NewAPIProxy(ctx, cfg.IdentityAPIURL, cfg.Version, cfg.EnvironmentHost, cfg.EnableV1BetaRestriction)
 		permissionsAPIProxy := proxy.NewAPIProxy(ctx, cfg.PermissionsAPIURL, cfg.Version, cfg.EnvironmentHost, cfg.EnableV1BetaRestriction)
@@ -257,7 +670,7 @@ func CreateRouter(ctx context.Context, cfg *config.Config) *mux.Router {
 
 		// Feature flag for Bundle API
 		if cfg.EnableBundleAPI {
-			bundle := proxy.NewAPIProxyWithOptions(ctx, cfg.BundleAPIURL, cfg.Version, cfg.EnvironmentHost, cfg.EnableV1BetaRestriction, proxy.Options{Interceptor: cfg.EnableInterceptor})
+			bundle := proxy.NewAPIProxyWithOptions(ctx, cfg.BundleAPIURL, cfg.Version, cfg.EnvironmentHost, cfg.EnableV1BetaRestriction, proxy.Options{Interceptor: cfg.EnableInterceptor, RequestInterceptor: enableRequestInterceptor})
 			addTransitionalHandler(router, bundle, "/bundles")
 			addTransitionalHandler(router, bundle, "/bundle-events")
 		}
@@ -302,6 +715,27 @@ func (svc *Service) Close(ctx context.Context) error {
 			hasShutdownError = true
 		}
 
+		// Stop refreshing the JWT verification keys, if present
+		if svc.JWTVerifier != nil {
+			svc.JWTVerifier.Stop()
+		}
+
+		// Stop refreshing the permissions cache, if present
+		if svc.PermissionsChecker != nil {
+			if err := svc.PermissionsChecker.Close(ctx); err != nil {
+				log.Error(ctx, "failed to close permissions checker", err)
+				hasShutdownError = true
+			}
+		}
+
+		// Flush any queued audit events and close the audit sinks before the Kafka Audit Producer is closed
+		if svc.AuditProducer != nil {
+			if err := svc.AuditProducer.Close(ctx); err != nil {
+				log.Error(ctx, "failed to flush audit producer", err)
+				hasShutdownError = true
+			}
+		}
+
 		// Close Kafka Audit Producer, if present
 		if svc.ServiceList.KafkaAuditProducer {
 			if err := svc.KafkaAuditProducer.Close(ctx); err != nil {
@@ -340,13 +774,34 @@ func (svc *Service) registerCheckers(ctx context.Context) (err error) {
 		log.Error(ctx, "failed to add zebedee checker", err)
 	}
 
-	if svc.Config.EnableAudit {
+	if svc.ServiceList.KafkaAuditProducer {
 		if err = svc.HealthCheck.AddCheck("Kafka Audit Producer", svc.KafkaAuditProducer.Checker); err != nil {
 			hasErrors = true
 			log.Error(ctx, "failed to add kafka audit producer checker", err)
 		}
 	}
 
+	if svc.AuditSpool != nil {
+		if err = svc.HealthCheck.AddCheck("Audit Spool", svc.AuditSpool.Checker); err != nil {
+			hasErrors = true
+			log.Error(ctx, "failed to add audit spool checker", err)
+		}
+	}
+
+	if svc.JWTVerifier != nil {
+		if err = svc.HealthCheck.AddCheck("JWT Verification Keys", svc.JWTVerifier.Checker); err != nil {
+			hasErrors = true
+			log.Error(ctx, "failed to add jwt verification keys checker", err)
+		}
+	}
+
+	if svc.PermissionsChecker != nil {
+		if err = svc.HealthCheck.AddCheck("Permissions Cache", svc.PermissionsChecker.HealthCheck); err != nil {
+			hasErrors = true
+			log.Error(ctx, "failed to add permissions cache checker", err)
+		}
+	}
+
 	if hasErrors {
 		return errors.New("Error(s) registering checkers for healthcheck")
 	}
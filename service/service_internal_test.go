@@ -0,0 +1,400 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/dp-api-clients-go/v2/health"
+	"github.com/ONSdigital/dp-api-router/config"
+	"github.com/ONSdigital/dp-api-router/event"
+	"github.com/ONSdigital/dp-api-router/middleware"
+	"github.com/ONSdigital/dp-api-router/schema"
+	authmock "github.com/ONSdigital/dp-authorisation/v2/authorisation/mock"
+	"github.com/ONSdigital/dp-healthcheck/healthcheck"
+	kafka "github.com/ONSdigital/dp-kafka/v3"
+	"github.com/ONSdigital/dp-kafka/v3/kafkatest"
+	dphttp "github.com/ONSdigital/dp-net/v3/http"
+	dprequest "github.com/ONSdigital/dp-net/v3/request"
+	permsdk "github.com/ONSdigital/dp-permissions-api/sdk"
+	"github.com/gorilla/mux"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	testServiceToken = "myServiceToken"
+	testIdentity     = "myService"
+	testOrigin       = "http://localhost:20000"
+	testOpenAPISpec  = `{
+  "openapi": "3.0.3",
+  "info": {"title": "Dataset API", "version": "1.0.0"},
+  "paths": {
+    "/datasets": {
+      "post": {
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"type": "object", "required": ["title"]}}}
+        },
+        "responses": {"201": {"description": "Created"}}
+      }
+    }
+  }
+}`
+)
+
+// recordingSink is an audit sink that records the messages written to it, and the order in which it and the kafka
+// producer are used
+type recordingSink struct {
+	mu       sync.Mutex
+	messages [][]byte
+	calls    []string
+}
+
+func (s *recordingSink) Write(message []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, message)
+	s.calls = append(s.calls, "write")
+	return nil
+}
+
+func (s *recordingSink) Close(ctx context.Context) error {
+	s.record("close sink")
+	return nil
+}
+
+func (s *recordingSink) record(call string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, call)
+}
+
+// auditEvents returns the version 4 audit events written to the sink
+func (s *recordingSink) auditEvents() []event.Audit {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := make([]event.Audit, len(s.messages))
+	for i, message := range s.messages {
+		So(schema.AuditEventV4.Unmarshal(message, &events[i]), ShouldBeNil)
+	}
+	return events
+}
+
+// testInitialiser creates the kafka producer returned by getKafkaProducer, recording the topics it is created for.
+// The service mocks can't be used by internal tests, as they import the service package.
+type testInitialiser struct {
+	getKafkaProducer func() (kafka.IProducer, error)
+	topics           []string
+}
+
+func (i *testInitialiser) DoGetHealthCheck(cfg *config.Config, buildTime, gitCommit, version string) (HealthChecker, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (i *testInitialiser) DoGetKafkaProducer(ctx context.Context, cfg *config.Config, topic string) (kafka.IProducer, error) {
+	i.topics = append(i.topics, topic)
+	return i.getKafkaProducer()
+}
+
+// testHealthCheck is a health check that is always healthy
+type testHealthCheck struct{}
+
+func (hc testHealthCheck) Handler(w http.ResponseWriter, req *http.Request) {}
+func (hc testHealthCheck) Start(ctx context.Context)                        {}
+func (hc testHealthCheck) Stop()                                            {}
+func (hc testHealthCheck) AddCheck(name string, checker healthcheck.Checker) error {
+	return nil
+}
+
+// loadJSON returns a loader of the provided JSON config
+func loadJSON(config string) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		return []byte(config), nil
+	}
+}
+
+// testConfig returns a copy of the default config, as the default config is shared
+func testConfig() *config.Config {
+	defaultCfg, err := config.Get()
+	So(err, ShouldBeNil)
+	cfg := *defaultCfg
+	return &cfg
+}
+
+// newTestAuditProducer creates an audit producer for the config, with a sink that discards the events
+func newTestAuditProducer(cfg *config.Config) (*event.AvroProducer, error) {
+	auditSchema, err := schema.AuditEventVersion(cfg.AuditSchemaVersion)
+	So(err, ShouldBeNil)
+	sink, err := event.NewJSONSink(io.Discard, auditSchema.Definition)
+	So(err, ShouldBeNil)
+	return newAuditProducer(cfg, sink, auditSchema)
+}
+
+func TestNewAuditProducer(t *testing.T) {
+	Convey("Given the default config", t, func() {
+		cfg := testConfig()
+		cfg.AuditQueueSize = 0
+
+		Convey("Then an audit producer is created", func() {
+			producer, err := newTestAuditProducer(cfg)
+			So(err, ShouldBeNil)
+			So(producer, ShouldNotBeNil)
+		})
+
+		Convey("When an audit chain key is configured, then audit schema version 3 or later is required", func() {
+			cfg.AuditChainKey = "secret"
+			cfg.AuditSchemaVersion = 2
+			_, err := newTestAuditProducer(cfg)
+			So(err, ShouldNotBeNil)
+
+			cfg.AuditSchemaVersion = 3
+			_, err = newTestAuditProducer(cfg)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("When api keys are configured, then audit schema version 4 or later is required", func() {
+			cfg.APIKeysConfigFilePath = "api-keys.json"
+			for _, version := range []int{1, 2, 3} {
+				cfg.AuditSchemaVersion = version
+				_, err := newTestAuditProducer(cfg)
+				So(err, ShouldNotBeNil)
+			}
+
+			cfg.AuditSchemaVersion = 4
+			_, err := newTestAuditProducer(cfg)
+			So(err, ShouldBeNil)
+		})
+	})
+}
+
+func TestNewAuditSink(t *testing.T) {
+	Convey("Given a service with a kafka producer", t, func() {
+		cfg := testConfig()
+		cfg.AuditFilePath = filepath.Join(t.TempDir(), "audit.log")
+		kafkaProducer := &kafkatest.IProducerMock{
+			ChannelsFunc: func() *kafka.ProducerChannels { return kafka.CreateProducerChannels() },
+		}
+		initialiser := &testInitialiser{getKafkaProducer: func() (kafka.IProducer, error) {
+			return kafkaProducer, nil
+		}}
+		svc := &Service{ServiceList: NewServiceList(initialiser)}
+		newAuditSink := func(sinks ...string) (event.AuditSink, error) {
+			cfg.AuditSinks = sinks
+			return svc.newAuditSink(context.Background(), cfg, schema.AuditEvent.Definition)
+		}
+
+		Convey("When the kafka sink is configured, then the kafka producer's output channel is used", func() {
+			sink, err := newAuditSink(" Kafka ")
+			So(err, ShouldBeNil)
+			So(sink, ShouldHaveSameTypeAs, event.ChannelSink(nil))
+			So(svc.KafkaAuditProducer, ShouldEqual, kafkaProducer)
+			So(svc.ServiceList.KafkaAuditProducer, ShouldBeTrue)
+			So(initialiser.topics, ShouldResemble, []string{cfg.AuditTopic})
+		})
+
+		Convey("When the kafka sink is configured with a spool, then the kafka producer is spooled", func() {
+			cfg.AuditSpoolPath = filepath.Join(t.TempDir(), "audit.spool")
+			sink, err := newAuditSink("kafka")
+			So(err, ShouldBeNil)
+			So(sink, ShouldEqual, svc.AuditSpool)
+			So(svc.AuditSpool.Close(context.Background()), ShouldBeNil)
+		})
+
+		Convey("When the kafka producer can't be created, then an error is returned", func() {
+			initialiser.getKafkaProducer = func() (kafka.IProducer, error) {
+				return nil, errors.New("no brokers")
+			}
+			_, err := newAuditSink("kafka")
+			So(err, ShouldNotBeNil)
+			So(svc.ServiceList.KafkaAuditProducer, ShouldBeFalse)
+		})
+
+		Convey("When the file, stdout and webhook sinks are configured, then they are created without kafka", func() {
+			cfg.AuditWebhookURL = "http://localhost:8080/audit"
+			sink, err := newAuditSink("file")
+			So(err, ShouldBeNil)
+			So(sink, ShouldHaveSameTypeAs, &event.JSONSink{})
+			So(sink.Close(context.Background()), ShouldBeNil)
+
+			sink, err = newAuditSink("stdout")
+			So(err, ShouldBeNil)
+			So(sink, ShouldHaveSameTypeAs, &event.JSONSink{})
+
+			sink, err = newAuditSink("webhook")
+			So(err, ShouldBeNil)
+			So(sink, ShouldHaveSameTypeAs, &event.WebhookSink{})
+			So(initialiser.topics, ShouldBeEmpty)
+		})
+
+		Convey("When more than one sink is configured, then they are combined", func() {
+			sink, err := newAuditSink("kafka", "stdout")
+			So(err, ShouldBeNil)
+			So(sink, ShouldHaveSameTypeAs, event.MultiSink{})
+			So(sink, ShouldHaveLength, 2)
+		})
+
+		Convey("When the webhook sink is configured without a url, then an error is returned", func() {
+			cfg.AuditWebhookURL = ""
+			_, err := newAuditSink("webhook")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("When an invalid sink is configured, then an error is returned", func() {
+			_, err := newAuditSink("stdout", "syslog")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("When no sinks are configured, then an error is returned", func() {
+			_, err := newAuditSink()
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestCreateMiddleware(t *testing.T) {
+	Convey("Given a service with every middleware that can reject a request", t, func() {
+		zebedee := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			_, _ = w.Write([]byte(`{"identifier": "` + testIdentity + `"}`))
+		}))
+		defer zebedee.Close()
+
+		cfg := testConfig()
+		cfg.EnableAudit = true
+		cfg.ZebedeeURL = zebedee.URL
+		sink := &recordingSink{}
+		hasPermission := false
+		permissions := &authmock.PermissionsCheckerMock{
+			HasPermissionFunc: func(ctx context.Context, entityData permsdk.EntityData, permission string, attributes map[string]string) (bool, error) {
+				return hasPermission, nil
+			},
+		}
+		svc := &Service{
+			HealthCheck:   testHealthCheck{},
+			ZebedeeClient: health.NewClient("Zebedee", zebedee.URL),
+			AuditProducer: event.NewAvroProducerWithSink(sink, schema.AuditEventV4),
+		}
+		var err error
+		svc.AuditRules, err = middleware.NewAuditRules(cfg.Version, nil, nil)
+		So(err, ShouldBeNil)
+		svc.RequestHygiene, err = middleware.LoadRequestHygiene(loadJSON(`{"max_url_length": 64}`))
+		So(err, ShouldBeNil)
+		rateLimitRules, err := middleware.LoadRateLimitRules(loadJSON(`[{"routes": ["POST /v1/datasets"], "requests": 2, "period": "1h"}]`))
+		So(err, ShouldBeNil)
+		svc.RateLimiter = middleware.NewRateLimiter(rateLimitRules, svc.rateLimitStore())
+		permissionRules, err := middleware.LoadPermissionRules(loadJSON(`[{"routes": ["POST /v1/datasets"], "permission": "datasets:edit"}]`))
+		So(err, ShouldBeNil)
+		svc.EdgeAuthorisation = middleware.NewEdgeAuthorisation(permissionRules, nil,
+			middleware.NewIdentityChecker(svc.ZebedeeClient.Client, zebedee.URL, nil), permissions)
+		svc.OpenAPIValidator, err = middleware.LoadOpenAPIValidator(
+			loadJSON(`{"apis": [{"routes": ["/v1/datasets"], "spec": "dataset-api.json", "base_path": "/v1"}]}`),
+			func(path string) ([]byte, error) { return []byte(testOpenAPISpec), nil }, false)
+		So(err, ShouldBeNil)
+
+		// only requests that match a route are audited
+		router := mux.NewRouter()
+		router.Path("/v1/datasets")
+		proxied := 0
+		handler := svc.CreateMiddleware(cfg, router).Then(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			proxied++
+		}))
+		serve := func(target, body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set(dprequest.AuthHeaderKey, dprequest.BearerPrefix+testServiceToken)
+			req.Header.Set("Origin", testOrigin)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			return w
+		}
+
+		Convey("When a request is rejected by request hygiene, then it has a request id but is not audited", func() {
+			w := serve("/v1/datasets?q="+strings.Repeat("a", 64), "{}")
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+			So(w.Header().Get("X-Request-Id"), ShouldNotBeEmpty)
+			So(sink.auditEvents(), ShouldBeEmpty)
+		})
+
+		Convey("When requests that don't match the spec are made until they are rate limited", func() {
+			forbidden := serve("/v1/datasets", "{}")
+			hasPermission = true
+			invalid := serve("/v1/datasets", "{}")
+			limited := serve("/v1/datasets", "{}")
+
+			Convey("Then authorisation is checked before validation, and limits before authorisation", func() {
+				So(forbidden.Code, ShouldEqual, http.StatusForbidden)
+				So(invalid.Code, ShouldEqual, http.StatusBadRequest)
+				So(limited.Code, ShouldEqual, http.StatusTooManyRequests)
+				So(permissions.HasPermissionCalls(), ShouldHaveLength, 2)
+				So(proxied, ShouldEqual, 0)
+			})
+
+			Convey("Then every rejection is audited, with the identity of the caller", func() {
+				events := sink.auditEvents()
+				So(events, ShouldHaveLength, 6)
+				for i, status := range []int32{http.StatusForbidden, http.StatusBadRequest, http.StatusTooManyRequests} {
+					So(events[2*i+1].StatusCode, ShouldEqual, status)
+					So(events[2*i+1].Identity, ShouldEqual, testIdentity)
+				}
+			})
+
+			Convey("Then the CORS headers are added before any of the rejections", func() {
+				for _, w := range []*httptest.ResponseRecorder{forbidden, invalid, limited} {
+					So(w.Header().Get("Access-Control-Allow-Origin"), ShouldEqual, testOrigin)
+				}
+			})
+		})
+	})
+}
+
+func TestAdminEndpoints(t *testing.T) {
+	Convey("Given a service without any features that have admin endpoints, then there are no admin endpoints", t, func() {
+		svc := &Service{}
+		So(svc.adminEndpoints(), ShouldBeEmpty)
+	})
+
+	Convey("Given a service with every feature that has admin endpoints, then their admin endpoints are served", t, func() {
+		svc := &Service{
+			IdentityCache:      middleware.NewIdentityCache(time.Minute, time.Second, 10),
+			ConcurrencyLimiter: middleware.NewConcurrencyLimiter(1, 1, http.StatusTooManyRequests, nil),
+			APIKeys:            middleware.NewAPIKeys(nil, middleware.NewMemoryRateLimitStore()),
+		}
+		endpoints := svc.adminEndpoints()
+		So(endpoints, ShouldHaveLength, 3)
+		So(endpoints["/admin/identity-cache/invalidate"].Methods, ShouldResemble, []string{http.MethodPost})
+		So(endpoints["/admin/concurrency"].Methods, ShouldResemble, []string{http.MethodGet})
+		So(endpoints["/admin/api-keys/usage"].Methods, ShouldResemble, []string{http.MethodGet})
+	})
+}
+
+func TestClose(t *testing.T) {
+	Convey("Given a service with queued audit events and a kafka producer", t, func() {
+		sink := &recordingSink{}
+		auditProducer := event.NewAsyncAvroProducerWithSink(sink, schema.AuditEvent, 10, event.OverflowBlock)
+		kafkaProducer := &kafkatest.IProducerMock{
+			CloseFunc: func(ctx context.Context) error {
+				sink.record("close kafka producer")
+				return nil
+			},
+		}
+		svc := &Service{
+			Config:             &config.Config{GracefulShutdown: time.Second},
+			ServiceList:        &ExternalServiceList{KafkaAuditProducer: true},
+			Server:             dphttp.NewServer("localhost:0", http.NotFoundHandler()),
+			AuditProducer:      auditProducer,
+			KafkaAuditProducer: kafkaProducer,
+		}
+		So(auditProducer.Audit(&event.Audit{Path: "/v1/datasets", Method: http.MethodGet}), ShouldBeNil)
+
+		Convey("When the service is closed, then the audit events are flushed before the kafka producer is closed", func() {
+			So(svc.Close(context.Background()), ShouldBeNil)
+			So(sink.calls, ShouldResemble, []string{"write", "close sink", "close kafka producer"})
+		})
+	})
+}